@@ -1,21 +1,35 @@
+// Package builder builds images from plans. It can be embedded in other
+// programs: create a Builder with NewBuilder, feed it plan code with one or
+// more calls to RunString, then Tag or Save the image and Close the builder.
 package builder
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"time"
 
 	"github.com/box-builder/box/builder/command"
+	"github.com/box-builder/box/builder/config"
 	"github.com/box-builder/box/builder/evaluator"
 	"github.com/box-builder/box/builder/evaluator/mruby"
 	"github.com/box-builder/box/builder/executor"
 	"github.com/box-builder/box/builder/executor/docker"
 	"github.com/box-builder/box/copy"
 	"github.com/box-builder/box/logger"
+	"github.com/box-builder/box/sbom"
 	"github.com/box-builder/box/types"
+	"github.com/box-builder/box/util"
 	"github.com/fatih/color"
 )
 
+// StdinFile is the FileName which reads the plan from standard input.
+const StdinFile = "-"
+
 // BuildConfig is a struct containing the configuration for the builder.
 type BuildConfig struct {
 	Globals  *types.Global
@@ -29,6 +43,9 @@ type Builder struct {
 	config *BuildConfig
 	exec   executor.Executor
 	eval   evaluator.Evaluator
+	interp *command.Interpreter
+	keep   int
+	prof   *profiler
 }
 
 // NewBuilder creates a new builder. Returns error on docker or mruby issues.
@@ -37,11 +54,11 @@ func NewBuilder(bc BuildConfig) (*Builder, error) {
 		bc.Globals = &types.Global{Context: context.Background()}
 	}
 
-	color.NoColor = !bc.Globals.Color
+	color.NoColor = !bc.Globals.Color || logger.NoColorEnv()
 	copy.NoTTY = !bc.Globals.TTY
 
 	if bc.Globals.Logger == nil {
-		bc.Globals.Logger = logger.New(bc.FileName, true)
+		bc.Globals.Logger = logger.New(bc.FileName, true, 0)
 	}
 
 	exec, err := NewExecutor("docker", bc.Globals)
@@ -49,11 +66,19 @@ func NewBuilder(bc BuildConfig) (*Builder, error) {
 		return nil, err
 	}
 
+	var prof *profiler
+	if bc.Globals.Profile {
+		prof = newProfiler()
+		exec = executor.Observe(exec, prof.observe)
+	}
+
+	interp := command.NewInterpreter(bc.Globals, exec, bc.Vars)
+
 	eval, err := mruby.NewMRuby(&mruby.Config{
 		Filename: bc.FileName,
 		Globals:  bc.Globals,
 		Exec:     exec,
-		Interp:   command.NewInterpreter(bc.Globals, exec, bc.Vars),
+		Interp:   interp,
 	})
 	if err != nil {
 		return nil, err
@@ -63,6 +88,8 @@ func NewBuilder(bc BuildConfig) (*Builder, error) {
 		config: &bc,
 		exec:   exec,
 		eval:   eval,
+		interp: interp,
+		prof:   prof,
 	}, nil
 }
 
@@ -78,11 +105,24 @@ func (b *Builder) Result() types.BuildResult {
 }
 
 // Run runs the script set by the BuildConfig. It closes the run channel when
-// it finishes.
-func (b *Builder) Run() types.BuildResult {
+// it finishes. If the FileName is StdinFile, the script is read from standard
+// input. The names given to ExpectTags which the plan did not tag are released
+// once it finishes.
+func (b *Builder) Run() (result types.BuildResult) {
 	defer close(b.config.Runner)
+	defer func() { b.interp.ReleaseTags(result.Err) }()
+
+	var (
+		script []byte
+		err    error
+	)
+
+	if b.config.FileName == StdinFile {
+		script, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		script, err = ioutil.ReadFile(b.config.FileName)
+	}
 
-	script, err := ioutil.ReadFile(b.config.FileName)
 	if err != nil {
 		return types.BuildResult{
 			FileName: b.config.FileName,
@@ -90,32 +130,279 @@ func (b *Builder) Run() types.BuildResult {
 		}
 	}
 
-	b.eval.RunScript(string(script))
+	b.evaluate(func() { b.eval.RunScript(string(script)) })
+
+	// there is nothing left to resume once the build succeeds.
+	result = b.Result()
+	if result.Err == nil && b.config.Globals.Checkpoint != "" {
+		if err := os.Remove(b.config.Globals.Checkpoint); err != nil && !os.IsNotExist(err) {
+			result.Err = err
+		}
+	}
+
+	return result
+}
+
+// RunString runs the plan code against the builder's state and returns the
+// result. It may be called repeatedly; each call continues from the image and
+// configuration left by the last one, and variables and functions defined by
+// earlier code stay in scope. The image is made after every call, so it can
+// be tagged or saved at any point. Unlike Run, after and validate blocks are
+// not run and the runner channel is left alone.
+func (b *Builder) RunString(code string) types.BuildResult {
+	b.evaluate(func() { b.keep, _ = b.eval.RunCode(code, b.keep, true) })
 	return b.Result()
 }
 
+// evaluate runs the evaluator call, profiling it if requested.
+func (b *Builder) evaluate(run func()) {
+	if b.prof == nil {
+		run()
+		return
+	}
+
+	b.prof.evaluate(run)
+}
+
+// Profile returns where the build has spent its time so far. It returns false
+// if the Profile global was not set.
+func (b *Builder) Profile() (Profile, bool) {
+	if b.prof == nil {
+		return Profile{}, false
+	}
+
+	return b.prof.profile(), true
+}
+
 // Wait waits for the build to complete.
 func (b *Builder) Wait() types.BuildResult {
 	<-b.config.Runner
 	return b.Result()
 }
 
-// Tag the image with the name
+// Tag the image with the name. In interactive builds, the user is asked
+// before an existing tag is moved. Like the `tag` verb, the name then refers
+// to the image for the `from` statements of the plans in this process.
 func (b *Builder) Tag(tag string) error {
-	return b.exec.Image().Tag(tag)
+	if err := b.interp.CheckTag(tag); err != nil {
+		return err
+	}
+
+	if err := b.exec.Image().Tag(tag); err != nil {
+		return err
+	}
+
+	b.interp.RegisterTag(tag)
+	return nil
+}
+
+// FailedTag returns the name of the image of another plan in this process
+// which the plan used, if the plan failed as that plan did.
+func (b *Builder) FailedTag() string {
+	return b.interp.FailedTag()
+}
+
+// tagStatement matches the `tag` statements of a plan giving the name as a
+// literal string, whose names are known before the plan is run.
+var tagStatement = regexp.MustCompile(`(?m)^[ \t]*tag[ \t(]+["']([^"'#{}\s]+)["']`)
+
+// ExpectTags records the names the plan tags with literal strings, so that
+// the `from` statements of the other plans in this process using them wait
+// for this plan to finish tagging them. Plans read from standard input, or
+// which cannot be read, expect nothing.
+func (b *Builder) ExpectTags() {
+	if b.config.FileName == StdinFile {
+		return
+	}
+
+	script, err := ioutil.ReadFile(b.config.FileName)
+	if err != nil {
+		return
+	}
+
+	names := []string{}
+	for _, match := range tagStatement.FindAllStringSubmatch(string(script), -1) {
+		names = append(names, match[1])
+	}
+
+	b.interp.ExpectTags(names)
+}
+
+// Save saves the image to the filename in the given format; see the `save`
+// function for the formats. The tag is recorded in the saved image, if set.
+func (b *Builder) Save(filename, kind, tag string) error {
+	return b.exec.Image().Save(filename, kind, tag)
+}
+
+// Push pushes the tag, which must have been applied with Tag, to its
+// registry. It returns the pushed image in `name@digest` form.
+func (b *Builder) Push(tag string) (string, error) {
+	return b.exec.Image().Push(tag)
+}
+
+// PushCache pushes the final image as the named cache image, recording the
+// steps that built it for --cache-image. It returns the pushed image in
+// `name@digest` form.
+func (b *Builder) PushCache(name string) (string, error) {
+	return b.exec.Image().PushCache(name)
+}
+
+// ImageInfo returns the size in bytes and the tags of the final image.
+func (b *Builder) ImageInfo() (int64, []string, error) {
+	id := b.exec.Config().Image
+	if id == "" {
+		return 0, nil, errors.New("no image was built")
+	}
+
+	size, err := b.exec.Layers().ImageSize(id)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	tags, err := b.exec.Layers().RepoTags(id)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return size, tags, nil
+}
+
+// Export copies the path src in the final image to the host directory dest,
+// which is created if missing. If src is a directory, its contents are copied
+// into dest.
+func (b *Builder) Export(src, dest string) error {
+	return b.interp.Export(src, dest)
+}
+
+// Attach runs an interactive shell in a container from the final image. The
+// container is removed when the shell exits.
+func (b *Builder) Attach(shell string) error {
+	return b.interp.Attach(shell)
+}
+
+// SBOM writes a CycloneDX bill of materials for the final image to filename.
+// It lists the base image, the layers and the packages found in the package
+// manager databases of the image. The name is recorded as the image's name,
+// and version as the version of box.
+func (b *Builder) SBOM(filename, name, version string) error {
+	id := b.exec.Config().Image
+	if id == "" {
+		return errors.New("no image was built to describe")
+	}
+
+	if name == "" {
+		name = id
+	}
+
+	layers, err := b.exec.Layers().LayerDigests(id)
+	if err != nil {
+		return err
+	}
+
+	digests, err := b.exec.Layers().RepoDigests(id)
+	if err != nil {
+		return err
+	}
+
+	info := sbom.Info{
+		Image:    sbom.Image{Name: name, ID: id, Digests: digests},
+		Layers:   layers,
+		Packages: []sbom.Package{},
+		Version:  version,
+		Created:  time.Now(),
+	}
+
+	if b.config.Globals.Reproducible {
+		info.Created = util.SourceDate()
+	}
+
+	if baseName, baseID := b.interp.BaseImage(); baseID != "" {
+		digests, err := b.exec.Layers().RepoDigests(baseID)
+		if err != nil {
+			return err
+		}
+
+		info.Base = &sbom.Image{Name: baseName, ID: baseID, Digests: digests}
+	}
+
+	// the databases and os-release are optional; an image without them has
+	// no packages to list.
+	if content, err := b.exec.CopyOneFileFromContainer("/etc/os-release"); err == nil {
+		info.Distro = sbom.ParseOSRelease(content)
+	}
+
+	// the databases are read in order, so the packages are listed the same
+	// on every build.
+	filenames := []string{}
+	for filename := range sbom.Databases {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	for _, filename := range filenames {
+		if content, err := b.exec.CopyOneFileFromContainer(filename); err == nil {
+			info.Packages = append(info.Packages, sbom.Databases[filename](content)...)
+		}
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := sbom.Write(f, info); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
 }
 
-// Close tears down all functions of the builder, preparing it for exit.
+// ImageConfig returns the config of the image built, or of the image the plan
+// would build if it was inspected.
+func (b *Builder) ImageConfig() *config.Config {
+	return b.exec.Config()
+}
+
+// Close tears down all functions of the builder, preparing it for exit. Any
+// on_exit blocks in the plan are run here, even if the build failed. The
+// build's temporary directory is removed afterwards, and the containers kept
+// with Global.KeepContainers are logged.
 func (b *Builder) Close() error {
-	return b.eval.Close()
+	err := b.eval.Close()
+	if rmErr := b.interp.RemoveTempDir(); err == nil {
+		err = rmErr
+	}
+
+	if kept := b.exec.KeptContainers(); len(kept) > 0 {
+		b.config.Globals.Logger.KeptContainers(kept)
+	}
+
+	return err
 }
 
-// NewExecutor returns a valid executor for the given name, or error.
+// NewExecutor returns a valid executor for the given name, or error. If
+// globals.Debug is set, the executor's operations are traced to the logger.
 func NewExecutor(name string, globals *types.Global) (executor.Executor, error) {
+	var (
+		exec executor.Executor
+		err  error
+	)
+
 	switch name {
 	case "docker":
-		return docker.NewDocker(globals)
+		exec, err = docker.NewDocker(globals)
+	default:
+		return nil, fmt.Errorf("Executor %q not found", name)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if globals.Debug {
+		exec = executor.Trace(exec, globals.Logger)
 	}
 
-	return nil, fmt.Errorf("Executor %q not found", name)
+	return exec, nil
 }
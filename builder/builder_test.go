@@ -3,10 +3,18 @@ package builder
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path"
@@ -16,8 +24,12 @@ import (
 	"time"
 
 	"github.com/box-builder/box/builder/command"
+	"github.com/box-builder/box/builder/executor/docker"
+	"github.com/box-builder/box/fetcher"
+	"github.com/box-builder/box/logger"
 	btypes "github.com/box-builder/box/types"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/strslice"
 	"github.com/docker/docker/client"
 
@@ -52,6 +64,7 @@ func (bs *builderSuite) SetUpSuite(c *C) {
 func (bs *builderSuite) SetUpTest(c *C) {
 	os.Setenv("NO_CACHE", "1")
 	command.ResetPulls()
+	command.ResetTags()
 }
 
 func (bs *builderSuite) TearDownTest(c *C) {
@@ -91,6 +104,257 @@ func (bs *builderSuite) TestFrom(c *C) {
 	b.Close()
 }
 
+func (bs *builderSuite) TestFromDigest(c *C) {
+	b, err := runBuilder(`
+		from "alpine"
+	`)
+	c.Assert(err, IsNil)
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(len(inspect.RepoDigests), Not(Equals), 0)
+	digest := strings.SplitN(inspect.RepoDigests[0], "@", 2)[1]
+	b.Close()
+
+	b, err = runBuilder(fmt.Sprintf(`
+		from "alpine", digest: %q
+	`, digest))
+	c.Assert(err, IsNil)
+	name, _ := b.interp.BaseImage()
+	c.Assert(name, Equals, "alpine@"+digest)
+	b.Close()
+
+	// --resolve-digests pins the base to the digest of the tag.
+	b, err = NewBuilder(BuildConfig{
+		Globals: &btypes.Global{ResolveDigests: true, Context: context.Background()},
+		Runner:  make(chan struct{}),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(b.eval.RunScript(`from "alpine"`), IsNil)
+	name, _ = b.interp.BaseImage()
+	c.Assert(name, Equals, "alpine@"+digest)
+	b.Close()
+
+	b, err = runBuilder(`
+		from "alpine", digest: "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	`)
+	c.Assert(err, NotNil)
+	b.Close()
+}
+
+func (bs *builderSuite) TestFromFile(c *C) {
+	dir, err := ioutil.TempDir("", "box-from-file")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	b, err := runBuilder(`from "alpine"`)
+	c.Assert(err, IsNil)
+	id := b.exec.Config().Image
+	b.Close()
+
+	r, err := dockerClient.ImageSave(context.Background(), []string{"alpine"})
+	c.Assert(err, IsNil)
+	content, err := ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, IsNil)
+
+	fn := filepath.Join(dir, "alpine.tar")
+	c.Assert(ioutil.WriteFile(fn, content, 0600), IsNil)
+
+	b, err = runBuilder(fmt.Sprintf(`
+		from "file:%s"
+		run "test -f /etc/alpine-release"
+	`, fn))
+	c.Assert(err, IsNil)
+	c.Assert(b.interp.CacheSalt, Not(Equals), "")
+	b.Close()
+
+	name, base := b.interp.BaseImage()
+	c.Assert(name, Equals, "file:"+fn)
+	c.Assert(base, Equals, id)
+
+	// the loaded image is used by its ID, which cannot be pulled.
+	b, err = NewBuilder(BuildConfig{
+		Globals: &btypes.Global{PullAlways: true, Context: context.Background()},
+		Runner:  make(chan struct{}),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(b.eval.RunScript(fmt.Sprintf(`from "file:%s"`, fn)), IsNil)
+	c.Assert(b.exec.Config().Image, Equals, id)
+	b.Close()
+
+	empty := filepath.Join(dir, "empty.tar")
+	f, err := os.Create(empty)
+	c.Assert(err, IsNil)
+	c.Assert(tar.NewWriter(f).Close(), IsNil)
+	f.Close()
+
+	b, err = runBuilder(fmt.Sprintf(`from "file:%s"`, empty))
+	c.Assert(err, NotNil)
+	b.Close()
+
+	b, err = runBuilder(fmt.Sprintf(`from "file:%s"`, filepath.Join(dir, "missing.tar")))
+	c.Assert(err, NotNil)
+	b.Close()
+}
+
+func (bs *builderSuite) TestFromPlatform(c *C) {
+	b, err := runBuilder(`from "alpine:3.9", arch: "arm", variant: "v6"`)
+	c.Assert(err, IsNil)
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Architecture, Equals, "arm")
+
+	name, _ := b.interp.BaseImage()
+	c.Assert(strings.HasPrefix(name, "alpine@sha256:"), Equals, true, Commentf("%s", name))
+	salt := b.interp.CacheSalt
+	c.Assert(salt, Not(Equals), "")
+	b.Close()
+
+	// another entry of the same image is cached apart.
+	b, err = runBuilder(`from "alpine:3.9", arch: "arm", variant: "v7"`)
+	c.Assert(err, IsNil)
+	c.Assert(b.interp.CacheSalt, Not(Equals), salt)
+	b.Close()
+
+	for _, plan := range []string{
+		`from "alpine:3.9", arch: "arm"`,
+		`from "alpine:3.9", arch: "mips"`,
+		`from :scratch, arch: "arm"`,
+	} {
+		b, err = runBuilder(plan)
+		c.Assert(err, NotNil, Commentf("%s", plan))
+		b.Close()
+	}
+}
+
+func (bs *builderSuite) TestFromBuildPlatform(c *C) {
+	b, err := NewBuilder(BuildConfig{
+		Globals: &btypes.Global{
+			Platform: btypes.Platform{Architecture: "arm", Variant: "v6"},
+			Context:  context.Background(),
+		},
+		Runner: make(chan struct{}),
+	})
+	c.Assert(err, IsNil)
+	defer b.Close()
+
+	// from uses the entry for the platform of --platform, unless the plan
+	// selects another, and the images tagged in the build as they are.
+	for _, test := range []struct {
+		plan, arch string
+	}{
+		{`from "alpine:3.9"`, "arm"},
+		{`from "alpine:3.9", arch: "amd64"`, "amd64"},
+		{`from "alpine:3.9"; tag "platformtest"; from :scratch; from "platformtest"`, "arm"},
+	} {
+		c.Assert(b.eval.RunScript(test.plan), IsNil, Commentf("%s", test.plan))
+
+		inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+		c.Assert(err, IsNil)
+		c.Assert(inspect.Architecture, Equals, test.arch, Commentf("%s", test.plan))
+	}
+
+	name, _ := b.interp.BaseImage()
+	c.Assert(name, Equals, "platformtest")
+}
+
+func (bs *builderSuite) TestFromList(c *C) {
+	b, err := runBuilder(`
+		from ["quezacoatl", "alpine"]
+	`)
+	c.Assert(err, IsNil)
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "alpine")
+	c.Assert(err, IsNil)
+	c.Assert(b.exec.Config().Image, Equals, inspect.ID)
+	b.Close()
+
+	b, err = runBuilder(`
+		from ["quezacoatl", "quezacoatl2"]
+	`)
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "quezacoatl2"), Equals, true)
+	b.Close()
+}
+
+func (bs *builderSuite) TestFromBaseCache(c *C) {
+	fetcher.ResetResolved()
+	defer fetcher.ResetResolved()
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "debian")
+	c.Assert(err, IsNil)
+
+	build := func(global btypes.Global) error {
+		global.Context = context.Background()
+		b, err := NewBuilder(BuildConfig{Globals: &global, Runner: make(chan struct{})})
+		c.Assert(err, IsNil)
+		defer b.Close()
+
+		if err := b.eval.RunScript(`from "box-base-cache-test"`); err != nil {
+			return err
+		}
+
+		c.Assert(b.exec.Config().Image, Equals, inspect.ID)
+		return nil
+	}
+
+	c.Assert(dockerClient.ImageTag(context.Background(), "debian", "box-base-cache-test:latest"), IsNil)
+	c.Assert(build(btypes.Global{BaseCacheTTL: time.Minute}), IsNil)
+
+	// the name is gone from the daemon, but still resolves within the ttl.
+	_, err = dockerClient.ImageRemove(context.Background(), "box-base-cache-test:latest", types.ImageRemoveOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(build(btypes.Global{BaseCacheTTL: time.Minute}), IsNil)
+
+	// pulling always looks it up in the registry, which does not have it.
+	c.Assert(build(btypes.Global{BaseCacheTTL: time.Minute, PullAlways: true}), NotNil)
+
+	fetcher.ResetResolved()
+	c.Assert(build(btypes.Global{BaseCacheTTL: time.Minute}), NotNil)
+}
+
+func (bs *builderSuite) TestAssertBaseMatches(c *C) {
+	b, err := runBuilder(`
+		assert_base_matches allow: ["docker.io/library/alpine", "registry.example.com"]
+		from "alpine"
+	`)
+	c.Assert(err, IsNil)
+	b.Close()
+
+	b, err = runBuilder(`
+		assert_base_matches deny: "docker.io/library/*"
+		from "alpine"
+	`)
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), `base image "alpine" (alpine@sha256:`), Equals, true, Commentf("%v", err))
+	c.Assert(strings.Contains(err.Error(), `denied by rule "docker.io/library/*"`), Equals, true)
+	b.Close()
+
+	// the current image is checked when the rules are given.
+	b, err = runBuilder(`
+		from "alpine"
+		assert_base_matches allow: "registry.example.com"
+	`)
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "is not allowed by the assert_base_matches rules"), Equals, true)
+	b.Close()
+
+	b, err = runBuilder(`
+		assert_base_matches allow: "registry.example.com"
+		from ["alpine", "debian"]
+	`)
+	c.Assert(err, NotNil)
+	b.Close()
+
+	b, err = runBuilder(`
+		assert_base_matches permit: "alpine"
+	`)
+	c.Assert(err, NotNil)
+	b.Close()
+}
+
 func (bs *builderSuite) TestAfter(c *C) {
 	b, err := runBuilder(`
 		from "alpine"
@@ -103,6 +367,30 @@ func (bs *builderSuite) TestAfter(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (bs *builderSuite) TestOnExit(c *C) {
+	b, err := runBuilder(`
+		from "alpine"
+		on_exit { tag "on-exit-test" }
+		run "exit 1"
+	`)
+	c.Assert(err, NotNil)
+
+	_, _, err = dockerClient.ImageInspectWithRaw(context.Background(), "on-exit-test")
+	c.Assert(err, NotNil)
+
+	c.Assert(b.Close(), IsNil)
+
+	_, _, err = dockerClient.ImageInspectWithRaw(context.Background(), "on-exit-test")
+	c.Assert(err, IsNil)
+
+	b, err = runBuilder(`
+		from "alpine"
+		on_exit { run "exit 1" }
+	`)
+	c.Assert(err, IsNil)
+	c.Assert(b.Close(), IsNil)
+}
+
 func (bs *builderSuite) TestContext(c *C) {
 	toCtx, cancel := context.WithTimeout(context.Background(), time.Second)
 
@@ -217,439 +505,2221 @@ func (bs *builderSuite) TestCopyWithGlob(c *C) {
 	b.Close()
 }
 
-func (bs *builderSuite) TestCopyWithIgnore(c *C) {
-	b, err := runBuilder(`
-		from "debian"
-		copy ".", "builder", ignore_list: ["builder.go"]
-		run "ls /builder"
-		run "test -f /builder/builder.go"
-	`)
-	c.Assert(err, NotNil)
-	b.Close()
+func (bs *builderSuite) TestInteractiveTag(c *C) {
+	c.Assert(dockerClient.ImageTag(context.Background(), "debian", "box-interactive-test:latest"), IsNil)
 
-	f, err := os.Create("filelist")
-	c.Assert(err, IsNil)
+	build := func(assumeYes bool, plan string) error {
+		b, err := NewBuilder(BuildConfig{
+			Globals: &btypes.Global{Context: context.Background(), Interactive: true, AssumeYes: assumeYes},
+		})
+		c.Assert(err, IsNil)
+		defer b.Close()
 
-	_, err = f.Write([]byte("builder.go\nutil.go\n"))
-	c.Assert(err, IsNil)
-	f.Close()
+		return b.RunString(plan).Err
+	}
 
-	b, err = runBuilder(`
-		from "debian"
-		copy ".", "builder", ignore_file: "filelist"
-		run "test -f /builder/builder.go || test -f /builder/util.go"
-	`)
-	c.Assert(err, NotNil)
-	b.Close()
+	// without a TTY, overwriting a tag requires --yes.
+	c.Assert(build(false, `
+    from "debian"
+    run "true"
+    tag "box-interactive-test"
+  `), NotNil)
 
-	os.Remove(f.Name())
+	// the tag is not looked up without someone to ask, so new tags need it
+	// too.
+	c.Assert(build(false, `
+    from "debian"
+    tag "box-interactive-test-new"
+  `), NotNil)
 
-	f, err = os.Create(".dockerignore")
-	c.Assert(err, IsNil)
+	c.Assert(build(true, `
+    from "debian"
+    run "true"
+    tag "box-interactive-test"
+  `), IsNil)
 
-	_, err = f.Write([]byte("builder.go\nutil.go\n"))
+	_, err := dockerClient.ImageRemove(context.Background(), "box-interactive-test", types.ImageRemoveOptions{})
 	c.Assert(err, IsNil)
-	f.Close()
-
-	b, err = runBuilder(`
-		from "debian"
-		copy ".", "builder"
-		run "test -f /builder/builder.go || test -f /builder/util.go"
-	`)
-	c.Assert(err, NotNil)
-	b.Close()
-
-	os.Remove(f.Name())
 }
 
-func (bs *builderSuite) TestCopyOverDir(c *C) {
-	testpath := filepath.Join(dockerfilePath, "test1.rb")
-
-	_, err := runBuilder(fmt.Sprintf(`
+func (bs *builderSuite) TestExport(c *C) {
+	b, err := runBuilder(`
     from "debian"
-    copy "%s", "/tmp"
-  `, testpath))
+    run "mkdir -p /out/sub && echo one >/out/one && echo two >/out/sub/two"
+  `)
 	c.Assert(err, IsNil)
+	defer b.Close()
 
-	_, err = runBuilder(fmt.Sprintf(`
-    from "debian"
-    copy "%s", "/tmp/"
-    run "test -f /tmp/test1.rb"
-  `, testpath))
+	dir, err := ioutil.TempDir("", "box-export")
 	c.Assert(err, IsNil)
-}
-
-func (bs *builderSuite) TestCopyOverVolume(c *C) {
-	// box deliberately does not support image volumes, so we must build from docker first.
-	cmd := exec.Command("docker", "build", "-t", "volumes", "-f", "testdata/dockerfiles/Dockerfile.volumes", ".")
-	out, err := cmd.CombinedOutput()
-	c.Assert(err, IsNil, Commentf("%v", string(out)))
+	defer os.RemoveAll(dir)
 
-	_, err = runBuilder(`
-  from "volumes"
-  copy ".", "/tmp/"
-  `)
+	c.Assert(b.Export("/out", filepath.Join(dir, "dir")), IsNil)
+	content, err := ioutil.ReadFile(filepath.Join(dir, "dir", "one"))
 	c.Assert(err, IsNil)
-}
+	c.Assert(string(content), Equals, "one\n")
+	content, err = ioutil.ReadFile(filepath.Join(dir, "dir", "sub", "two"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "two\n")
 
-func (bs *builderSuite) TestCopy(c *C) {
-	testpath := filepath.Join(dockerfilePath, "test1.rb")
+	c.Assert(b.Export("/out/one", filepath.Join(dir, "file")), IsNil)
+	content, err = ioutil.ReadFile(filepath.Join(dir, "file", "one"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "one\n")
 
-	b, err := runBuilder(fmt.Sprintf(`
-    from "debian"
-    copy "%s", "/test1.rb"
-  `, testpath))
+	c.Assert(b.Export("/", filepath.Join(dir, "root")), IsNil)
+	_, err = os.Stat(filepath.Join(dir, "root", "out", "sub", "two"))
 	c.Assert(err, IsNil)
 
-	result := readContainerFile(c, b, "/test1.rb")
+	c.Assert(b.Export("/nonexistent", filepath.Join(dir, "missing")), NotNil)
+}
 
-	content, err := ioutil.ReadFile(testpath)
+func (bs *builderSuite) TestFromLocalTag(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    run "echo base >/base"
+    tag "box-local-tag-test:base"
+  `)
 	c.Assert(err, IsNil)
-	c.Assert(string(content), Not(Equals), "")
-
-	c.Assert(bytes.Equal(result, content), Equals, true)
+	id := b.exec.Config().Image
 	b.Close()
 
+	// move the name in the daemon; the plans in this process still get the
+	// image they tagged.
+	c.Assert(dockerClient.ImageTag(context.Background(), "debian", "box-local-tag-test:base"), IsNil)
+
 	b, err = runBuilder(`
-    from "debian"
-    copy "builder.go", "/"
+    from "box-local-tag-test:base"
+    run "test -f /base"
   `)
-
-	c.Assert(err, IsNil)
-	result = readContainerFile(c, b, "/builder.go")
-	content, err = ioutil.ReadFile("builder.go")
 	c.Assert(err, IsNil)
-	c.Assert(string(content), Not(Equals), "")
+	_, baseID := b.interp.BaseImage()
+	c.Assert(baseID, Equals, id)
+	b.Close()
 
-	c.Assert(content, DeepEquals, result)
+	command.ResetTags()
+
+	b, err = runBuilder(`
+    from "box-local-tag-test:base"
+    run "test -f /base"
+  `)
+	c.Assert(err, NotNil)
 	b.Close()
 
+	// so are the names tagged after the plan, like --tag does.
 	b, err = runBuilder(`
     from "debian"
-    copy ".", "test"
+    run "echo cli >/cli"
   `)
-
 	c.Assert(err, IsNil)
+	id = b.exec.Config().Image
+	c.Assert(b.Tag("box-local-tag-test:cli"), IsNil)
+	b.Close()
+	defer dockerClient.ImageRemove(context.Background(), "box-local-tag-test:cli", types.ImageRemoveOptions{})
 
-	result = readContainerFile(c, b, "/test/builder.go")
-	c.Assert(content, DeepEquals, result)
+	b, err = runBuilder(`from "box-local-tag-test:cli"`)
+	c.Assert(err, IsNil)
+	_, baseID = b.interp.BaseImage()
+	c.Assert(baseID, Equals, id)
 	b.Close()
+}
 
-	b, err = runBuilder(`
+func (bs *builderSuite) TestRunAllowExit(c *C) {
+	b, err := runBuilder(`
     from "debian"
-    workdir "/test"
-    copy ".", "test/"
+    run "exit 1", allow_exit: [0, 1]
+    run "exit 3", allow_exit: 3
+    run "touch /test"
   `)
-
 	c.Assert(err, IsNil)
-
-	result = readContainerFile(c, b, "/test/test/builder.go")
-	c.Assert(content, DeepEquals, result)
+	c.Assert(string(readContainerFile(c, b, "/test")), Equals, "")
+	b.Close()
+
+	for _, plan := range []string{
+		`run "exit 2", allow_exit: [0, 1]`,
+		`run "true", allow_exit: [1]`,
+		`run "true", allow_exit: ["one"]`,
+	} {
+		b, err := runBuilder("from \"debian\"\n" + plan)
+		c.Assert(err, NotNil, Commentf("%s", plan))
+		b.Close()
+	}
+
+	b, err = runBuilder(`
+    from "debian"
+    res = run_capture("echo out; exit 4")
+    raise "bad status" unless res[:status] == 4
+    raise "bad output" unless res[:output] == "out\n"
+    run "true" unless run_capture("true")[:status] != 0
+  `)
+	c.Assert(err, IsNil)
+	b.Close()
+}
+
+func (bs *builderSuite) TestRunAssert(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    out = run_assert "cat /etc/os-release", contains: "Debian", matches: "(?m)^ID=debian$"
+    raise "bad output" unless out.include?("ID=debian")
+  `)
+	c.Assert(err, IsNil)
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+    run_assert "echo version 1.1", contains: "version 1.2"
+  `)
+	c.Assert(err, ErrorMatches, `(?s).*run_assert "echo version 1.1" failed: the output does not contain "version 1.2" \(exit status 0\):.version 1.1.*`)
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+    run_assert "head -c 4096 /dev/zero | tr '\\0' x", matches: "^y"
+  `)
+	c.Assert(err, ErrorMatches, `(?s).*does not match /\^y/.*x{1024}\.\.\..*`)
+	b.Close()
+
+	for _, plan := range []string{
+		`run_assert "true", {}`,
+		`run_assert "true", matches: "("`,
+	} {
+		b, err := runBuilder("from \"debian\"\n" + plan)
+		c.Assert(err, NotNil, Commentf("%s", plan))
+		b.Close()
+	}
+}
+
+func (bs *builderSuite) TestDebug(c *C) {
+	log := logger.New("debug.rb", true, 0)
+	log.Record()
+
+	b, err := NewBuilder(BuildConfig{
+		Globals: &btypes.Global{Context: context.Background(), Cache: false, Debug: true, Logger: log},
+	})
+	c.Assert(err, IsNil)
+	defer b.Close()
+
+	res := b.RunString(`
+    from "debian"
+    run "true"
+  `)
+	c.Assert(res.Err, IsNil)
+
+	out := log.Output().(*bytes.Buffer).String()
+	for _, op := range []string{"Debug: pull image=debian", "create image=", "start id=", "wait id=", "commit id="} {
+		c.Assert(strings.Contains(out, op), Equals, true, Commentf("%s: %q", op, out))
+	}
+}
+
+func (bs *builderSuite) TestPostCommitHook(c *C) {
+	dir, err := ioutil.TempDir("", "box-post-commit")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	hooked := filepath.Join(dir, "hooked")
+
+	build := func(hook, plan string) (*Builder, string, error) {
+		log := logger.New("hook.rb", true, 0)
+		log.Record()
+
+		b, err := NewBuilder(BuildConfig{
+			Globals: &btypes.Global{Context: context.Background(), PostCommitHook: hook, Logger: log},
+		})
+		c.Assert(err, IsNil)
+
+		res := b.RunString(plan)
+		return b, log.Output().(*bytes.Buffer).String(), res.Err
+	}
+
+	b, out, err := build(`echo hooked; echo "$BOX_PARENT_ID $BOX_IMAGE_ID" >>`+hooked+`; test "$BOX_IMAGE_ID" =`, `
+    from "debian"
+    run "touch /a"
+    env FOO: "bar"
+  `)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(out, "hooked"), Equals, true, Commentf("%q", out))
+
+	content, err := ioutil.ReadFile(hooked)
+	c.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	c.Assert(lines, HasLen, 2)
+
+	// each layer is committed on the one before.
+	run := strings.Fields(lines[0])
+	c.Assert(run, HasLen, 2)
+	env := strings.Fields(lines[1])
+	c.Assert(env, DeepEquals, []string{run[1], b.exec.Config().Image})
+	b.Close()
+
+	// the image a failed hook was given is removed, so it is not found in the
+	// cache.
+	failed := filepath.Join(dir, "failed")
+	b, _, err = build(`echo -n "$BOX_IMAGE_ID" >`+failed+`; false`, `
+    from "debian"
+    run "touch /a"
+  `)
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "Post-commit hook"), Equals, true, Commentf("%v", err))
+	b.Close()
+
+	id, err := ioutil.ReadFile(failed)
+	c.Assert(err, IsNil)
+	_, _, err = dockerClient.ImageInspectWithRaw(context.Background(), string(id))
+	c.Assert(client.IsErrImageNotFound(err), Equals, true, Commentf("%v", err))
+}
+
+func (bs *builderSuite) TestProfile(c *C) {
+	b, err := NewBuilder(BuildConfig{
+		Globals: &btypes.Global{Context: context.Background(), Profile: true},
+	})
+	c.Assert(err, IsNil)
+	defer b.Close()
+
+	res := b.RunString(`
+    from "debian"
+    run "sleep 1"
+    x = 0
+    200000.times { x += 1 }
+  `)
+	c.Assert(res.Err, IsNil)
+
+	profile, ok := b.Profile()
+	c.Assert(ok, Equals, true)
+	c.Assert(profile.Plan > 0, Equals, true)
+	c.Assert(profile.Executor > time.Second, Equals, true)
+
+	ops := map[string]int{}
+	for _, op := range profile.Operations {
+		ops[op.Name] = op.Count
+	}
+
+	// the run's start and wait is part of its commit, so it is not counted.
+	c.Assert(ops["pull"], Equals, 1)
+	c.Assert(ops["commit"], Equals, 1)
+	c.Assert(ops["start and wait"], Equals, 0)
+
+	b, err = NewBuilder(BuildConfig{Globals: &btypes.Global{Context: context.Background()}})
+	c.Assert(err, IsNil)
+	defer b.Close()
+
+	_, ok = b.Profile()
+	c.Assert(ok, Equals, false)
+}
+
+// TestParallelProfile profiles the runs of a parallel block, which are
+// observed concurrently; run it with -race to check the profiler is locked.
+func (bs *builderSuite) TestParallelProfile(c *C) {
+	b, err := NewBuilder(BuildConfig{
+		Globals: &btypes.Global{Context: context.Background(), Profile: true, Experimental: true},
+	})
+	c.Assert(err, IsNil)
+	defer b.Close()
+
+	res := b.RunString(`
+    from "debian"
+    parallel do
+      run "sleep 1 && touch /one"
+      run "sleep 1 && touch /two"
+      run "sleep 1 && touch /three"
+    end
+  `)
+	c.Assert(res.Err, IsNil)
+
+	profile, ok := b.Profile()
+	c.Assert(ok, Equals, true)
+
+	ops := map[string]int{}
+	for _, op := range profile.Operations {
+		ops[op.Name] = op.Count
+	}
+
+	// the runs overlap without being nested in each other, so each is counted.
+	c.Assert(ops["start and wait"], Equals, 3)
+	c.Assert(ops["diff"], Equals, 3)
+	c.Assert(ops["commit"], Equals, 1)
+}
+
+func (bs *builderSuite) TestRunString(c *C) {
+	b, err := NewBuilder(BuildConfig{
+		Globals: &btypes.Global{Context: context.Background(), Cache: true},
+	})
+	c.Assert(err, IsNil)
+	defer b.Close()
+
+	res := b.RunString(`from "debian"`)
+	c.Assert(res.Err, IsNil)
+	c.Assert(res.Value, Not(Equals), "")
+
+	res = b.RunString(`undefined_verb "foo"`)
+	c.Assert(res.Err, NotNil)
+
+	res = b.RunString(`
+    name = "/test"
+    run "touch #{name}"
+    env "FOO" => "bar"
+  `)
+	c.Assert(res.Err, IsNil)
+	c.Assert(res.Value, Equals, b.exec.Config().Image)
+	c.Assert(string(readContainerFile(c, b, "/test")), Equals, "")
+
+	res = b.RunString(`name`)
+	c.Assert(res.Err, IsNil)
+	c.Assert(res.Value, Equals, "/test")
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+
+	found := false
+
+	for _, str := range inspect.Config.Env {
+		if str == "FOO=bar" {
+			found = true
+		}
+	}
+
+	c.Assert(found, Equals, true)
+}
+
+func (bs *builderSuite) TestSource(c *C) {
+	b, err := NewBuilder(BuildConfig{
+		Globals: &btypes.Global{Context: context.Background()},
+	})
+	c.Assert(err, IsNil)
+	defer b.Close()
+
+	keep, err := b.eval.RunCode(`prefix = "/src"`, 0, false)
+	c.Assert(err, IsNil)
+
+	// the plan sees the variables of the session, and the session those of
+	// the plan.
+	keep, err = b.eval.Source("source.rb", `
+    from "debian"
+    name = "#{prefix}/test"
+    run "mkdir -p #{prefix} && touch #{name}"
+  `, keep)
+	c.Assert(err, IsNil)
+
+	_, err = b.eval.RunCode(`name`, keep, false)
+	c.Assert(err, IsNil)
+	c.Assert(b.eval.Result().Value, Equals, "/src/test")
+	c.Assert(string(readContainerFile(c, b, "/src/test")), Equals, "")
+
+	// the error of a failed plan is located in its file, and the steps before
+	// it are kept.
+	image := b.exec.Config().Image
+	_, err = b.eval.Source("failed.rb", `
+    run "touch /done"
+    raise "stop"
+  `, keep)
+	planErr, ok := err.(*btypes.PlanError)
+	c.Assert(ok, Equals, true, Commentf("%v", err))
+	c.Assert(planErr.File, Equals, "failed.rb")
+	c.Assert(planErr.Line, Equals, 3)
+	c.Assert(b.exec.Config().Image, Not(Equals), image)
+}
+
+func (bs *builderSuite) TestCopyWithParents(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    copy "config/*.go", "/out/", parents: true
+    run "test -f /out/config/config.go"
+    run "test ! -f /out/config.go"
+    copy "config/config.go", "/single/", parents: true
+    run "test -f /single/config/config.go"
+  `)
+	c.Assert(err, IsNil)
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+    copy "config/*.go", "/out/"
+    run "test -f /out/config.go"
+    run "test ! -d /out/config"
+  `)
+	c.Assert(err, IsNil)
+	b.Close()
+}
+
+func (bs *builderSuite) TestCopyInheritOwner(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    run "mkdir -p /var/www && chown www-data:www-data /var/www"
+    copy "config", "/var/www/config", inherit_owner: true
+    run "test $(stat -c %U:%G /var/www/config) = www-data:www-data"
+    run "test $(stat -c %U:%G /var/www/config/config.go) = www-data:www-data"
+    copy "config/config.go", "/var/www/", inherit_owner: true
+    run "test $(stat -c %U /var/www/config.go) = www-data"
+    copy "config/config.go", "/var/www/new/app.go", inherit_owner: true
+    run "test $(stat -c %U /var/www/new/app.go) = www-data"
+    copy "config/config.go", "/root.go", inherit_owner: true
+    run "test $(stat -c %U /root.go) = root"
+  `)
+	c.Assert(err, IsNil)
+	b.Close()
+
+	_, err = runBuilder(`
+    from "debian"
+    copy content("x"), "/x", inherit_owner: true
+  `)
+	c.Assert(err, NotNil)
+}
+
+func (bs *builderSuite) TestCopyInterpolation(c *C) {
+	if os.Getenv("NO_CACHE") != "" {
+		c.Skip("the cache is disabled by NO_CACHE")
+	}
+
+	defer os.RemoveAll("interpolated")
+	for _, arch := range []string{"amd64", "arm64"} {
+		c.Assert(os.MkdirAll(filepath.Join("interpolated", arch), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(filepath.Join("interpolated", arch, "app"), []byte(arch), 0644), IsNil)
+	}
+
+	defer os.Unsetenv("ARCH")
+
+	ids := map[string]string{}
+
+	for _, arch := range []string{"amd64", "arm64", "amd64"} {
+		os.Setenv("ARCH", arch)
+
+		b, err := runBuilder(`
+      from "debian"
+      copy "interpolated/#{getenv("ARCH")}/app", "/usr/bin/app"
+    `)
+		c.Assert(err, IsNil)
+		c.Assert(string(readContainerFile(c, b, "/usr/bin/app")), Equals, arch)
+
+		// the resolved source is what is hashed, so each variable has its own
+		// layer, which is reused when the variable is the same again.
+		if id, ok := ids[arch]; ok {
+			c.Assert(b.exec.Config().Image, Equals, id)
+		}
+		ids[arch] = b.exec.Config().Image
+		b.Close()
+	}
+
+	c.Assert(ids["amd64"], Not(Equals), ids["arm64"])
+}
+
+func (bs *builderSuite) TestCopyContent(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    workdir "/tmp"
+    copy content("hello\n"), "/etc/app/config"
+    copy content(run_capture("cat /etc/debian_version")[:output]), "version"
+  `)
+	c.Assert(err, IsNil)
+
+	c.Assert(string(readContainerFile(c, b, "/etc/app/config")), Equals, "hello\n")
+	version := readContainerFile(c, b, "/etc/debian_version")
+	c.Assert(readContainerFile(c, b, "/tmp/version"), DeepEquals, version)
+	b.Close()
+
+	for _, target := range []string{"/etc/", "."} {
+		b, err = runBuilder(fmt.Sprintf(`
+      from "debian"
+      copy content("hello"), %q
+    `, target))
+		c.Assert(err, NotNil)
+		b.Close()
+	}
+}
+
+func (bs *builderSuite) TestAdd(c *C) {
+	dir, err := ioutil.TempDir("", "box-add")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	content, err := ioutil.ReadFile("builder.go")
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "builder.go"), content, 0644), IsNil)
+
+	archive, err := os.Create(filepath.Join(dir, "archive.tar.gz"))
+	c.Assert(err, IsNil)
+	gz := gzip.NewWriter(archive)
+	tw := tar.NewWriter(gz)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "app/", Mode: 0755, Typeflag: tar.TypeDir}), IsNil)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "app/builder.go", Mode: 0600, Size: int64(len(content)), Typeflag: tar.TypeReg}), IsNil)
+	_, err = tw.Write(content)
+	c.Assert(err, IsNil)
+	c.Assert(tw.Close(), IsNil)
+	c.Assert(gz.Close(), IsNil)
+	c.Assert(archive.Close(), IsNil)
+
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+
+	sum := sha256.Sum256(content)
+	checksum := "sha256:" + hex.EncodeToString(sum[:])
+	sum512 := sha512.Sum512(content)
+
+	b, err := runBuilder(fmt.Sprintf(`
+    from "debian"
+    add "%[1]s/builder.go", "/tmp/"
+    add "%[1]s/builder.go", "/tmp/checked.go", checksum: %[2]q
+    add "%[1]s/builder.go", "/tmp/checked512.go", checksum: "sha512:%[3]x"
+    add "%[1]s/archive.tar.gz", "/opt"
+  `, server.URL, checksum, sum512))
+	c.Assert(err, IsNil)
+	c.Assert(readContainerFile(c, b, "/tmp/builder.go"), DeepEquals, content)
+	c.Assert(readContainerFile(c, b, "/tmp/checked.go"), DeepEquals, content)
+	c.Assert(readContainerFile(c, b, "/tmp/checked512.go"), DeepEquals, content)
+	c.Assert(readContainerFile(c, b, "/opt/app/builder.go"), DeepEquals, content)
+	c.Assert(string(runContainerCommand(c, b, []string{"stat", "-c", "%a", "/tmp/builder.go", "/opt/app/builder.go"})), Equals, "644\n600\n")
+	b.Close()
+
+	for _, plan := range []string{
+		fmt.Sprintf(`add "%s/builder.go", "/tmp/", checksum: "sha256:%064d"`, server.URL, 0),
+		fmt.Sprintf(`add "%s/archive.tar.gz", "/tmp/", checksum: "sha256:%064d"`, server.URL, 0),
+		fmt.Sprintf(`add "%s/builder.go", "/tmp/", checksum: "md5:0123"`, server.URL),
+		fmt.Sprintf(`add "%s/builder.go", "/tmp/", checksum: "sha256"`, server.URL),
+		fmt.Sprintf(`add "%s/builder.go", "/tmp/", mode: "0600"`, server.URL),
+		fmt.Sprintf(`add "%s/missing", "/tmp/"`, server.URL),
+		fmt.Sprintf(`add "%s", "/tmp/"`, server.URL),
+		fmt.Sprintf(`copy "%s/builder.go", "/tmp/"`, server.URL),
+		`add "builder.go", "/tmp/"`,
+	} {
+		b, err = runBuilder("from \"debian\"\n" + plan)
+		c.Assert(err, NotNil, Commentf("%s", plan))
+		b.Close()
+	}
+}
+
+func (bs *builderSuite) TestCopyWithIgnore(c *C) {
+	b, err := runBuilder(`
+		from "debian"
+		copy ".", "builder", ignore_list: ["builder.go"]
+		run "ls /builder"
+		run "test -f /builder/builder.go"
+	`)
+	c.Assert(err, NotNil)
+	b.Close()
+
+	f, err := os.Create("filelist")
+	c.Assert(err, IsNil)
+
+	_, err = f.Write([]byte("builder.go\nutil.go\n"))
+	c.Assert(err, IsNil)
+	f.Close()
+
+	b, err = runBuilder(`
+		from "debian"
+		copy ".", "builder", ignore_file: "filelist"
+		run "test -f /builder/builder.go || test -f /builder/util.go"
+	`)
+	c.Assert(err, NotNil)
+	b.Close()
+
+	os.Remove(f.Name())
+
+	f, err = os.Create(".dockerignore")
+	c.Assert(err, IsNil)
+
+	_, err = f.Write([]byte("builder.go\nutil.go\n"))
+	c.Assert(err, IsNil)
+	f.Close()
+
+	b, err = runBuilder(`
+		from "debian"
+		copy ".", "builder"
+		run "test -f /builder/builder.go || test -f /builder/util.go"
+	`)
+	c.Assert(err, NotNil)
+	b.Close()
+
+	os.Remove(f.Name())
+}
+
+func (bs *builderSuite) TestCopyHardLinks(c *C) {
+	c.Assert(os.MkdirAll("hardlinks/bin", 0755), IsNil)
+	defer os.RemoveAll("hardlinks")
+
+	c.Assert(ioutil.WriteFile("hardlinks/bin/busybox", []byte("#!/bin/sh\necho hi\n"), 0755), IsNil)
+	c.Assert(os.Link("hardlinks/bin/busybox", "hardlinks/bin/ls"), IsNil)
+
+	b, err := runBuilder(`
+		from "debian"
+		copy "hardlinks", "/opt"
+	`)
+	c.Assert(err, IsNil)
+
+	result := runContainerCommand(c, b, []string{"/bin/sh", "-c", "stat -c '%h %i' /opt/bin/busybox /opt/bin/ls | sort -u"})
+	c.Assert(strings.Count(string(result), "\n"), Equals, 1, Commentf("%s", result))
+	c.Assert(strings.HasPrefix(string(result), "2 "), Equals, true, Commentf("%s", result))
+	b.Close()
+}
+
+func (bs *builderSuite) TestCopyWithCaps(c *C) {
+	dir, err := ioutil.TempDir("", "box-caps")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "main.go")
+	c.Assert(ioutil.WriteFile(src, []byte(`package main
+
+import "net"
+
+func main() {
+	l, err := net.Listen("tcp", ":80")
+	if err != nil {
+		panic(err)
+	}
+	l.Close()
+}
+`), 0644), IsNil)
+
+	cmd := exec.Command("go", "build", "-o", "bind", src)
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+	out, err := cmd.CombinedOutput()
+	c.Assert(err, IsNil, Commentf("%v", string(out)))
+	defer os.Remove("bind")
+
+	b, err := runBuilder(`
+		from "debian"
+		copy "bind", "/bind"
+		user "nobody"
+		run "/bind"
+	`)
+	c.Assert(err, NotNil)
+	b.Close()
+
+	b, err = runBuilder(`
+		from "debian"
+		copy "bind", "/bind", caps: ["cap_net_bind_service+ep"]
+		user "nobody"
+		run "/bind"
+	`)
+	c.Assert(err, IsNil)
+	b.Close()
+
+	_, err = runBuilder(`
+		from "debian"
+		copy "bind", "/bind", caps: ["cap_bogus+ep"]
+	`)
+	c.Assert(err, NotNil)
+}
+
+func (bs *builderSuite) TestCopyOverDir(c *C) {
+	testpath := filepath.Join(dockerfilePath, "test1.rb")
+
+	_, err := runBuilder(fmt.Sprintf(`
+    from "debian"
+    copy "%s", "/tmp"
+  `, testpath))
+	c.Assert(err, IsNil)
+
+	_, err = runBuilder(fmt.Sprintf(`
+    from "debian"
+    copy "%s", "/tmp/"
+    run "test -f /tmp/test1.rb"
+  `, testpath))
+	c.Assert(err, IsNil)
+}
+
+func (bs *builderSuite) TestCopyTargetDirectory(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    copy "builder.go", "/fresh/nested/"
+    copy "builder.go", "/other/nested/renamed.go"
+    workdir "/app"
+    copy "builder.go", "sub/"
+    copy "builder.go", "sub/renamed.go"
+  `)
+	c.Assert(err, IsNil)
+	defer b.Close()
+
+	content, err := ioutil.ReadFile("builder.go")
+	c.Assert(err, IsNil)
+
+	for _, fn := range []string{"/fresh/nested/builder.go", "/other/nested/renamed.go", "/app/sub/builder.go", "/app/sub/renamed.go"} {
+		c.Assert(readContainerFile(c, b, fn), DeepEquals, content, Commentf("%s", fn))
+	}
+
+	result := runContainerCommand(c, b, []string{"/bin/sh", "-c", "test -d /fresh/nested && test -d /app/sub && echo dirs"})
+	c.Assert(string(result), Equals, "dirs\n")
+}
+
+func (bs *builderSuite) TestCopyMap(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    workdir "/app"
+    copy({"builder.go" => "/renamed/b.go", "config/config.go" => "c.go", "config" => "conf/"})
+  `)
+	c.Assert(err, IsNil)
+	defer b.Close()
+
+	// the sources are copied in one layer.
+	history, err := dockerClient.ImageHistory(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+
+	base, err := dockerClient.ImageHistory(context.Background(), "debian")
+	c.Assert(err, IsNil)
+	c.Assert(len(history)-len(base), Equals, 2) // workdir and copy
+
+	for fn, target := range map[string]string{"builder.go": "/renamed/b.go", "config/config.go": "/app/c.go"} {
+		content, err := ioutil.ReadFile(fn)
+		c.Assert(err, IsNil)
+		c.Assert(readContainerFile(c, b, target), DeepEquals, content, Commentf("%s", fn))
+	}
+
+	result := runContainerCommand(c, b, []string{"/bin/sh", "-c", "test -f /app/conf/config.go && echo dir"})
+	c.Assert(string(result), Equals, "dir\n")
+
+	for _, plan := range []string{
+		`copy({"builder.go" => "/b.go"}, parents: true)`,
+		`copy({"../builder.go" => "/b.go"})`,
+		`copy({content("x") => "/x"})`,
+		`copy({})`,
+		`copy({"builder.go" => "/b.go"}, "/other")`,
+	} {
+		_, err := runBuilder("from \"debian\"\n" + plan)
+		c.Assert(err, NotNil, Commentf("%s", plan))
+	}
+}
+
+func (bs *builderSuite) TestCopyOverVolume(c *C) {
+	// box deliberately does not support image volumes, so we must build from docker first.
+	cmd := exec.Command("docker", "build", "-t", "volumes", "-f", "testdata/dockerfiles/Dockerfile.volumes", ".")
+	out, err := cmd.CombinedOutput()
+	c.Assert(err, IsNil, Commentf("%v", string(out)))
+
+	_, err = runBuilder(`
+  from "volumes"
+  copy ".", "/tmp/"
+  `)
+	c.Assert(err, IsNil)
+}
+
+func (bs *builderSuite) TestCopy(c *C) {
+	testpath := filepath.Join(dockerfilePath, "test1.rb")
+
+	b, err := runBuilder(fmt.Sprintf(`
+    from "debian"
+    copy "%s", "/test1.rb"
+  `, testpath))
+	c.Assert(err, IsNil)
+
+	result := readContainerFile(c, b, "/test1.rb")
+
+	content, err := ioutil.ReadFile(testpath)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Not(Equals), "")
+
+	c.Assert(bytes.Equal(result, content), Equals, true)
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+    copy "builder.go", "/"
+  `)
+
+	c.Assert(err, IsNil)
+	result = readContainerFile(c, b, "/builder.go")
+	content, err = ioutil.ReadFile("builder.go")
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Not(Equals), "")
+
+	c.Assert(content, DeepEquals, result)
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+    copy ".", "test"
+  `)
+
+	c.Assert(err, IsNil)
+
+	result = readContainerFile(c, b, "/test/builder.go")
+	c.Assert(content, DeepEquals, result)
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+    workdir "/test"
+    copy ".", "test/"
+  `)
+
+	c.Assert(err, IsNil)
+
+	result = readContainerFile(c, b, "/test/test/builder.go")
+	c.Assert(content, DeepEquals, result)
 	b.Close()
 
 	b, err = runBuilder(`
     from "debian"
 		run "mkdir /test"
     inside "/test" do
-      copy ".", "test/"
+      copy ".", "test/"
+    end
+  `)
+
+	c.Assert(err, IsNil)
+
+	result = readContainerFile(c, b, "/test/test/builder.go")
+	c.Assert(content, DeepEquals, result)
+
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+    inside "/test" do
+      copy "..", "test/"
+    end
+  `)
+
+	c.Assert(err, NotNil)
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+    inside "/test" do
+      copy "testdata/..", "test/"
+    end
+  `)
+
+	c.Assert(err, IsNil)
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+    inside "/test" do
+      copy "testdata/../..", "test/"
+    end
+  `)
+
+	c.Assert(err, NotNil)
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+    inside "/test" do
+      copy "testdata/../../builder/..", "test/"
+    end
+  `)
+
+	c.Assert(err, NotNil)
+	b.Close()
+}
+
+func (bs *builderSuite) TestTag(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    tag "test"
+  `)
+
+	c.Assert(err, IsNil)
+	c.Assert(b.exec.Config().Image, Not(Equals), "test")
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "test")
+	c.Assert(err, IsNil)
+
+	c.Assert(inspect.RepoTags, DeepEquals, []string{"test:latest"})
+	b.Close()
+}
+
+func (bs *builderSuite) TestSave(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+		save tag: "test"
+  `)
+
+	c.Assert(err, IsNil)
+	c.Assert(b.exec.Config().Image, Not(Equals), "test")
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "test")
+	c.Assert(err, IsNil)
+
+	var found bool
+
+	for _, tag := range inspect.RepoTags {
+		if tag == "test:latest" {
+			found = true
+		}
+	}
+
+	c.Assert(found, Equals, true)
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+		run "apt-get update -qq"
+		save file: "test.tar"
+  `)
+	c.Assert(err, IsNil)
+	b.Close()
+
+	defer os.Remove("test.tar")
+	f, err := os.Open("test.tar")
+	c.Assert(err, IsNil)
+
+	r, err := dockerClient.ImageLoad(context.Background(), f, true)
+	c.Assert(err, IsNil)
+	io.Copy(ioutil.Discard, r.Body)
+
+	b, err = runBuilder(`
+    from "debian"
+		save file: "../test.tar"
+  `)
+	c.Assert(err, NotNil)
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+		save file: "/test.tar"
+  `)
+	c.Assert(err, NotNil)
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+		run "apt-get update -qq"
+		save file: "oci.tar", kind: "oci"
+  `)
+	c.Assert(err, IsNil)
+	b.Close()
+
+	defer os.Remove("oci.tar")
+	f, err = os.Open("oci.tar")
+	c.Assert(err, IsNil)
+
+	tr := tar.NewReader(f)
+	found = false
+	for {
+		header, err := tr.Next()
+		c.Assert(err, IsNil)
+
+		if path.Base(header.Name) == "oci" {
+			found = true
+			break
+		}
+	}
+
+	c.Assert(found, Equals, true)
+
+	b, err = runBuilder(`
+    from "debian"
+		label "org.example.team" => "builders"
+		save file: "oci-out", kind: "oci-layout"
+  `)
+	c.Assert(err, IsNil)
+	defer os.RemoveAll("oci-out")
+
+	content, err := ioutil.ReadFile("oci-out/index.json")
+	c.Assert(err, IsNil)
+
+	var index struct {
+		Manifests []struct {
+			Digest      string
+			Annotations map[string]string
+		}
+	}
+	c.Assert(json.Unmarshal(content, &index), IsNil)
+	c.Assert(len(index.Manifests), Equals, 1)
+	c.Assert(index.Manifests[0].Annotations["org.opencontainers.image.ref.name"], Equals, "oci-out")
+
+	content, err = ioutil.ReadFile(filepath.Join("oci-out/blobs/sha256", strings.TrimPrefix(index.Manifests[0].Digest, "sha256:")))
+	c.Assert(err, IsNil)
+
+	var manifest struct{ Annotations map[string]string }
+	c.Assert(json.Unmarshal(content, &manifest), IsNil)
+	c.Assert(manifest.Annotations["org.example.team"], Equals, "builders")
+	b.Close()
+}
+
+func (bs *builderSuite) TestSBOM(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    run "true"
+  `)
+	c.Assert(err, IsNil)
+	defer b.Close()
+
+	f, err := ioutil.TempFile("", "box-sbom")
+	c.Assert(err, IsNil)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	c.Assert(b.SBOM(f.Name(), "sbom-test", "test"), IsNil)
+
+	content, err := ioutil.ReadFile(f.Name())
+	c.Assert(err, IsNil)
+
+	var doc struct {
+		Metadata struct {
+			Component struct {
+				Name    string
+				Version string
+			}
+		}
+		Components []struct {
+			Name string
+			PURL string
+		}
+	}
+
+	c.Assert(json.Unmarshal(content, &doc), IsNil)
+	c.Assert(doc.Metadata.Component.Name, Equals, "sbom-test")
+	c.Assert(doc.Metadata.Component.Version, Equals, b.exec.Config().Image)
+	c.Assert(doc.Components[0].Name, Equals, "debian")
+
+	var found bool
+	for _, component := range doc.Components {
+		if component.Name == "bash" {
+			found = true
+			c.Assert(strings.HasPrefix(component.PURL, "pkg:deb/debian/bash@"), Equals, true, Commentf("%q", component.PURL))
+		}
+	}
+	c.Assert(found, Equals, true)
+}
+
+func (bs *builderSuite) TestReproducible(c *C) {
+	digests := []string{}
+
+	for _, dir := range []string{"repro1", "repro2"} {
+		b, err := NewBuilder(BuildConfig{
+			Globals: &btypes.Global{
+				Cache:        false,
+				Reproducible: true,
+				Context:      context.Background(),
+			},
+			Runner: make(chan struct{}),
+		})
+		c.Assert(err, IsNil)
+
+		err = b.eval.RunScript(fmt.Sprintf(`
+      from "debian"
+      env "ZED" => "1", "ALPHA" => "2", "MIDDLE" => "3"
+      label "b" => "2", "a" => "1"
+      save file: "%s", kind: "oci-layout"
+    `, dir))
+		c.Assert(err, IsNil)
+		b.Close()
+		defer os.RemoveAll(dir)
+
+		content, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+		c.Assert(err, IsNil)
+
+		var index struct{ Manifests []struct{ Digest string } }
+		c.Assert(json.Unmarshal(content, &index), IsNil)
+		c.Assert(len(index.Manifests), Equals, 1)
+
+		content, err = ioutil.ReadFile(filepath.Join(dir, "blobs/sha256", strings.TrimPrefix(index.Manifests[0].Digest, "sha256:")))
+		c.Assert(err, IsNil)
+
+		var manifest struct{ Config struct{ Digest string } }
+		c.Assert(json.Unmarshal(content, &manifest), IsNil)
+		digests = append(digests, manifest.Config.Digest)
+	}
+
+	c.Assert(digests[0], Equals, digests[1])
+}
+
+func (bs *builderSuite) TestPull(c *C) {
+	b, err := runBuilder(`
+    label digest: pull("debian")
+  `)
+	c.Assert(err, NotNil) // label needs an image; pull does not provide one
+	b.Close()
+
+	b, err = runBuilder(`
+    digest = pull "debian"
+    from "debian"
+    label digest: digest
+  `)
+	c.Assert(err, IsNil)
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(inspect.Config.Labels["digest"], "debian@sha256:"), Equals, true, Commentf("%s", inspect.Config.Labels["digest"]))
+	b.Close()
+
+	b, err = runBuilder(`pull "box-builder/does-not-exist"`)
+	c.Assert(err, NotNil)
+	b.Close()
+}
+
+func (bs *builderSuite) TestTempDir(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    save file: "#{tmpdir}/image.tar"
+    label dir: tmpdir
+  `)
+	c.Assert(err, IsNil)
+
+	dir, err := b.interp.TempDir()
+	c.Assert(err, IsNil)
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Config.Labels["dir"], Equals, dir)
+
+	_, err = os.Stat(filepath.Join(dir, "image.tar"))
+	c.Assert(err, IsNil)
+
+	c.Assert(b.Close(), IsNil)
+	_, err = os.Stat(dir)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// the path differs between builds, but is not part of the cache key.
+	ids := []string{}
+	for n := 0; n < 2; n++ {
+		b, err := NewBuilder(BuildConfig{
+			Globals: &btypes.Global{Cache: true, Context: context.Background()},
+			Runner:  make(chan struct{}),
+		})
+		c.Assert(err, IsNil)
+		c.Assert(b.eval.RunScript(`
+      from "debian"
+      run "test -d #{tmpdir}; date +%s%N >/built"
+    `), IsNil)
+		ids = append(ids, b.exec.Config().Image)
+		c.Assert(b.Close(), IsNil)
+	}
+	c.Assert(ids[1], Equals, ids[0])
+}
+
+func (bs *builderSuite) TestFlatten(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    run "echo foo >bar"
+    run "echo here is another layer >a_file"
+    tag "notflattened"
+    run "chown -R nobody:nogroup a_file"
+    flatten
+    tag "flattened"
+  `)
+
+	c.Assert(err, IsNil)
+	c.Assert(b.exec.Config().Image, Not(Equals), "flattened")
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+
+	c.Assert(len(inspect.RootFS.Layers), Equals, 1)
+
+	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), "notflattened")
+	c.Assert(err, IsNil)
+	c.Assert(len(inspect.RootFS.Layers), Not(Equals), 1)
+	b.Close()
+
+	result := runContainerCommand(c, b, []string{"/bin/sh", "-c", "/usr/bin/stat -c %U a_file"})
+	c.Assert(string(result), Equals, "nobody\n")
+}
+
+func (bs *builderSuite) TestEntrypointCmd(c *C) {
+	b, err := runBuilder(`
+		from "debian"
+		run "echo"
+		set_exec cmd: [ "foo" ]
+	`)
+	c.Assert(err, IsNil)
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{})
+	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"foo"})
+
+	b, err = runBuilder(`
+    from "debian"
+    run "echo hi"
+    entrypoint "/bin/cat"
+  `)
+
+	c.Assert(err, IsNil)
+	original, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "debian")
+	c.Assert(err, IsNil)
+	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/cat"})
+	c.Assert(inspect.Config.Cmd, DeepEquals, original.Config.Cmd)
+	b.Close()
+
+	// the echo hi is to trigger a specific interaction problem with entrypoint
+	// and run where the entrypoint/cmd would not be overridden during commit
+	// time for run.
+	b, err = runBuilder(`
+    from "debian"
+    entrypoint "/bin/cat"
+    run "echo hi"
+  `)
+
+	c.Assert(err, IsNil)
+	original, _, err = dockerClient.ImageInspectWithRaw(context.Background(), "debian")
+	c.Assert(err, IsNil)
+	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/cat"})
+	c.Assert(inspect.Config.Cmd, DeepEquals, original.Config.Cmd)
+	b.Close()
+
+	// if cmd is set earlier than entrypoint, it should not change
+	b, err = runBuilder(`
+    from "debian"
+    cmd "hi"
+    entrypoint "/bin/echo"
+  `)
+
+	c.Assert(err, IsNil)
+	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/echo"})
+	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"hi"})
+	b.Close()
+
+	// likewise for entrypoint.
+	b, err = runBuilder(`
+    from "debian"
+    entrypoint "/bin/echo"
+    cmd "hi"
+  `)
+
+	c.Assert(err, IsNil)
+	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/echo"})
+	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"hi"})
+	b.Close()
+
+	// normal cmd usage.
+	b, err = runBuilder(`
+    from "debian"
+    cmd "hi"
+  `)
+
+	c.Assert(err, IsNil)
+	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{})
+	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"hi"})
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+		entrypoint []
+		cmd []
+  `)
+	c.Assert(err, IsNil)
+
+	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+
+	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"/bin/sh"})
+	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{})
+	b.Close()
+
+	// nil and an empty array clear it alike.
+	for _, clear := range []string{"[]", "nil"} {
+		b, err = runBuilder(fmt.Sprintf(`
+      from "debian"
+      entrypoint "/bin/echo"
+      entrypoint %s
+      cmd ["/bin/bash"]
+    `, clear))
+		c.Assert(err, IsNil)
+
+		inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+		c.Assert(err, IsNil)
+		c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"/bin/bash"}, Commentf("%s", clear))
+		c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{}, Commentf("%s", clear))
+		b.Close()
+	}
+
+	b, err = runBuilder(`
+    from "debian"
+		entrypoint %w[/bin/echo -e]
+		cmd %w[foo bar quux baz]
+  `)
+	c.Assert(err, IsNil)
+	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/echo", "-e"})
+	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"foo", "bar", "quux", "baz"})
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+		entrypoint "/bin/echo"
+		cmd "hi"
+		clear_entrypoint
+  `)
+	c.Assert(err, IsNil)
+	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{})
+	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"hi"})
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+		entrypoint "/bin/echo"
+		cmd "hi"
+		clear_cmd
+  `)
+	c.Assert(err, IsNil)
+	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/echo"})
+	c.Assert(len(inspect.Config.Cmd), Equals, 0)
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+		entrypoint "/bin/echo"
+		cmd nil
+  `)
+	c.Assert(err, IsNil)
+	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(len(inspect.Config.Cmd), Equals, 0)
+	b.Close()
+}
+
+func (bs *builderSuite) TestRunEnv(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    env "CC" => "gcc", "LANG" => "C"
+    run "echo -n $CC $LANG > /cc", env: { "CC" => "clang" }
+    run "echo -n $CC > /later"
+  `)
+	c.Assert(err, IsNil)
+
+	c.Assert(string(readContainerFile(c, b, "/cc")), Equals, "clang C")
+	c.Assert(string(readContainerFile(c, b, "/later")), Equals, "gcc")
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	env := inspect.Config.Env
+	c.Assert(env[len(env)-2:], DeepEquals, []string{"CC=gcc", "LANG=C"})
+	for _, value := range env {
+		c.Assert(value, Not(Equals), "CC=clang")
+	}
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+    run "true", env: "CC=clang"
+  `)
+	c.Assert(err, NotNil)
+	b.Close()
+}
+
+func (bs *builderSuite) TestRunLogin(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    run "mkdir -p /opt/tool/bin && printf '#!/bin/sh\\necho -n tool' > /opt/tool/bin/tool && chmod 755 /opt/tool/bin/tool"
+    run "echo 'PATH=/opt/tool/bin:$PATH' > /etc/profile.d/tool.sh"
+    run "tool > /login", login: true
+    run "tool > /script
+tool >> /script", login: true
+  `)
+	c.Assert(err, IsNil)
+	c.Assert(string(readContainerFile(c, b, "/login")), Equals, "tool")
+	c.Assert(string(readContainerFile(c, b, "/script")), Equals, "tooltool")
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+    run "echo 'PATH=/opt/tool/bin:$PATH' > /etc/profile.d/tool.sh"
+    run "tool"
+  `)
+	c.Assert(err, NotNil)
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+    shell ["/usr/bin/perl", "-e"]
+    run "print 1", login: true
+  `)
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Matches, ".*run login requires a POSIX shell.*")
+	b.Close()
+}
+
+func (bs *builderSuite) TestMoveAndRemove(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    run "mkdir -p /build/bin && echo -n app >/build/bin/app && ln /build/bin/app /build/bin/app2 && chown -R nobody /build"
+    mv "/build/bin", "/opt/app"
+    mv "/opt/app/app2", "/usr/local/bin/"
+    workdir "/opt"
+    rm "app/app", "/build"
+  `)
+	c.Assert(err, IsNil)
+	defer b.Close()
+
+	c.Assert(string(readContainerFile(c, b, "/usr/local/bin/app2")), Equals, "app")
+
+	result := runContainerCommand(c, b, []string{"/bin/sh", "-c", "stat -c %U /opt/app /usr/local/bin/app2; test ! -e /build && test ! -e /opt/app/app && echo removed"})
+	c.Assert(string(result), Equals, "nobody\nnobody\nremoved\n")
+
+	// nothing is run, so images without rm and mv have them too.
+	b, err = runBuilder(`
+    from :scratch
+    write "/app/bin/app", "app"
+    write "/app/config", "config"
+    mv "/app/bin", "/opt/"
+    rm "/app/config"
+    tag "box-scratch-mv-rm"
+
+    from "debian"
+    copy_from "box-scratch-mv-rm", "/", "/scratch"
+  `)
+	c.Assert(err, IsNil)
+
+	c.Assert(string(readContainerFile(c, b, "/scratch/opt/bin/app")), Equals, "app")
+	result = runContainerCommand(c, b, []string{"/bin/sh", "-c", "test -d /scratch/app && test ! -e /scratch/app/bin && test ! -e /scratch/app/config && echo removed"})
+	c.Assert(string(result), Equals, "removed\n")
+	b.Close()
+
+	for _, plan := range []string{
+		`from "debian"
+     rm "/nonexistent"`,
+		`from :scratch
+     rm "/nonexistent"`,
+		`from "debian"
+     mv "/etc", "/etc/sub"`,
+		`from "debian"
+     rm "/"`,
+	} {
+		b, err := runBuilder(plan)
+		c.Assert(err, NotNil, Commentf("%s", plan))
+		b.Close()
+	}
+}
+
+func (bs *builderSuite) TestCopyFrom(c *C) {
+	for _, asTar := range []bool{false, true} {
+		b, err := runBuilder(fmt.Sprintf(`
+      from "debian"
+      run "mkdir -p /out/bin && echo -n app >/out/bin/app && ln /out/bin/app /out/bin/app2 && chmod 0750 /out/bin/app && chown -R nobody /out"
+      tag "box-copy-from-build"
+
+      from "debian"
+      workdir "/srv"
+      copy_from "box-copy-from-build", "/out", "app", as_tar: %v
+      copy_from "box-copy-from-build", "/out/bin/app", "/usr/local/bin/"
+    `, asTar))
+		c.Assert(err, IsNil)
+
+		c.Assert(string(readContainerFile(c, b, "/srv/app/bin/app2")), Equals, "app")
+		c.Assert(string(readContainerFile(c, b, "/usr/local/bin/app")), Equals, "app")
+
+		result := runContainerCommand(c, b, []string{"/bin/sh", "-c", "stat -c '%a %U %h' /srv/app/bin/app /srv/app/bin/app2; test ! -e /out && echo only"})
+		c.Assert(string(result), Equals, "750 nobody 2\n750 nobody 2\nonly\n")
+		b.Close()
+	}
+
+	for _, plan := range []string{
+		`from "debian"
+     copy_from "debian", "etc", "/tmp/"`,
+		`from "debian"
+     copy_from "debian", "/nonexistent", "/tmp/"`,
+		`from "debian"
+     copy_from "debian", "/etc", "/tmp/", stream: true`,
+	} {
+		b, err := runBuilder(plan)
+		c.Assert(err, NotNil, Commentf("%s", plan))
+		b.Close()
+	}
+}
+
+func (bs *builderSuite) TestWrite(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    workdir "/tmp"
+    write "/etc/app/config", "hello\n"
+    write "script", "#!/bin/sh\necho hi", mode: 0755, owner: "nobody:nogroup"
+  `)
+	c.Assert(err, IsNil)
+
+	c.Assert(string(readContainerFile(c, b, "/etc/app/config")), Equals, "hello\n")
+	c.Assert(string(runContainerCommand(c, b, []string{"/bin/sh", "-c", "stat -c '%a %U:%G' /etc/app/config /tmp/script"})), Equals, "644 root:root\n755 nobody:nogroup\n")
+	c.Assert(string(runContainerCommand(c, b, []string{"/tmp/script"})), Equals, "hi\n")
+	b.Close()
+
+	b, err = runBuilder(`
+    from :scratch
+    write "/hello", "scratch", mode: "0600", owner: "1000:1000"
+  `)
+	c.Assert(err, IsNil)
+	b.Close()
+
+	b, err = runBuilder(`
+    from :scratch
+    write "/hello", "scratch", owner: "nobody"
+  `)
+	c.Assert(err, NotNil)
+	b.Close()
+}
+
+func (bs *builderSuite) TestParallel(c *C) {
+	b, err := runExperimental(`
+    from "debian"
+    run "mkdir /srv/app && echo old > /srv/app/old"
+    parallel do
+      run "echo one > /srv/app/one"
+      run "echo two > /srv/app/two && mkdir -p /opt/two/bin"
+      run "rm /srv/app/old && rm -r /etc/apt"
+    end
+  `)
+	c.Assert(err, IsNil)
+
+	c.Assert(string(readContainerFile(c, b, "/srv/app/one")), Equals, "one\n")
+	c.Assert(string(readContainerFile(c, b, "/srv/app/two")), Equals, "two\n")
+	c.Assert(string(runContainerCommand(c, b, []string{"/bin/sh", "-c", "test -d /opt/two/bin && test ! -e /srv/app/old && test ! -e /etc/apt && echo ok"})), Equals, "ok\n")
+	b.Close()
+
+	// both write the same file, so they are run in order instead
+	b, err = runExperimental(`
+    from "debian"
+    parallel do
+      run "echo one > /same"
+      run "echo two > /same"
+    end
+  `)
+	c.Assert(err, IsNil)
+	c.Assert(string(readContainerFile(c, b, "/same")), Equals, "two\n")
+	b.Close()
+
+	for _, plan := range []string{
+		`parallel do run "false" end`,
+		`parallel do copy ".", "/tmp" end`,
+		`parallel do run "true", allow_exit: 1 end`,
+	} {
+		b, err = runExperimental("from \"debian\"\n" + plan)
+		c.Assert(err, NotNil)
+		b.Close()
+	}
+
+	// parallel is refused without --experimental.
+	b, err = runBuilder(`
+    from "debian"
+    parallel do
+      run "true"
     end
   `)
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "parallel is experimental"), Equals, true, Commentf("%v", err))
+	b.Close()
+}
+
+func (bs *builderSuite) TestPlanErrorLocation(c *C) {
+	for _, test := range []struct {
+		plan   string
+		line   int
+		column bool
+	}{
+		{"from \"debian\"\n\nrun \"false\"\n", 3, false},
+		{"from \"debian\"\nrun \"true\" )\nrun \"ls\"\n", 2, true},
+		{"from \"debian\"\nexpose \"80\"\n  rnu \"ls\"\n", 3, false},
+	} {
+		b, err := NewBuilder(BuildConfig{
+			FileName: "plan.rb",
+			Globals: &btypes.Global{
+				Cache:   os.Getenv("NO_CACHE") == "",
+				Context: context.Background(),
+			},
+			Runner: make(chan struct{}),
+		})
+		c.Assert(err, IsNil)
+
+		err = b.eval.RunScript(test.plan)
+		c.Assert(err, NotNil, Commentf("%q", test.plan))
+
+		planErr, ok := err.(*btypes.PlanError)
+		c.Assert(ok, Equals, true, Commentf("%q: %#v", test.plan, err))
+		c.Assert(planErr.File, Equals, "plan.rb")
+		c.Assert(planErr.Source, Equals, test.plan)
+		c.Assert(planErr.Line, Equals, test.line, Commentf("%q", test.plan))
+		c.Assert(planErr.Column != 0, Equals, test.column, Commentf("%q", test.plan))
+		c.Assert(b.Result().Err, Equals, err)
+		b.Close()
+	}
+}
+
+func (bs *builderSuite) TestKeepContainers(c *C) {
+	b, err := NewBuilder(BuildConfig{
+		Globals: &btypes.Global{
+			KeepContainers: true,
+			Logger:         logger.New("", false, 0),
+			Context:        context.Background(),
+		},
+		Runner: make(chan struct{}),
+	})
+	c.Assert(err, IsNil)
+
+	b.config.Globals.Logger.Record()
+
+	err = b.eval.RunScript(`
+    from "debian"
+    run "echo kept > /kept"
+    run "touch /failed && false"
+  `)
+	c.Assert(err, NotNil)
+
+	kept := b.exec.KeptContainers()
+	c.Assert(kept, HasLen, 2)
+
+	for _, id := range kept {
+		_, err := dockerClient.ContainerInspect(context.Background(), id)
+		c.Assert(err, IsNil)
+		defer dockerClient.ContainerRemove(context.Background(), id, types.ContainerRemoveOptions{Force: true})
+	}
+
+	// the failed step's container has its changes.
+	changes, err := dockerClient.ContainerDiff(context.Background(), kept[1])
+	c.Assert(err, IsNil)
+
+	paths := []string{}
+	for _, change := range changes {
+		paths = append(paths, change.Path)
+	}
+	c.Assert(paths, DeepEquals, []string{"/failed"})
+
+	c.Assert(b.Close(), IsNil)
+	c.Assert(b.config.Globals.Logger.Output().(*bytes.Buffer).String(), Matches, "(?s).*Kept container: "+kept[1][:12]+".*")
+}
 
+func (bs *builderSuite) TestRunPriority(c *C) {
+	b, err := NewBuilder(BuildConfig{
+		Globals: &btypes.Global{
+			KeepContainers: true,
+			LowPriority:    true,
+			Context:        context.Background(),
+		},
+		Runner: make(chan struct{}),
+	})
 	c.Assert(err, IsNil)
 
-	result = readContainerFile(c, b, "/test/test/builder.go")
-	c.Assert(content, DeepEquals, result)
+	c.Assert(b.eval.RunScript(`
+    from "debian"
+    run "touch /a", nice: 10
+    run "touch /b"
+  `), IsNil)
 
-	b.Close()
+	kept := b.exec.KeptContainers()
+	c.Assert(kept, HasLen, 2)
 
-	b, err = runBuilder(`
+	// the run's own niceness wins over --build-priority low.
+	for i, shares := range []int64{514, 55} {
+		inspect, err := dockerClient.ContainerInspect(context.Background(), kept[i])
+		c.Assert(err, IsNil)
+		defer dockerClient.ContainerRemove(context.Background(), kept[i], types.ContainerRemoveOptions{Force: true})
+		c.Assert(inspect.HostConfig.CPUShares, Equals, shares)
+	}
+
+	c.Assert(b.Close(), IsNil)
+
+	for _, plan := range []string{
+		`run "true", nice: 20`,
+		`run "true", ionice: -1`,
+		`run "true", nice: "low"`,
+	} {
+		b, err := runBuilder("from \"debian\"\n" + plan)
+		c.Assert(err, NotNil, Commentf("%s", plan))
+		b.Close()
+	}
+
+	// the priority is not part of the cache key.
+	build := func(nice int) string {
+		b, err := NewBuilder(BuildConfig{
+			Globals: &btypes.Global{Cache: true, Context: context.Background()},
+			Runner:  make(chan struct{}),
+		})
+		c.Assert(err, IsNil)
+		defer b.Close()
+
+		c.Assert(b.eval.RunScript(fmt.Sprintf(`
+      from "debian"
+      run "date +%%s%%N > /priority", nice: %d
+    `, nice)), IsNil)
+		return b.exec.Config().Image
+	}
+
+	c.Assert(build(5), Equals, build(10))
+}
+
+func (bs *builderSuite) TestRunScript(c *C) {
+	b, err := runBuilder(`
     from "debian"
-    inside "/test" do
-      copy "..", "test/"
-    end
+    shell "/bin/bash", "-c"
+    env "GREETING" => "hello"
+    run "mkdir /test && chown nobody:nogroup /test"
+    user "nobody"
+    run <<-EOF
+      set -e
+      if [[ -n "$GREETING" ]]; then
+        echo -n "$GREETING $(whoami)" > /test/bar
+      fi
+    EOF
   `)
+	c.Assert(err, IsNil)
 
-	c.Assert(err, NotNil)
+	result := readContainerFile(c, b, "/test/bar")
+	c.Assert(string(result), Equals, "hello nobody")
+
+	result = runContainerCommand(c, b, []string{"/bin/sh", "-c", "ls -A /tmp"})
+	c.Assert(string(result), Equals, "")
 	b.Close()
 
 	b, err = runBuilder(`
     from "debian"
-    inside "/test" do
-      copy "testdata/..", "test/"
-    end
+    run "#!/usr/bin/perl\nopen(F, '>/bar'); print F 'perl'; close F;\n"
   `)
+	c.Assert(err, IsNil)
 
+	result = readContainerFile(c, b, "/bar")
+	c.Assert(string(result), Equals, "perl")
+	b.Close()
+
+	for _, plan := range []string{
+		`
+    run <<-EOF
+      set -e
+      false
+      true
+    EOF
+    `,
+		// the flags of the shell and of the interpreter apply.
+		`
+    shell "/bin/bash", "-o", "pipefail", "-c"
+    run "false | true\ntrue"
+    `,
+		`run "#!/bin/sh -e\nfalse\ntrue"`,
+		// the script with an interpreter is its standard input.
+		`run "#!/bin/sh\ncat", stdin: "input"`,
+		`parallel { run "#!/bin/sh\ntrue" }`,
+	} {
+		_, err = runBuilder("from \"debian\"\n" + plan)
+		c.Assert(err, NotNil, Commentf("%s", plan))
+	}
+}
+
+func (bs *builderSuite) TestRunCacheMount(c *C) {
+	defer dockerClient.VolumeRemove(context.Background(), docker.CacheVolume("/cache"), true)
+
+	b, err := runBuilder(`
+    from "debian"
+    run "echo -n cached > /cache/file", cache_mount: "/cache"
+    run "test ! -f /cache/file"
+  `)
 	c.Assert(err, IsNil)
 	b.Close()
 
 	b, err = runBuilder(`
     from "debian"
-    inside "/test" do
-      copy "testdata/../..", "test/"
-    end
+    run "cp /cache/file /result", cache_mount: ["/cache"]
   `)
+	c.Assert(err, IsNil)
 
-	c.Assert(err, NotNil)
+	result := readContainerFile(c, b, "/result")
+	c.Assert(string(result), Equals, "cached")
 	b.Close()
 
-	b, err = runBuilder(`
+	_, err = runBuilder(`
     from "debian"
-    inside "/test" do
-      copy "testdata/../../builder/..", "test/"
-    end
+    run "true", cache_mount: "relative"
   `)
-
 	c.Assert(err, NotNil)
-	b.Close()
+
+	// the cache mounts are not part of the cache key.
+	defer dockerClient.VolumeRemove(context.Background(), docker.CacheVolume("/other"), true)
+
+	build := func(mount string) string {
+		b, err := NewBuilder(BuildConfig{
+			Globals: &btypes.Global{Cache: true, Context: context.Background()},
+			Runner:  make(chan struct{}),
+		})
+		c.Assert(err, IsNil)
+		defer b.Close()
+
+		c.Assert(b.eval.RunScript(fmt.Sprintf(`
+      from "debian"
+      run "date +%%s%%N > /mounted", cache_mount: %q
+    `, mount)), IsNil)
+		return b.exec.Config().Image
+	}
+
+	c.Assert(build("/cache"), Equals, build("/other"))
 }
 
-func (bs *builderSuite) TestTag(c *C) {
-	b, err := runBuilder(`
-    from "debian"
-    tag "test"
-  `)
+func (bs *builderSuite) TestCacheTTL(c *C) {
+	build := func(ttl string) string {
+		b, err := NewBuilder(BuildConfig{
+			Globals: &btypes.Global{Cache: true, Context: context.Background()},
+			Runner:  make(chan struct{}),
+		})
+		c.Assert(err, IsNil)
+		defer b.Close()
 
-	c.Assert(err, IsNil)
-	c.Assert(b.exec.Config().Image, Not(Equals), "test")
+		c.Assert(b.eval.RunScript(fmt.Sprintf(`
+      from "debian"
+      run "date +%%s%%N > /ttl", cache_ttl: %q
+    `, ttl)), IsNil)
+		return b.exec.Config().Image
+	}
 
-	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "test")
-	c.Assert(err, IsNil)
+	// the ttl is not part of the cache key, only the cache check uses it.
+	cached := build("1h")
+	c.Assert(build("2h"), Equals, cached)
 
-	c.Assert(inspect.RepoTags, DeepEquals, []string{"test:latest"})
-	b.Close()
+	time.Sleep(time.Second)
+	c.Assert(build("1ms"), Not(Equals), cached)
 }
 
-func (bs *builderSuite) TestSave(c *C) {
+func (bs *builderSuite) TestRunTmpfs(c *C) {
 	b, err := runBuilder(`
     from "debian"
-		save tag: "test"
+    run "mount | grep -q 'on /scratch type tmpfs' && echo -n scratch >/scratch/file", tmpfs: ["/scratch:size=16m,mode=1777"]
+    run "test ! -e /scratch/file"
   `)
-
 	c.Assert(err, IsNil)
-	c.Assert(b.exec.Config().Image, Not(Equals), "test")
+	id := b.exec.Config().Image
+	b.Close()
 
-	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "test")
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), id)
 	c.Assert(err, IsNil)
+	c.Assert(inspect.Comment, Equals, base64.StdEncoding.EncodeToString([]byte("run, test ! -e /scratch/file")))
 
-	var found bool
-
-	for _, tag := range inspect.RepoTags {
-		if tag == "test:latest" {
-			found = true
-		}
+	for _, spec := range []string{"scratch", "/scratch:size=lots", "/scratch:exec=1", "/scratch:user=1"} {
+		b, err = runBuilder(fmt.Sprintf(`
+      from "debian"
+      run "true", tmpfs: %q
+    `, spec))
+		c.Assert(err, NotNil, Commentf("%s", spec))
+		b.Close()
 	}
+}
 
-	c.Assert(found, Equals, true)
+func (bs *builderSuite) TestRunReadOnly(c *C) {
+	volumes, err := dockerClient.VolumeList(context.Background(), filters.NewArgs())
+	c.Assert(err, IsNil)
+
+	b, err := runBuilder(`
+    from "debian"
+    run "test -f /etc/hostname.box || touch /etc/hostname.box"
+    run "echo -n written >/tmp/file && test -f /etc/hostname.box && touch /etc/hostname.box 2>/dev/null; test $? -ne 0", readonly_rootfs: true, writable: "/tmp"
+    run "test ! -e /tmp/file"
+  `)
+	c.Assert(err, IsNil)
 	b.Close()
 
+	// the writable paths hold the image's files.
 	b, err = runBuilder(`
     from "debian"
-		run "apt-get update -qq"
-		save file: "test.tar"
+    run "test -f /etc/passwd && echo -n x >>/etc/passwd", readonly_rootfs: true, writable: ["/etc", "/tmp"]
   `)
 	c.Assert(err, IsNil)
 	b.Close()
 
-	defer os.Remove("test.tar")
-	f, err := os.Open("test.tar")
+	// the volumes of the writable paths go with the containers.
+	after, err := dockerClient.VolumeList(context.Background(), filters.NewArgs())
 	c.Assert(err, IsNil)
+	c.Assert(len(after.Volumes), Equals, len(volumes.Volumes))
 
-	r, err := dockerClient.ImageLoad(context.Background(), f, true)
-	c.Assert(err, IsNil)
-	io.Copy(ioutil.Discard, r.Body)
+	for _, plan := range []string{
+		`from "debian"
+     run "touch /file", readonly_rootfs: true`,
+		`from "debian"
+     run "true", writable: "/tmp"`,
+		`from "debian"
+     run "true", readonly_rootfs: true, writable: "tmp"`,
+	} {
+		b, err := runBuilder(plan)
+		c.Assert(err, NotNil, Commentf("%s", plan))
+		b.Close()
+	}
+}
 
-	b, err = runBuilder(`
+func (bs *builderSuite) TestRunStdin(c *C) {
+	b, err := runBuilder(`
     from "debian"
-		save file: "../test.tar"
+    run "cat >/stdin", stdin: "line one\nline two\n"
   `)
-	c.Assert(err, NotNil)
+	c.Assert(err, IsNil)
+	c.Assert(string(readContainerFile(c, b, "/stdin")), Equals, "line one\nline two\n")
+	id := b.exec.Config().Image
 	b.Close()
 
+	sum := sha256.Sum256([]byte("line one\nline two\n"))
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), id)
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Comment, Equals, base64.StdEncoding.EncodeToString([]byte("run, cat >/stdin, stdin sha256:"+hex.EncodeToString(sum[:]))))
+
+	// commands need not read their input.
 	b, err = runBuilder(`
     from "debian"
-		save file: "/test.tar"
+    run "true", stdin: "unread"
   `)
-	c.Assert(err, NotNil)
+	c.Assert(err, IsNil)
 	b.Close()
 
 	b, err = runBuilder(`
     from "debian"
-		run "apt-get update -qq"
-		save file: "oci.tar", kind: "oci"
+    run "cat", stdin: ["not", "a", "string"]
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, NotNil)
 	b.Close()
+}
 
-	defer os.Remove("oci.tar")
-	f, err = os.Open("oci.tar")
-	c.Assert(err, IsNil)
+func (bs *builderSuite) TestRunNoChanges(c *C) {
+	build := func(plan string) (string, string) {
+		log := logger.New("", false, 0)
+		log.Record()
 
-	tr := tar.NewReader(f)
-	found = false
-	for {
-		header, err := tr.Next()
+		b, err := NewBuilder(BuildConfig{
+			Globals: &btypes.Global{Cache: true, Context: context.Background(), Logger: log},
+			Runner:  make(chan struct{}),
+		})
 		c.Assert(err, IsNil)
+		defer b.Close()
 
-		if path.Base(header.Name) == "oci" {
-			found = true
-			break
-		}
+		c.Assert(b.eval.RunScript(plan), IsNil)
+		return b.exec.Config().Image, log.Output().(*bytes.Buffer).String()
 	}
 
-	c.Assert(found, Equals, true)
-}
+	debian, _ := build(`from "debian"`)
 
-func (bs *builderSuite) TestFlatten(c *C) {
-	b, err := runBuilder(`
+	// unique, so it is not cached by an earlier test run.
+	check := fmt.Sprintf("test -d /etc # %d", time.Now().UnixNano())
+
+	for i := 0; i < 2; i++ {
+		id, output := build(fmt.Sprintf(`
+      from "debian"
+      run %q
+    `, check))
+		c.Assert(id, Equals, debian)
+
+		// the step is cached the second time, and only run the first.
+		c.Assert(strings.Contains(output, "No changes"), Equals, i == 0, Commentf("%s", output))
+		c.Assert(strings.Contains(output, "Cache hit"), Equals, i == 1, Commentf("%s", output))
+	}
+
+	id, _ := build(`
     from "debian"
-    run "echo foo >bar"
-    run "echo here is another layer >a_file"
-    tag "notflattened"
-    run "chown -R nobody:nogroup a_file"
-    flatten
-    tag "flattened"
+    run "test -d /etc", commit: true
   `)
+	c.Assert(id, Not(Equals), debian)
 
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), id)
 	c.Assert(err, IsNil)
-	c.Assert(b.exec.Config().Image, Not(Equals), "flattened")
+	c.Assert(inspect.Parent, Equals, debian)
 
-	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	id, _ = build(`
+    from "debian"
+    run "touch /changed"
+  `)
+	c.Assert(id, Not(Equals), debian)
+}
+
+func (bs *builderSuite) TestCheckpoint(c *C) {
+	dir, err := ioutil.TempDir("", "box-checkpoint")
 	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
 
-	c.Assert(len(inspect.RootFS.Layers), Equals, 1)
+	checkpoint := filepath.Join(dir, ".box-checkpoint")
 
-	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), "notflattened")
-	c.Assert(err, IsNil)
-	c.Assert(len(inspect.RootFS.Layers), Not(Equals), 1)
-	b.Close()
+	// the cache is off, so the steps are only found in the checkpoint.
+	build := func(plan string) (*Builder, btypes.BuildResult, string) {
+		fn := filepath.Join(dir, "box.rb")
+		c.Assert(ioutil.WriteFile(fn, []byte(plan), 0644), IsNil)
 
-	result := runContainerCommand(c, b, []string{"/bin/sh", "-c", "/usr/bin/stat -c %U a_file"})
-	c.Assert(string(result), Equals, "nobody\n")
-}
+		log := logger.New("", false, 0)
+		log.Record()
 
-func (bs *builderSuite) TestEntrypointCmd(c *C) {
-	b, err := runBuilder(`
-		from "debian"
-		run "echo"
-		set_exec cmd: [ "foo" ]
-	`)
-	c.Assert(err, IsNil)
-	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{})
-	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"foo"})
+		b, err := NewBuilder(BuildConfig{
+			Globals:  &btypes.Global{Checkpoint: checkpoint, Context: context.Background(), Logger: log},
+			Runner:   make(chan struct{}),
+			FileName: fn,
+		})
+		c.Assert(err, IsNil)
 
-	b, err = runBuilder(`
+		result := b.Run()
+		return b, result, log.Output().(*bytes.Buffer).String()
+	}
+
+	b, result, _ := build(`
     from "debian"
-    run "echo hi"
-    entrypoint "/bin/cat"
+    run "date +%s%N >/built"
+    run "test -f /never"
   `)
+	c.Assert(result.Err, NotNil)
+	built := readContainerFile(c, b, "/built")
+	b.Close()
 
+	_, err = os.Stat(checkpoint)
 	c.Assert(err, IsNil)
-	original, _, err := dockerClient.ImageInspectWithRaw(context.Background(), "debian")
-	c.Assert(err, IsNil)
-	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/cat"})
-	c.Assert(inspect.Config.Cmd, DeepEquals, original.Config.Cmd)
-	b.Close()
 
-	// the echo hi is to trigger a specific interaction problem with entrypoint
-	// and run where the entrypoint/cmd would not be overridden during commit
-	// time for run.
-	b, err = runBuilder(`
+	b, result, output := build(`
     from "debian"
-    entrypoint "/bin/cat"
-    run "echo hi"
+    run "date +%s%N >/built"
+    run "test -f /built"
   `)
-
-	c.Assert(err, IsNil)
-	original, _, err = dockerClient.ImageInspectWithRaw(context.Background(), "debian")
-	c.Assert(err, IsNil)
-	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/cat"})
-	c.Assert(inspect.Config.Cmd, DeepEquals, original.Config.Cmd)
+	c.Assert(result.Err, IsNil, Commentf("%s", output))
+	c.Assert(strings.Contains(output, "Checkpoint: resuming"), Equals, true, Commentf("%s", output))
+	c.Assert(readContainerFile(c, b, "/built"), DeepEquals, built)
 	b.Close()
 
-	// if cmd is set earlier than entrypoint, it should not change
-	b, err = runBuilder(`
+	// there is nothing to resume after a successful build.
+	_, err = os.Stat(checkpoint)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// a changed step discards the rest of the checkpoint.
+	b, result, _ = build(`
     from "debian"
-    cmd "hi"
-    entrypoint "/bin/echo"
+    run "date +%s%N >/built"
+    run "test -f /never"
   `)
-
-	c.Assert(err, IsNil)
-	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/echo"})
-	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"hi"})
+	c.Assert(result.Err, NotNil)
 	b.Close()
 
-	// likewise for entrypoint.
-	b, err = runBuilder(`
+	b, result, output = build(`
     from "debian"
-    entrypoint "/bin/echo"
-    cmd "hi"
+    run "date +%s%N >/built # changed"
+    run "date +%s%N >/built"
+    run "true"
   `)
+	c.Assert(result.Err, IsNil, Commentf("%s", output))
+	c.Assert(strings.Contains(output, "Checkpoint: resuming"), Equals, false, Commentf("%s", output))
+	b.Close()
+}
 
+func (bs *builderSuite) TestRunScriptFile(c *C) {
+	// scripts must be in the build directory.
+	dir, err := ioutil.TempDir(".", "box-run-script")
 	c.Assert(err, IsNil)
-	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/echo"})
-	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"hi"})
-	b.Close()
+	defer os.RemoveAll(dir)
 
-	// normal cmd usage.
-	b, err = runBuilder(`
+	fn := filepath.Join(dir, "setup.sh")
+	plan := fmt.Sprintf(`
     from "debian"
-    cmd "hi"
-  `)
+    env "GREETING" => "hello"
+    run script: %q
+  `, fn)
+
+	build := func(script string) (string, *Builder) {
+		c.Assert(ioutil.WriteFile(fn, []byte(script), 0644), IsNil)
+
+		b, err := NewBuilder(BuildConfig{
+			Globals: &btypes.Global{Cache: true, Context: context.Background()},
+			Runner:  make(chan struct{}),
+		})
+		c.Assert(err, IsNil)
+
+		c.Assert(b.eval.RunScript(plan), IsNil)
+		return b.exec.Config().Image, b
+	}
 
+	// without a shebang it runs with the shell, and with one, its interpreter;
+	// nothing but what the script writes is left in the image.
+	id, b := build("echo -n \"$GREETING $0\" > /greeting")
+	c.Assert(string(readContainerFile(c, b, "/greeting")), Equals, "hello /bin/sh")
+	c.Assert(string(runContainerCommand(c, b, []string{"/bin/sh", "-c", "ls -A /tmp"})), Equals, "")
+	b.Close()
+
+	cachedID, b := build("echo -n \"$GREETING $0\" > /greeting")
+	c.Assert(cachedID, Equals, id)
+	b.Close()
+
+	newID, b := build("#!/usr/bin/perl\nopen(F, '>/greeting'); print F \"$ENV{GREETING} perl\"; close F;\n")
+	c.Assert(newID, Not(Equals), id)
+	c.Assert(string(readContainerFile(c, b, "/greeting")), Equals, "hello perl")
+	b.Close()
+
+	for _, plan := range []string{
+		fmt.Sprintf(`run "ls", script: %q`, fn),
+		`run script: "missing.sh"`,
+		`run script: "../main.go"`,
+		`run script: "/etc/passwd"`,
+		`run output: false`,
+		fmt.Sprintf(`run_group do run script: %q end`, fn),
+	} {
+		_, err := runBuilder("from \"debian\"\n" + plan)
+		c.Assert(err, NotNil, Commentf("%s", plan))
+	}
+}
+
+func (bs *builderSuite) TestRunSinceFile(c *C) {
+	dir, err := ioutil.TempDir("", "box-since-file")
 	c.Assert(err, IsNil)
-	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "VERSION")
+	plan := fmt.Sprintf(`
+    from "debian"
+    run "date +%%s%%N >/built", since_file: %q
+  `, fn)
+
+	build := func(version string) (string, string) {
+		c.Assert(ioutil.WriteFile(fn, []byte(version), 0644), IsNil)
+
+		b, err := NewBuilder(BuildConfig{
+			Globals: &btypes.Global{Cache: true, Context: context.Background()},
+			Runner:  make(chan struct{}),
+		})
+		c.Assert(err, IsNil)
+		defer b.Close()
+
+		c.Assert(b.eval.RunScript(plan), IsNil)
+		return b.exec.Config().Image, string(readContainerFile(c, b, "/built"))
+	}
+
+	id, built := build("1.0")
+	sum := sha256.Sum256([]byte("1.0"))
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), id)
 	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{})
-	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"hi"})
-	b.Close()
+	c.Assert(inspect.Comment, Equals, base64.StdEncoding.EncodeToString([]byte("run, date +%s%N >/built, since_file "+fn+" sha256:"+hex.EncodeToString(sum[:]))))
 
-	b, err = runBuilder(`
+	cachedID, cachedBuilt := build("1.0")
+	c.Assert(cachedID, Equals, id)
+	c.Assert(cachedBuilt, Equals, built)
+
+	newID, newBuilt := build("1.1")
+	c.Assert(newID, Not(Equals), id)
+	c.Assert(newBuilt, Not(Equals), built)
+
+	_, err = runBuilder(`
     from "debian"
-		entrypoint []
-		cmd []
+    run "true", since_file: "/nonexistent/VERSION"
+  `)
+	c.Assert(err, NotNil)
+}
+
+func (bs *builderSuite) TestRunCapabilities(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    run "chown nobody /tmp", cap_drop: "CHOWN"
   `)
-	c.Assert(err, IsNil)
+	c.Assert(err, NotNil)
+	b.Close()
 
-	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
+	plan := `
+    from "debian"
+    run "mount -t tmpfs tmpfs /mnt && umount /mnt", cap_add: ["SYS_ADMIN"], cap_drop: ["CHOWN"]
+  `
 
-	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"/bin/sh"})
-	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{})
+	b, err = runBuilder(plan)
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "--allow-privileged"), Equals, true)
 	b.Close()
 
-	b, err = runBuilder(`
-    from "debian"
-		entrypoint []
-		cmd ["/bin/bash"]
-  `)
+	b, err = NewBuilder(BuildConfig{
+		Globals: &btypes.Global{Cache: os.Getenv("NO_CACHE") == "", AllowPrivileged: true, Context: context.Background()},
+		Runner:  make(chan struct{}),
+	})
 	c.Assert(err, IsNil)
+	c.Assert(b.eval.RunScript(plan), IsNil)
+	id := b.exec.Config().Image
+	b.Close()
 
-	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), id)
 	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"/bin/bash"})
-	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{})
-	b.Close()
+	c.Assert(inspect.Comment, Equals, base64.StdEncoding.EncodeToString([]byte("run, mount -t tmpfs tmpfs /mnt && umount /mnt")))
 
 	b, err = runBuilder(`
     from "debian"
-		entrypoint %w[/bin/echo -e]
-		cmd %w[foo bar quux baz]
+    run "mount -t tmpfs tmpfs /mnt", privileged: true
   `)
-	c.Assert(err, IsNil)
-	inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
-	c.Assert(err, IsNil)
-	c.Assert(inspect.Config.Entrypoint, DeepEquals, strslice.StrSlice{"/bin/echo", "-e"})
-	c.Assert(inspect.Config.Cmd, DeepEquals, strslice.StrSlice{"foo", "bar", "quux", "baz"})
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "--allow-privileged"), Equals, true)
 	b.Close()
 }
 
@@ -715,6 +2785,27 @@ func (bs *builderSuite) TestRun(c *C) {
 	b.Close()
 }
 
+func (bs *builderSuite) TestShell(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    shell %w[/bin/bash -c]
+    run "[[ -d /etc ]]"
+  `)
+	c.Assert(err, IsNil)
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert([]string(inspect.Config.Shell), DeepEquals, []string{"/bin/bash", "-c"})
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+    run "[[ -d /etc ]]"
+  `)
+	c.Assert(err, NotNil)
+	b.Close()
+}
+
 func (bs *builderSuite) TestWorkDirInside(c *C) {
 	b, err := runBuilder(`
     from "debian"
@@ -916,6 +3007,77 @@ func (bs *builderSuite) TestBuildCache(c *C) {
 	b.Close()
 }
 
+func (bs *builderSuite) TestNoCache(c *C) {
+	// enable cache; will reset on next test run
+	os.Setenv("NO_CACHE", "")
+
+	plan := `
+    from "debian"
+    run "echo first"
+    %s
+    run "echo second"
+  `
+
+	b, err := runBuilder(fmt.Sprintf(plan, ""))
+	c.Assert(err, IsNil)
+	cached := b.exec.Config().Image
+	b.Close()
+
+	b, err = runBuilder(fmt.Sprintf(plan, ""))
+	c.Assert(err, IsNil)
+	c.Assert(b.exec.Config().Image, Equals, cached)
+	b.Close()
+
+	b, err = runBuilder(fmt.Sprintf(plan, "no_cache!"))
+	c.Assert(err, IsNil)
+	c.Assert(b.exec.Config().Image, Not(Equals), cached)
+
+	// the first run is still taken from the cache
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	cachedInspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), cached)
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Parent, Equals, cachedInspect.Parent)
+	b.Close()
+}
+
+func (bs *builderSuite) TestSteps(c *C) {
+	// enable cache; will reset on next test run
+	os.Setenv("NO_CACHE", "")
+
+	plan := `
+    from "debian"
+    run "echo -n one > /one"
+    run "echo -n %s > /two"
+    run "echo -n three > /three"
+  `
+
+	buildSteps := func(plan string, steps btypes.StepRange) (*Builder, error) {
+		b, err := NewBuilder(BuildConfig{
+			Globals: &btypes.Global{Cache: true, Context: context.Background(), Steps: steps},
+			Runner:  make(chan struct{}),
+		})
+		c.Assert(err, IsNil)
+		return b, b.eval.RunScript(plan)
+	}
+
+	b, err := runBuilder(fmt.Sprintf(plan, "two"))
+	c.Assert(err, IsNil)
+	b.Close()
+
+	b, err = buildSteps(fmt.Sprintf(plan, "changed"), btypes.StepRange{First: 3, Last: 3})
+	c.Assert(err, IsNil)
+	c.Assert(string(readContainerFile(c, b, "/two")), Equals, "changed")
+	result := runContainerCommand(c, b, []string{"/bin/sh", "-c", "test -e /three || echo -n skipped"})
+	c.Assert(string(result), Equals, "skipped")
+	b.Close()
+
+	// the steps before the range must be cached.
+	b, err = buildSteps(fmt.Sprintf(plan, "uncached")+`run "echo -n four > /four"`, btypes.StepRange{First: 5})
+	c.Assert(err, ErrorMatches, ".*step 3 is not cached.*")
+	b.Close()
+}
+
 func (bs *builderSuite) TestSetExec(c *C) {
 	b, err := runBuilder(`
     from "debian"
@@ -1072,6 +3234,181 @@ func (bs *builderSuite) TestEnv(c *C) {
 	b.Close()
 }
 
+func (bs *builderSuite) TestBuildEnv(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    env "STAGE" => "image"
+    build_env "STAGE" => "build", "PROXY" => "http://proxy"
+    run "echo -n $STAGE $PROXY > /build-env"
+  `)
+	c.Assert(err, IsNil)
+	defer b.Close()
+
+	c.Assert(string(readContainerFile(c, b, "/build-env")), Equals, "build http://proxy")
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+
+	for _, item := range inspect.Config.Env {
+		c.Assert(strings.HasPrefix(item, "PROXY="), Equals, false)
+		c.Assert(item, Not(Equals), "STAGE=build")
+	}
+
+	found := false
+	for _, item := range inspect.Config.Env {
+		found = found || item == "STAGE=image"
+	}
+	c.Assert(found, Equals, true)
+
+	// the variables are in the cache keys of the steps after build_env.
+	b2, err := runBuilder(`
+    from "debian"
+    env "STAGE" => "image"
+    build_env "STAGE" => "build", "PROXY" => "http://other"
+    run "echo -n $STAGE $PROXY > /build-env"
+  `)
+	c.Assert(err, IsNil)
+	defer b2.Close()
+
+	c.Assert(string(readContainerFile(c, b2, "/build-env")), Equals, "build http://other")
+
+	_, err = runBuilder(`
+    from "debian"
+    build_env "STAGE"
+  `)
+	c.Assert(err, NotNil)
+
+	// a later from starts a stage without them, or their cache salt.
+	b3, err := runBuilder(`
+    from "debian"
+    build_env "PROXY" => "http://proxy"
+    run "true"
+    from "debian"
+    run "echo -n stage:$PROXY > /build-env"
+  `)
+	c.Assert(err, IsNil)
+	defer b3.Close()
+
+	c.Assert(string(readContainerFile(c, b3, "/build-env")), Equals, "stage:")
+	c.Assert(b3.interp.CacheSalt, Equals, "")
+
+	// the salt of local_run is kept for the following stages.
+	b4, err := NewBuilder(BuildConfig{
+		Globals: &btypes.Global{
+			AllowLocalExec: true,
+			Logger:         logger.New("", false, 0),
+			Context:        context.Background(),
+		},
+		Runner: make(chan struct{}),
+	})
+	c.Assert(err, IsNil)
+	defer b4.Close()
+
+	c.Assert(b4.eval.RunScript(`
+    from "debian"
+    local_run "echo -n revision"
+    build_env "PROXY" => "http://proxy"
+  `), IsNil)
+	c.Assert(b4.interp.CacheSalt, Not(Equals), "")
+	staged := b4.interp.CacheSalt
+
+	c.Assert(b4.eval.RunScript(`from "debian"`), IsNil)
+	c.Assert(b4.interp.CacheSalt, Not(Equals), "")
+	c.Assert(b4.interp.CacheSalt, Not(Equals), staged)
+}
+
+func (bs *builderSuite) TestUnenv(c *C) {
+	for _, plan := range []string{
+		`
+      from "debian"
+      env GOPATH: "/go", GOROOT: "/usr/local/go"
+      unenv "GOPATH", "NOTSET"
+    `,
+		`
+      from "debian"
+      env GOPATH: "/go", GOROOT: "/usr/local/go"
+      env GOPATH: nil
+    `,
+	} {
+		b, err := runBuilder(plan)
+		c.Assert(err, IsNil, Commentf("%s", plan))
+
+		inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+		c.Assert(err, IsNil)
+
+		for _, item := range inspect.Config.Env {
+			c.Assert(strings.HasPrefix(item, "GOPATH="), Equals, false, Commentf("%s", plan))
+		}
+
+		c.Assert(inspect.Config.Env[len(inspect.Config.Env)-1], Equals, "GOROOT=/usr/local/go")
+		c.Assert(string(runContainerCommand(c, b, []string{"env"})), Not(Matches), "(?s).*GOPATH=.*")
+		b.Close()
+	}
+
+	// a variable of the base image is removed too, and stays removed in the
+	// steps after it.
+	b, err := runBuilder(`
+    from "debian"
+    env DEBUG: "1"
+    tag "box-unenv-test"
+  `)
+	c.Assert(err, IsNil)
+	b.Close()
+	defer dockerClient.ImageRemove(context.Background(), "box-unenv-test", types.ImageRemoveOptions{})
+
+	for i := 0; i < 2; i++ {
+		b, err = runBuilder(`
+      from "box-unenv-test"
+      unenv "DEBUG"
+      run "test -z \"${DEBUG+set}\""
+      workdir "/tmp"
+    `)
+		c.Assert(err, IsNil)
+
+		inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+		c.Assert(err, IsNil)
+
+		for _, item := range inspect.Config.Env {
+			c.Assert(strings.HasPrefix(item, "DEBUG="), Equals, false)
+		}
+
+		c.Assert(inspect.Config.WorkingDir, Equals, "/tmp")
+		b.Close()
+	}
+
+	_, err = runBuilder(`
+    from "debian"
+    unenv
+  `)
+	c.Assert(err, NotNil)
+}
+
+func (bs *builderSuite) TestPathExistsFuncs(c *C) {
+	b, err := runBuilder(`
+    raise "dir before from" if dir_exists?("/etc")
+    raise "file before from" if file_exists?("/etc/passwd")
+
+    from "debian"
+    run "mkdir /app && ln -s /app /applink && touch /app/conf"
+    raise "dir" unless dir_exists?("/app") && dir_exists?("/applink")
+    raise "file" unless file_exists?("/app/conf")
+    raise "dir is a file" if file_exists?("/app")
+    raise "file is a dir" if dir_exists?("/app/conf")
+    raise "missing" if dir_exists?("/nonexistent") || file_exists?("/nonexistent")
+  `)
+	c.Assert(err, IsNil)
+	b.Close()
+
+	for _, plan := range []string{
+		`file_exists?("/etc/passwd", strict: true)`,
+		`from "debian"; file_exists?("etc/passwd")`,
+	} {
+		b, err := runBuilder(plan)
+		c.Assert(err, NotNil, Commentf("%s", plan))
+		b.Close()
+	}
+}
+
 func (bs *builderSuite) TestReaderFuncs(c *C) {
 	b, err := runBuilder(`
     from "debian"
@@ -1118,6 +3455,84 @@ func (bs *builderSuite) TestReaderFuncs(c *C) {
   `)
 	c.Assert(err, NotNil)
 	b.Close()
+
+	// files read are kept until the image changes.
+	b, err = runBuilder(`
+    from "debian"
+    run "echo -n #{getuid("root")}#{getuid("nobody")} > /uids"
+    run "useradd -u 1234 quux"
+    run "echo -n #{getuid("quux")} > /uid"
+  `)
+	c.Assert(err, IsNil)
+	c.Assert(string(readContainerFile(c, b, "/uids")), Equals, "065534")
+	c.Assert(string(readContainerFile(c, b, "/uid")), Equals, "1234")
+	b.Close()
+}
+
+func (bs *builderSuite) TestValidate(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    run "touch /app && chmod +x /app"
+    validate do
+      check "app is executable", "test -x /app"
+      check "root exists", "id root"
+    end
+  `)
+	c.Assert(err, IsNil)
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+    validate do
+      check "nginx user exists", "id nginx"
+    end
+  `)
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "nginx user exists"), Equals, true, Commentf("%v", err))
+	b.Close()
+
+	b, err = runBuilder(`
+    check "no image", "true"
+  `)
+	c.Assert(err, NotNil)
+	b.Close()
+}
+
+func (bs *builderSuite) TestWaitFor(c *C) {
+	b, err := runBuilder(`
+    from "debian"
+    run "date +%s > /start"
+    wait_for "test $(date +%s) -gt $(cat /start)", timeout: "10s", interval: "500ms"
+    sleep 0.1
+    sleep "100ms"
+  `)
+	c.Assert(err, IsNil)
+	b.Close()
+
+	start := time.Now()
+	b, err = runBuilder(`
+    from "debian"
+    wait_for "false", timeout: "2s", interval: "1s"
+  `)
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "timed out"), Equals, true, Commentf("%v", err))
+	c.Assert(time.Since(start) < time.Minute, Equals, true)
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+    wait_for "true", timeout: "soon"
+  `)
+	c.Assert(err, NotNil)
+	b.Close()
+
+	for _, option := range []string{`interval: "0s"`, `timeout: "-1s"`, `interval: 1`, `timeuot: "10s"`} {
+		b, err = runBuilder(`
+      from "debian"
+      wait_for "true", ` + option)
+		c.Assert(err, NotNil, Commentf("%s", option))
+		b.Close()
+	}
 }
 
 func (bs *builderSuite) TestExecPropagation(c *C) {
@@ -1286,3 +3701,174 @@ func (bs *builderSuite) TestCommitAfter(c *C) {
 	_, _, err = dockerClient.ImageInspectWithRaw(context.Background(), "debian:test")
 	c.Assert(err, IsNil)
 }
+
+func (bs *builderSuite) TestBoxVersion(c *C) {
+	for version, results := range map[string]map[string]bool{
+		"0.5.1": {
+			">= 0.5":          true,
+			"~> 0.5":          true,
+			">= 0.4, < 0.5":   false,
+			"0.5.1":           true,
+			"!= 0.5.1":        false,
+			"> 0.5.1-rc.2":    true,
+			"~> 0.4.2":        false,
+			">= 0.6":          false,
+			"< 1":             true,
+			"~> 1":            false,
+			"= 0.5.1+linux64": true,
+		},
+		// builds which are not releases are not checked.
+		"": {">= 0.5": true},
+		"0b8e5e4d8af5b3c1a2f6b7bd4f4a6a1c0e2f3d4a": {"< 0.1": true},
+	} {
+		for constraint, ok := range results {
+			b, err := NewBuilder(BuildConfig{
+				Globals: &btypes.Global{Context: context.Background(), Version: version},
+				Runner:  make(chan struct{}),
+			})
+			c.Assert(err, IsNil)
+
+			err = b.eval.RunScript(fmt.Sprintf(`
+        box_version %q
+        from "debian"
+      `, constraint))
+			b.Close()
+
+			if ok {
+				c.Assert(err, IsNil, Commentf("%s %s", version, constraint))
+			} else {
+				c.Assert(err, NotNil, Commentf("%s %s", version, constraint))
+				c.Assert(strings.Contains(err.Error(), "this plan requires box "+constraint+", but this is box "+version), Equals, true, Commentf("%v", err))
+			}
+		}
+	}
+
+	for _, constraint := range []string{"", ">=", "=> 0.5", "0.5,", "latest"} {
+		b, err := NewBuilder(BuildConfig{
+			Globals: &btypes.Global{Context: context.Background(), Version: "0.5.1"},
+			Runner:  make(chan struct{}),
+		})
+		c.Assert(err, IsNil)
+
+		err = b.eval.RunScript(fmt.Sprintf("box_version %q", constraint))
+		b.Close()
+		c.Assert(err, NotNil, Commentf("%q", constraint))
+		c.Assert(strings.Contains(err.Error(), "invalid box_version constraint"), Equals, true, Commentf("%v", err))
+	}
+}
+
+func (bs *builderSuite) TestMissingFrom(c *C) {
+	for _, statement := range []string{
+		`run "true"`,
+		`copy ".", "/"`,
+		`write "/x", "x"`,
+		`env "FOO" => "bar"`,
+		`workdir "/tmp"`,
+		`user "nobody"`,
+		`label foo: "bar"`,
+		`entrypoint "/bin/sh"`,
+		`tag "box-test"`,
+		`flatten`,
+		`rm "/x"`,
+		`with_user "nobody" do; end`,
+		`read "/etc/passwd"`,
+		`getuid "root"`,
+		`run_capture "true"`,
+		`check "ok", "true"`,
+	} {
+		_, err := runBuilder(statement)
+		c.Assert(err, NotNil, Commentf("%s", statement))
+		verb := strings.Fields(statement)[0]
+		c.Assert(strings.Contains(err.Error(), verb+" cannot be used before from; call from first"), Equals, true, Commentf("%s: %v", statement, err))
+	}
+
+	_, err := runBuilder(`
+    after { tag "box-test-missing-from" }
+    from "debian"
+  `)
+	c.Assert(err, IsNil)
+}
+
+func (bs *builderSuite) TestRunGroup(c *C) {
+	b, err := runBuilder(`from "debian"`)
+	c.Assert(err, IsNil)
+	debian := b.exec.Config().Image
+	b.Close()
+
+	b, err = runBuilder(`
+    from "debian"
+    run_group do
+      run "mkdir /group && cd /group"
+      run "echo one >one"
+      run "FOO=bar; echo two >two"
+      run "echo $FOO >foo"
+    end
+  `)
+	c.Assert(err, IsNil)
+	defer b.Close()
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), b.exec.Config().Image)
+	c.Assert(err, IsNil)
+	c.Assert(inspect.Parent, Equals, debian)
+	c.Assert(string(readContainerFile(c, b, "/group/two")), Equals, "two\n")
+	c.Assert(string(readContainerFile(c, b, "/group/foo")), Equals, "bar\n")
+
+	log := logger.New("", false, 0)
+	log.Record()
+
+	b, err = NewBuilder(BuildConfig{
+		Globals: &btypes.Global{Context: context.Background(), Logger: log, ShowRun: true},
+		Runner:  make(chan struct{}),
+	})
+	c.Assert(err, IsNil)
+	defer b.Close()
+
+	err = b.eval.RunScript(`
+    from "debian"
+    run_group do
+      run "true"
+      run "test -d /never || (exit 3)"
+      run "touch /never"
+    end
+  `)
+	c.Assert(err, NotNil)
+	output := log.Output().(*bytes.Buffer).String()
+	c.Assert(strings.Contains(output, "run_group: command 2 of 3 failed with exit status 3: test -d /never || (exit 3)"), Equals, true, Commentf("%s", output))
+
+	for _, plan := range []string{
+		`run_group do copy ".", "/tmp" end`,
+		`run_group do run "true", privileged: true end`,
+		`run_group do parallel do run "true" end end`,
+		`parallel do run_group do run "true" end end`,
+	} {
+		_, err := runExperimental("from \"debian\"\n" + plan)
+		c.Assert(err, NotNil, Commentf("%s", plan))
+	}
+}
+
+func (bs *builderSuite) TestExperimental(c *C) {
+	plan := `
+    from "debian"
+    parallel do
+      run "true"
+    end
+  `
+
+	for _, experimental := range []bool{false, true} {
+		b, err := NewBuilder(BuildConfig{
+			Globals: &btypes.Global{Context: context.Background(), Experimental: experimental},
+			Runner:  make(chan struct{}),
+		})
+		c.Assert(err, IsNil)
+
+		err = b.eval.RunScript(plan)
+		b.Close()
+
+		if experimental {
+			c.Assert(err, IsNil)
+		} else {
+			c.Assert(err, NotNil)
+			c.Assert(strings.Contains(err.Error(), "parallel is experimental and may change in future releases; pass --experimental to use it"), Equals, true, Commentf("%v", err))
+		}
+	}
+}
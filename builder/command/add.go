@@ -0,0 +1,198 @@
+package command
+
+import (
+	archivetar "archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/box-builder/box/copy"
+	"github.com/box-builder/box/tar"
+	"github.com/box-builder/box/util"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/pkg/errors"
+)
+
+// checksumAlgorithms are the algorithms a checksum given to `add` may use, by
+// the prefix naming them.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// Add implements `add`. The URL is downloaded to a temporary file, and hashed
+// as it is written. If checksum is not empty, it is the expected digest of the
+// download as `algorithm:hex`, and the step fails if the download does not
+// match, before anything is extracted or written to the image. Tar archives,
+// compressed with gzip, bzip2 or xz or not, are extracted into the target
+// directory. Other files are written to the target with mode 0644, as name if
+// the target ends in `/`.
+func (i *Interpreter) Add(url, name, target, checksum string) error {
+	if err := i.hasImage(); err != nil {
+		return err
+	}
+
+	newHash := sha256.New
+	var expected string
+
+	if checksum != "" {
+		parts := strings.SplitN(checksum, ":", 2)
+		algorithm, ok := checksumAlgorithms[parts[0]]
+		if !ok || len(parts) != 2 || parts[1] == "" {
+			return errors.Errorf("invalid checksum %q for %s; it must be sha256:, sha384: or sha512: followed by the hex digest", checksum, url)
+		}
+
+		newHash, expected = algorithm, strings.ToLower(parts[1])
+	}
+
+	f, err := ioutil.TempFile("", "box-add")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hasher := newHash()
+	if err := i.download(url, io.MultiWriter(f, hasher)); err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(hasher.Sum(nil)); expected != "" && sum != expected {
+		return errors.Errorf("checksum of %s does not match: expected %s, got %s:%s", url, checksum, strings.SplitN(checksum, ":", 2)[0], sum)
+	}
+
+	layer, err := ioutil.TempFile("", "box-add-layer")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(layer.Name())
+	defer layer.Close()
+
+	tw := archivetar.NewWriter(layer)
+
+	extracted, err := extractArchive(f, tw, target)
+	if err != nil {
+		return errors.Wrapf(err, "could not extract %s", url)
+	}
+
+	if !extracted {
+		if strings.HasSuffix(target, "/") {
+			if name == "" || name == "/" || name == "." {
+				return errors.Errorf("cannot name the file downloaded from %s; add it to a file name", url)
+			}
+			target = path.Join(target, name)
+		}
+
+		if err := addFile(f, tw, target, i.globals.Reproducible); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	hook := func(ctx context.Context, id string) error {
+		if _, err := layer.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		return i.exec.CopyToContainer(id, layer)
+	}
+
+	return i.exec.Commit(i.CacheKey, hook)
+}
+
+// download writes the body of a GET of the URL to w.
+func (i *Interpreter) download(url string, w io.Writer) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(i.globals.Context))
+	if err != nil {
+		return errors.Wrapf(err, "could not download %s", url)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("could not download %s: %s", url, resp.Status)
+	}
+
+	if err := copy.WithProgress(w, resp.Body, i.globals.Logger, "Downloading "+url); err != nil {
+		return errors.Wrapf(err, "could not download %s", url)
+	}
+
+	return nil
+}
+
+// extractArchive writes the entries of the tar archive in f to tw under the
+// directory dir, and reports whether f was an archive. Anything which is not
+// a tar archive once decompressed is left alone.
+func extractArchive(f *os.File, tw *archivetar.Writer, dir string) (bool, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	r, err := archive.DecompressStream(bufio.NewReader(f))
+	if err != nil {
+		return false, nil
+	}
+	defer r.Close()
+
+	br := bufio.NewReader(r)
+	header, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return false, nil
+	}
+
+	if _, err := archivetar.NewReader(bytes.NewReader(header)).Next(); err != nil {
+		return false, nil
+	}
+
+	return true, tar.Rebase(br, tw, dir, false)
+}
+
+// addFile writes the content of f to tw as the file name, with mode 0644.
+func addFile(f *os.File, tw *archivetar.Writer, name string, reproducible bool) error {
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	header := &archivetar.Header{
+		Name:     strings.TrimPrefix(path.Clean("/"+name), "/"),
+		Mode:     0644,
+		Size:     stat.Size(),
+		ModTime:  time.Now(),
+		Typeflag: archivetar.TypeReg,
+	}
+
+	if reproducible {
+		header.ModTime = util.SourceDate()
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, f)
+	return err
+}
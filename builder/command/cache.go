@@ -0,0 +1,111 @@
+package command
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	steps      = map[string]*sync.Mutex{}
+	stepsMutex = new(sync.Mutex)
+
+	mounts      = map[string]*sync.Mutex{}
+	mountsMutex = new(sync.Mutex)
+)
+
+// NextStep counts a step of the plan. Once the step configured with
+// --no-cache-from-step is reached, the cache is disabled for the rest of the
+// build.
+func (i *Interpreter) NextStep() {
+	if i.globals.NoCacheFrom > 0 && i.step+1 == i.globals.NoCacheFrom {
+		i.NoCache()
+	}
+
+	i.step++
+}
+
+// SkipStep returns true if the current step is after the range set with
+// --steps, so it is not evaluated.
+func (i *Interpreter) SkipStep() bool {
+	return i.globals.Steps.Last > 0 && i.step > i.globals.Steps.Last
+}
+
+// CheckStepRange returns an error if the current step is before the range set
+// with --steps and was not found in the cache: the steps in the range are
+// built on top of the cached ones.
+func (i *Interpreter) CheckStepRange(cached bool) error {
+	if cached || i.step >= i.globals.Steps.First {
+		return nil
+	}
+
+	return errors.Errorf("step %d is not cached; the steps before %d must be cached to build from step %d", i.step, i.globals.Steps.First, i.globals.Steps.First)
+}
+
+// NoCache corresponds to the `no_cache!` function. It disables the cache for
+// the steps that follow, while the steps before it remain cached.
+func (i *Interpreter) NoCache() {
+	if i.globals.Cache {
+		i.globals.Cache = false
+		i.globals.Logger.CacheDisabled(i.step + 1)
+	}
+}
+
+// LockStep serializes the evaluation of identical steps across all builders
+// in the process, such as the plans of a multi build. A step is identified by
+// its cache key and the image it is applied to. Once the first builder has
+// committed the step, the others waiting on it will find it in the cache
+// instead of building it again. The returned function releases the lock.
+func (i *Interpreter) LockStep(cacheKey string) func() {
+	if !i.globals.Cache {
+		return func() {}
+	}
+
+	key := i.exec.Config().Image + "\x00" + cacheKey
+
+	stepsMutex.Lock()
+	mutex, ok := steps[key]
+	if !ok {
+		mutex = new(sync.Mutex)
+		steps[key] = mutex
+	}
+	stepsMutex.Unlock()
+
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+// lockMounts serializes the use of cache mounts across all builders in the
+// process, so that two steps never write to the same cache at once. Locks are
+// taken in sorted order to avoid deadlocks. The returned function releases
+// them.
+func lockMounts(paths []string) func() {
+	sorted := append([]string{}, paths...)
+	sort.Strings(sorted)
+
+	locked := []*sync.Mutex{}
+
+	for i, path := range sorted {
+		if i > 0 && sorted[i-1] == path {
+			continue
+		}
+
+		mountsMutex.Lock()
+		mutex, ok := mounts[path]
+		if !ok {
+			mutex = new(sync.Mutex)
+			mounts[path] = mutex
+		}
+		mountsMutex.Unlock()
+
+		mutex.Lock()
+		locked = append(locked, mutex)
+	}
+
+	return func() {
+		for _, mutex := range locked {
+			mutex.Unlock()
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package command
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// checkpointStep is a step recorded in the checkpoint file, with the image
+// the build had once it was done.
+type checkpointStep struct {
+	Step     int    `json:"step"`
+	CacheKey string `json:"cache_key"`
+	Image    string `json:"image"`
+}
+
+// readCheckpoint reads the steps of the previous build from the checkpoint
+// file once, if there is one.
+func (i *Interpreter) readCheckpoint() error {
+	if i.resumeRead {
+		return nil
+	}
+	i.resumeRead = true
+
+	content, err := ioutil.ReadFile(i.globals.Checkpoint)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "could not read the checkpoint")
+	}
+
+	if err := json.Unmarshal(content, &i.resume); err != nil {
+		return errors.Wrapf(err, "could not read the checkpoint %q", i.globals.Checkpoint)
+	}
+
+	return nil
+}
+
+// Resume returns true if the current step is the next one of the previous
+// build's checkpoint, with the same cache key, and makes the image it had
+// after the step the current one. If it is not, or the image is gone, the rest
+// of the checkpoint is discarded, as the steps after it no longer follow from
+// the same ones.
+func (i *Interpreter) Resume(cacheKey string) (bool, error) {
+	if i.globals.Checkpoint == "" {
+		return false, nil
+	}
+
+	if err := i.readCheckpoint(); err != nil {
+		return false, err
+	}
+
+	if len(i.resume) == 0 {
+		return false, nil
+	}
+
+	next := i.resume[0]
+	if next.Step != i.step || next.CacheKey != cacheKey {
+		i.resume = nil
+		return false, nil
+	}
+
+	id, err := i.exec.Layers().Resolve(next.Image)
+	if err != nil {
+		return false, err
+	}
+
+	if id == "" {
+		i.resume = nil
+		return false, nil
+	}
+
+	i.globals.Logger.Resumed(id)
+	return true, i.exec.Image().UseImage(id)
+}
+
+// Checkpoint records the current step, now that it is done, and the image it
+// left in the checkpoint file. A step that differs from the previous build's,
+// such as a `from` whose image has changed, discards the rest of its
+// checkpoint.
+func (i *Interpreter) Checkpoint(cacheKey string) error {
+	if i.globals.Checkpoint == "" {
+		return nil
+	}
+
+	if err := i.readCheckpoint(); err != nil {
+		return err
+	}
+
+	step := checkpointStep{Step: i.step, CacheKey: cacheKey, Image: i.exec.Config().Image}
+
+	if len(i.resume) > 0 && i.resume[0] == step {
+		i.resume = i.resume[1:]
+	} else {
+		i.resume = nil
+	}
+
+	i.checkpoint = append(i.checkpoint, step)
+
+	content, err := json.MarshalIndent(i.checkpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// written aside and renamed, so a build killed while writing it leaves
+	// the last checkpoint.
+	tmp := i.globals.Checkpoint + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return errors.Wrap(err, "could not write the checkpoint")
+	}
+
+	return errors.Wrap(os.Rename(tmp, i.globals.Checkpoint), "could not write the checkpoint")
+}
@@ -7,17 +7,42 @@
 package command
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
 	"github.com/box-builder/box/builder/executor"
+	"github.com/box-builder/box/policy"
 	"github.com/box-builder/box/types"
 )
 
 // Interpreter is a set of statements combined with an executor used to compose
 // images. It is driven by an evaluator.
 type Interpreter struct {
-	CacheKey string // if set to "", does not consider cache next step
-	globals  *types.Global
-	exec     executor.Executor
-	vars     map[string]string
+	CacheKey    string // if set to "", does not consider cache next step
+	CacheSalt   string // folded into the following cache keys, for data the image cannot see
+	planSalt    string // the part of CacheSalt which outlives the stage, such as the output of local_run
+	globals     *types.Global
+	exec        executor.Executor
+	vars        map[string]string
+	buildEnv    map[string]string // the variables set with build_env for the commands of the runs
+	step        int
+	baseName    string // the image given to the last `from`
+	baseID      string
+	parallel    []parallelRun     // the runs of the parallel block being recorded, if any
+	group       []groupRun        // the runs of the run_group block being recorded, if any
+	baseRules   *policy.Base      // the rules given to assert_base_matches, if any
+	contents    map[string][]byte // files read from the image, by path
+	contentID   string            // the image the contents were read from
+	tempDir     string            // the build's temporary directory, once created
+	declared    map[string]bool   // the variables declared with arg
+	undeclared  []string          // the variables used without being declared or passed, with --strict-vars
+	inspectMiss bool              // a step reported to the inspection was not cached
+	checkpoint  []checkpointStep  // the steps of this build recorded in the checkpoint file
+	resume      []checkpointStep  // the steps of the previous build's checkpoint which are left to resume
+	resumeRead  bool              // the previous build's checkpoint was read
+	waitingFor  *localTag         // the name of another plan `from` waits for, if any
+	failedTag   string            // the name of another plan `from` waited for, which failed
 }
 
 // NewInterpreter contypes a new *Interpreter.
@@ -29,7 +54,18 @@ func NewInterpreter(globals *types.Global, exec executor.Executor, vars map[stri
 	}
 }
 
+// BaseImage returns the name and id of the image given to the last `from`
+// statement. Both are empty if there was none, or it was scratch.
+func (i *Interpreter) BaseImage() (string, string) {
+	return i.baseName, i.baseID
+}
+
 func (i *Interpreter) makeLayer(useHook bool) error {
+	// an inspection only changes the config; nothing is committed.
+	if i.Inspecting() {
+		return nil
+	}
+
 	hook := i.exec.RunHook
 	if !useHook {
 		hook = nil
@@ -37,3 +73,41 @@ func (i *Interpreter) makeLayer(useHook bool) error {
 
 	return i.exec.Commit(i.CacheKey, hook)
 }
+
+// addSalt folds the data into the cache salt. Unless it is for the plan, it
+// only applies to the steps of the stage, and the next `from` drops it.
+func (i *Interpreter) addSalt(data string, plan bool) {
+	sum := sha256.Sum256([]byte(i.CacheSalt + data))
+	i.CacheSalt = hex.EncodeToString(sum[:])
+
+	if plan {
+		sum := sha256.Sum256([]byte(i.planSalt + data))
+		i.planSalt = hex.EncodeToString(sum[:])
+	}
+}
+
+// checkLayerCache checks the cache for a step committed with CommitLayer, and
+// returns its cache key. The image it loads has no parent, so the key names
+// the image the step applies to instead.
+func (i *Interpreter) checkLayerCache() (string, bool, error) {
+	cacheKey := fmt.Sprintf("%s, on %s", i.CacheKey, i.exec.Config().Image)
+
+	cached, err := i.exec.Image().CheckCache(cacheKey)
+	return cacheKey, cached, err
+}
+
+// commitConfig commits the config on the current image without a layer. A
+// commit merges the environment of the image into the container's, so the
+// variables removed from the config would come back with one.
+func (i *Interpreter) commitConfig() error {
+	if i.Inspecting() {
+		return nil
+	}
+
+	cacheKey, cached, err := i.checkLayerCache()
+	if err != nil || cached {
+		return err
+	}
+
+	return i.exec.CommitLayer(cacheKey, nil)
+}
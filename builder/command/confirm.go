@@ -0,0 +1,94 @@
+package command
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/pkg/term"
+	"github.com/pkg/errors"
+)
+
+// promptMutex keeps the questions of concurrent builds from interleaving.
+var promptMutex = new(sync.Mutex)
+
+// asking reports whether confirm would ask its questions. Builds that are not
+// interactive, or given --yes, always proceed. The answers are read from
+// standard input, so without a terminal there is no one to ask and --yes is
+// required.
+func (i *Interpreter) asking() (bool, error) {
+	if !i.globals.Interactive || i.globals.AssumeYes {
+		return false, nil
+	}
+
+	if !i.globals.TTY || !term.IsTerminal(os.Stdin.Fd()) {
+		return false, errors.New("cannot ask for confirmation without a TTY; pass --yes to proceed")
+	}
+
+	return true, nil
+}
+
+// confirm asks the question if the build is interactive and reports whether
+// the answer was yes.
+func (i *Interpreter) confirm(question string) (bool, error) {
+	ask, err := i.asking()
+	if err != nil {
+		return false, errors.Wrap(err, question)
+	}
+
+	if !ask {
+		return true, nil
+	}
+
+	promptMutex.Lock()
+	defer promptMutex.Unlock()
+
+	i.globals.Logger.Prompt(question)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		return false, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// CheckTag asks before the name is moved from the image it tags to the
+// current image, if the build is interactive. The tag is only looked up if
+// there is someone to ask.
+func (i *Interpreter) CheckTag(name string) error {
+	ask, err := i.asking()
+	if err != nil {
+		return errors.Wrapf(err, "overwrite the existing tag %s?", name)
+	}
+
+	if !ask {
+		return nil
+	}
+
+	existing, err := i.exec.Layers().Resolve(name)
+	if err != nil {
+		return err
+	}
+
+	if existing == "" || existing == i.exec.Image().ImageID() {
+		return nil
+	}
+
+	ok, err := i.confirm("overwrite the existing tag " + name + "?")
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errors.Errorf("not overwriting the existing tag %q", name)
+	}
+
+	return nil
+}
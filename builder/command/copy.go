@@ -1,39 +1,95 @@
 package command
 
 import (
+	archivetar "archive/tar"
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"strings"
+	"time"
 
 	"github.com/box-builder/box/tar"
 	"github.com/box-builder/box/util"
 	"github.com/pkg/errors"
 )
 
-// Copy implements `copy`
-func (i *Interpreter) Copy(source, target string, ignoreList []string) error {
+// Copy implements `copy`. caps, if supplied, are file capabilities set on every
+// copied file. If parents is true, the source's directories relative to the
+// build root are kept under the target. If inheritOwner is true, the copied
+// files are owned by the owner of the directory they are copied into.
+func (i *Interpreter) Copy(source, target string, ignoreList, caps []string, parents, inheritOwner bool) error {
 	if err := i.hasImage(); err != nil {
 		return err
 	}
 
-	list, err := util.ReadLines(".dockerignore")
-	if os.IsNotExist(err) {
-		list = []string{}
-	} else if err != nil {
+	ignoreList, xattrs, err := i.copyOptions([]string{target}, ignoreList, caps)
+	if err != nil {
 		return err
 	}
 
-	ignoreList = append(ignoreList, list...)
+	fn, cacheKey, err := tar.Archive(i.globals.Context, source, target, ignoreList, xattrs, parents, i.globals.Logger)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fn)
 
-	// XXX for if we ever add volume support back
-	for _, volume := range i.exec.Config().Volumes {
-		if strings.HasPrefix(target, volume) {
-			return errors.Errorf("Volume %q cannot be copied into (you tried %q). This is caused by a bug in docker. We are working with docker on a fix.", volume, target)
+	cacheKey = fmt.Sprintf("box:copy %s", cacheKey)
+
+	// the owner is found in the image the step is cached against, so it is
+	// not looked up unless the step is built.
+	if inheritOwner {
+		cacheKey += ", inherit_owner"
+	}
+
+	cached, err := i.exec.Image().CheckCache(cacheKey)
+	if err != nil {
+		return err
+	}
+
+	if cached {
+		return nil
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	hook := func(ctx context.Context, id string) error {
+		if !inheritOwner {
+			return i.exec.CopyToContainer(id, f)
 		}
+
+		return i.copyInheritingOwner(id, f, copyDir(source, target, parents))
+	}
+
+	return i.exec.Commit(cacheKey, hook)
+}
+
+// CopyMap implements `copy` with a mapping of sources to their targets, which
+// are copied in one step, and one layer. The content of every source is part
+// of the step's cache key.
+func (i *Interpreter) CopyMap(mapping map[string]string, ignoreList, caps []string) error {
+	if err := i.hasImage(); err != nil {
+		return err
+	}
+
+	targets := []string{}
+	for _, target := range mapping {
+		targets = append(targets, target)
+	}
+
+	ignoreList, xattrs, err := i.copyOptions(targets, ignoreList, caps)
+	if err != nil {
+		return err
 	}
 
-	fn, cacheKey, err := tar.Archive(i.globals.Context, source, target, ignoreList, i.globals.Logger)
+	fn, cacheKey, err := tar.ArchiveMap(i.globals.Context, mapping, ignoreList, xattrs, i.globals.Logger)
 	if err != nil {
 		return err
 	}
@@ -63,3 +119,308 @@ func (i *Interpreter) Copy(source, target string, ignoreList []string) error {
 
 	return i.exec.Commit(cacheKey, hook)
 }
+
+// copyOptions returns the patterns ignored by a copy to the targets, with
+// those of the .dockerignore, and the extended attributes setting the caps.
+func (i *Interpreter) copyOptions(targets, ignoreList, caps []string) ([]string, map[string]string, error) {
+	list, err := util.ReadLines(".dockerignore")
+	if os.IsNotExist(err) {
+		list = []string{}
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	ignoreList = append(ignoreList, list...)
+
+	// XXX for if we ever add volume support back
+	for _, target := range targets {
+		for _, volume := range i.exec.Config().Volumes {
+			if strings.HasPrefix(target, volume) {
+				return nil, nil, errors.Errorf("Volume %q cannot be copied into (you tried %q). This is caused by a bug in docker. We are working with docker on a fix.", volume, target)
+			}
+		}
+	}
+
+	var xattrs map[string]string
+
+	if len(caps) > 0 {
+		capability, err := tar.EncodeCapabilities(caps)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		xattrs = map[string]string{tar.CapabilityXattr: capability}
+	}
+
+	return ignoreList, xattrs, nil
+}
+
+// copyDir returns the directory in the image the source is copied into: the
+// target, unless a single file is copied to a file name.
+func copyDir(source, target string, parents bool) string {
+	if strings.HasSuffix(target, "/") || parents {
+		return target
+	}
+
+	if fi, err := os.Stat(source); err == nil && !fi.IsDir() {
+		return path.Dir(target)
+	}
+
+	return target
+}
+
+// copyInheritingOwner copies the archive to the container with its entries
+// owned by the owner of dir, or of the closest directory above it if it does
+// not exist yet.
+func (i *Interpreter) copyInheritingOwner(id string, archive io.Reader, dir string) error {
+	uid, gid, err := i.directoryOwner(id, dir)
+	if err != nil {
+		return err
+	}
+
+	tempDir, err := i.TempDir()
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(tempDir, "box-copy.")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	tw := archivetar.NewWriter(f)
+	if err := tar.Chown(archive, tw, uid, gid); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return i.exec.CopyToContainer(id, f)
+}
+
+// directoryOwner returns the uid and gid of dir in the container, which is the
+// first entry of its archive.
+func (i *Interpreter) directoryOwner(id, dir string) (int, int, error) {
+	dir = path.Clean("/" + dir)
+
+	for {
+		r, _, err := i.exec.CopyFromContainer(id, dir)
+		if err != nil {
+			if dir == "/" {
+				return 0, 0, errors.Wrap(err, "could not find the owner of the copy target")
+			}
+
+			dir = path.Dir(dir)
+			continue
+		}
+
+		header, err := archivetar.NewReader(r).Next()
+		if closer, ok := r.(io.Closer); ok {
+			closer.Close()
+		}
+
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "could not find the owner of %q", dir)
+		}
+
+		return header.Uid, header.Gid, nil
+	}
+}
+
+// CopyContent implements `copy` for content from the `stdin` and `content`
+// functions, which is written to the target file with mode 0644. The content
+// is part of the step's cache key. caps, if supplied, are file capabilities set
+// on the file.
+func (i *Interpreter) CopyContent(content []byte, target string, caps []string) error {
+	if err := i.hasImage(); err != nil {
+		return err
+	}
+
+	file := tar.File{Name: target, Content: content, Mode: 0644, ModTime: time.Now()}
+	if i.globals.Reproducible {
+		file.ModTime = util.SourceDate()
+	}
+
+	if len(caps) > 0 {
+		capability, err := tar.EncodeCapabilities(caps)
+		if err != nil {
+			return err
+		}
+
+		file.Xattrs = map[string]string{tar.CapabilityXattr: capability}
+	}
+
+	buf, err := tar.ArchiveFile(file)
+	if err != nil {
+		return err
+	}
+
+	hook := func(ctx context.Context, id string) error {
+		return i.exec.CopyToContainer(id, buf)
+	}
+
+	return i.exec.Commit(i.CacheKey, hook)
+}
+
+// CopyFrom implements `copy_from`. The source path is copied from a container
+// of the image to the target, keeping its owners, modes and hard links, like
+// mv. A target ending in `/` is a directory the source is copied into. The
+// archive is written to a temporary file first, unless asTar is set, when it
+// is streamed between the containers without touching the host's disk.
+func (i *Interpreter) CopyFrom(image, source, target string, asTar bool) error {
+	if err := i.hasImage(); err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(target, "/") {
+		target = path.Join(target, path.Base(source))
+	}
+
+	id, ok := lookupTag(image)
+	if !ok {
+		var err error
+		if id, err = i.exec.Layers().Pull(image); err != nil {
+			return errors.Wrapf(err, "could not pull %q to copy from", image)
+		}
+	}
+
+	// the image is in the key by id, so the step is built again when it is.
+	cacheKey := fmt.Sprintf("box:copy_from %s:%s %s", id, source, target)
+
+	cached, err := i.exec.Image().CheckCache(cacheKey)
+	if err != nil {
+		return err
+	}
+
+	if cached {
+		return nil
+	}
+
+	from, err := i.createFrom(id)
+	if err != nil {
+		return err
+	}
+	defer i.exec.Destroy(from)
+
+	hook := func(ctx context.Context, id string) error {
+		r, _, err := i.exec.CopyFromContainer(from, source)
+		if err != nil {
+			return errors.Wrapf(err, "could not copy %q from %q", source, image)
+		}
+
+		if closer, ok := r.(io.Closer); ok {
+			defer closer.Close()
+		}
+
+		if asTar {
+			return i.streamMoved(id, r, target)
+		}
+
+		return i.copyMoved(id, r, target)
+	}
+
+	return i.exec.Commit(cacheKey, hook)
+}
+
+// createFrom creates a container of the image with the id, instead of the
+// current image.
+func (i *Interpreter) createFrom(id string) (string, error) {
+	config := i.exec.Config()
+
+	image := config.Image
+	config.Image = id
+	defer func() { config.Image = image }()
+
+	return i.exec.Create()
+}
+
+// copyMoved copies the archive of a path to the container with the path
+// renamed to target, through a temporary file.
+func (i *Interpreter) copyMoved(id string, r io.Reader, target string) error {
+	tempDir, err := i.TempDir()
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(tempDir, "box-copy-from.")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	tw := archivetar.NewWriter(f)
+	if err := tar.Move(r, tw, target); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return i.exec.CopyToContainer(id, f)
+}
+
+// streamMoved copies the archive of a path to the container with the path
+// renamed to target, as it is read.
+func (i *Interpreter) streamMoved(id string, r io.Reader, target string) error {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		tw := archivetar.NewWriter(pw)
+		err := tar.Move(r, tw, target)
+		if err == nil {
+			err = tw.Close()
+		}
+
+		pw.CloseWithError(err)
+	}()
+
+	err := i.exec.CopyToContainer(id, pr)
+
+	// stops the rewriting if the copy failed before reading all of it.
+	pr.CloseWithError(errors.New("copy_from was interrupted"))
+	<-done
+
+	return err
+}
+
+// Export copies the path src in the current image to the host directory dest.
+// If src is a directory, its contents are copied into dest.
+func (i *Interpreter) Export(src, dest string) error {
+	if err := i.hasImage(); err != nil {
+		return err
+	}
+
+	id, err := i.exec.Create()
+	if err != nil {
+		return err
+	}
+	defer i.exec.Destroy(id)
+
+	r, _, err := i.exec.CopyFromContainer(id, src)
+	if err != nil {
+		return errors.Wrapf(err, "could not copy %q from the image", src)
+	}
+
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+
+	return tar.Extract(r, src, dest)
+}
@@ -0,0 +1,19 @@
+package command
+
+import "github.com/pkg/errors"
+
+// experimental are the verbs and funcs which may still change or be removed.
+// They are refused unless --experimental is passed.
+var experimental = map[string]bool{
+	"parallel": true,
+}
+
+// RequireExperimental returns an error naming the flag to pass if the verb or
+// func is experimental and experimental features are not enabled.
+func (i *Interpreter) RequireExperimental(name string) error {
+	if experimental[name] && !i.globals.Experimental {
+		return errors.Errorf("%s is experimental and may change in future releases; pass --experimental to use it", name)
+	}
+
+	return nil
+}
@@ -0,0 +1,269 @@
+package command
+
+import (
+	archivetar "archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/box-builder/box/tar"
+	"github.com/box-builder/box/util"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/pkg/errors"
+)
+
+// maxSymlinks is how many symlinks are followed in the directories above a
+// path of mv or rm, as the kernel does.
+const maxSymlinks = 40
+
+// Move corresponds to the `mv` verb. The step's layer is written with the
+// source, as it is copied from the container with its owners, modes and hard
+// links, renamed to the target, and a whiteout of the source. A target ending
+// in `/` is a directory the source is moved into.
+func (i *Interpreter) Move(source, target string) error {
+	if err := i.hasImage(); err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(target, "/") {
+		target = path.Join(target, path.Base(source))
+	}
+
+	source, target = path.Clean(source), path.Clean(target)
+
+	if source == "/" || target == "/" {
+		return errors.New("mv cannot move the root directory")
+	}
+
+	if source == target || strings.HasPrefix(target, source+"/") {
+		return errors.Errorf("cannot move %q into itself", source)
+	}
+
+	if strings.HasPrefix(source, target+"/") {
+		return errors.Errorf("cannot move %q over a directory containing it", source)
+	}
+
+	return i.commitLayer(func(tw *archivetar.Writer, id string, written map[string]bool) error {
+		source, err := i.writeParents(tw, id, source, written)
+		if err != nil {
+			return err
+		}
+
+		if err := writeWhiteout(tw, source, i.globals.Reproducible); err != nil {
+			return err
+		}
+
+		r, _, err := i.exec.CopyFromContainer(id, source)
+		if err != nil {
+			return errors.Wrapf(err, "could not move %q", source)
+		}
+
+		target, err := i.writeParents(tw, id, target, written)
+		if err != nil {
+			if closer, ok := r.(io.Closer); ok {
+				closer.Close()
+			}
+			return err
+		}
+
+		err = tar.Move(r, tw, target)
+		if closer, ok := r.(io.Closer); ok {
+			closer.Close()
+		}
+
+		return err
+	})
+}
+
+// Remove corresponds to the `rm` verb. The step's layer is written with a
+// whiteout for each path, which removes it with everything under it, so
+// nothing is run and images without rm, such as scratch, may use it too. A
+// path which does not exist fails the step.
+func (i *Interpreter) Remove(paths []string) error {
+	if err := i.hasImage(); err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		if path.Clean(p) == "/" {
+			return errors.New("rm cannot remove the root directory")
+		}
+	}
+
+	return i.commitLayer(func(tw *archivetar.Writer, id string, written map[string]bool) error {
+		for _, p := range paths {
+			p, err := i.writeParents(tw, id, path.Clean(p), written)
+			if err != nil {
+				return err
+			}
+
+			header, err := i.pathHeader(id, p)
+			if err != nil {
+				return err
+			}
+
+			if header == nil {
+				return errors.Errorf("could not remove %q: no such file or directory", p)
+			}
+
+			if err := writeWhiteout(tw, p, i.globals.Reproducible); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// commitLayer commits the layer of mv or rm, which write writes to tw from
+// the files of the container id. The directories it has written are in
+// written. The layer is loaded without a parent, so the cache key it is
+// committed with names the image it is on, and the step checks the cache
+// itself.
+func (i *Interpreter) commitLayer(write func(*archivetar.Writer, string, map[string]bool) error) error {
+	config := i.exec.Config()
+
+	if config.OS == "windows" {
+		return errors.New("mv and rm are not supported for windows images")
+	}
+
+	cacheKey, cached, err := i.checkLayerCache()
+	if err != nil || cached {
+		return err
+	}
+
+	dir, err := i.TempDir()
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, "box-layer.")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	id, err := i.exec.Create()
+	if err != nil {
+		return err
+	}
+	defer i.exec.Destroy(id)
+
+	tw := archivetar.NewWriter(f)
+	if err := write(tw, id, map[string]bool{}); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return i.exec.CommitLayer(cacheKey, f)
+}
+
+// writeParents writes the directories above p to tw as they are in the
+// container, so the layer keeps their owners and modes, and returns p with
+// the symlinks among them resolved. Those which do not exist are written as
+// root's with mode 0755, and those in written are skipped.
+func (i *Interpreter) writeParents(tw *archivetar.Writer, id, p string, written map[string]bool) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	headers := []*archivetar.Header{}
+	dir := "/"
+
+	for links := 0; len(parts) > 1; {
+		next := path.Join(dir, parts[0])
+
+		header, err := i.pathHeader(id, next)
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case header == nil:
+			header = &archivetar.Header{Mode: 0755, ModTime: modTime(i.globals.Reproducible), Typeflag: archivetar.TypeDir}
+		case header.Typeflag == archivetar.TypeSymlink:
+			if links++; links > maxSymlinks {
+				return "", errors.Errorf("too many levels of symbolic links in %q", p)
+			}
+
+			link := header.Linkname
+			if !path.IsAbs(link) {
+				link = path.Join(dir, link)
+			}
+
+			// the link is followed from the root, with what is left of p.
+			parts = append(strings.Split(strings.TrimPrefix(path.Clean(link), "/"), "/"), parts[1:]...)
+			headers, dir = nil, "/"
+			continue
+		case header.Typeflag != archivetar.TypeDir:
+			return "", errors.Errorf("%q is not a directory", next)
+		}
+
+		header.Name = strings.TrimPrefix(next, "/") + "/"
+		headers = append(headers, header)
+		dir, parts = next, parts[1:]
+	}
+
+	for _, header := range headers {
+		if written[header.Name] {
+			continue
+		}
+		written[header.Name] = true
+
+		if err := tw.WriteHeader(header); err != nil {
+			return "", err
+		}
+	}
+
+	return path.Join(dir, parts[0]), nil
+}
+
+// pathHeader returns the tar header of p in the container, which is the first
+// entry of its archive, or nil if it does not exist.
+func (i *Interpreter) pathHeader(id, p string) (*archivetar.Header, error) {
+	r, _, err := i.exec.CopyFromContainer(id, p)
+	if err != nil {
+		return nil, nil
+	}
+
+	header, err := archivetar.NewReader(r).Next()
+	if closer, ok := r.(io.Closer); ok {
+		closer.Close()
+	}
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read %q", p)
+	}
+
+	return header, nil
+}
+
+// writeWhiteout writes the whiteout of p to tw, which removes it and what is
+// under it from the layers below.
+func writeWhiteout(tw *archivetar.Writer, p string, reproducible bool) error {
+	name := path.Join(path.Dir(p), archive.WhiteoutPrefix+path.Base(p))
+
+	return tw.WriteHeader(&archivetar.Header{
+		Name:     strings.TrimPrefix(name, "/"),
+		Mode:     0600,
+		ModTime:  modTime(reproducible),
+		Typeflag: archivetar.TypeReg,
+	})
+}
+
+// modTime is the modification time of the entries written to a layer.
+func modTime(reproducible bool) time.Time {
+	if reproducible {
+		return util.SourceDate()
+	}
+
+	return time.Now()
+}
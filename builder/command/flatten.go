@@ -6,7 +6,6 @@ import (
 	"os"
 
 	"github.com/box-builder/box/copy"
-	"github.com/box-builder/box/signal"
 )
 
 // Flatten implements `flatten`
@@ -23,13 +22,16 @@ func (i *Interpreter) Flatten() error {
 		return err
 	}
 
-	f, err := ioutil.TempFile("", "box-flatten.")
+	dir, err := i.TempDir()
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, "box-flatten.")
 	if err != nil {
 		return err
 	}
 
-	signal.Handler.AddFile(f.Name())
-	defer signal.Handler.RemoveFile(f.Name())
 	defer os.Remove(f.Name())
 
 	if err := copy.WithProgress(f, rc, i.globals.Logger, "Downloading image contents to host"); err != nil && err != io.EOF {
@@ -1,23 +1,245 @@
 package command
 
-import "sync"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/box-builder/box/policy"
+	"github.com/box-builder/box/types"
+	"github.com/pkg/errors"
+)
+
+// fileScheme prefixes the paths of image archives given to `from`.
+const fileScheme = "file:"
 
 var (
 	pulls     = map[string]chan struct{}{}
 	pullMutex = new(sync.Mutex)
+
+	// localTags holds the names tagged by the plans in this process, or
+	// expected to be, so that `from` uses the image built here instead of
+	// pulling the name.
+	localTags = map[string]*localTag{}
+	tagMutex  = new(sync.Mutex)
 )
 
+// localTag is a name tagged by a plan in this process, or which a plan of a
+// `box multi` run is expected to tag.
+type localTag struct {
+	id    string        // the image tagged
+	owner *Interpreter  // the plan expected to tag the name, until it does or finishes
+	done  chan struct{} // closed once the name is tagged, or will not be
+	err   error         // the error of the plan which failed to tag the name
+}
+
 // ResetPulls is a function to facilitate testing of the coordinated pull functionality.
 func ResetPulls() {
 	pulls = map[string]chan struct{}{}
 }
 
-// From corresponds to the `from` verb.
-func (i *Interpreter) From(image string) error {
+// ResetTags is a function to facilitate testing of the local tag registry.
+func ResetTags() {
+	tagMutex.Lock()
+	defer tagMutex.Unlock()
+	localTags = map[string]*localTag{}
+}
+
+// tagName adds the default tag to names without one, so that `foo` and
+// `foo:latest` are the same image. A colon in a registry host is not a tag.
+func tagName(name string) string {
+	if strings.Contains(name, "@") || strings.Contains(name[strings.LastIndex(name, "/")+1:], ":") {
+		return name
+	}
+
+	return name + ":latest"
+}
+
+// registerTag records the image tagged with the name, releasing the `from`
+// statements waiting for it.
+func registerTag(name, id string) {
+	tagMutex.Lock()
+	defer tagMutex.Unlock()
+
+	name = tagName(name)
+	if tag, ok := localTags[name]; ok && tag.owner != nil {
+		tag.id, tag.owner = id, nil
+		close(tag.done)
+		return
+	}
+
+	done := make(chan struct{})
+	close(done)
+	localTags[name] = &localTag{id: id, done: done}
+}
+
+// lookupTag returns the image tagged with the name by a plan in this process.
+func lookupTag(name string) (string, bool) {
+	tagMutex.Lock()
+	defer tagMutex.Unlock()
+
+	if tag, ok := localTags[tagName(name)]; ok && tag.owner == nil && tag.id != "" {
+		return tag.id, true
+	}
+
+	return "", false
+}
+
+// RegisterTag records the name as tagging the current image, like the `tag`
+// verb, for a tag made after the plan was run.
+func (i *Interpreter) RegisterTag(name string) {
+	registerTag(name, i.exec.Image().ImageID())
+}
+
+// FailedTag returns the name tagged by another plan which failed, if the plan
+// could not be built for it.
+func (i *Interpreter) FailedTag() string {
+	return i.failedTag
+}
+
+// ExpectTags records the names the plan is expected to tag, so that the
+// `from` statements of the other plans in this process wait for the plan to
+// tag them, rather than resolving them before. Names already tagged, or
+// expected of another plan, are left alone.
+func (i *Interpreter) ExpectTags(names []string) {
+	tagMutex.Lock()
+	defer tagMutex.Unlock()
+
+	for _, name := range names {
+		name = tagName(name)
+		if _, ok := localTags[name]; !ok {
+			localTags[name] = &localTag{owner: i, done: make(chan struct{})}
+		}
+	}
+}
+
+// ReleaseTags gives up the names the plan was expected to tag, and has not,
+// once it finishes. If err is set, the plan failed, and so do the `from`
+// statements waiting for the names; otherwise they resolve the names as
+// usual.
+func (i *Interpreter) ReleaseTags(err error) {
+	tagMutex.Lock()
+	defer tagMutex.Unlock()
+
+	for name, tag := range localTags {
+		if tag.owner != i {
+			continue
+		}
+
+		tag.owner, tag.err = nil, err
+		close(tag.done)
+
+		if err == nil {
+			delete(localTags, name)
+		}
+	}
+}
+
+// waitTag returns the image tagged with the name by a plan in this process,
+// if any. If another plan is expected to tag the name, it waits until it
+// does, and fails if that plan fails.
+func (i *Interpreter) waitTag(name string) (string, bool, error) {
+	tagMutex.Lock()
+	tag, ok := localTags[tagName(name)]
+	pending := ok && tag.owner != nil && tag.owner != i
+
+	// plans waiting for each other's names would never finish.
+	for owner := tag; pending && owner != nil && owner.owner != nil; owner = owner.owner.waitingFor {
+		if owner.owner == i {
+			tagMutex.Unlock()
+			return "", false, errors.Errorf("image %q cannot be waited for: the plan tagging it waits for this one", name)
+		}
+	}
+
+	if pending {
+		i.waitingFor = tag
+	}
+	tagMutex.Unlock()
+
+	if !ok {
+		return "", false, nil
+	}
+
+	if pending {
+		i.globals.Logger.WaitingForTag(name)
+
+		select {
+		case <-tag.done:
+		case <-i.globals.Context.Done():
+		}
+
+		tagMutex.Lock()
+		i.waitingFor = nil
+		tagMutex.Unlock()
+
+		if err := i.globals.Context.Err(); err != nil {
+			return "", false, err
+		}
+	}
+
+	tagMutex.Lock()
+	defer tagMutex.Unlock()
+
+	if tag.err != nil {
+		i.failedTag = name
+		return "", false, errors.Errorf("image %q was not built, as the plan tagging it failed", name)
+	}
+
+	// a name of this plan's own which it has not tagged yet, or one the plan
+	// expected to tag it did not, is resolved as usual.
+	return tag.id, tag.owner == nil && tag.id != "", nil
+}
+
+// From corresponds to the `from` verb. If digest is not empty, the image must
+// match it. Images named `file:path` are loaded from the `docker save`
+// archive at the path instead of being pulled. If the platform is set, the
+// image's entry for it is used; otherwise that of the --platform being built,
+// if any, is used for the images pulled from a registry.
+//
+// A `from` starts a new stage, so the variables of build_env and the cache
+// salt of the previous one no longer apply; that of the plan, such as the
+// output of local_run, still does.
+func (i *Interpreter) From(image, digest string, platform types.Platform) error {
+	i.buildEnv = nil
+	i.CacheSalt = i.planSalt
+
+	if platform != (types.Platform{}) {
+		return i.fromPlatform(image, digest, platform)
+	}
+
+	return i.fromImage(image, digest, i.globals.Platform)
+}
+
+// fromImage uses the image for `from`. scratch, archives and the images tagged
+// in this process are used as they are; the others are pulled, as their entry
+// for the platform if it is set.
+func (i *Interpreter) fromImage(image, digest string, platform types.Platform) error {
 	if image == "scratch" || image == "" {
+		i.baseName, i.baseID = "", ""
 		return i.makeLayer(false)
 	}
 
+	if strings.HasPrefix(image, fileScheme) {
+		return i.fromFile(image, digest)
+	}
+
+	id, ok, err := i.waitTag(image)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		return i.fromLocal(image, id, digest)
+	}
+
+	if platform != (types.Platform{}) {
+		return i.fromPlatform(image, digest, platform)
+	}
+
 	var (
 		pullChan chan struct{}
 		pulling  bool
@@ -33,11 +255,6 @@ func (i *Interpreter) From(image string) error {
 	}
 	pullMutex.Unlock()
 
-	var (
-		id  string
-		err error
-	)
-
 	if pulling {
 		<-pullChan
 		id, err = i.exec.Layers().Lookup(i.exec.Config(), image)
@@ -53,6 +270,308 @@ func (i *Interpreter) From(image string) error {
 	}
 
 	i.exec.Config().Image = id
+	i.baseName, i.baseID = image, id
+
+	if digest != "" || i.globals.ResolveDigests {
+		if err := i.checkDigest(image, id, digest); err != nil {
+			return err
+		}
+	}
+
+	return i.VerifyBase()
+}
+
+// Pull corresponds to the `pull` function. The image is pulled into the
+// daemon, unless it already has it, without using it, so that the `from`
+// statements using it later need not wait for the network. It returns the
+// image's registry digest in `name@digest` form, or its ID if it has none.
+func (i *Interpreter) Pull(image string) (string, error) {
+	pullMutex.Lock()
+	pullChan, pulling := pulls[image]
+	if !pulling {
+		pullChan = make(chan struct{})
+		pulls[image] = pullChan
+	}
+	pullMutex.Unlock()
+
+	var (
+		id  string
+		err error
+	)
+
+	if pulling {
+		<-pullChan
+		id, err = i.exec.Layers().Resolve(image)
+		if err == nil && id == "" {
+			err = errors.Errorf("image %q could not be pulled", image)
+		}
+	} else {
+		id, err = i.exec.Layers().Pull(image)
+		close(pullChan)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	digests, err := i.exec.Layers().RepoDigests(id)
+	if err != nil {
+		return "", err
+	}
+
+	return repoDigest(image, id, digests), nil
+}
+
+// repoDigest returns the registry digest of the image pulled by name, out of
+// those of the image with the id.
+func repoDigest(image, id string, digests []string) string {
+	names := policy.Names(image)
+
+	for _, digest := range digests {
+		for _, name := range policy.Names(digest) {
+			if len(names) > 0 && name == names[0] {
+				return digest
+			}
+		}
+	}
+
+	if len(digests) > 0 {
+		return digests[0]
+	}
+
+	return id
+}
+
+// fromFile loads the image from the archive. The archive's digest is folded
+// into the cache keys of the following steps, like the output of local_run.
+func (i *Interpreter) fromFile(image, digest string) error {
+	filename := strings.TrimPrefix(image, fileScheme)
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return errors.Wrapf(err, "reading image archive %q", filename)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	id, err := i.exec.Layers().Load(f)
+	if err != nil {
+		return errors.Wrapf(err, "loading image archive %q", filename)
+	}
+
+	if id, err = i.useID(id); err != nil {
+		return errors.Wrapf(err, "image archive %q", filename)
+	}
+
+	i.exec.Config().Image = id
+	i.baseName, i.baseID = image, id
+
+	i.addSalt(image+"\x00"+hex.EncodeToString(hash.Sum(nil)), false)
+
+	if digest != "" || i.globals.ResolveDigests {
+		if err := i.checkDigest(image, id, digest); err != nil {
+			return err
+		}
+	}
+
+	return i.VerifyBase()
+}
+
+// fromPlatform uses the entry of the multi-platform image for the platform,
+// pulled by its digest. If digest is not empty, it is the digest of the
+// manifest list the entry is selected from. The entry's digest is folded into
+// the cache keys of the following steps, so the steps on another entry of the
+// same image are not cached the same.
+func (i *Interpreter) fromPlatform(image, digest string, platform types.Platform) error {
+	if image == "scratch" || image == "" || strings.HasPrefix(image, fileScheme) {
+		return errors.Errorf("arch and variant can only select from an image in a registry, not %q", image)
+	}
+
+	resolved, err := i.exec.Layers().ResolvePlatform(image, digest, platform)
+	if err != nil {
+		return err
+	}
+
+	i.globals.Logger.Resolved(image, resolved)
+
+	if err := i.fromImage(resolved, "", types.Platform{}); err != nil {
+		return err
+	}
+
+	i.addSalt(resolved, false)
+
+	return nil
+}
+
+// fromLocal uses the image tagged by a plan in this process. Its ID is used
+// rather than the name, which may not point at it yet, or any longer.
+func (i *Interpreter) fromLocal(image, id, digest string) error {
+	id, err := i.useID(id)
+	if err != nil {
+		return errors.Wrapf(err, "image %q tagged by this build", image)
+	}
+
+	i.exec.Config().Image = id
+	i.baseName, i.baseID = image, id
+
+	if digest != "" || i.globals.ResolveDigests {
+		return i.checkDigest(image, id, digest)
+	}
+
+	return nil
+}
+
+// useID uses the image the daemon has by its ID, as the image of a loaded
+// archive or of a tag this build made. It is inspected directly rather than
+// fetched, as the pull policy is for names: an ID cannot be pulled.
+func (i *Interpreter) useID(id string) (string, error) {
+	id, err := i.exec.Layers().Lookup(i.exec.Config(), id)
+	if err != nil {
+		return "", err
+	}
+
+	layers, err := i.exec.Layers().LayerDigests(id)
+	if err != nil {
+		return "", err
+	}
+	i.exec.Layers().SetLayers(layers)
+
+	return id, nil
+}
+
+// FromList corresponds to the `from` verb when given a list of images. Each
+// image is tried in order until one can be pulled; the digest and platform,
+// if set, apply to whichever image is chosen.
+func (i *Interpreter) FromList(images []string, digest string, platform types.Platform) error {
+	if len(images) == 0 {
+		return errors.New("from requires at least one image")
+	}
+
+	failures := []string{}
+
+	for _, image := range images {
+		if err := i.From(image, digest, platform); err != nil {
+			i.globals.Logger.FromFailed(image, err)
+			failures = append(failures, fmt.Sprintf("%s: %v", image, err))
+			continue
+		}
+
+		if len(images) > 1 {
+			i.globals.Logger.FromChosen(image)
+		}
+
+		return nil
+	}
+
+	return errors.Errorf("none of the images could be used:\n\t%s", strings.Join(failures, "\n\t"))
+}
+
+// checkDigest verifies the image against the pinned digest, if any, and
+// reports the resolved digests when requested. The base image is then
+// recorded by its digest, as `name@digest`, rather than by its tag.
+func (i *Interpreter) checkDigest(image, id, digest string) error {
+	digests, err := i.exec.Layers().RepoDigests(id)
+	if err != nil {
+		return err
+	}
+
+	if digest != "" {
+		var pinned string
+
+		for _, repoDigest := range digests {
+			parts := strings.SplitN(repoDigest, "@", 2)
+			if len(parts) == 2 && parts[1] == digest {
+				pinned = repoDigest
+				break
+			}
+		}
+
+		if pinned == "" && id != digest {
+			if len(digests) == 0 {
+				return errors.Errorf("image %q has no registry digest and cannot be verified against pinned digest %q", image, digest)
+			}
+
+			return errors.Errorf("image %q does not match pinned digest %q (found %s); the tag may have moved", image, digest, strings.Join(digests, ", "))
+		}
+
+		if pinned != "" {
+			i.baseName = pinned
+		}
+	}
+
+	if i.globals.ResolveDigests {
+		for _, repoDigest := range digests {
+			i.globals.Logger.Resolved(image, repoDigest)
+		}
+
+		if digest == "" && len(digests) > 0 {
+			i.baseName = repoDigest(image, id, digests)
+		}
+	}
+
+	return nil
+}
+
+// VerifyBase checks the image given to the last `from` against the base image
+// policies of the --base-policy file and assert_base_matches. The image is
+// matched by the name it was given as and the names of its registry digests,
+// which are reported with the error. Scratch and images tagged by the plans in
+// this process, whose own bases were checked, always pass.
+func (i *Interpreter) VerifyBase() error {
+	if i.baseID == "" || (i.globals.BasePolicy == nil && i.baseRules == nil) {
+		return nil
+	}
+
+	if _, ok := lookupTag(i.baseName); ok {
+		return nil
+	}
+
+	digests, err := i.exec.Layers().RepoDigests(i.baseID)
+	if err != nil {
+		return err
+	}
+
+	names := policy.Names(i.baseName)
+	for _, digest := range digests {
+		names = append(names, policy.Names(digest)...)
+	}
+
+	ref := fmt.Sprintf("%q", i.baseName)
+	if len(digests) > 0 {
+		ref += " (" + strings.Join(digests, ", ") + ")"
+	}
+
+	for _, rules := range []*policy.Base{i.globals.BasePolicy, i.baseRules} {
+		if rules == nil {
+			continue
+		}
+
+		if err := rules.Check(ref, names); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
+
+// AssertBaseMatches corresponds to the `assert_base_matches` function. The
+// rules are added to those of earlier calls, which apply to the following
+// `from` statements, and the current base image is checked against them.
+func (i *Interpreter) AssertBaseMatches(allow, deny []string) error {
+	if i.baseRules == nil {
+		i.baseRules = &policy.Base{Source: "assert_base_matches rules"}
+	}
+
+	i.baseRules.Allow = append(i.baseRules.Allow, allow...)
+	i.baseRules.Deny = append(i.baseRules.Deny, deny...)
+
+	return i.VerifyBase()
+}
@@ -1,22 +1,32 @@
 package command
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"os/exec"
 	"path"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 // VarExists corresponds to the `var_exists` func.
 func (i *Interpreter) VarExists(key string) bool {
+	i.useVar(key)
 	_, ok := i.vars[key]
 	return ok
 }
 
-// Var corresponds to the `var` func.
+// Var corresponds to the `var` func. With --strict-vars, a variable that was
+// neither declared nor passed is recorded for CheckVars instead, and is empty.
 func (i *Interpreter) Var(key string) (string, error) {
+	if !i.useVar(key) {
+		return "", nil
+	}
+
 	val, ok := i.vars[key]
 	if !ok {
 		return "", fmt.Errorf("value for key %q does not exist", key)
@@ -25,6 +35,70 @@ func (i *Interpreter) Var(key string) (string, error) {
 	return val, nil
 }
 
+// Vars corresponds to the `vars` func. It returns a copy of the variables
+// which are set, by --var or by the defaults of `arg`. Only set variables are
+// returned, so none of them are recorded under --strict-vars.
+func (i *Interpreter) Vars() map[string]string {
+	vars := map[string]string{}
+	for key, value := range i.vars {
+		vars[key] = value
+	}
+
+	return vars
+}
+
+// Arg corresponds to the `arg` func. It declares the variable, which is set to
+// def if it was not passed and def is not nil. It returns the value and
+// whether the variable is set.
+func (i *Interpreter) Arg(key string, def *string) (string, bool) {
+	if i.declared == nil {
+		i.declared = map[string]bool{}
+	}
+	i.declared[key] = true
+
+	if _, ok := i.vars[key]; !ok && def != nil {
+		if i.vars == nil {
+			i.vars = map[string]string{}
+		}
+		i.vars[key] = *def
+	}
+
+	val, ok := i.vars[key]
+	return val, ok
+}
+
+// useVar returns false if --strict-vars is set and the variable was neither
+// declared with `arg` nor passed, recording it for CheckVars.
+func (i *Interpreter) useVar(key string) bool {
+	if !i.globals.StrictVars || i.declared[key] {
+		return true
+	}
+
+	if _, ok := i.vars[key]; ok {
+		return true
+	}
+
+	for _, name := range i.undeclared {
+		if name == key {
+			return false
+		}
+	}
+
+	i.undeclared = append(i.undeclared, key)
+	return false
+}
+
+// CheckVars returns an error naming all the variables used so far that were
+// neither declared with `arg` nor passed, if --strict-vars is set. It is
+// checked before each step, so that no step is built with them.
+func (i *Interpreter) CheckVars() error {
+	if len(i.undeclared) == 0 {
+		return nil
+	}
+
+	return errors.Errorf("the plan uses variables that are not declared with arg or passed with --var: %s", strings.Join(i.undeclared, ", "))
+}
+
 // Save corresponds to the `save` func.
 func (i *Interpreter) Save(file, kind, tag string) error {
 	if tag != "" {
@@ -51,9 +125,36 @@ func (i *Interpreter) GetEnv(arg string) string {
 	return os.Getenv(arg)
 }
 
+// LocalRun is the `local_run` function. It runs the command on the host and
+// returns its standard output. The command and its output are folded into the
+// cache key of the following steps.
+func (i *Interpreter) LocalRun(command string) (string, error) {
+	if !i.globals.AllowLocalExec {
+		return "", errors.New("local_run is disabled; pass --allow-local-exec to enable it")
+	}
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+
+	cmd := exec.CommandContext(i.globals.Context, "/bin/sh", "-c", command)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctxErr := i.globals.Context.Err(); ctxErr != nil {
+			return "", ctxErr
+		}
+
+		return "", errors.Errorf("local command %q failed: %v: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	i.addSalt(command+"\x00"+stdout.String(), true)
+
+	return stdout.String(), nil
+}
+
 // Read reads a file from inside the container, and returns its contents.
 func (i *Interpreter) Read(filename string) (string, error) {
-	content, err := i.exec.CopyOneFileFromContainer(filename)
+	content, err := i.containerContent(filename)
 	if err != nil {
 		return "", err
 	}
@@ -61,8 +162,28 @@ func (i *Interpreter) Read(filename string) (string, error) {
 	return string(content), nil
 }
 
-func (i *Interpreter) getID(id, filename, typeName string) (string, error) {
+// containerContent returns the content of a file in the current image. Each
+// read needs a container, so the files are kept until the image changes.
+func (i *Interpreter) containerContent(filename string) ([]byte, error) {
+	if image := i.exec.Config().Image; image != i.contentID {
+		i.contents, i.contentID = map[string][]byte{}, image
+	}
+
+	if content, ok := i.contents[filename]; ok {
+		return content, nil
+	}
+
 	content, err := i.exec.CopyOneFileFromContainer(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	i.contents[filename] = content
+	return content, nil
+}
+
+func (i *Interpreter) getID(id, filename, typeName string) (string, error) {
+	content, err := i.containerContent(filename)
 	if err != nil {
 		return "", err
 	}
@@ -88,6 +209,152 @@ func (i *Interpreter) GetGID(id string) (string, error) {
 	return i.getID(id, "/etc/group", "group")
 }
 
+// PathExists corresponds to the `dir_exists?` and `file_exists?` functions. It
+// returns true if the path in the current image is a directory, if dir is
+// set, or a regular file otherwise, following symlinks. Before from, there is
+// nothing to find.
+func (i *Interpreter) PathExists(filename string, dir bool) (bool, error) {
+	if i.exec.Config().Image == "" {
+		return false, nil
+	}
+
+	if !path.IsAbs(filename) {
+		return false, errors.Errorf("path %q is not absolute", filename)
+	}
+
+	mode, ok, err := i.exec.StatPath(filename)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if dir {
+		return mode.IsDir(), nil
+	}
+
+	return mode.IsRegular(), nil
+}
+
+// Check is the `check` function. It runs the command in a throwaway container
+// against the current image and fails if the command does not exit cleanly.
+func (i *Interpreter) Check(name, command string) error {
+	if err := i.hasImage(); err != nil {
+		return err
+	}
+
+	output, stat, err := i.capture(command)
+	if err != nil {
+		return errors.Wrapf(err, "validation %q could not be run", name)
+	}
+
+	if stat != 0 {
+		return errors.Errorf("validation %q failed (command %q exited with status %d): %s", name, command, stat, strings.TrimSpace(output))
+	}
+
+	i.globals.Logger.Validated(name)
+	return nil
+}
+
+// RunCapture is the `run_capture` function. It runs the command in a
+// throwaway container against the current image and returns its output and
+// exit status. A non-zero exit status is not an error.
+func (i *Interpreter) RunCapture(command string) (string, int, error) {
+	if err := i.hasImage(); err != nil {
+		return "", -1, err
+	}
+
+	output, stat, err := i.capture(command)
+	if err != nil {
+		return "", -1, errors.Wrapf(err, "run_capture %q could not be run", command)
+	}
+
+	return output, stat, nil
+}
+
+// capture runs the command with the run shell in a throwaway container
+// against the current image, and returns its output and exit status. The
+// temporary command is put back afterwards, so the next container does not
+// inherit it.
+func (i *Interpreter) capture(command string) (string, int, error) {
+	config := i.exec.Config()
+	entrypoint, cmd := config.Entrypoint.Temporary, config.Cmd.Temporary
+	defer config.TemporaryCommand(entrypoint, cmd)
+
+	config.TemporaryCommand(config.RunShell(), []string{command})
+	return i.exec.RunCapture(i.globals.Context)
+}
+
+// maxAssertOutput is how much of the output of a failed run_assert is shown.
+const maxAssertOutput = 1024
+
+// RunAssert is the `run_assert` function. It runs the command like RunCapture
+// and fails unless the output contains the string, if not empty, and matches
+// the pattern, if not nil. The error shows the output, truncated.
+func (i *Interpreter) RunAssert(command, contains string, pattern *regexp.Regexp) (string, error) {
+	output, stat, err := i.RunCapture(command)
+	if err != nil {
+		return "", err
+	}
+
+	var expected string
+	switch {
+	case contains != "" && !strings.Contains(output, contains):
+		expected = fmt.Sprintf("does not contain %q", contains)
+	case pattern != nil && !pattern.MatchString(output):
+		expected = fmt.Sprintf("does not match /%s/", pattern)
+	default:
+		return output, nil
+	}
+
+	shown := output
+	if len(shown) > maxAssertOutput {
+		shown = shown[:maxAssertOutput] + "..."
+	}
+
+	return "", errors.Errorf("run_assert %q failed: the output %s (exit status %d):\n%s", command, expected, stat, shown)
+}
+
+// Sleep is the `sleep` function. It returns early if the build is canceled.
+func (i *Interpreter) Sleep(dur time.Duration) error {
+	select {
+	case <-i.globals.Context.Done():
+		return i.globals.Context.Err()
+	case <-time.After(dur):
+		return nil
+	}
+}
+
+// WaitFor is the `wait_for` function. It runs the command in a throwaway
+// container every interval until it exits cleanly, failing once the timeout
+// has passed.
+func (i *Interpreter) WaitFor(command string, timeout, interval time.Duration) error {
+	if err := i.hasImage(); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		output, stat, err := i.capture(command)
+		if err != nil {
+			return errors.Wrapf(err, "wait_for %q could not be run", command)
+		}
+
+		if stat == 0 {
+			return nil
+		}
+
+		if time.Now().Add(interval).After(deadline) {
+			return errors.Errorf("wait_for %q timed out after %v (last exit status %d): %s", command, timeout, stat, strings.TrimSpace(output))
+		}
+
+		select {
+		case <-i.globals.Context.Done():
+			return i.globals.Context.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
 // Skip is the `skip` function.
 func (i *Interpreter) Skip(run func() error) error {
 	i.exec.Layers().SetSkipLayers(true)
@@ -0,0 +1,96 @@
+package command
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// groupRun is a run statement recorded in a run_group block.
+type groupRun struct {
+	command  string
+	cacheKey string
+}
+
+// InGroup returns true while the statements of a run_group block are
+// recorded.
+func (i *Interpreter) InGroup() bool {
+	return i.group != nil
+}
+
+// RunGroup corresponds to the `run_group` verb. The run statements in the
+// block are recorded, then run one after the other in a single container, as
+// if joined with `&&`, and committed as a single layer. The layer is cached
+// under the cache keys of all of them. If one fails, the output names it.
+func (i *Interpreter) RunGroup(block func() error) error {
+	if err := i.hasImage(); err != nil {
+		return err
+	}
+
+	if i.group != nil || i.parallel != nil {
+		return errors.New("run_group blocks cannot be nested in other run_group or parallel blocks")
+	}
+
+	i.group = []groupRun{}
+	err := block()
+	runs := i.group
+	i.group = nil
+
+	if err != nil || len(runs) == 0 {
+		return err
+	}
+
+	keys := []string{"run_group"}
+	for _, run := range runs {
+		keys = append(keys, run.cacheKey)
+	}
+	cacheKey := base64.StdEncoding.EncodeToString([]byte(strings.Join(keys, ", ")))
+
+	unlock := i.LockStep(cacheKey)
+	defer unlock()
+
+	cached, err := i.exec.Image().CheckCache(cacheKey)
+	if err != nil || cached {
+		return err
+	}
+
+	i.CacheKey = cacheKey
+	return i.Run(groupScript(runs), RunOptions{ShowRun: true})
+}
+
+// recordGroupRun records a run statement of a run_group block. Only plain
+// commands can be grouped, as the options apply to a whole container.
+func (i *Interpreter) recordGroupRun(command string, opts RunOptions) error {
+	if !opts.ShowRun || opts.hasOptions() || opts.Login || opts.Script || len(opts.Env) > 0 {
+		return errors.New("run options cannot be used in a run_group block")
+	}
+
+	if strings.HasPrefix(command, "#!") {
+		return errors.New("scripts with an interpreter cannot be used in a run_group block")
+	}
+
+	i.group = append(i.group, groupRun{command: command, cacheKey: i.CacheKey})
+	return nil
+}
+
+// groupScript returns a script running the commands in order in the same
+// shell, so a `cd` or variable carries over to the next one, as with `&&`.
+// The first command to fail stops the script with its exit status, after
+// printing which one it was.
+func groupScript(runs []groupRun) string {
+	lines := []string{}
+
+	for n, run := range runs {
+		failed := fmt.Sprintf(`printf 'run_group: command %d of %d failed with exit status %%s: %%s\n' "$rc" %s >&2`, n+1, len(runs), shellQuote(run.command))
+		lines = append(lines, fmt.Sprintf("{\n%s\n} || { rc=$?; %s; exit $rc; }", run.command, failed))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// shellQuote quotes a string for the shell with single quotes.
+func shellQuote(str string) string {
+	return "'" + strings.Replace(str, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,37 @@
+package command
+
+import "github.com/box-builder/box/types"
+
+// Inspecting returns true if the plan is inspected rather than built.
+func (i *Interpreter) Inspecting() bool {
+	return i.globals.Inspect != nil
+}
+
+// Inspect reports the current step to the inspection instead of evaluating
+// it. Steps are looked up in the cache until the first miss; the steps after
+// it would be built on a new image, so none of them can be cached.
+func (i *Interpreter) Inspect(verb string, args []string, cacheKey string) error {
+	if args == nil {
+		args = []string{}
+	}
+
+	step := types.PlannedStep{
+		Step:     i.step,
+		Verb:     verb,
+		Args:     args,
+		CacheKey: cacheKey,
+	}
+
+	if !i.inspectMiss {
+		cached, err := i.exec.Image().CheckCache(cacheKey)
+		if err != nil {
+			return err
+		}
+
+		step.Cached = cached
+		i.inspectMiss = !cached
+	}
+
+	i.globals.Inspect(step)
+	return nil
+}
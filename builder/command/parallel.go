@@ -0,0 +1,291 @@
+package command
+
+import (
+	archivetar "archive/tar"
+	"context"
+	"encoding/base64"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/box-builder/box/builder/executor"
+	"github.com/box-builder/box/tar"
+	"github.com/pkg/errors"
+)
+
+// parallelRun is a run statement recorded in a parallel block.
+type parallelRun struct {
+	command  string
+	opts     RunOptions
+	cacheKey string
+}
+
+// parallelResult is the container a parallel run was committed from, with
+// the changes it made.
+type parallelResult struct {
+	id      string
+	changes []executor.Change
+	err     error
+}
+
+// InParallel returns true while the statements of a parallel block are
+// recorded.
+func (i *Interpreter) InParallel() bool {
+	return i.parallel != nil
+}
+
+// Parallel corresponds to the `parallel` verb. The run statements in the block
+// are recorded, and a container off the current image is created for each in
+// turn. Only the commands themselves run concurrently, at most --concurrency
+// at a time; once all have exited, their changes are copied out and merged
+// into a single layer by one commit, in the order of the statements. The
+// layer is cached under the cache keys of all of them. If two statements
+// change the same path, they are run again one after the other instead.
+func (i *Interpreter) Parallel(block func() error) error {
+	if err := i.hasImage(); err != nil {
+		return err
+	}
+
+	if i.parallel != nil || i.group != nil {
+		return errors.New("parallel blocks cannot be nested in other parallel or run_group blocks")
+	}
+
+	i.parallel = []parallelRun{}
+	err := block()
+	runs := i.parallel
+	i.parallel = nil
+
+	if err != nil || len(runs) == 0 {
+		return err
+	}
+
+	keys := []string{"parallel"}
+	for _, run := range runs {
+		keys = append(keys, run.cacheKey)
+	}
+	cacheKey := base64.StdEncoding.EncodeToString([]byte(strings.Join(keys, ", ")))
+
+	unlock := i.LockStep(cacheKey)
+	defer unlock()
+
+	cached, err := i.exec.Image().CheckCache(cacheKey)
+	if err != nil || cached {
+		return err
+	}
+
+	results := i.startParallel(runs)
+	defer func() {
+		for _, result := range results {
+			if result.id != "" {
+				i.exec.Destroy(result.id)
+			}
+		}
+	}()
+
+	for _, result := range results {
+		if result.err != nil {
+			return result.err
+		}
+	}
+
+	copies, deletes, conflict := mergeChanges(results)
+	if conflict != "" {
+		i.globals.Logger.Warning("parallel runs both changed " + conflict + "; running them in order")
+		return i.runSequential(runs)
+	}
+
+	if len(deletes) > 0 {
+		config := i.exec.Config()
+		config.TemporaryCommand([]string{"rm", "-rf", "--"}, deletes)
+
+		user := config.User.Temporary
+		config.User.Temporary = "root"
+		defer func() { config.User.Temporary = user }()
+	}
+
+	hook := func(ctx context.Context, id string) error {
+		r, w := io.Pipe()
+		go func() {
+			w.CloseWithError(i.archiveChanges(results, copies, w))
+		}()
+		defer r.Close()
+
+		if err := i.exec.CopyToContainer(id, r); err != nil {
+			return err
+		}
+
+		if len(deletes) > 0 {
+			return i.exec.RunHook(ctx, id)
+		}
+
+		return nil
+	}
+
+	i.CacheKey = cacheKey
+	return i.exec.Commit(cacheKey, hook)
+}
+
+// startParallel creates a container for each run in turn, as they share the
+// executor's configuration, then runs them concurrently. Their output is not
+// shown, as it would be interleaved.
+func (i *Interpreter) startParallel(runs []parallelRun) []*parallelResult {
+	results := make([]*parallelResult, len(runs))
+	for n := range results {
+		results[n] = &parallelResult{}
+	}
+
+	for n, run := range runs {
+		if err := i.runCommand(run.command, run.opts); err != nil {
+			results[n].err = err
+			return results
+		}
+
+		if results[n].id, results[n].err = i.exec.Create(); results[n].err != nil {
+			return results
+		}
+	}
+
+	state := i.globals.ShowRun
+	i.globals.ShowRun = false
+	defer func() { i.globals.ShowRun = state }()
+
+	limit := i.globals.Concurrency
+	if limit <= 0 {
+		limit = len(runs)
+	}
+	slots := make(chan struct{}, limit)
+
+	wg := new(sync.WaitGroup)
+	for _, result := range results {
+		wg.Add(1)
+		go func(result *parallelResult) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			if result.err = i.exec.RunHook(i.globals.Context, result.id); result.err == nil {
+				result.changes, result.err = i.exec.Changes(result.id)
+			}
+		}(result)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// runSequential runs the recorded statements as if there were no parallel
+// block, each committed and cached on its own.
+func (i *Interpreter) runSequential(runs []parallelRun) error {
+	for _, run := range runs {
+		cached, err := i.exec.Image().CheckCache(run.cacheKey)
+		if err != nil {
+			return err
+		}
+
+		if cached {
+			continue
+		}
+
+		i.CacheKey = run.cacheKey
+		if err := i.Run(run.command, run.opts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeChanges returns the paths to copy from each container of a parallel
+// block, and the paths to delete, in order. Paths within an added directory
+// are left to the copy of the directory. Modified directories, whose contents
+// are copied separately, are copied without them; the last one wins. If a
+// path, or a path within it, was changed by more than one container, it is
+// returned as the conflict.
+func mergeChanges(results []*parallelResult) ([][]executor.Change, []string, string) {
+	copies := make([][]executor.Change, len(results))
+	deletes := []string{}
+	owners := map[string]int{}  // changed paths, by container
+	parents := map[string]int{} // directories holding changed paths, by container
+
+	for n, result := range results {
+		changed := map[string]struct{}{}
+
+		for _, change := range result.changes {
+			if change.Kind == executor.Modified && change.Dir {
+				copies[n] = append(copies[n], change)
+				continue
+			}
+
+			if within(change.Path, changed) {
+				continue
+			}
+			changed[change.Path] = struct{}{}
+
+			if owner, ok := owners[change.Path]; ok && owner != n {
+				return nil, nil, change.Path
+			}
+
+			if owner, ok := parents[change.Path]; ok && owner != n {
+				return nil, nil, change.Path
+			}
+
+			for dir := path.Dir(change.Path); dir != "/" && dir != "."; dir = path.Dir(dir) {
+				if owner, ok := owners[dir]; ok && owner != n {
+					return nil, nil, dir
+				}
+
+				if _, ok := parents[dir]; !ok {
+					parents[dir] = n
+				}
+			}
+
+			owners[change.Path] = n
+
+			if change.Kind == executor.Deleted {
+				deletes = append(deletes, change.Path)
+			} else {
+				copies[n] = append(copies[n], change)
+			}
+		}
+	}
+
+	return copies, deletes, ""
+}
+
+// within returns true if a parent directory of the path is in the set.
+func within(name string, set map[string]struct{}) bool {
+	for dir := path.Dir(name); dir != "/" && dir != "."; dir = path.Dir(dir) {
+		if _, ok := set[dir]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// archiveChanges writes the copied paths of each container to w as a single
+// archive, in order, to be extracted at the root of the merged layer.
+func (i *Interpreter) archiveChanges(results []*parallelResult, copies [][]executor.Change, w io.Writer) error {
+	tw := archivetar.NewWriter(w)
+
+	for n, changes := range copies {
+		for _, change := range changes {
+			r, _, err := i.exec.CopyFromContainer(results[n].id, change.Path)
+			if err != nil {
+				return err
+			}
+
+			err = tar.Rebase(r, tw, path.Dir(change.Path), change.Dir)
+			if closer, ok := r.(io.Closer); ok {
+				closer.Close()
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tw.Close()
+}
@@ -1,18 +1,425 @@
 package command
 
-// Run corresponds to the `run` verb
-func (i *Interpreter) Run(command string, showRun bool) error {
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RunOptions are the options to the `run` verb.
+type RunOptions struct {
+	ShowRun     bool              // show the output of the command
+	CacheMounts []string          // paths backed by persistent volumes while the command runs; their contents are not part of the image
+	StopTimeout time.Duration     // time the command has to exit after its stop signal if the build is canceled; zero uses the container's stop timeout
+	Env         map[string]string // variables set for this command only, overriding the image's
+	AllowExit   []int             // exit statuses that do not fail the step; if empty, only 0
+	Privileged  bool              // run the container privileged; requires --allow-privileged
+	CapAdd      []string          // capabilities added to the container
+	CapDrop     []string          // capabilities dropped from the container
+	Login       bool              // run the command in a login shell, which sources the image's profile
+	Binds       []Bind            // host paths mounted into the container; requires --allow-bind
+	Tmpfs       []string          // tmpfs mounts of the container, as path[:options]; their contents are not part of the image
+	Stdin       *string           // if set, written to the standard input of the command, which is then closed
+	ReadOnly    bool              // run the container with a read-only root filesystem
+	Writable    []string          // paths which can still be written with ReadOnly; their contents are not part of the image
+	Commit      bool              // commit a layer even if the command changes nothing
+	Script      bool              // the command is a script read from a file, run as a script even if it is one line
+	Nice        *int              // if set, the cpu niceness of the container, from 0 to 19
+	IONice      *int              // if set, the I/O niceness of the container, from 0 to 7
+}
+
+// hasOptions returns true if any of the options which change the container of
+// the run, or its commit, are set.
+func (opts RunOptions) hasOptions() bool {
+	return len(opts.CacheMounts) > 0 || opts.StopTimeout != 0 || len(opts.AllowExit) > 0 || opts.Privileged || len(opts.CapAdd) > 0 || len(opts.CapDrop) > 0 || len(opts.Binds) > 0 || len(opts.Tmpfs) > 0 || opts.Stdin != nil || opts.Commit || opts.ReadOnly || opts.Nice != nil || opts.IONice != nil
+}
+
+// Bind is a host path bind-mounted into the container of a run. It is not
+// committed, and only its target is part of the cache key.
+type Bind struct {
+	Source   string // the absolute path on the host
+	Target   string // the absolute path in the container
+	ReadOnly bool
+}
+
+// String returns the bind in the src:dst[:ro] form docker uses.
+func (b Bind) String() string {
+	if b.ReadOnly {
+		return b.Source + ":" + b.Target + ":ro"
+	}
+
+	return b.Source + ":" + b.Target
+}
+
+// Run corresponds to the `run` verb. Multi-line commands are run as a script.
+func (i *Interpreter) Run(command string, opts RunOptions) error {
 	if err := i.hasImage(); err != nil {
 		return err
 	}
 
-	i.exec.Config().TemporaryCommand([]string{"/bin/sh", "-c"}, []string{command})
+	if i.group != nil {
+		return i.recordGroupRun(command, opts)
+	}
+
+	if i.parallel != nil {
+		if opts.hasOptions() {
+			return errors.New("cache_mount, stop_timeout, allow_exit, privileged, cap_add, cap_drop, bind, tmpfs, stdin, commit, readonly_rootfs, nice and ionice cannot be used in a parallel block")
+		}
+
+		// the script would be the standard input of every container.
+		if isScript(command, opts) && strings.HasPrefix(command, "#!") {
+			return errors.New("scripts with an interpreter cannot be used in a parallel block")
+		}
+
+		i.parallel = append(i.parallel, parallelRun{command: command, opts: opts, cacheKey: i.CacheKey})
+		return nil
+	}
+
+	if opts.StopTimeout != 0 {
+		i.exec.Config().StopGrace = opts.StopTimeout
+		defer func() { i.exec.Config().StopGrace = 0 }()
+	}
+
+	if len(opts.AllowExit) > 0 {
+		i.exec.Config().AllowExit = opts.AllowExit
+		defer func() { i.exec.Config().AllowExit = nil }()
+	}
+
+	// privileges apply to the step's container only; they are not part of
+	// the image, nor of the cache key.
+	if opts.Privileged {
+		if !i.globals.AllowPrivileged {
+			return errors.New("run with privileged: true is disabled; pass --allow-privileged to enable it")
+		}
+
+		i.exec.Config().Privileged = true
+		defer func() { i.exec.Config().Privileged = false }()
+	}
+
+	// added capabilities can grant as much as a privileged container, so
+	// they are gated alike. Dropping them only takes privileges away.
+	if len(opts.CapAdd) > 0 && !i.globals.AllowPrivileged {
+		return errors.New("run with cap_add is disabled; pass --allow-privileged to enable it")
+	}
+
+	if len(opts.CapAdd) > 0 || len(opts.CapDrop) > 0 {
+		i.exec.Config().CapAdd, i.exec.Config().CapDrop = opts.CapAdd, opts.CapDrop
+		defer func() { i.exec.Config().CapAdd, i.exec.Config().CapDrop = nil, nil }()
+	}
+
+	if len(opts.Binds) > 0 {
+		binds, err := i.binds(opts.Binds)
+		if err != nil {
+			return err
+		}
+
+		i.exec.Config().Binds = binds
+		defer func() { i.exec.Config().Binds = nil }()
+	}
 
-	if i.globals.ShowRun == true && !showRun {
+	if len(opts.Tmpfs) > 0 {
+		tmpfs, err := parseTmpfs(opts.Tmpfs)
+		if err != nil {
+			return err
+		}
+
+		i.exec.Config().Tmpfs = tmpfs
+		defer func() { i.exec.Config().Tmpfs = nil }()
+	}
+
+	if len(opts.Writable) > 0 && !opts.ReadOnly {
+		return errors.New("writable can only be used with readonly_rootfs: true")
+	}
+
+	// the root filesystem cannot change, so the step adds no layer, but
+	// makes sure the command writes nothing outside the writable paths.
+	if opts.ReadOnly {
+		for _, p := range opts.Writable {
+			if !path.IsAbs(p) {
+				return errors.Errorf("writable path %q is not absolute", p)
+			}
+		}
+
+		i.exec.Config().ReadOnly, i.exec.Config().Writable = true, opts.Writable
+		defer func() { i.exec.Config().ReadOnly, i.exec.Config().Writable = false, nil }()
+	}
+
+	// like privileges, the priority is not part of the image or the cache key.
+	if opts.Nice != nil {
+		if *opts.Nice < 0 || *opts.Nice > 19 {
+			return errors.Errorf("nice %d is out of range; expected 0 to 19", *opts.Nice)
+		}
+
+		i.exec.Config().Nice = opts.Nice
+		defer func() { i.exec.Config().Nice = nil }()
+	}
+
+	if opts.IONice != nil {
+		if *opts.IONice < 0 || *opts.IONice > 7 {
+			return errors.Errorf("ionice %d is out of range; expected 0 to 7", *opts.IONice)
+		}
+
+		i.exec.Config().IONice = opts.IONice
+		defer func() { i.exec.Config().IONice = nil }()
+	}
+
+	// a script with an interpreter is also given on the standard input.
+	if opts.Stdin != nil {
+		i.exec.Config().Stdin = []byte(*opts.Stdin)
+	}
+	defer func() { i.exec.Config().Stdin = nil }()
+
+	cacheMounts := opts.CacheMounts
+	if len(cacheMounts) > 0 {
+		for _, mount := range cacheMounts {
+			if !path.IsAbs(mount) {
+				return errors.Errorf("cache mount %q is not an absolute path", mount)
+			}
+		}
+
+		unlock := lockMounts(cacheMounts)
+		defer unlock()
+
+		i.exec.Config().Mounts = cacheMounts
+		defer func() { i.exec.Config().Mounts = nil }()
+	}
+
+	if err := i.runCommand(command, opts); err != nil {
+		return err
+	}
+
+	// a command which changes nothing, such as a check, adds no layer.
+	i.exec.Config().SkipEmpty = !opts.Commit
+	defer func() { i.exec.Config().SkipEmpty = false }()
+
+	if i.globals.ShowRun == true && !opts.ShowRun {
 		state := i.globals.ShowRun
-		i.globals.ShowRun = showRun
+		i.globals.ShowRun = opts.ShowRun
 		defer func() { i.globals.ShowRun = state }()
 	}
 
 	return i.makeLayer(true)
 }
+
+// binds checks the binds of a run and returns them in docker's form.
+func (i *Interpreter) binds(binds []Bind) ([]string, error) {
+	if !i.globals.AllowBind {
+		return nil, errors.New("run with bind is disabled; pass --allow-bind to enable it")
+	}
+
+	if i.exec.Config().OS == "windows" {
+		return nil, errors.New("run bind is not supported for windows images")
+	}
+
+	result := []string{}
+
+	for _, bind := range binds {
+		if !filepath.IsAbs(bind.Source) {
+			return nil, errors.Errorf("bind source %q is not an absolute path", bind.Source)
+		}
+
+		if !path.IsAbs(bind.Target) {
+			return nil, errors.Errorf("bind target %q is not an absolute path", bind.Target)
+		}
+
+		if _, err := os.Stat(bind.Source); err != nil {
+			return nil, errors.Wrap(err, "invalid bind source")
+		}
+
+		result = append(result, bind.String())
+	}
+
+	return result, nil
+}
+
+// tmpfsFlags are the mount options of tmpfs mounts which take no value.
+var tmpfsFlags = map[string]bool{
+	"ro": true, "rw": true,
+	"exec": true, "noexec": true,
+	"suid": true, "nosuid": true,
+	"dev": true, "nodev": true,
+}
+
+// tmpfsSize matches the size of a tmpfs: bytes, with an optional k, m or g
+// suffix, or a percentage of the memory.
+var tmpfsSize = regexp.MustCompile(`^[0-9]+([kKmMgG%]?)$`)
+
+// parseTmpfs checks the tmpfs mounts of a run, given as path[:options] such as
+// `/tmp:size=1g,mode=1777`, and returns their options by path.
+func parseTmpfs(specs []string) (map[string]string, error) {
+	tmpfs := map[string]string{}
+
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, ":", 2)
+		target := parts[0]
+
+		if !path.IsAbs(target) {
+			return nil, errors.Errorf("tmpfs %q is not mounted at an absolute path", spec)
+		}
+
+		if _, ok := tmpfs[target]; ok {
+			return nil, errors.Errorf("tmpfs %q is mounted more than once", target)
+		}
+
+		var options string
+		if len(parts) == 2 {
+			options = parts[1]
+
+			for _, option := range strings.Split(options, ",") {
+				kv := strings.SplitN(option, "=", 2)
+
+				if len(kv) == 1 {
+					if !tmpfsFlags[option] {
+						return nil, errors.Errorf("invalid tmpfs option %q in %q", option, spec)
+					}
+					continue
+				}
+
+				var valid bool
+				switch kv[0] {
+				case "size":
+					valid = tmpfsSize.MatchString(kv[1])
+				case "mode":
+					_, err := strconv.ParseUint(kv[1], 8, 32)
+					valid = err == nil
+				case "uid", "gid", "nr_inodes", "nr_blocks":
+					_, err := strconv.ParseUint(kv[1], 10, 64)
+					valid = err == nil
+				default:
+					return nil, errors.Errorf("invalid tmpfs option %q in %q", kv[0], spec)
+				}
+
+				if !valid {
+					return nil, errors.Errorf("invalid value %q for tmpfs option %s in %q", kv[1], kv[0], spec)
+				}
+			}
+		}
+
+		tmpfs[target] = options
+	}
+
+	return tmpfs, nil
+}
+
+// runCommand sets up the command, with the variables set for it only, as the
+// temporary command of the container.
+func (i *Interpreter) runCommand(command string, opts RunOptions) error {
+	if opts.Login && i.exec.Config().OS == "windows" {
+		return errors.New("run login is not supported for windows images")
+	}
+
+	if isScript(command, opts) && i.exec.Config().OS == "windows" {
+		return errors.New("multi-line run scripts are not supported for windows images")
+	}
+
+	if isScript(command, opts) && strings.HasPrefix(command, "#!") {
+		if err := i.runInterpreter(command, opts.Login); err != nil {
+			return err
+		}
+	} else if opts.Login {
+		shell, err := i.exec.Config().LoginShell()
+		if err != nil {
+			return err
+		}
+
+		i.exec.Config().TemporaryCommand(shell, []string{command})
+	} else {
+		i.exec.Config().TemporaryCommand(i.exec.Config().RunShell(), []string{command})
+	}
+
+	// the variables of build_env come first, so those given to the run
+	// override them.
+	env := map[string]string{}
+	for key, value := range i.buildEnv {
+		env[key] = value
+	}
+
+	for key, value := range opts.Env {
+		env[key] = value
+	}
+
+	if len(env) > 0 {
+		return i.runEnv(env)
+	}
+
+	return nil
+}
+
+// isScript returns true if the command is a script: read from a file, or on
+// several lines. Scripts are run by the configured shell like any command,
+// unless they start with `#!`.
+func isScript(command string, opts RunOptions) bool {
+	return opts.Script || strings.Contains(command, "\n")
+}
+
+// runInterpreter sets up the command to run a script starting with `#!` with
+// the interpreter it names, and its argument if any, like the kernel would.
+// The script is read from standard input, so nothing is written to the
+// container. With login, the interpreter is started by a login shell, so the
+// script inherits the environment of the image's profile.
+func (i *Interpreter) runInterpreter(script string, login bool) error {
+	config := i.exec.Config()
+
+	if config.Stdin != nil {
+		return errors.New("stdin cannot be given to a script starting with #!, which is read from standard input")
+	}
+
+	line := strings.TrimSpace(strings.TrimPrefix(strings.SplitN(script, "\n", 2)[0], "#!"))
+	if line == "" {
+		return errors.New("script starting with #! names no interpreter")
+	}
+
+	command := []string{line}
+	if n := strings.IndexAny(line, " \t"); n > 0 {
+		command = []string{line[:n], strings.TrimSpace(line[n:])}
+	}
+	command = append(command, "/dev/stdin")
+
+	if login {
+		shell, err := config.LoginShell()
+		if err != nil {
+			return err
+		}
+
+		// the -c command sees the interpreter as $0 and the rest as "$@".
+		config.TemporaryCommand(shell, append([]string{`exec "$0" "$@"`}, command...))
+	} else {
+		config.TemporaryCommand(command[:1], command[1:])
+	}
+
+	config.Stdin = []byte(script)
+	return nil
+}
+
+// runEnv sets variables for the command only by running it through env(1).
+// Setting them on the container instead would leak them into the image, as
+// docker merges the container's environment into the committed config.
+func (i *Interpreter) runEnv(env map[string]string) error {
+	config := i.exec.Config()
+
+	if config.OS == "windows" {
+		return errors.New("run env is not supported for windows images")
+	}
+
+	keys := []string{}
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	entrypoint := []string{"env"}
+	for _, key := range keys {
+		entrypoint = append(entrypoint, fmt.Sprintf("%s=%s", key, env[key]))
+	}
+
+	config.Entrypoint.Temporary = append(entrypoint, config.Entrypoint.Temporary...)
+	return nil
+}
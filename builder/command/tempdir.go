@@ -0,0 +1,46 @@
+package command
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/box-builder/box/signal"
+)
+
+// TempDir returns the build's temporary directory, creating it on first use.
+// Steps that need scratch space on the host use it, so that whatever they
+// leave behind is removed with it by RemoveTempDir, or when the build is
+// canceled.
+func (i *Interpreter) TempDir() (string, error) {
+	if i.tempDir != "" {
+		return i.tempDir, nil
+	}
+
+	dir, err := ioutil.TempDir("", "box-build-")
+	if err != nil {
+		return "", err
+	}
+
+	signal.Handler.AddFile(dir)
+	i.tempDir = dir
+	return dir, nil
+}
+
+// TempDirPath returns the path of the build's temporary directory, or an empty
+// string if it was not created.
+func (i *Interpreter) TempDirPath() string {
+	return i.tempDir
+}
+
+// RemoveTempDir removes the build's temporary directory and its contents, if
+// it was created.
+func (i *Interpreter) RemoveTempDir() error {
+	if i.tempDir == "" {
+		return nil
+	}
+
+	dir := i.tempDir
+	i.tempDir = ""
+	signal.Handler.RemoveFile(dir)
+	return os.RemoveAll(dir)
+}
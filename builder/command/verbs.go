@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -20,6 +21,16 @@ func (i *Interpreter) hasImage() error {
 	return nil
 }
 
+// RequireImage returns an error naming the verb or func if from has not been
+// called yet, for those which need an image.
+func (i *Interpreter) RequireImage(name string) error {
+	if i.exec.Config().Image == "" {
+		return errors.Wrapf(ErrNoImage, "%s cannot be used before from; call from first to set the base image", name)
+	}
+
+	return nil
+}
+
 // Label corresponds to the `label` verb.
 func (i *Interpreter) Label(labelMap map[string]string) error {
 	if err := i.hasImage(); err != nil {
@@ -52,6 +63,28 @@ func (i *Interpreter) Debug(shell string) error {
 	return i.makeLayer(true)
 }
 
+// Attach runs an interactive shell in a container from the current image,
+// like the `debug` verb, but removes the container afterwards instead of
+// committing it.
+func (i *Interpreter) Attach(shell string) error {
+	if err := i.hasImage(); err != nil {
+		return err
+	}
+
+	i.exec.SetStdin(true)
+	defer i.exec.SetStdin(false)
+
+	i.exec.Config().TemporaryCommand([]string{}, []string{shell})
+
+	id, err := i.exec.Create()
+	if err != nil {
+		return err
+	}
+	defer i.exec.Destroy(id)
+
+	return i.exec.RunHook(i.globals.Context, id)
+}
+
 // SetExec corresponds to the `set_exec` verb.
 func (i *Interpreter) SetExec(execTargets map[string][]string) error {
 	if err := i.hasImage(); err != nil {
@@ -106,7 +139,17 @@ func (i *Interpreter) Tag(name string) error {
 	if err := i.exec.Commit("", nil); err != nil {
 		return err
 	}
-	return i.exec.Image().Tag(name)
+
+	if err := i.CheckTag(name); err != nil {
+		return err
+	}
+
+	if err := i.exec.Image().Tag(name); err != nil {
+		return err
+	}
+
+	registerTag(name, i.exec.Image().ImageID())
+	return nil
 }
 
 // Entrypoint is the `entrypoint` verb.
@@ -166,34 +209,95 @@ func (i *Interpreter) Inside(p string, run func() error) error {
 	return run()
 }
 
-// Env corresponds to the `env` verb.
-func (i *Interpreter) Env(env map[string]string) error {
+// Env corresponds to the `env` and `unenv` verbs. The variables in unset are
+// removed from the environment, rather than set to an empty value.
+func (i *Interpreter) Env(env map[string]string, unset []string) error {
 	if err := i.hasImage(); err != nil {
 		return err
 	}
 
+	// existing variables keep their position and new ones are appended in
+	// sorted order, so the resulting config is the same on every build.
+	keys := []string{}
 	newEnv := map[string]string{}
 
 	for _, part := range i.exec.Config().Env {
 		parts := strings.SplitN(part, "=", 2)
+		if _, ok := newEnv[parts[0]]; !ok {
+			keys = append(keys, parts[0])
+		}
 		newEnv[parts[0]] = parts[1]
 	}
 
-	for key, value := range env {
-		newEnv[key] = value
+	added := []string{}
+	for key := range env {
+		if _, ok := newEnv[key]; !ok {
+			added = append(added, key)
+		}
+		newEnv[key] = env[key]
+	}
+
+	sort.Strings(added)
+	keys = append(keys, added...)
+
+	removed := false
+	for _, key := range unset {
+		if _, ok := newEnv[key]; ok {
+			removed = true
+		}
+		delete(newEnv, key)
 	}
 
 	rebuiltEnv := []string{}
 
-	for key, value := range newEnv {
-		rebuiltEnv = append(rebuiltEnv, fmt.Sprintf("%s=%s", key, value))
+	for _, key := range keys {
+		if _, ok := newEnv[key]; !ok {
+			continue
+		}
+
+		rebuiltEnv = append(rebuiltEnv, fmt.Sprintf("%s=%s", key, newEnv[key]))
 	}
 
 	i.exec.Config().Env = rebuiltEnv
 
+	if removed {
+		return i.commitConfig()
+	}
+
 	return i.makeLayer(false)
 }
 
+// BuildEnv corresponds to the `build_env` verb. The variables are set for the
+// commands of the following runs, but are not committed to the image's config.
+// As the image does not record them, they are folded into the cache keys of
+// the following steps instead.
+func (i *Interpreter) BuildEnv(env map[string]string) error {
+	if err := i.hasImage(); err != nil {
+		return err
+	}
+
+	if i.buildEnv == nil {
+		i.buildEnv = map[string]string{}
+	}
+
+	keys := []string{}
+	for key := range env {
+		keys = append(keys, key)
+		i.buildEnv[key] = env[key]
+	}
+
+	sort.Strings(keys)
+
+	vars := []string{}
+	for _, key := range keys {
+		vars = append(vars, fmt.Sprintf("%s=%s", key, env[key]))
+	}
+
+	i.addSalt("build_env\x00"+strings.Join(vars, "\x00"), false)
+
+	return nil
+}
+
 // Cmd corresponds to the `cmd` verb.
 func (i *Interpreter) Cmd(cmds []string) error {
 	if err := i.hasImage(); err != nil {
@@ -203,3 +307,13 @@ func (i *Interpreter) Cmd(cmds []string) error {
 	i.exec.Config().Cmd.Image = cmds
 	return i.makeLayer(false)
 }
+
+// Shell corresponds to the `shell` verb.
+func (i *Interpreter) Shell(shell []string) error {
+	if err := i.hasImage(); err != nil {
+		return err
+	}
+
+	i.exec.Config().Shell = shell
+	return i.makeLayer(false)
+}
@@ -0,0 +1,197 @@
+package command
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var versionRegexp = regexp.MustCompile(`^v?([0-9]+)(?:\.([0-9]+))?(?:\.([0-9]+))?(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+// version is a semantic version. Components missing from the string are zero
+// and are recorded in parts, which the `~>` constraint relies on.
+type version struct {
+	numbers [3]int
+	pre     string
+	parts   int
+}
+
+type versionConstraint struct {
+	op      string
+	version version
+}
+
+// BoxVersion corresponds to the `box_version` func. The constraint is a comma
+// separated list of versions, each preceded by one of `=`, `!=`, `>`, `>=`,
+// `<`, `<=` or `~>`, all of which the running box must satisfy. A plain
+// version is the same as `=`. Builds of box which are not releases, such as
+// those made from a git commit, satisfy every constraint with a warning.
+func (i *Interpreter) BoxVersion(constraint string) error {
+	constraints, err := parseConstraints(constraint)
+	if err != nil {
+		return err
+	}
+
+	running, err := parseVersion(i.globals.Version)
+	if err != nil {
+		i.globals.Logger.Warning(fmt.Sprintf("box version %q is not a release; not checking box_version %q", i.globals.Version, constraint))
+		return nil
+	}
+
+	for _, c := range constraints {
+		if !c.match(running) {
+			return errors.Errorf("this plan requires box %s, but this is box %s", constraint, i.globals.Version)
+		}
+	}
+
+	return nil
+}
+
+func parseConstraints(constraint string) ([]versionConstraint, error) {
+	constraints := []versionConstraint{}
+
+	for _, str := range strings.Split(constraint, ",") {
+		str = strings.TrimSpace(str)
+
+		c := versionConstraint{op: "="}
+		for _, op := range []string{"~>", ">=", "<=", "!=", "=", ">", "<"} {
+			if strings.HasPrefix(str, op) {
+				c.op = op
+				str = strings.TrimSpace(strings.TrimPrefix(str, op))
+				break
+			}
+		}
+
+		v, err := parseVersion(str)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid box_version constraint %q", constraint)
+		}
+
+		c.version = v
+		constraints = append(constraints, c)
+	}
+
+	return constraints, nil
+}
+
+func parseVersion(str string) (version, error) {
+	var v version
+
+	match := versionRegexp.FindStringSubmatch(str)
+	if match == nil {
+		return v, errors.Errorf("%q is not a version", str)
+	}
+
+	for n, number := range match[1:4] {
+		if number == "" {
+			break
+		}
+
+		var err error
+		if v.numbers[n], err = strconv.Atoi(number); err != nil {
+			return v, errors.Errorf("%q is not a version", str)
+		}
+		v.parts++
+	}
+
+	v.pre = match[4]
+	return v, nil
+}
+
+func (c versionConstraint) match(v version) bool {
+	cmp := v.compare(c.version)
+
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case "~>":
+		// ~> 0.5 allows any 0.x from 0.5, ~> 0.5.1 any 0.5.x from 0.5.1.
+		if cmp < 0 {
+			return false
+		}
+
+		fixed := c.version.parts - 1
+		if fixed < 1 {
+			fixed = 1
+		}
+
+		for n := 0; n < fixed; n++ {
+			if v.numbers[n] != c.version.numbers[n] {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// compare returns -1, 0 or 1 as v is lower than, equal to or greater than
+// other. A pre-release is lower than the release, and pre-releases are
+// compared by their dot separated identifiers, numerically where both are
+// numbers.
+func (v version) compare(other version) int {
+	for n := range v.numbers {
+		if v.numbers[n] != other.numbers[n] {
+			return sign(v.numbers[n] - other.numbers[n])
+		}
+	}
+
+	switch {
+	case v.pre == other.pre:
+		return 0
+	case v.pre == "":
+		return 1
+	case other.pre == "":
+		return -1
+	}
+
+	ids, otherIDs := strings.Split(v.pre, "."), strings.Split(other.pre, ".")
+	for n := 0; n < len(ids) && n < len(otherIDs); n++ {
+		if ids[n] == otherIDs[n] {
+			continue
+		}
+
+		a, aErr := strconv.Atoi(ids[n])
+		b, bErr := strconv.Atoi(otherIDs[n])
+		switch {
+		case aErr == nil && bErr == nil:
+			return sign(a - b)
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		case ids[n] < otherIDs[n]:
+			return -1
+		default:
+			return 1
+		}
+	}
+
+	return sign(len(ids) - len(otherIDs))
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,89 @@
+package command
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/box-builder/box/tar"
+	"github.com/box-builder/box/util"
+	"github.com/pkg/errors"
+)
+
+// Write corresponds to the `write` verb. It creates the file at target with
+// the content, mode and owner, which is a user or user:group by name or
+// number. Missing parent directories are created. No command is run in the
+// container, so this works for images without a shell.
+func (i *Interpreter) Write(target, content string, mode os.FileMode, owner string) error {
+	if err := i.hasImage(); err != nil {
+		return err
+	}
+
+	uid, gid, err := i.parseOwner(owner)
+	if err != nil {
+		return err
+	}
+
+	modTime := time.Now()
+	if i.globals.Reproducible {
+		modTime = util.SourceDate()
+	}
+
+	buf, err := tar.ArchiveFile(tar.File{
+		Name:    target,
+		Content: []byte(content),
+		Mode:    mode,
+		UID:     uid,
+		GID:     gid,
+		ModTime: modTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	hook := func(ctx context.Context, id string) error {
+		return i.exec.CopyToContainer(id, buf)
+	}
+
+	return i.exec.Commit(i.CacheKey, hook)
+}
+
+// parseOwner returns the uid and gid for a user or user:group. Names are
+// looked up in the image; the group defaults to gid 0.
+func (i *Interpreter) parseOwner(owner string) (int, int, error) {
+	if owner == "" {
+		return 0, 0, nil
+	}
+
+	parts := strings.SplitN(owner, ":", 2)
+
+	uid, err := i.lookupID(parts[0], i.GetUID)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "invalid owner %q", owner)
+	}
+
+	var gid int
+	if len(parts) == 2 {
+		gid, err = i.lookupID(parts[1], i.GetGID)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "invalid owner %q", owner)
+		}
+	}
+
+	return uid, gid, nil
+}
+
+func (i *Interpreter) lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(id)
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"path"
 	"time"
 
 	"github.com/docker/docker/api/types/container"
@@ -20,6 +21,16 @@ type StringState struct {
 	Image     string
 }
 
+// DefaultShell returns the shell used for shell-form commands, such as `run`,
+// for the provided operating system when no shell has been configured.
+func DefaultShell(os string) []string {
+	if os == "windows" {
+		return []string{"cmd", "/S", "/C"}
+	}
+
+	return []string{"/bin/sh", "-c"}
+}
+
 // Config is a basic configuration of an image at each step. It is kept in sync
 // by commit routines in the executor. Setting properties here will propagate
 // them to various image-manipulating command when needed.
@@ -32,6 +43,22 @@ type Config struct {
 	Env        []string          // Environment variables
 	Volumes    []string          // Volume paths
 	Labels     map[string]string // Image Labels
+	Shell      []string          // Shell for shell-form commands; if empty, the OS default is used.
+	OS         string            // Operating system of the image, as reported by the executor.
+	Mounts     []string          // Cache mount paths for the current step, backed by persistent volumes; never committed.
+	StopGrace  time.Duration     // Time a canceled step has to exit after its stop signal before it is killed; if zero, the container's stop timeout applies.
+	AllowExit  []int             // Exit statuses of the current step's command that do not fail it; if empty, only 0.
+	Privileged bool              // Run the current step's container privileged; never committed.
+	CapAdd     []string          // Capabilities added to the current step's container; never committed.
+	CapDrop    []string          // Capabilities dropped from the current step's container; never committed.
+	Binds      []string          // Host paths bind-mounted into the current step's container, as src:dst[:ro]; never committed.
+	Tmpfs      map[string]string // tmpfs mounts of the current step's container, by path, with their mount options; never committed.
+	ReadOnly   bool              // Run the current step's container with a read-only root filesystem; never committed.
+	Writable   []string          // Paths of the current step's read-only container backed by volumes holding the image's files there, so they can be written; never committed.
+	Stdin      []byte            // Written to the standard input of the current step's command, which is then closed; never committed.
+	Nice       *int              // CPU niceness of the current step's container, from 0 to 19, which lowers its cpu shares; never committed.
+	IONice     *int              // I/O niceness of the current step's container, from 0 to 7, which lowers its block I/O weight; never committed.
+	SkipEmpty  bool              // If the current step's container has no changes, the step adds no layer and is only recorded in the cache; never committed.
 }
 
 // NewConfig initializes a new configuration.
@@ -43,7 +70,56 @@ func NewConfig() *Config {
 		User:    StringState{"", "root"},
 		WorkDir: StringState{"", "/"},
 		Image:   "",
+		OS:      "linux",
+	}
+}
+
+// ExitAllowed reports whether the exit status of the current step's command
+// lets the step succeed.
+func (c *Config) ExitAllowed(stat int) bool {
+	if len(c.AllowExit) == 0 {
+		return stat == 0
+	}
+
+	for _, allowed := range c.AllowExit {
+		if stat == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RunShell returns the shell used to execute shell-form commands.
+func (c *Config) RunShell() []string {
+	if len(c.Shell) > 0 {
+		return c.Shell
+	}
+
+	return DefaultShell(c.OS)
+}
+
+// loginShells are the POSIX shells that accept -l to start as a login shell.
+var loginShells = map[string]bool{
+	"sh":   true,
+	"bash": true,
+	"dash": true,
+	"ash":  true,
+	"ksh":  true,
+	"mksh": true,
+	"zsh":  true,
+}
+
+// LoginShell returns the shell used to execute shell-form commands, started
+// as a login shell so that it sources the image's profile scripts. Only POSIX
+// shells are supported; shells such as cmd or powershell return an error.
+func (c *Config) LoginShell() ([]string, error) {
+	shell := c.RunShell()
+	if len(shell) == 0 || !loginShells[path.Base(shell[0])] {
+		return nil, fmt.Errorf("run login requires a POSIX shell such as /bin/sh or /bin/bash, not %q", shell)
 	}
+
+	return append([]string{shell[0], "-l"}, shell[1:]...), nil
 }
 
 // TemporaryCommand is used to manage run and debug statements and similar
@@ -102,6 +178,8 @@ func (c *Config) ToDocker(temporary, tty, stdin bool) *container.Config {
 		User:         user,
 		WorkingDir:   workdir,
 		Labels:       c.Labels,
+		Shell:        c.Shell,
+		ArgsEscaped:  c.OS == "windows",
 	}
 }
 
@@ -134,10 +212,12 @@ func (c *Config) FromDocker(temporary bool, cont *container.Config) {
 
 	c.Labels = cont.Labels
 	c.Volumes = []string{}
+	c.Shell = cont.Shell
 }
 
-// ToImage returns the config as an image manifest.
-func (c *Config) ToImage(layers []string) map[string]interface{} {
+// ToImage returns the config as an image manifest, created at the provided
+// time.
+func (c *Config) ToImage(layers []string, created time.Time) map[string]interface{} {
 	shaLayers := []string{}
 	for _, layer := range layers {
 		shaLayers = append(shaLayers, fmt.Sprintf("sha256:%v", layer))
@@ -145,9 +225,9 @@ func (c *Config) ToImage(layers []string) map[string]interface{} {
 
 	fields := map[string]interface{}{}
 	fields["config"] = c.ToDocker(false, false, false)
-	fields["created"] = time.Now().Format("2006-01-02T15:04:05Z07:00")
+	fields["created"] = created.Format("2006-01-02T15:04:05Z07:00")
 	fields["architecture"] = "amd64"
-	fields["os"] = "linux"
+	fields["os"] = c.OS
 	fields["history"] = []map[string]interface{}{{}}
 	fields["rootfs"] = map[string]interface{}{
 		"diff_ids": shaLayers,
@@ -9,5 +9,6 @@ type Evaluator interface {
 	Result() types.BuildResult
 	RunCode(string, int, bool) (int, error)
 	RunScript(string) error
+	Source(string, string, int) (int, error)
 	Close() error
 }
@@ -0,0 +1,76 @@
+package mruby
+
+// #cgo CFLAGS: -I${SRCDIR}/../../../vendor/github.com/mitchellh/go-mruby/vendor/mruby/include
+// #cgo LDFLAGS: ${SRCDIR}/../../../vendor/github.com/mitchellh/go-mruby/libmruby.a -lm
+// #include <stdlib.h>
+// #include <string.h>
+// #include <mruby.h>
+// #include <mruby/compile.h>
+// #include <mruby/dump.h>
+// #include <mruby/proc.h>
+//
+// static int _box_bytecode(const char *code, size_t len, uint8_t **bin, size_t *size) {
+//   mrb_state *mrb = mrb_open();
+//   mrbc_context *cxt;
+//   struct mrb_parser_state *p;
+//   struct RProc *proc;
+//   uint8_t *dumped;
+//   size_t dumped_size;
+//   int result = -1;
+//
+//   if (mrb == NULL) {
+//     return -1;
+//   }
+//
+//   cxt = mrbc_context_new(mrb);
+//   cxt->capture_errors = TRUE;
+//
+//   p = mrb_parse_nstring(mrb, code, len, cxt);
+//   if (p != NULL && p->nerr == 0) {
+//     proc = mrb_generate_code(mrb, p);
+//     // without DUMP_DEBUG_INFO, the lines are left out.
+//     if (proc != NULL && mrb_dump_irep(mrb, proc->body.irep, 0, &dumped, &dumped_size) == MRB_DUMP_OK) {
+//       *bin = malloc(dumped_size);
+//       memcpy(*bin, dumped, dumped_size);
+//       *size = dumped_size;
+//       mrb_free(mrb, dumped);
+//       result = 0;
+//     }
+//   }
+//
+//   if (p != NULL) {
+//     mrb_parser_free(p);
+//   }
+//
+//   mrbc_context_free(mrb, cxt);
+//   mrb_close(mrb);
+//   return result;
+// }
+import "C"
+
+import (
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// Bytecode compiles the code without running it and returns its bytecode,
+// without the lines it was compiled from, so code which only differs in its
+// layout has the same bytecode. It returns an error if the code does not
+// compile; CheckSyntax says why.
+func Bytecode(code string) ([]byte, error) {
+	s := C.CString(code)
+	defer C.free(unsafe.Pointer(s))
+
+	var (
+		bin  *C.uint8_t
+		size C.size_t
+	)
+
+	if C._box_bytecode(s, C.size_t(len(code)), &bin, &size) != 0 {
+		return nil, errors.New("could not compile the code")
+	}
+	defer C.free(unsafe.Pointer(bin))
+
+	return C.GoBytes(unsafe.Pointer(bin), C.int(size)), nil
+}
@@ -3,7 +3,9 @@ package mruby
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -12,108 +14,341 @@ import (
 	mruby "github.com/mitchellh/go-mruby"
 )
 
-func parseCopyArgs(args []*mruby.MrbValue) (string, string, []string, error) {
-	var source, target string
-	ignoreList := []string{}
+// contentClass is the class of the strings returned by the `stdin` and
+// `content` functions, which copy treats as file content instead of paths.
+const contentClass = "BoxContent"
+
+type copyArgs struct {
+	source     string
+	target     string
+	ignoreList []string
+	caps       []string
+	parents    bool
+	inherit    bool // the copied files are owned by the target's owner
+	content    bool // the source is the content to copy, not a path
+}
+
+// isURL reports whether the source is a URL to download.
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// isContent reports whether the value was made by the `stdin` or `content`
+// functions.
+func isContent(arg *mruby.MrbValue) bool {
+	class, err := arg.Call("class")
+	return err == nil && class.String() == contentClass
+}
+
+func parseCopyArgs(args []*mruby.MrbValue) (*copyArgs, error) {
+	ca := &copyArgs{ignoreList: []string{}, caps: []string{}}
+	var sourceSet bool
 
 	for _, arg := range args {
 		switch arg.Type() {
 		case mruby.TypeString:
-			if source != "" {
-				if target != "" {
-					return "", "", nil, errors.New("too many arguments in copy")
+			if sourceSet {
+				if ca.target != "" {
+					return nil, errors.New("too many arguments in copy")
 				}
 
-				target = arg.String()
+				ca.target = arg.String()
 				continue
 			}
-			source = arg.String()
+			ca.source = arg.String()
+			ca.content = isContent(arg)
+			if !ca.content && isURL(ca.source) {
+				return nil, fmt.Errorf("copy cannot download %s; use add", ca.source)
+			}
+			sourceSet = ca.source != "" || ca.content
 		case mruby.TypeHash:
 			hash, err := coerceHash(arg.Hash())
 			if err != nil {
-				return "", "", nil, err
+				return nil, err
 			}
 
 			if _, ok := hash["ignore_list"]; ok {
 				list, err := util.InterfaceListToString(hash["ignore_list"])
 				if err != nil {
-					return "", "", nil, err
+					return nil, err
 				}
 
-				ignoreList = append(ignoreList, list...)
+				ca.ignoreList = append(ca.ignoreList, list...)
 			}
 
 			file, ok := hash["ignore_file"].(string)
 			if ok {
 				lines, err := util.ReadLines(file)
 				if err != nil {
-					return "", "", nil, err
+					return nil, err
 				}
 
-				ignoreList = append(ignoreList, lines...)
+				ca.ignoreList = append(ca.ignoreList, lines...)
+			}
+
+			if _, ok := hash["caps"]; ok {
+				list, err := util.InterfaceListToString(hash["caps"])
+				if err != nil {
+					return nil, err
+				}
+
+				ca.caps = append(ca.caps, list...)
+			}
+
+			if value, ok := hash["parents"].(string); ok {
+				ca.parents = value == "true"
+			}
+
+			if value, ok := hash["inherit_owner"].(string); ok {
+				ca.inherit = value == "true"
 			}
 		}
 	}
 
-	return source, target, ignoreList, nil
+	if ca.inherit && ca.content {
+		return nil, errors.New("inherit_owner can only be used when copying files")
+	}
+
+	return ca, nil
 }
 
-func checkCopyArgs(workdir config.StringState, args []*mruby.MrbValue) (string, string, []string, error) {
-	source, target, ignoreList, err := parseCopyArgs(args)
+func checkCopyArgs(workdir config.StringState, args []*mruby.MrbValue) (*copyArgs, error) {
+	ca, err := parseCopyArgs(args)
 	if err != nil {
-		return "", "", nil, err
+		return nil, err
 	}
 
-	var rel string
+	var targetWd string
 
-	relfiles, err := filepath.Glob(source)
-	if err != nil || len(relfiles) == 1 {
-		source, err = filepath.Abs(source)
-		if err != nil {
-			return "", "", nil, err
+	if workdir.Temporary == "" {
+		targetWd = workdir.Image
+	} else {
+		targetWd = workdir.Temporary
+	}
+
+	if ca.content {
+		if ca.target == "" || ca.target == "." || strings.HasSuffix(ca.target, "/") {
+			return nil, fmt.Errorf("copying content requires a file name to copy to, not %q", ca.target)
 		}
 
-		wd, err := os.Getwd()
-		if err != nil {
-			return "", "", nil, err
+		if !strings.HasPrefix(ca.target, "/") {
+			ca.target = filepath.Join(targetWd, ca.target)
 		}
 
-		rel, err = filepath.Rel(wd, source)
+		return ca, nil
+	}
+
+	var rel string
+
+	relfiles, err := filepath.Glob(ca.source)
+	if err != nil || len(relfiles) == 1 {
+		rel, err = relativeSource(ca.source)
 		if err != nil {
-			return "", "", nil, err
+			return nil, err
 		}
+	} else {
+		rel = ca.source
+	}
 
-		if strings.HasPrefix(rel, "..") {
-			return "", "", nil, fmt.Errorf("cannot use relative path %s because it may fall below the root build directory", source)
+	// special case `.`
+	if ca.target == "." && len(relfiles) == 1 {
+		ca.target = filepath.Join(targetWd, rel)
+	} else if !strings.HasPrefix(ca.target, "/") {
+		// the trailing slash makes the target a directory, so it is kept.
+		dir := strings.HasSuffix(ca.target, "/")
+		ca.target = filepath.Join(targetWd, ca.target)
+		if dir && !strings.HasSuffix(ca.target, "/") {
+			ca.target += "/"
 		}
-	} else {
-		rel = source
 	}
 
-	var targetWd string
+	ca.source = filepath.Clean(rel)
+	return ca, nil
+}
 
-	if workdir.Temporary == "" {
-		targetWd = workdir.Image
-	} else {
-		targetWd = workdir.Temporary
+// relativeSource returns the source relative to the root build directory,
+// which it may not fall below.
+func relativeSource(source string) (string, error) {
+	abs, err := filepath.Abs(source)
+	if err != nil {
+		return "", err
 	}
 
-	// special case `.`
-	if target == "." && len(relfiles) == 1 {
-		target = filepath.Join(targetWd, rel)
-	} else {
-		if !strings.HasPrefix(target, "/") {
-			target = filepath.Join(targetWd, target)
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("cannot use relative path %s because it may fall below the root build directory", abs)
+	}
+
+	return rel, nil
+}
+
+// copyMap copies the sources of the mapping in the first argument to their
+// targets, with the options of the second, if any.
+func (m *MRuby) copyMap(args []*mruby.MrbValue) error {
+	if len(args) > 2 || (len(args) == 2 && args[1].Type() != mruby.TypeHash) {
+		return errors.New("copy with a mapping takes only a hash of options after it")
+	}
+
+	ca, err := parseCopyArgs(args[1:])
+	if err != nil {
+		return err
+	}
+
+	if ca.parents || ca.inherit {
+		return errors.New("parents and inherit_owner cannot be used when copying a mapping")
+	}
+
+	mapping := map[string]string{}
+
+	err = iterateRubyHash(args[0], func(key, value *mruby.MrbValue) error {
+		if key.Type() != mruby.TypeString || value.Type() != mruby.TypeString {
+			return fmt.Errorf("invalid mapping %q => %q in copy; both must be paths", key.String(), value.String())
+		}
+
+		if isContent(key) || isURL(key.String()) {
+			return fmt.Errorf("cannot copy %q in a mapping; only files and directories can be", key.String())
+		}
+
+		source, err := relativeSource(key.String())
+		if err != nil {
+			return err
 		}
+
+		mapping[source] = m.imagePath(value.String())
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	return filepath.Clean(rel), target, ignoreList, nil
+	if len(mapping) == 0 {
+		return errors.New("copy with a mapping requires at least one source")
+	}
+
+	return m.Interp.CopyMap(mapping, ca.ignoreList, ca.caps)
 }
 
 func (m *MRuby) doCopy(args []*mruby.MrbValue, self *mruby.MrbValue) error {
-	source, target, ignores, err := checkCopyArgs(m.Exec.Config().WorkDir, args)
+	if len(args) > 0 && args[0].Type() == mruby.TypeHash {
+		return m.copyMap(args)
+	}
+
+	ca, err := checkCopyArgs(m.Exec.Config().WorkDir, args)
+	if err != nil {
+		return err
+	}
+
+	if ca.content {
+		return m.Interp.CopyContent([]byte(ca.source), ca.target, ca.caps)
+	}
+
+	return m.Interp.Copy(ca.source, ca.target, ca.ignoreList, ca.caps, ca.parents, ca.inherit)
+}
+
+// add implements the `add` verb, which downloads a URL into the image. The
+// target is resolved against the workdir; whether it names a file or the
+// directory an archive is extracted into is only known once it is downloaded.
+func (m *MRuby) add(args []*mruby.MrbValue, self *mruby.MrbValue) error {
+	if len(args) < 2 || len(args) > 3 {
+		return fmt.Errorf("Expected 2 or 3 arg(s), got %d", len(args))
+	}
+
+	for _, arg := range args[:2] {
+		if arg.Type() != mruby.TypeString {
+			return fmt.Errorf("invalid argument %q for add statement", arg.String())
+		}
+	}
+
+	source := args[0].String()
+	if !isURL(source) {
+		return fmt.Errorf("add requires a http or https URL, not %q; use copy for files", source)
+	}
+
+	u, err := url.Parse(source)
 	if err != nil {
 		return err
 	}
-	return m.Interp.Copy(source, target, ignores)
+
+	var checksum string
+
+	if len(args) == 3 {
+		if args[2].Type() != mruby.TypeHash {
+			return fmt.Errorf("invalid argument %q for add statement", args[2].String())
+		}
+
+		err := iterateRubyHash(args[2], func(key, value *mruby.MrbValue) error {
+			switch key.String() {
+			case "checksum":
+				if value.Type() != mruby.TypeString {
+					return fmt.Errorf("checksum must be a string, not %q", value.String())
+				}
+				checksum = value.String()
+			default:
+				return fmt.Errorf("%q is not a valid option to add", key.String())
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	target := args[1].String()
+	if target == "" || target == "." {
+		target = "./"
+	}
+
+	return m.Interp.Add(source, path.Base(u.Path), m.imagePath(target), checksum)
+}
+
+func (m *MRuby) copyFrom(args []*mruby.MrbValue, self *mruby.MrbValue) error {
+	if len(args) < 3 || len(args) > 4 {
+		return fmt.Errorf("Expected 3 or 4 arg(s), got %d", len(args))
+	}
+
+	for _, arg := range args[:3] {
+		if arg.Type() != mruby.TypeString {
+			return fmt.Errorf("invalid argument %q for copy_from statement", arg.String())
+		}
+	}
+
+	var asTar bool
+
+	if len(args) == 4 {
+		if args[3].Type() != mruby.TypeHash {
+			return fmt.Errorf("invalid argument %q for copy_from statement", args[3].String())
+		}
+
+		err := iterateRubyHash(args[3], func(key, value *mruby.MrbValue) error {
+			switch key.String() {
+			case "as_tar":
+				asTar = value.String() == "true"
+			default:
+				return fmt.Errorf("%q is not a valid option to copy_from", key.String())
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// the source is in another image, whose workdir is not known.
+	source := args[1].String()
+	if !path.IsAbs(source) {
+		return fmt.Errorf("path %q is not absolute in copy_from", source)
+	}
+
+	return m.Interp.CopyFrom(args[0].String(), source, m.imagePath(args[2].String()), asTar)
 }
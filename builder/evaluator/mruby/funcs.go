@@ -2,11 +2,23 @@ package mruby
 
 import (
 	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/box-builder/box/util"
 	gm "github.com/mitchellh/go-mruby"
 	"github.com/pkg/errors"
 )
 
+var (
+	stdinOnce    sync.Once
+	stdinContent []byte
+	stdinErr     error
+)
+
 type funcDefinition struct {
 	fun     funcFunc
 	argSpec gm.ArgSpec
@@ -16,15 +28,32 @@ type funcFunc func(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value)
 
 func (m *MRuby) funcJumpTable() map[string]*funcDefinition {
 	return map[string]*funcDefinition{
-		"var_exists": {m.varExistsFunc, gm.ArgsReq(1)},
-		"var":        {m.varFunc, gm.ArgsReq(1)},
-		"import":     {m.importFunc, gm.ArgsReq(1)},
-		"save":       {m.saveFunc, gm.ArgsReq(1)},
-		"getenv":     {m.getenv, gm.ArgsReq(1)},
-		"getuid":     {m.getuid, gm.ArgsReq(1)},
-		"getgid":     {m.getgid, gm.ArgsReq(1)},
-		"read":       {m.read, gm.ArgsReq(1)},
-		"skip":       {m.skip, gm.ArgsNone() | gm.ArgsBlock()},
+		"var_exists":          {m.varExistsFunc, gm.ArgsReq(1)},
+		"var":                 {m.varFunc, gm.ArgsReq(1)},
+		"vars":                {m.varsFunc, gm.ArgsNone()},
+		"arg":                 {m.argFunc, gm.ArgsReq(1) | gm.ArgsOpt(1)},
+		"import":              {m.importFunc, gm.ArgsReq(1)},
+		"save":                {m.saveFunc, gm.ArgsReq(1)},
+		"getenv":              {m.getenv, gm.ArgsReq(1)},
+		"getuid":              {m.getuid, gm.ArgsReq(1)},
+		"getgid":              {m.getgid, gm.ArgsReq(1)},
+		"read":                {m.read, gm.ArgsReq(1)},
+		"dir_exists?":         {m.dirExists, gm.ArgsReq(1) | gm.ArgsOpt(1)},
+		"file_exists?":        {m.fileExists, gm.ArgsReq(1) | gm.ArgsOpt(1)},
+		"skip":                {m.skip, gm.ArgsNone() | gm.ArgsBlock()},
+		"check":               {m.check, gm.ArgsReq(2)},
+		"local_run":           {m.localRun, gm.ArgsReq(1)},
+		"run_capture":         {m.runCapture, gm.ArgsReq(1)},
+		"run_assert":          {m.runAssert, gm.ArgsReq(2)},
+		"wait_for":            {m.waitFor, gm.ArgsReq(1) | gm.ArgsOpt(1)},
+		"sleep":               {m.sleep, gm.ArgsReq(1)},
+		"no_cache!":           {m.noCache, gm.ArgsNone()},
+		"stdin":               {m.stdin, gm.ArgsNone()},
+		"content":             {m.content, gm.ArgsReq(1)},
+		"assert_base_matches": {m.assertBaseMatches, gm.ArgsReq(1)},
+		"tmpdir":              {m.tmpdir, gm.ArgsNone()},
+		"pull":                {m.pull, gm.ArgsReq(1)},
+		"box_version":         {m.boxVersion, gm.ArgsReq(1)},
 	}
 }
 
@@ -53,6 +82,49 @@ func (m *MRuby) varFunc(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Va
 	return gm.String(value), nil
 }
 
+func (m *MRuby) varsFunc(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value) {
+	result, err := m.mrb.Class("Hash", nil).New()
+	if err != nil {
+		return nil, m.createException(err)
+	}
+
+	vars := m.Interp.Vars()
+
+	// added in order, so iterating over the hash is the same on every build.
+	keys := []string{}
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := result.Hash().Set(gm.String(key), gm.String(vars[key])); err != nil {
+			return nil, m.createException(err)
+		}
+	}
+
+	return result, nil
+}
+
+func (m *MRuby) argFunc(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, m.createException(errors.Errorf("Expected 1 or 2 arg(s), got %d", len(args)))
+	}
+
+	var def *string
+	if len(args) == 2 {
+		str := args[1].String()
+		def = &str
+	}
+
+	value, ok := m.Interp.Arg(args[0].String(), def)
+	if !ok {
+		return nil, nil
+	}
+
+	return gm.String(value), nil
+}
+
 func (m *MRuby) importFunc(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value) {
 	if err := checkArgs(args, 1); err != nil {
 		return nil, m.createException(err)
@@ -137,6 +209,51 @@ func (m *MRuby) read(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value
 	return gm.String(res), m.createException(err)
 }
 
+func (m *MRuby) dirExists(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value) {
+	return m.pathExists("dir_exists?", args, true)
+}
+
+func (m *MRuby) fileExists(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value) {
+	return m.pathExists("file_exists?", args, false)
+}
+
+// pathExists checks the path given to dir_exists? or file_exists?. With
+// strict: true, the function fails if there is no image yet rather than
+// returning false.
+func (m *MRuby) pathExists(name string, args []*gm.MrbValue, dir bool) (gm.Value, gm.Value) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, m.createException(errors.Errorf("Expected 1 or 2 arg(s), got %d", len(args)))
+	}
+
+	if len(args) == 2 {
+		if args[1].Type() != gm.TypeHash {
+			return nil, m.createException(errors.Errorf("invalid argument %q for %s", args[1].String(), name))
+		}
+
+		hash, err := coerceHash(args[1].Hash())
+		if err != nil {
+			return nil, m.createException(err)
+		}
+
+		if hash["strict"] == "true" {
+			if err := m.Interp.RequireImage(name); err != nil {
+				return nil, m.createException(err)
+			}
+		}
+	}
+
+	exists, err := m.Interp.PathExists(args[0].String(), dir)
+	if err != nil {
+		return nil, m.createException(err)
+	}
+
+	if exists {
+		return m.mrb.TrueValue(), nil
+	}
+
+	return m.mrb.FalseValue(), nil
+}
+
 func (m *MRuby) skip(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value) {
 	if err := checkArgs(args, 1); err != nil {
 		return nil, m.createException(err)
@@ -147,3 +264,266 @@ func (m *MRuby) skip(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value
 		return err
 	}))
 }
+
+func (m *MRuby) noCache(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value) {
+	if err := checkArgs(args, 0); err != nil {
+		return nil, m.createException(err)
+	}
+
+	m.Interp.NoCache()
+	return nil, nil
+}
+
+func (m *MRuby) tmpdir(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value) {
+	if err := checkArgs(args, 0); err != nil {
+		return nil, m.createException(err)
+	}
+
+	dir, err := m.Interp.TempDir()
+	if err != nil {
+		return nil, m.createException(err)
+	}
+
+	return gm.String(dir), nil
+}
+
+func (m *MRuby) pull(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value) {
+	if err := checkArgs(args, 1); err != nil {
+		return nil, m.createException(err)
+	}
+
+	digest, err := m.Interp.Pull(args[0].String())
+	if err != nil {
+		return nil, m.createException(err)
+	}
+
+	return gm.String(digest), nil
+}
+
+func (m *MRuby) check(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value) {
+	if err := checkArgs(args, 2); err != nil {
+		return nil, m.createException(err)
+	}
+
+	return nil, m.createException(m.Interp.Check(args[0].String(), args[1].String()))
+}
+
+func (m *MRuby) localRun(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value) {
+	if err := checkArgs(args, 1); err != nil {
+		return nil, m.createException(err)
+	}
+
+	res, err := m.Interp.LocalRun(args[0].String())
+	return gm.String(res), m.createException(err)
+}
+
+func (m *MRuby) runCapture(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value) {
+	if err := checkArgs(args, 1); err != nil {
+		return nil, m.createException(err)
+	}
+
+	output, stat, err := m.Interp.RunCapture(args[0].String())
+	if err != nil {
+		return nil, m.createException(err)
+	}
+
+	return m.captureResult(output, stat)
+}
+
+// captureResult returns the hash of the output and status returned by
+// run_capture.
+func (m *MRuby) captureResult(output string, stat int) (gm.Value, gm.Value) {
+	result, err := m.mrb.Class("Hash", nil).New()
+	if err != nil {
+		return nil, m.createException(err)
+	}
+
+	for key, value := range map[string]gm.Value{"output": gm.String(output), "status": m.mrb.FixnumValue(stat)} {
+		sym, err := gm.String(key).MrbValue(m.mrb).Call("to_sym")
+		if err != nil {
+			return nil, m.createException(err)
+		}
+
+		if err := result.Hash().Set(sym, value); err != nil {
+			return nil, m.createException(err)
+		}
+	}
+
+	return result, nil
+}
+
+func (m *MRuby) runAssert(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value) {
+	if len(args) != 2 || args[0].Type() != gm.TypeString || args[1].Type() != gm.TypeHash {
+		return nil, m.createException(errors.New("run_assert requires a command and a hash of contains: or matches:"))
+	}
+
+	hash, err := coerceHash(args[1].Hash())
+	if err != nil {
+		return nil, m.createException(err)
+	}
+
+	contains, _ := hash["contains"].(string)
+
+	var pattern *regexp.Regexp
+	if matches, ok := hash["matches"].(string); ok {
+		if pattern, err = regexp.Compile(matches); err != nil {
+			return nil, m.createException(errors.Wrapf(err, "invalid matches for run_assert"))
+		}
+	}
+
+	if contains == "" && pattern == nil {
+		return nil, m.createException(errors.New("run_assert requires contains: or matches:"))
+	}
+
+	output, err := m.Interp.RunAssert(args[0].String(), contains, pattern)
+	if err != nil {
+		return nil, m.createException(err)
+	}
+
+	return gm.String(output), nil
+}
+
+// newContent returns the string as content for copy.
+func (m *MRuby) newContent(str string) (gm.Value, gm.Value) {
+	value, err := m.mrb.Class(contentClass, nil).New(gm.String(str))
+	if err != nil {
+		return nil, m.createException(err)
+	}
+
+	return value, nil
+}
+
+func (m *MRuby) stdin(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value) {
+	// "-" is builder.StdinFile; the plan itself was read from standard input.
+	if m.Filename == "-" {
+		return nil, m.createException(errors.New("stdin cannot be used when the plan is read from standard input"))
+	}
+
+	// all plans of the process share standard input, so it is read once.
+	stdinOnce.Do(func() {
+		stdinContent, stdinErr = ioutil.ReadAll(os.Stdin)
+	})
+
+	if stdinErr != nil {
+		return nil, m.createException(errors.Wrap(stdinErr, "reading standard input"))
+	}
+
+	return m.newContent(string(stdinContent))
+}
+
+func (m *MRuby) content(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value) {
+	if err := checkArgs(args, 1); err != nil {
+		return nil, m.createException(err)
+	}
+
+	return m.newContent(args[0].String())
+}
+
+func (m *MRuby) assertBaseMatches(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value) {
+	if err := checkArgs(args, 1); err != nil {
+		return nil, m.createException(err)
+	}
+
+	if args[0].Type() != gm.TypeHash {
+		return nil, m.createException(errors.New("assert_base_matches must be called with allow and/or deny parameters"))
+	}
+
+	hash, err := coerceHash(args[0].Hash())
+	if err != nil {
+		return nil, m.createException(err)
+	}
+
+	rules := map[string][]string{}
+
+	for key, value := range hash {
+		if key != "allow" && key != "deny" {
+			return nil, m.createException(errors.Errorf("%q is not a valid parameter to the assert_base_matches function", key))
+		}
+
+		if str, ok := value.(string); ok {
+			rules[key] = []string{str}
+			continue
+		}
+
+		list, err := util.InterfaceListToString(value)
+		if err != nil {
+			return nil, m.createException(errors.Wrapf(err, "%s must be a rule or a list of rules", key))
+		}
+		rules[key] = list
+	}
+
+	return nil, m.createException(m.Interp.AssertBaseMatches(rules["allow"], rules["deny"]))
+}
+
+func (m *MRuby) sleep(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value) {
+	if err := checkArgs(args, 1); err != nil {
+		return nil, m.createException(err)
+	}
+
+	var dur time.Duration
+
+	switch args[0].Type() {
+	case gm.TypeFixnum:
+		dur = time.Duration(args[0].Fixnum()) * time.Second
+	case gm.TypeFloat:
+		dur = time.Duration(args[0].Float() * float64(time.Second))
+	default:
+		var err error
+		if dur, err = time.ParseDuration(args[0].String()); err != nil {
+			return nil, m.createException(errors.Wrapf(err, "invalid duration %q for sleep", args[0].String()))
+		}
+	}
+
+	return nil, m.createException(m.Interp.Sleep(dur))
+}
+
+func (m *MRuby) waitFor(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value) {
+	if len(args) < 1 || args[0].Type() != gm.TypeString {
+		return nil, m.createException(errors.New("wait_for requires a command"))
+	}
+
+	timeout, interval := 60*time.Second, time.Second
+
+	if len(args) > 1 {
+		if args[1].Type() != gm.TypeHash {
+			return nil, m.createException(errors.Errorf("invalid argument %q for wait_for", args[1].String()))
+		}
+
+		hash, err := coerceHash(args[1].Hash())
+		if err != nil {
+			return nil, m.createException(err)
+		}
+
+		durations := map[string]*time.Duration{"timeout": &timeout, "interval": &interval}
+
+		for key, value := range hash {
+			dur, ok := durations[key]
+			if !ok {
+				return nil, m.createException(errors.Errorf("%q is not a valid option to wait_for", key))
+			}
+
+			str, ok := value.(string)
+			if !ok {
+				return nil, m.createException(errors.Errorf("%s for wait_for must be a duration such as \"10s\"", key))
+			}
+
+			if *dur, err = time.ParseDuration(str); err != nil {
+				return nil, m.createException(errors.Wrapf(err, "invalid %s %q for wait_for", key, str))
+			}
+
+			if *dur <= 0 {
+				return nil, m.createException(errors.Errorf("%s %q for wait_for must be positive", key, str))
+			}
+		}
+	}
+
+	return nil, m.createException(m.Interp.WaitFor(args[0].String(), timeout, interval))
+}
+
+func (m *MRuby) boxVersion(args []*gm.MrbValue, self *gm.MrbValue) (gm.Value, gm.Value) {
+	if len(args) != 1 || args[0].Type() != gm.TypeString {
+		return nil, m.createException(errors.New("box_version requires a version constraint such as \">= 0.5\""))
+	}
+
+	return nil, m.createException(m.Interp.BoxVersion(args[0].String()))
+}
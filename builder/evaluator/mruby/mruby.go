@@ -17,6 +17,8 @@ import (
 type MRuby struct {
 	mrb            *gm.Mrb
 	afterFunc      *gm.MrbValue
+	validateFunc   *gm.MrbValue
+	exitFuncs      []*gm.MrbValue
 	parser         *gm.Parser
 	compileContext *gm.CompileContext
 	result         types.BuildResult
@@ -43,6 +45,130 @@ func NewMRuby(config *Config) (*MRuby, error) {
 	return m, nil
 }
 
+// uncachedVerbs are never found in the cache, so they are evaluated before the
+// range of steps set with --steps as well.
+var uncachedVerbs = map[string]bool{
+	"from":      true,
+	"debug":     true,
+	"tag":       true,
+	"build_env": true,
+}
+
+// imagelessVerbs do not change the image, so they can be used before from.
+var imagelessVerbs = map[string]bool{
+	"from":     true,
+	"after":    true,
+	"validate": true,
+	"on_exit":  true,
+}
+
+// imageFuncs use the current image, so they cannot be used before from.
+var imageFuncs = map[string]bool{
+	"read":        true,
+	"getuid":      true,
+	"getgid":      true,
+	"check":       true,
+	"run_capture": true,
+	"run_assert":  true,
+	"wait_for":    true,
+	"save":        true,
+}
+
+// inspectedFuncs act on the host, an image or a registry, so an inspection,
+// which builds nothing, returns their placeholder instead of running them.
+var inspectedFuncs = map[string]func(m *MRuby) (gm.Value, gm.Value){
+	"save":         func(m *MRuby) (gm.Value, gm.Value) { return nil, nil },
+	"check":        func(m *MRuby) (gm.Value, gm.Value) { return nil, nil },
+	"wait_for":     func(m *MRuby) (gm.Value, gm.Value) { return nil, nil },
+	"sleep":        func(m *MRuby) (gm.Value, gm.Value) { return nil, nil },
+	"local_run":    func(m *MRuby) (gm.Value, gm.Value) { return gm.String(""), nil },
+	"run_assert":   func(m *MRuby) (gm.Value, gm.Value) { return gm.String(""), nil },
+	"read":         func(m *MRuby) (gm.Value, gm.Value) { return gm.String(""), nil },
+	"getuid":       func(m *MRuby) (gm.Value, gm.Value) { return gm.String(""), nil },
+	"getgid":       func(m *MRuby) (gm.Value, gm.Value) { return gm.String(""), nil },
+	"pull":         func(m *MRuby) (gm.Value, gm.Value) { return gm.String(""), nil },
+	"dir_exists?":  func(m *MRuby) (gm.Value, gm.Value) { return m.mrb.FalseValue(), nil },
+	"file_exists?": func(m *MRuby) (gm.Value, gm.Value) { return m.mrb.FalseValue(), nil },
+	"run_capture":  func(m *MRuby) (gm.Value, gm.Value) { return m.captureResult("", 0) },
+}
+
+// hostVerbs copy files whose content their cache keys do not cover, from the
+// host, another image or a server, so they are never resumed from a
+// checkpoint.
+var hostVerbs = map[string]bool{
+	"copy":      true,
+	"copy_from": true,
+	"add":       true,
+}
+
+// configVerbs only change the image config, so an inspection applies them to
+// it as well, to know the config the plan results in. build_env changes the
+// cache keys of the steps after it instead.
+var configVerbs = map[string]bool{
+	"label":            true,
+	"set_exec":         true,
+	"workdir":          true,
+	"user":             true,
+	"entrypoint":       true,
+	"env":              true,
+	"unenv":            true,
+	"cmd":              true,
+	"clear_entrypoint": true,
+	"clear_cmd":        true,
+	"shell":            true,
+	"build_env":        true,
+}
+
+// keyedVerb describes how the options of a verb are put in its cache key.
+type keyedVerb struct {
+	// omit are the options left out of the key.
+	omit []string
+	// key returns the entries put in the key instead, from the options.
+	key func(options map[string]interface{}) ([]string, error)
+	// secret is an option which is logged by its size only.
+	secret string
+}
+
+// keyedVerbs are the verbs with options which are not in their cache keys as
+// they are given. The cache_ttl of any step is left out as well, as it only
+// decides whether its cached layer is used, which the cache check does.
+//
+// The privileges, cache and tmpfs mounts, read-only root filesystem and
+// priority of a run do not change what it produces, so they are not part of
+// its cache key. Of its binds only the targets are, as the host paths may
+// differ between machines. Its stdin is in the key by digest, and is not
+// logged, as it may be a secret; so are its since_file files and its script,
+// so it is rebuilt when they change.
+var keyedVerbs = map[string]keyedVerb{
+	"run": {
+		omit:   []string{"cache_mount", "privileged", "cap_add", "cap_drop", "bind", "tmpfs", "readonly_rootfs", "writable", "nice", "ionice", "stdin", "since_file"},
+		key:    runKeyOptions,
+		secret: "stdin",
+	},
+}
+
+// cacheKeyArgs returns the arguments of the verb which are in its cache key
+// as they are given, and the entries keyedVerbs adds for its options.
+func (m *MRuby) cacheKeyArgs(name string, args []*gm.MrbValue, options map[string]interface{}) ([]*gm.MrbValue, []string, error) {
+	verb := keyedVerbs[name]
+
+	keyArgs, err := m.withoutOptions(args, append([]string{"cache_ttl"}, verb.omit...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if verb.key == nil || options == nil {
+		return keyArgs, nil, nil
+	}
+
+	keyOptions, err := verb.key(options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return keyArgs, keyOptions, nil
+}
+
 func (m *MRuby) wrapVerbFunc(name string, vd *verbDefinition) gm.Func {
 	return func(mrb *gm.Mrb, self *gm.MrbValue) (gm.Value, gm.Value) {
 		select {
@@ -55,41 +181,189 @@ func (m *MRuby) wrapVerbFunc(name string, vd *verbDefinition) gm.Func {
 		default:
 		}
 
+		if err := m.Interp.CheckVars(); err != nil {
+			return nil, m.createException(err)
+		}
+
+		if err := m.Interp.RequireExperimental(name); err != nil {
+			return nil, m.createException(err)
+		}
+
+		// checked before the step is logged or looked up in the cache, which
+		// would fail less clearly without an image.
+		if !imagelessVerbs[name] {
+			if err := m.Interp.RequireImage(name); err != nil {
+				return nil, m.createException(err)
+			}
+		}
+
 		args := mrb.GetArgs()
 		strArgs := extractStringArgs(args)
-		cacheKey := strings.Join(append([]string{name}, strArgs...), ", ")
+
+		options, err := trailingOptions(args)
+		if err != nil {
+			return nil, m.createException(err)
+		}
+
+		keyArgs, keyOptions, err := m.cacheKeyArgs(name, args, options)
+		if err != nil {
+			return nil, m.createException(err)
+		}
+
+		if secret := keyedVerbs[name].secret; secret != "" {
+			if value, ok := options[secret].(string); ok {
+				logArgs, err := m.withoutOptions(args, secret)
+				if err != nil {
+					return nil, m.createException(err)
+				}
+
+				strArgs = append(extractStringArgs(logArgs), fmt.Sprintf("%s: %d bytes", secret, len(value)))
+			}
+		}
+
+		cacheKey := strings.Join(append(append([]string{name}, extractStringArgs(keyArgs)...), keyOptions...), ", ")
+
+		// the build's temporary directory has another path on every build,
+		// which would make every step using it a miss.
+		if dir := m.Interp.TempDirPath(); dir != "" {
+			cacheKey = strings.Replace(cacheKey, dir, "<tmpdir>", -1)
+		}
+
+		if m.Interp.CacheSalt != "" {
+			cacheKey += ", " + m.Interp.CacheSalt
+		}
 		cacheKey = base64.StdEncoding.EncodeToString([]byte(cacheKey))
 
 		m.Globals.Logger.BuildStep(name, strings.Join(strArgs, ", "))
+		m.Interp.NextStep()
 
 		if os.Getenv("BOX_DEBUG") != "" {
 			content, _ := json.MarshalIndent(m.Exec.Config(), "", "  ")
 			fmt.Println(string(content))
 		}
 
-		cached, err := m.Exec.Image().CheckCache(cacheKey)
+		// an inspection evaluates from, which the cached steps are found on,
+		// and the blocks, for the steps in them; other steps are only reported,
+		// though the config verbs are also applied to the config.
+		if m.Interp.Inspecting() && name != "from" && !hasBlock(args) {
+			if err := m.Interp.Inspect(name, strArgs, cacheKey); err != nil {
+				return nil, m.createException(err)
+			}
+
+			if configVerbs[name] {
+				return nil, m.createException(vd.verbFunc(args, self))
+			}
+
+			return nil, nil
+		}
+
+		// the runs of a parallel or run_group block are only recorded; the
+		// block checks the cache for all of them at once.
+		if m.Interp.InParallel() || m.Interp.InGroup() {
+			if name != "run" {
+				block := "parallel"
+				if m.Interp.InGroup() {
+					block = "run_group"
+				}
+
+				return nil, m.createException(fmt.Errorf("%s cannot be used in a %s block; only run can", name, block))
+			}
+
+			m.Interp.CacheKey = cacheKey
+			if err := vd.verbFunc(args, self); err != nil {
+				return nil, m.createException(err)
+			}
+
+			return nil, m.createException(m.Interp.Checkpoint(cacheKey))
+		}
+
+		ttl, err := extractCacheTTL(options)
 		if err != nil {
 			return nil, m.createException(err)
 		}
 
+		if ttl != 0 {
+			origTTL := m.Globals.CacheTTL
+			m.Globals.CacheTTL = ttl
+			defer func() { m.Globals.CacheTTL = origTTL }()
+		}
+
+		// block verbs contain other steps, which may be identical to them, so
+		// they are not locked, nor limited by --steps; the steps in them are.
+		if !hasBlock(args) {
+			if m.Interp.SkipStep() {
+				return nil, nil
+			}
+
+			unlock := m.Interp.LockStep(cacheKey)
+			defer unlock()
+		}
+
+		// the uncached verbs and host verbs are never resumed from the
+		// checkpoint. The image a copy or from leaves is checkpointed, so the
+		// steps after it are only resumed if it has not changed.
+		var cached bool
+		if !hasBlock(args) && !uncachedVerbs[name] && !hostVerbs[name] {
+			if cached, err = m.Interp.Resume(cacheKey); err != nil {
+				return nil, m.createException(err)
+			}
+		}
+
+		if !cached {
+			if cached, err = m.Exec.Image().CheckCache(cacheKey); err != nil {
+				return nil, m.createException(err)
+			}
+		}
+
+		if !hasBlock(args) && !uncachedVerbs[name] {
+			if err := m.Interp.CheckStepRange(cached); err != nil {
+				return nil, m.createException(err)
+			}
+		}
+
 		m.Interp.CacheKey = cacheKey
 
 		// if we don't do this for debug, we will step past it on successive runs
 		if !cached || name == "debug" {
-			return nil, m.createException(vd.verbFunc(args, self))
+			if err := vd.verbFunc(args, self); err != nil {
+				return nil, m.createException(err)
+			}
+		}
+
+		// tag and debug commit a new image on every build, which does not mean
+		// the steps after them changed, so they are not checkpointed; nor is
+		// build_env, which must be evaluated again on resuming.
+		if uncachedVerbs[name] && name != "from" {
+			return nil, nil
 		}
 
-		return nil, nil
+		return nil, m.createException(m.Interp.Checkpoint(cacheKey))
 	}
 }
 
 func (m *MRuby) wrapFuncFunc(name string, jump *funcDefinition) func(m *gm.Mrb, self *gm.MrbValue) (gm.Value, gm.Value) {
 	return func(mrb *gm.Mrb, self *gm.MrbValue) (gm.Value, gm.Value) {
+		if err := m.Interp.RequireExperimental(name); err != nil {
+			return nil, m.createException(err)
+		}
+
+		if imageFuncs[name] {
+			if err := m.Interp.RequireImage(name); err != nil {
+				return nil, m.createException(err)
+			}
+		}
+
+		if placeholder, ok := inspectedFuncs[name]; ok && m.Interp.Inspecting() {
+			return placeholder(m)
+		}
+
 		return jump.fun(mrb.GetArgs(), self)
 	}
 }
 
 func (m *MRuby) prepare() {
+	m.mrb.DefineClass(contentClass, m.mrb.Class("String", nil))
+
 	for name, jump := range m.verbJumpTable() {
 		var found bool
 		for _, omit := range m.Globals.OmitFuncs {
@@ -114,6 +388,32 @@ func (m *MRuby) prepare() {
 	}
 }
 
+// planError returns the error with the line, and column if there is one, of
+// the source it was raised at, if mruby reported it, so the logger can show
+// the line.
+func (m *MRuby) planError(err error, source string) error {
+	var line, column int
+
+	switch e := err.(type) {
+	case *gm.ParserError:
+		if len(e.Errors) > 0 {
+			line, column = e.Errors[0].Line, e.Errors[0].Col
+		}
+	case *gm.Exception:
+		// the exception may have been raised in code from elsewhere, such as
+		// a file given to import.
+		if e.File == m.Filename {
+			line = e.Line
+		}
+	}
+
+	if line == 0 {
+		return err
+	}
+
+	return &types.PlanError{Err: err, File: m.Filename, Source: source, Line: line, Column: column}
+}
+
 func (m *MRuby) makeError(err error) error {
 	m.result = types.BuildResult{
 		Err:      err,
@@ -146,29 +446,25 @@ func (m *MRuby) Result() types.BuildResult {
 // appropriately evaluated and on any evaluation error, return its position so
 // the evaluation can continue.
 //
+// If make is true, the image is made from the resulting configuration, even
+// if the code yielded a value.
+//
 // Given this function is intended to run multiple times, it does not execute
 // the after hooks if they are set.
 func (m *MRuby) RunCode(line string, stackKeep int, make bool) (int, error) {
-	if m.compileContext == nil {
-		m.compileContext = gm.NewCompileContext(m.mrb)
-		m.compileContext.CaptureErrors(true)
-	}
-
-	if m.parser == nil {
-		m.parser = gm.NewParser(m.mrb)
-	}
+	m.initParser()
 
 	if _, err := m.parser.Parse(line, m.compileContext); err != nil {
-		return stackKeep, m.makeError(err)
+		return stackKeep, m.makeError(m.planError(err, line))
 	}
 
 	keep, res, err := m.mrb.RunWithContext(m.parser.GenerateCode(), m.mrb.TopSelf(), stackKeep)
 	if err != nil {
-		return keep, m.makeError(err)
+		return keep, m.makeError(m.planError(err, line))
 	}
 
-	if res != nil && res.String() != "" {
-		return keep, m.makeResult(res.String())
+	if err := m.Interp.CheckVars(); err != nil {
+		return keep, m.makeError(err)
 	}
 
 	if make {
@@ -177,33 +473,142 @@ func (m *MRuby) RunCode(line string, stackKeep int, make bool) (int, error) {
 		}
 	}
 
+	if res != nil && res.String() != "" {
+		return keep, m.makeResult(res.String())
+	}
+
 	return keep, m.makeResult(m.Exec.Image().ImageID())
 }
 
+// initParser creates the parser and compile context kept by RunCode and
+// Source, which hold the local variables of the code run before.
+func (m *MRuby) initParser() {
+	if m.compileContext == nil {
+		m.compileContext = gm.NewCompileContext(m.mrb)
+		m.compileContext.SetFilename(m.Filename)
+		m.compileContext.CaptureErrors(true)
+	}
+
+	if m.parser == nil {
+		m.parser = gm.NewParser(m.mrb)
+	}
+}
+
 // RunScript runs the string provided. Returns a BuildResult
 func (m *MRuby) RunScript(script string) error {
-	if _, err := m.mrb.LoadString(script); err != nil {
-		return m.makeError(err)
+	// parsed with the filename, so the errors raised carry their line.
+	ctx := gm.NewCompileContext(m.mrb)
+	defer ctx.Close()
+	ctx.SetFilename(m.Filename)
+	ctx.CaptureErrors(true)
+
+	parser := gm.NewParser(m.mrb)
+	defer parser.Close()
+
+	if _, err := parser.Parse(script, ctx); err != nil {
+		return m.makeError(m.planError(err, script))
 	}
 
-	if _, err := m.Exec.Layers().MakeImage(m.Exec.Config()); err != nil {
+	if _, err := m.mrb.Run(parser.GenerateCode(), m.mrb.TopSelf()); err != nil {
+		return m.makeError(m.planError(err, script))
+	}
+
+	return m.finishScript(script)
+}
+
+// finishScript makes the image of the plan run, then runs its after and
+// validate blocks.
+func (m *MRuby) finishScript(script string) error {
+	if err := m.Interp.CheckVars(); err != nil {
 		return m.makeError(err)
 	}
 
+	// nothing was built by an inspection, so there is no image to make or
+	// validate.
+	if !m.Interp.Inspecting() {
+		if _, err := m.Exec.Layers().MakeImage(m.Exec.Config()); err != nil {
+			return m.makeError(err)
+		}
+	}
+
+	// the steps of the after block are only reported by an inspection, and
+	// its funcs return their placeholders, like those of the plan.
 	if m.afterFunc != nil {
 		_, err := m.mrb.Yield(m.afterFunc)
 		if err != nil {
-			return m.makeError(err)
+			return m.makeError(m.planError(err, script))
+		}
+	}
+
+	if m.validateFunc != nil && !m.Interp.Inspecting() {
+		_, err := m.mrb.Yield(m.validateFunc)
+		if err != nil {
+			return m.makeError(m.planError(err, script))
 		}
 	}
 
 	return m.makeResult(m.Exec.Image().ImageID())
 }
 
-// Close the interpreter.
+// Source runs the plan read from the file as RunScript does, with its errors
+// located in the file, into the state of the interpreter, such as a repl's.
+// Like RunCode, it takes the previous stack reference and returns the new one,
+// and it is parsed with the parser of RunCode, so the code run after it sees
+// its local variables. If the plan fails, the steps done before the error are
+// kept.
+func (m *MRuby) Source(filename, script string, stackKeep int) (int, error) {
+	m.initParser()
+
+	name := m.Filename
+	m.Filename = filename
+	m.compileContext.SetFilename(filename)
+	defer func() {
+		m.Filename = name
+		m.compileContext.SetFilename(name)
+	}()
+
+	if _, err := m.parser.Parse(script, m.compileContext); err != nil {
+		return stackKeep, m.makeError(m.planError(err, script))
+	}
+
+	keep, _, err := m.mrb.RunWithContext(m.parser.GenerateCode(), m.mrb.TopSelf(), stackKeep)
+	if err != nil {
+		return keep, m.makeError(m.planError(err, script))
+	}
+
+	return keep, m.finishScript(script)
+}
+
+// Close the interpreter. Any on_exit blocks are run first, in reverse order of
+// appearance; their errors are logged, not returned.
 func (m *MRuby) Close() error {
+	for i := len(m.exitFuncs) - 1; i >= 0; i-- {
+		if _, err := m.mrb.Yield(m.exitFuncs[i]); err != nil {
+			m.Globals.Logger.Error(fmt.Sprintf("in on_exit block: %v", err))
+		}
+	}
+	m.exitFuncs = nil
+
 	m.mrb.EnableGC()
 	m.mrb.FullGC()
 	m.mrb.Close()
 	return nil
 }
+
+// CheckSyntax parses the code without running it, and returns the parser's
+// errors.
+func CheckSyntax(filename, code string) error {
+	mrb := gm.NewMrb()
+	defer mrb.Close()
+
+	ctx := gm.NewCompileContext(mrb)
+	defer ctx.Close()
+	ctx.SetFilename(filename)
+	ctx.CaptureErrors(true)
+
+	parser := gm.NewParser(mrb)
+	defer parser.Close()
+
+	_, err := parser.Parse(code, ctx)
+	return err
+}
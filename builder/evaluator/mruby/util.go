@@ -2,6 +2,7 @@ package mruby
 
 import (
 	"fmt"
+	"time"
 
 	gm "github.com/mitchellh/go-mruby"
 	"github.com/pkg/errors"
@@ -49,6 +50,66 @@ func iterateRubyHash(arg *gm.MrbValue, fn func(*gm.MrbValue, *gm.MrbValue) error
 	return nil
 }
 
+// trailingOptions returns the trailing hash argument coerced to a map, or nil
+// if there is none.
+func trailingOptions(args []*gm.MrbValue) (map[string]interface{}, error) {
+	if len(args) == 0 || args[len(args)-1] == nil || args[len(args)-1].Type() != gm.TypeHash {
+		return nil, nil
+	}
+
+	return coerceHash(args[len(args)-1].Hash())
+}
+
+// extractCacheTTL returns the duration supplied as the `cache_ttl` key of
+// the options, or 0 if there is none.
+func extractCacheTTL(options map[string]interface{}) (time.Duration, error) {
+	ttl, ok := options["cache_ttl"].(string)
+	if !ok {
+		return 0, nil
+	}
+
+	dur, err := time.ParseDuration(ttl)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid cache_ttl %q", ttl)
+	}
+
+	return dur, nil
+}
+
+// withoutOptions returns the arguments with the keys removed from a trailing
+// hash argument, which is left out if no other keys remain.
+func (m *MRuby) withoutOptions(args []*gm.MrbValue, keys ...string) ([]*gm.MrbValue, error) {
+	if len(args) == 0 || args[len(args)-1] == nil || args[len(args)-1].Type() != gm.TypeHash {
+		return args, nil
+	}
+
+	hash, err := args[len(args)-1].Call("dup")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		sym, err := gm.String(key).MrbValue(m.mrb).Call("to_sym")
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := hash.Hash().Delete(sym); err != nil {
+			return nil, err
+		}
+	}
+
+	rest := append([]*gm.MrbValue{}, args[:len(args)-1]...)
+
+	if remaining, err := hash.Hash().Keys(); err != nil {
+		return nil, err
+	} else if remaining.Array().Len() > 0 {
+		rest = append(rest, hash)
+	}
+
+	return rest, nil
+}
+
 func checkArgs(args []*gm.MrbValue, l int) error {
 	if len(args) != l {
 		return errors.Errorf("Expected %d arg(s), got %d", l, len(args))
@@ -75,6 +136,16 @@ func extractStringOrArray(m *gm.Mrb, args []*gm.MrbValue) ([]*gm.MrbValue, error
 	return args, nil
 }
 
+func hasBlock(args []*gm.MrbValue) bool {
+	for _, arg := range args {
+		if arg != nil && arg.Type() == gm.TypeProc {
+			return true
+		}
+	}
+
+	return false
+}
+
 func extractStringArgs(args []*gm.MrbValue) []string {
 	strArgs := []string{}
 
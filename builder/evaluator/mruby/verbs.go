@@ -1,8 +1,19 @@
 package mruby
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/box-builder/box/builder/command"
+	"github.com/box-builder/box/types"
+	"github.com/box-builder/box/util"
 	gm "github.com/mitchellh/go-mruby"
 	"github.com/pkg/errors"
 )
@@ -20,22 +31,36 @@ type verbFunc func(args []*gm.MrbValue, self *gm.MrbValue) error
 // verbJumpTable is the dispatch instructions sent to the builder at preparation time.
 func (m *MRuby) verbJumpTable() map[string]*verbDefinition {
 	return map[string]*verbDefinition{
-		"after":      {m.after, gm.ArgsBlock()},
-		"label":      {m.label, gm.ArgsReq(1)},
-		"debug":      {m.debug, gm.ArgsNone()},
-		"set_exec":   {m.setExec, gm.ArgsReq(1)},
-		"workdir":    {m.workdir, gm.ArgsReq(1)},
-		"user":       {m.user, gm.ArgsReq(1)},
-		"flatten":    {m.flatten, gm.ArgsNone()},
-		"tag":        {m.tag, gm.ArgsReq(1)},
-		"entrypoint": {m.entrypoint, gm.ArgsAny()},
-		"from":       {m.from, gm.ArgsReq(1)},
-		"with_user":  {m.withUser, gm.ArgsBlock() | gm.ArgsReq(2)},
-		"inside":     {m.inside, gm.ArgsBlock() | gm.ArgsReq(2)},
-		"env":        {m.env, gm.ArgsAny()},
-		"cmd":        {m.cmd, gm.ArgsAny()},
-		"run":        {m.run, gm.ArgsAny()},
-		"copy":       {m.doCopy, gm.ArgsReq(2)}, // see builder/copy.go
+		"after":            {m.after, gm.ArgsBlock()},
+		"validate":         {m.validate, gm.ArgsBlock()},
+		"on_exit":          {m.onExit, gm.ArgsBlock()},
+		"label":            {m.label, gm.ArgsReq(1)},
+		"debug":            {m.debug, gm.ArgsNone()},
+		"set_exec":         {m.setExec, gm.ArgsReq(1)},
+		"workdir":          {m.workdir, gm.ArgsReq(1)},
+		"user":             {m.user, gm.ArgsReq(1)},
+		"flatten":          {m.flatten, gm.ArgsNone()},
+		"tag":              {m.tag, gm.ArgsReq(1)},
+		"entrypoint":       {m.entrypoint, gm.ArgsAny()},
+		"from":             {m.from, gm.ArgsReq(1) | gm.ArgsOpt(1)},
+		"with_user":        {m.withUser, gm.ArgsBlock() | gm.ArgsReq(2)},
+		"inside":           {m.inside, gm.ArgsBlock() | gm.ArgsReq(2)},
+		"parallel":         {m.parallel, gm.ArgsBlock()},
+		"run_group":        {m.runGroup, gm.ArgsBlock()},
+		"env":              {m.env, gm.ArgsAny()},
+		"unenv":            {m.unenv, gm.ArgsAny()},
+		"build_env":        {m.buildEnv, gm.ArgsReq(1)},
+		"cmd":              {m.cmd, gm.ArgsAny()},
+		"clear_entrypoint": {m.clearEntrypoint, gm.ArgsNone()},
+		"clear_cmd":        {m.clearCmd, gm.ArgsNone()},
+		"shell":            {m.shell, gm.ArgsAny()},
+		"run":              {m.run, gm.ArgsAny()},
+		"copy":             {m.doCopy, gm.ArgsReq(1) | gm.ArgsOpt(2)}, // see builder/copy.go
+		"copy_from":        {m.copyFrom, gm.ArgsReq(3) | gm.ArgsOpt(1)},
+		"add":              {m.add, gm.ArgsReq(2) | gm.ArgsOpt(1)},
+		"write":            {m.write, gm.ArgsReq(2) | gm.ArgsOpt(1)},
+		"mv":               {m.mv, gm.ArgsReq(2)},
+		"rm":               {m.rm, gm.ArgsAny()},
 	}
 }
 
@@ -49,6 +74,26 @@ func (m *MRuby) after(args []*gm.MrbValue, self *gm.MrbValue) error {
 	return nil
 }
 
+func (m *MRuby) validate(args []*gm.MrbValue, self *gm.MrbValue) error {
+	if len(args) != 1 {
+		return errors.New("invalid args to validate")
+	}
+
+	m.validateFunc = args[0]
+
+	return nil
+}
+
+func (m *MRuby) onExit(args []*gm.MrbValue, self *gm.MrbValue) error {
+	if len(args) != 1 {
+		return errors.New("invalid args to on_exit")
+	}
+
+	m.exitFuncs = append(m.exitFuncs, args[0])
+
+	return nil
+}
+
 func (m *MRuby) label(args []*gm.MrbValue, self *gm.MrbValue) error {
 	if len(args) != 1 {
 		return errors.New("label error: please supply a hash for the labels")
@@ -138,26 +183,66 @@ func (m *MRuby) tag(args []*gm.MrbValue, self *gm.MrbValue) error {
 	return m.Interp.Tag(args[0].String())
 }
 
+// entrypoint with nil, or an empty array, clears it like clear_entrypoint.
 func (m *MRuby) entrypoint(args []*gm.MrbValue, self *gm.MrbValue) error {
+	if len(args) == 1 && args[0].Type() == gm.TypeNil {
+		return m.Interp.Entrypoint([]string{})
+	}
+
 	values, err := extractStringOrArray(m.mrb, args)
 	if err != nil {
 		return err
 	}
 
 	stringArgs := extractStringArgs(values)
-	if len(stringArgs) == 0 {
-		stringArgs = nil
-	}
 
 	return m.Interp.Entrypoint(stringArgs)
 }
 
 func (m *MRuby) from(args []*gm.MrbValue, self *gm.MrbValue) error {
-	if err := checkArgs(args, 1); err != nil {
-		return err
+	if len(args) < 1 || len(args) > 2 {
+		return errors.Errorf("Expected 1 or 2 arg(s), got %d", len(args))
+	}
+
+	var (
+		digest   string
+		platform types.Platform
+	)
+
+	if len(args) == 2 {
+		if args[1].Type() != gm.TypeHash {
+			return errors.Errorf("invalid argument %q for from statement", args[1].String())
+		}
+
+		err := iterateRubyHash(args[1], func(key, value *gm.MrbValue) error {
+			switch key.String() {
+			case "digest":
+				digest = value.String()
+			case "arch":
+				platform.Architecture = value.String()
+			case "variant":
+				platform.Variant = value.String()
+			default:
+				return errors.Errorf("%q is not a valid option to from", key.String())
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
 	}
 
-	return m.Interp.From(args[0].String())
+	if args[0].Type() == gm.TypeArray {
+		values, err := extractStringOrArray(m.mrb, args[:1])
+		if err != nil {
+			return err
+		}
+
+		return m.Interp.FromList(extractStringArgs(values), digest, platform)
+	}
+
+	return m.Interp.From(args[0].String(), digest, platform)
 }
 
 func (m *MRuby) withUser(args []*gm.MrbValue, self *gm.MrbValue) error {
@@ -190,25 +275,112 @@ func (m *MRuby) inside(args []*gm.MrbValue, self *gm.MrbValue) error {
 	})
 }
 
+func (m *MRuby) parallel(args []*gm.MrbValue, self *gm.MrbValue) error {
+	if len(args) != 1 || args[0].Type() != gm.TypeProc {
+		return errors.New("invalid args to parallel; it takes a block")
+	}
+
+	return m.Interp.Parallel(func() error {
+		_, err := m.mrb.Yield(args[0])
+		return err
+	})
+}
+
+func (m *MRuby) runGroup(args []*gm.MrbValue, self *gm.MrbValue) error {
+	if len(args) != 1 || args[0].Type() != gm.TypeProc {
+		return errors.New("invalid args to run_group; it takes a block")
+	}
+
+	return m.Interp.RunGroup(func() error {
+		_, err := m.mrb.Yield(args[0])
+		return err
+	})
+}
+
 func (m *MRuby) env(args []*gm.MrbValue, self *gm.MrbValue) error {
 	if err := checkArgs(args, 1); err != nil {
 		return err
 	}
 
 	newEnv := map[string]string{}
+	unset := []string{}
 
+	// a nil value removes the variable.
 	err := iterateRubyHash(args[0], func(key, value *gm.MrbValue) error {
-		newEnv[key.String()] = value.String()
+		if value.Type() == gm.TypeNil {
+			unset = append(unset, key.String())
+		} else {
+			newEnv[key.String()] = value.String()
+		}
 		return nil
 	})
 	if err != nil {
 		return err
 	}
 
-	return m.Interp.Env(newEnv)
+	return m.Interp.Env(newEnv, unset)
 }
 
+func (m *MRuby) buildEnv(args []*gm.MrbValue, self *gm.MrbValue) error {
+	if len(args) != 1 || args[0].Type() != gm.TypeHash {
+		return errors.New("build_env requires a hash of the variables to set")
+	}
+
+	env := map[string]string{}
+
+	err := iterateRubyHash(args[0], func(key, value *gm.MrbValue) error {
+		env[key.String()] = value.String()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return m.Interp.BuildEnv(env)
+}
+
+func (m *MRuby) unenv(args []*gm.MrbValue, self *gm.MrbValue) error {
+	if len(args) == 0 {
+		return errors.New("unenv requires at least one variable to remove")
+	}
+
+	unset := []string{}
+	for _, arg := range args {
+		if arg.Type() != gm.TypeString && arg.Type() != gm.TypeSymbol {
+			return errors.Errorf("invalid argument %q for unenv statement", arg.String())
+		}
+
+		unset = append(unset, arg.String())
+	}
+
+	return m.Interp.Env(nil, unset)
+}
+
+// cmd with nil, or an empty array, clears it like clear_cmd.
 func (m *MRuby) cmd(args []*gm.MrbValue, self *gm.MrbValue) error {
+	if len(args) == 1 && args[0].Type() == gm.TypeNil {
+		return m.Interp.Cmd([]string{})
+	}
+
+	values, err := extractStringOrArray(m.mrb, args)
+	if err != nil {
+		return err
+	}
+
+	stringArgs := extractStringArgs(values)
+
+	return m.Interp.Cmd(stringArgs)
+}
+
+func (m *MRuby) clearEntrypoint(args []*gm.MrbValue, self *gm.MrbValue) error {
+	return m.Interp.Entrypoint([]string{})
+}
+
+func (m *MRuby) clearCmd(args []*gm.MrbValue, self *gm.MrbValue) error {
+	return m.Interp.Cmd([]string{})
+}
+
+func (m *MRuby) shell(args []*gm.MrbValue, self *gm.MrbValue) error {
 	values, err := extractStringOrArray(m.mrb, args)
 	if err != nil {
 		return err
@@ -219,33 +391,422 @@ func (m *MRuby) cmd(args []*gm.MrbValue, self *gm.MrbValue) error {
 		stringArgs = nil
 	}
 
-	return m.Interp.Cmd(stringArgs)
+	return m.Interp.Shell(stringArgs)
 }
 
 func (m *MRuby) run(args []*gm.MrbValue, self *gm.MrbValue) error {
-	if len(args) < 1 {
-		return errors.New("no command to run in run statement")
-	} else if args[0].Type() != gm.TypeString {
+	// `run script: "file"` has no command, only the options.
+	var cmd string
+	var options *gm.MrbValue
+
+	switch {
+	case len(args) > 0 && args[0].Type() == gm.TypeString:
+		cmd = args[0].String()
+		if len(args) > 1 {
+			if args[1].Type() != gm.TypeHash {
+				return errors.Errorf("invalid argument %q for run statement", args[1].String())
+			}
+
+			options = args[1]
+		}
+	case len(args) == 1 && args[0].Type() == gm.TypeHash:
+		options = args[0]
+	default:
 		return errors.New("no command to run in run statement")
 	}
 
-	output := true
+	opts := command.RunOptions{ShowRun: true}
+
+	if options != nil {
+		hash, err := coerceHash(options.Hash())
+		if err != nil {
+			return err
+		}
+
+		if script, ok := hash["script"].(string); ok {
+			if args[0].Type() == gm.TypeString {
+				return errors.New("run takes either a command or a script, not both")
+			}
 
-	if len(args) > 1 {
-		if args[1].Type() == gm.TypeHash {
-			hash, err := coerceHash(args[1].Hash())
+			content, err := readScript(script)
 			if err != nil {
 				return err
 			}
 
-			outstr, ok := hash["output"].(string)
-			if ok && outstr == "false" {
-				output = false
+			if len(content) == 0 {
+				return errors.Errorf("script %q for run statement is empty", script)
+			}
+
+			cmd, opts.Script = string(content), true
+		}
+
+		outstr, ok := hash["output"].(string)
+		if ok && outstr == "false" {
+			opts.ShowRun = false
+		}
+
+		switch mounts := hash["cache_mount"].(type) {
+		case nil:
+		case string:
+			opts.CacheMounts = append(opts.CacheMounts, mounts)
+		default:
+			list, err := util.InterfaceListToString(mounts)
+			if err != nil {
+				return errors.Wrap(err, "invalid cache_mount for run statement")
+			}
+			opts.CacheMounts = append(opts.CacheMounts, list...)
+		}
+
+		switch mounts := hash["tmpfs"].(type) {
+		case nil:
+		case string:
+			opts.Tmpfs = []string{mounts}
+		default:
+			if opts.Tmpfs, err = util.InterfaceListToString(mounts); err != nil {
+				return errors.Wrap(err, "invalid tmpfs for run statement")
 			}
+		}
+
+		if timeout, ok := hash["stop_timeout"].(string); ok {
+			opts.StopTimeout, err = time.ParseDuration(timeout)
+			if err != nil {
+				return errors.Wrapf(err, "invalid stop_timeout %q", timeout)
+			}
+		}
+
+		if opts.Stdin, err = parseStdin(hash["stdin"]); err != nil {
+			return err
+		}
+
+		for key, level := range map[string]**int{"nice": &opts.Nice, "ionice": &opts.IONice} {
+			value, ok := hash[key].(string)
+			if !ok {
+				continue
+			}
+
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return errors.Errorf("invalid %s %q for run statement", key, value)
+			}
+			*level = &n
+		}
+
+		opts.Privileged = hash["privileged"] == "true"
+		opts.Login = hash["login"] == "true"
+		opts.Commit = hash["commit"] == "true"
+		opts.ReadOnly = hash["readonly_rootfs"] == "true"
+
+		switch paths := hash["writable"].(type) {
+		case nil:
+		case string:
+			opts.Writable = []string{paths}
+		default:
+			if opts.Writable, err = util.InterfaceListToString(paths); err != nil {
+				return errors.Wrap(err, "invalid writable for run statement")
+			}
+		}
+
+		if opts.Binds, err = parseBinds(hash["bind"]); err != nil {
+			return err
+		}
+
+		for key, caps := range map[string]*[]string{"cap_add": &opts.CapAdd, "cap_drop": &opts.CapDrop} {
+			switch list := hash[key].(type) {
+			case nil:
+			case string:
+				*caps = []string{list}
+			default:
+				if *caps, err = util.InterfaceListToString(list); err != nil {
+					return errors.Wrapf(err, "invalid %s for run statement", key)
+				}
+			}
+		}
+
+		if codes, ok := hash["allow_exit"]; ok {
+			list, ok := codes.([]interface{})
+			if !ok {
+				list = []interface{}{codes}
+			}
+
+			if opts.AllowExit, err = parseExitCodes(list); err != nil {
+				return err
+			}
+		}
+
+		switch env := hash["env"].(type) {
+		case nil:
+		case map[string]interface{}:
+			opts.Env = map[string]string{}
+			for key, value := range env {
+				str, ok := value.(string)
+				if !ok {
+					return errors.Errorf("invalid value for %q in run env", key)
+				}
+				opts.Env[key] = str
+			}
+		default:
+			return errors.New("env for run statement must be a hash")
+		}
+	}
+
+	if !opts.Script && args[0].Type() != gm.TypeString {
+		return errors.New("no command to run in run statement")
+	}
+
+	return m.Interp.Run(cmd, opts)
+}
+
+// runKeyOptions returns the cache key entries of the options of run which
+// are not in its key as they are given: the targets of its binds, and the
+// names and digests of the contents of its since_file files, its script and
+// its stdin.
+func runKeyOptions(options map[string]interface{}) ([]string, error) {
+	keys := []string{}
+
+	binds, err := parseBinds(options["bind"])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, bind := range binds {
+		keys = append(keys, "bind "+bind.Target)
+	}
+
+	var files []string
+
+	switch value := options["since_file"].(type) {
+	case nil:
+	case string:
+		files = []string{value}
+	default:
+		if files, err = util.InterfaceListToString(value); err != nil {
+			return nil, errors.Wrap(err, "invalid since_file for run statement")
+		}
+	}
+
+	for _, fn := range files {
+		content, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read since_file for run statement")
+		}
+
+		sum := sha256.Sum256(content)
+		keys = append(keys, "since_file "+fn+" sha256:"+hex.EncodeToString(sum[:]))
+	}
+
+	if fn, ok := options["script"].(string); ok {
+		content, err := readScript(fn)
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(content)
+		keys = append(keys, "script "+fn+" sha256:"+hex.EncodeToString(sum[:]))
+	}
+
+	stdin, err := parseStdin(options["stdin"])
+	if err != nil {
+		return nil, err
+	}
+
+	if stdin != nil {
+		sum := sha256.Sum256([]byte(*stdin))
+		keys = append(keys, "stdin sha256:"+hex.EncodeToString(sum[:]))
+	}
+
+	return keys, nil
+}
+
+// readScript reads the script of run, which may not fall below the root build
+// directory, as the sources of copy may not.
+func readScript(fn string) ([]byte, error) {
+	rel, err := relativeSource(fn)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid script for run statement")
+	}
+
+	content, err := ioutil.ReadFile(rel)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read script for run statement")
+	}
+
+	return content, nil
+}
+
+func parseStdin(value interface{}) (*string, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return &value, nil
+	default:
+		return nil, errors.New("stdin for run statement must be a string")
+	}
+}
+
+// parseBinds parses the bind option of run: a hash with src, dst and ro keys,
+// or an array of them. Binds are read-only unless ro is false.
+func parseBinds(value interface{}) ([]command.Bind, error) {
+	var list []interface{}
+
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		list = []interface{}{value}
+	case []interface{}:
+		list = value
+	default:
+		return nil, errors.New("bind for run statement must be a hash or an array of hashes")
+	}
+
+	binds := []command.Bind{}
+
+	for _, item := range list {
+		hash, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("bind for run statement must be a hash or an array of hashes")
+		}
+
+		for key := range hash {
+			if key != "src" && key != "dst" && key != "ro" {
+				return nil, errors.Errorf("invalid key %q in run bind; expected src, dst or ro", key)
+			}
+		}
+
+		src, _ := hash["src"].(string)
+		dst, _ := hash["dst"].(string)
+		if src == "" || dst == "" {
+			return nil, errors.New("bind for run statement requires src and dst")
+		}
+
+		binds = append(binds, command.Bind{Source: src, Target: dst, ReadOnly: hash["ro"] != "false"})
+	}
+
+	return binds, nil
+}
+
+func (m *MRuby) mv(args []*gm.MrbValue, self *gm.MrbValue) error {
+	if err := checkArgs(args, 2); err != nil {
+		return err
+	}
+
+	for _, arg := range args {
+		if arg.Type() != gm.TypeString {
+			return errors.Errorf("invalid argument %q for mv statement", arg.String())
+		}
+	}
+
+	return m.Interp.Move(m.imagePath(args[0].String()), m.imagePath(args[1].String()))
+}
+
+func (m *MRuby) rm(args []*gm.MrbValue, self *gm.MrbValue) error {
+	if len(args) == 0 {
+		return errors.New("no path to remove in rm statement")
+	}
+
+	paths := []string{}
+	for _, arg := range args {
+		if arg.Type() != gm.TypeString {
+			return errors.Errorf("invalid argument %q for rm statement", arg.String())
+		}
+
+		paths = append(paths, m.imagePath(arg.String()))
+	}
+
+	return m.Interp.Remove(paths)
+}
+
+// imagePath resolves a path in the image against the workdir, keeping a
+// trailing slash.
+func (m *MRuby) imagePath(p string) string {
+	if path.IsAbs(p) {
+		return p
+	}
+
+	workdir := m.Exec.Config().WorkDir
+	dir := workdir.Temporary
+	if dir == "" {
+		dir = workdir.Image
+	}
+
+	resolved := path.Join("/", dir, p)
+	if strings.HasSuffix(p, "/") && resolved != "/" {
+		resolved += "/"
+	}
+
+	return resolved
+}
+
+// parseExitCodes parses the exit statuses given to the allow_exit option of
+// run.
+func parseExitCodes(codes []interface{}) ([]int, error) {
+	result := []int{}
+
+	for _, code := range codes {
+		str, ok := code.(string)
+		if !ok {
+			return nil, errors.Errorf("invalid exit status %v in allow_exit", code)
+		}
+
+		stat, err := strconv.Atoi(str)
+		if err != nil {
+			return nil, errors.Errorf("invalid exit status %q in allow_exit", str)
+		}
+		result = append(result, stat)
+	}
+
+	return result, nil
+}
+
+func (m *MRuby) write(args []*gm.MrbValue, self *gm.MrbValue) error {
+	if len(args) < 2 || len(args) > 3 {
+		return errors.Errorf("Expected 2 or 3 arg(s), got %d", len(args))
+	}
+
+	mode := os.FileMode(0644)
+	var owner string
+
+	if len(args) == 3 {
+		if args[2].Type() != gm.TypeHash {
+			return errors.Errorf("invalid argument %q for write statement", args[2].String())
+		}
+
+		err := iterateRubyHash(args[2], func(key, value *gm.MrbValue) error {
+			switch key.String() {
+			case "mode":
+				if value.Type() == gm.TypeFixnum {
+					mode = os.FileMode(value.Fixnum())
+					return nil
+				}
+
+				parsed, err := strconv.ParseUint(value.String(), 8, 32)
+				if err != nil {
+					return errors.Errorf("invalid mode %q for write statement", value.String())
+				}
+				mode = os.FileMode(parsed)
+			case "owner":
+				owner = value.String()
+			default:
+				return errors.Errorf("%q is not a valid option to write", key.String())
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	target := args[0].String()
+	if !path.IsAbs(target) {
+		workdir := m.Exec.Config().WorkDir
+		if workdir.Temporary != "" {
+			target = path.Join(workdir.Temporary, target)
 		} else {
-			return errors.Errorf("invalid argument %q for run statement", args[1].String())
+			target = path.Join(workdir.Image, target)
 		}
 	}
 
-	return m.Interp.Run(args[0].String(), output)
+	return m.Interp.Write(target, args[1].String(), mode, owner)
 }
@@ -3,10 +3,19 @@ package docker
 import (
 	"archive/tar"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/box-builder/box/builder/config"
 	"github.com/box-builder/box/builder/executor"
@@ -14,6 +23,8 @@ import (
 	btypes "github.com/box-builder/box/types"
 	"github.com/box-builder/box/util"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
 )
 
@@ -25,6 +36,13 @@ type Docker struct {
 	stdin   bool
 	layers  layers.Layers
 	image   layers.Image
+
+	// the runs of a parallel block destroy their containers concurrently.
+	keptMutex sync.Mutex
+	kept      []string
+
+	// the daemon's refusal of the priority is only reported once.
+	priorityWarning sync.Once
 }
 
 // NewDocker contypes a new docker instance, for executing against docker
@@ -35,6 +53,10 @@ func NewDocker(globals *btypes.Global) (*Docker, error) {
 		return nil, err
 	}
 
+	if err := waitForDaemon(globals, client); err != nil {
+		return nil, err
+	}
+
 	config := config.NewConfig()
 
 	l, err := layers.NewDocker(globals)
@@ -60,6 +82,41 @@ func NewDocker(globals *btypes.Global) (*Docker, error) {
 	}, nil
 }
 
+// waitForDaemon pings the docker daemon until it answers, backing off between
+// attempts, for up to globals.DaemonTimeout. It does nothing if no timeout is
+// set.
+func waitForDaemon(globals *btypes.Global, client *client.Client) error {
+	if globals.DaemonTimeout == 0 {
+		return nil
+	}
+
+	deadline := time.Now().Add(globals.DaemonTimeout)
+	wait := 100 * time.Millisecond
+
+	for attempt := 1; ; attempt++ {
+		_, err := client.Ping(globals.Context)
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().Add(wait).After(deadline) {
+			return fmt.Errorf("could not connect to the docker daemon after %v: %v", globals.DaemonTimeout, err)
+		}
+
+		globals.Logger.DaemonRetry(attempt, wait, err)
+
+		select {
+		case <-globals.Context.Done():
+			return globals.Context.Err()
+		case <-time.After(wait):
+		}
+
+		if wait *= 2; wait > 5*time.Second {
+			wait = 5 * time.Second
+		}
+	}
+}
+
 // SetStdin turns on the stdin features during run invocations. It is used to
 // facilitate debugging.
 func (d *Docker) SetStdin(on bool) {
@@ -118,19 +175,120 @@ func (d *Docker) Commit(cacheKey string, hook executor.Hook) error {
 		return err
 	}
 
-	commitResp, err := d.client.ContainerCommit(d.globals.Context, id, types.ContainerCommitOptions{Config: d.config.ToDocker(false, d.globals.TTY, d.stdin), Comment: cacheKey})
+	comment := cacheKey
+
+	// a step which changed nothing keeps the image. It is only committed to
+	// be found in the cache, as its parent is the next step's.
+	if d.config.SkipEmpty {
+		changes, err := d.Changes(id)
+		if err != nil {
+			return err
+		}
+
+		if len(changes) == 0 {
+			d.globals.Logger.NoChanges()
+			if !d.globals.Cache {
+				return nil
+			}
+
+			comment += layers.NoChanges
+		}
+	}
+
+	done := d.trace("commit", fmt.Sprintf("id=%s parent=%s comment=%q", id, d.config.Image, comment))
+	commitResp, err := d.client.ContainerCommit(d.globals.Context, id, types.ContainerCommitOptions{Config: d.config.ToDocker(false, d.globals.TTY, d.stdin), Comment: comment})
+	done(err)
 	if err != nil {
 		return fmt.Errorf("Error during commit: %v", err)
 	}
 
-	// try a clean remove first, otherwise the defer above will take over in a last-ditch attempt
-	err = d.client.ContainerRemove(d.globals.Context, id, types.ContainerRemoveOptions{})
-	if err != nil {
-		return fmt.Errorf("Could not remove intermediate container %q: %v", id, err)
+	// try a clean remove first, otherwise the defer above will take over in a last-ditch attempt.
+	// the anonymous volumes of writable paths go with the container.
+	if !d.globals.KeepContainers {
+		done := d.trace("remove", "id="+id)
+		err = d.client.ContainerRemove(d.globals.Context, id, types.ContainerRemoveOptions{RemoveVolumes: true})
+		done(err)
+		if err != nil {
+			return fmt.Errorf("Could not remove intermediate container %q: %v", id, err)
+		}
 	}
 
+	if comment != cacheKey {
+		return nil
+	}
+
+	parent := d.config.Image
 	d.config.Image = commitResp.ID
-	return d.Layers().AddImage(commitResp.ID)
+	if err := d.Layers().AddImage(commitResp.ID); err != nil {
+		return err
+	}
+
+	return d.postCommit(commitResp.ID, parent, cacheKey)
+}
+
+// CommitLayer commits the tar archive of a layer on the current image. Unlike
+// the changes of a container, it is loaded as it is, so its whiteouts remove
+// the paths under them without running anything in the image. Without a
+// layer, only the config is committed, exactly as it is.
+func (d *Docker) CommitLayer(cacheKey string, layer io.Reader) error {
+	if err := util.CheckContext(d.globals.Context); err != nil {
+		return err
+	}
+
+	parent := d.config.Image
+
+	done := d.trace("add layer", fmt.Sprintf("parent=%s comment=%q", parent, cacheKey))
+	err := d.image.AddLayer(layer, cacheKey)
+	done(err)
+	if err != nil {
+		return fmt.Errorf("Error during commit: %v", err)
+	}
+
+	return d.postCommit(d.config.Image, parent, cacheKey)
+}
+
+// postCommit runs the --post-commit-hook, if any, with the id of the image
+// just committed as its last argument. Its output goes to the log between the
+// output markers, and a failure fails the step and removes the image, so the
+// next build does not find it in the cache without running the hook.
+func (d *Docker) postCommit(id, parent, cacheKey string) error {
+	hook := d.globals.PostCommitHook
+	if hook == "" {
+		return nil
+	}
+
+	// the command is run by the shell so it may carry its own arguments;
+	// "$@" adds the id as the last one.
+	cmd := exec.CommandContext(d.globals.Context, "/bin/sh", "-c", hook+` "$@"`, "sh", id)
+	cmd.Env = append(os.Environ(), "BOX_IMAGE_ID="+id, "BOX_PARENT_ID="+parent, "BOX_CACHE_KEY="+cacheKey)
+
+	output, replay := d.globals.Logger.RunOutput(false)
+
+	d.globals.Logger.BeginOutput()
+	cmd.Stdout = output
+	cmd.Stderr = output
+	err := cmd.Run()
+	d.globals.Logger.EndOutput()
+
+	if err != nil {
+		replay()
+
+		done := d.trace("remove image", "id="+id)
+		_, rmErr := d.client.ImageRemove(context.Background(), id, types.ImageRemoveOptions{PruneChildren: true})
+		done(rmErr)
+
+		if ctxErr := d.globals.Context.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		if rmErr != nil {
+			return fmt.Errorf("Post-commit hook %q failed for %s: %v; could not remove the image: %v", hook, id, err, rmErr)
+		}
+
+		return fmt.Errorf("Post-commit hook %q failed for %s: %v", hook, id, err)
+	}
+
+	return nil
 }
 
 // CopyOneFileFromContainer copies a file from the container and returns its content.
@@ -143,7 +301,9 @@ func (d *Docker) CopyOneFileFromContainer(fn string) ([]byte, error) {
 
 	defer d.Destroy(id)
 
+	done := d.trace("copy from container", fmt.Sprintf("id=%s path=%s", id, fn))
 	rc, _, err := d.client.CopyFromContainer(d.globals.Context, id, fn)
+	done(err)
 	if err != nil {
 		return nil, err
 	}
@@ -175,35 +335,293 @@ func (d *Docker) CopyOneFileFromContainer(fn string) ([]byte, error) {
 	return ioutil.ReadAll(tr)
 }
 
+// StatPath returns the mode of the path in the current image, following
+// symlinks, and false if nothing is there.
+func (d *Docker) StatPath(fn string) (os.FileMode, bool, error) {
+	id, err := d.Create()
+	if err != nil {
+		return 0, false, err
+	}
+
+	defer d.Destroy(id)
+
+	done := d.trace("stat path", fmt.Sprintf("id=%s path=%s", id, fn))
+	stat, err := d.client.ContainerStatPath(d.globals.Context, id, fn)
+	done(err)
+	if isPathNotFound(err) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	// the link target is resolved by the daemon, so it is never a link.
+	if stat.Mode&os.ModeSymlink != 0 && stat.LinkTarget != "" {
+		done := d.trace("stat path", fmt.Sprintf("id=%s path=%s", id, stat.LinkTarget))
+		stat, err = d.client.ContainerStatPath(d.globals.Context, id, stat.LinkTarget)
+		done(err)
+		if isPathNotFound(err) {
+			return 0, false, nil
+		} else if err != nil {
+			return 0, false, err
+		}
+	}
+
+	return stat.Mode, true, nil
+}
+
+// isPathNotFound returns true if the error is a stat of a path which does not
+// exist. The response to the stat has no body, so the client only reports its
+// status.
+func isPathNotFound(err error) bool {
+	return err != nil && strings.Contains(err.Error(), http.StatusText(http.StatusNotFound))
+}
+
+// lowest priority levels, used for the steps with Global.LowPriority.
+var lowNice, lowIONice = 19, 7
+
+// priority returns the cpu shares and block I/O weight of the step's
+// container from the niceness of its run, or of --build-priority. Zero leaves
+// docker's default. Niceness 0 and I/O niceness 4 are the defaults of 1024
+// shares and a weight of 500; each level lowers them in even steps.
+func (d *Docker) priority() (int64, uint16) {
+	nice, ionice := d.config.Nice, d.config.IONice
+	if d.globals.LowPriority {
+		if nice == nil {
+			nice = &lowNice
+		}
+
+		if ionice == nil {
+			ionice = &lowIONice
+		}
+	}
+
+	var (
+		shares int64
+		weight uint16
+	)
+
+	if nice != nil {
+		shares = 1024 - int64(*nice)*51
+	}
+
+	if ionice != nil {
+		weight = uint16(900 - *ionice*100)
+	}
+
+	return shares, weight
+}
+
 // Create creates a new container based on the existing configuration.
 func (d *Docker) Create() (string, error) {
+	var hostConfig *container.HostConfig
+
+	shares, weight := d.priority()
+
+	if len(d.config.Mounts) > 0 || len(d.config.Binds) > 0 || len(d.config.Tmpfs) > 0 || d.config.Privileged || len(d.config.CapAdd) > 0 || len(d.config.CapDrop) > 0 || d.config.ReadOnly || shares != 0 || weight != 0 {
+		hostConfig = &container.HostConfig{
+			Privileged:     d.config.Privileged,
+			CapAdd:         d.config.CapAdd,
+			CapDrop:        d.config.CapDrop,
+			Binds:          d.config.Binds,
+			Tmpfs:          d.config.Tmpfs,
+			ReadonlyRootfs: d.config.ReadOnly,
+			Resources:      container.Resources{CPUShares: shares, BlkioWeight: weight},
+		}
+
+		// anonymous volumes, which docker fills with the image's files at
+		// the target, and removes with the container.
+		for _, target := range d.config.Writable {
+			hostConfig.Mounts = append(hostConfig.Mounts, mount.Mount{
+				Type:   mount.TypeVolume,
+				Target: target,
+			})
+		}
+
+		for _, target := range d.config.Mounts {
+			hostConfig.Mounts = append(hostConfig.Mounts, mount.Mount{
+				Type:   mount.TypeVolume,
+				Source: CacheVolume(target),
+				Target: target,
+			})
+		}
+	}
+
+	config := d.config.ToDocker(true, d.tty(), d.stdin || d.config.Stdin != nil)
+	config.StdinOnce = d.config.Stdin != nil
+
+	c := d.config
+	params := fmt.Sprintf("image=%s user=%q workdir=%q entrypoint=%q cmd=%q mounts=%q binds=%q tmpfs=%q", c.Image, c.User.Temporary, c.WorkDir.Temporary, c.Entrypoint.Temporary, c.Cmd.Temporary, c.Mounts, c.Binds, c.Tmpfs)
+	if c.Stdin != nil {
+		params += fmt.Sprintf(" stdin=%d bytes", len(c.Stdin))
+	}
+
+	// the id is only known afterwards, so it is logged by hand.
+	start := time.Now()
 	cont, err := d.client.ContainerCreate(
 		d.globals.Context,
-		d.config.ToDocker(true, d.globals.TTY, d.stdin),
-		nil,
+		config,
+		hostConfig,
 		nil,
 		"",
 	)
+	d.debug("create", params+" id="+cont.ID, start, err)
+
+	// daemons without the cgroup controllers either discard the settings
+	// with a warning, or refuse them; the step then runs at the default
+	// priority. Other errors are returned as they are.
+	if err != nil && (shares != 0 || weight != 0) && isPriorityError(err) && d.globals.Context.Err() == nil {
+		d.priorityWarning.Do(func() {
+			d.globals.Logger.Warning(fmt.Sprintf("the daemon refused the priority of the step, running it at the default: %v", err))
+		})
+
+		hostConfig.Resources = container.Resources{}
+		start = time.Now()
+		cont, err = d.client.ContainerCreate(d.globals.Context, config, hostConfig, nil, "")
+		d.debug("create", params+" id="+cont.ID, start, err)
+	} else if err == nil && (shares != 0 || weight != 0) && len(cont.Warnings) > 0 {
+		d.priorityWarning.Do(func() {
+			d.globals.Logger.Warning(strings.Join(cont.Warnings, "; "))
+		})
+	}
 
 	return cont.ID, err
 }
 
+// priorityErrors are parts of the errors of daemons refusing the cpu shares or
+// block I/O weight of a container.
+var priorityErrors = []string{"cpu shares", "cpu-shares", "cpushares", "cpu.shares", "cpu.weight", "blkio", "block i/o", "io.weight"}
+
+// isPriorityError returns true if the error is the daemon refusing the
+// priority of a container.
+func isPriorityError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, part := range priorityErrors {
+		if strings.Contains(msg, part) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CacheVolume returns the name of the docker volume that persists the cache
+// mount at the path between builds.
+func CacheVolume(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return "box-cache-" + hex.EncodeToString(sum[:])[:16]
+}
+
 // Destroy destroys a container for the given id.
 func (d *Docker) Destroy(id string) error {
+	if d.globals.KeepContainers {
+		d.keep(id)
+		return nil
+	}
+
 	// XXX do not use the stored context because it may already be canceled when we arrive at this code.
-	return d.client.ContainerRemove(context.Background(), id, types.ContainerRemoveOptions{Force: true})
+	done := d.trace("destroy", "id="+id)
+	err := d.client.ContainerRemove(context.Background(), id, types.ContainerRemoveOptions{Force: true, RemoveVolumes: true})
+	done(err)
+	return err
+}
+
+// keep records the container as kept, once; a container may be destroyed
+// more than once, such as after a failed run.
+func (d *Docker) keep(id string) {
+	d.keptMutex.Lock()
+	defer d.keptMutex.Unlock()
+
+	for _, kept := range d.kept {
+		if kept == id {
+			return
+		}
+	}
+
+	d.kept = append(d.kept, id)
+}
+
+// KeptContainers returns the IDs of the containers which were not destroyed,
+// as Global.KeepContainers is set, in the order they were left.
+func (d *Docker) KeptContainers() []string {
+	d.keptMutex.Lock()
+	defer d.keptMutex.Unlock()
+
+	return append([]string{}, d.kept...)
 }
 
 // CopyFromContainer copies a series of files in a similar fashion to
 // CopyToContainer, just in reverse.
 func (d *Docker) CopyFromContainer(id, path string) (io.Reader, int64, error) {
+	done := d.trace("copy from container", fmt.Sprintf("id=%s path=%s", id, path))
 	rc, stat, err := d.client.CopyFromContainer(d.globals.Context, id, path)
+	done(err)
 	return rc, stat.Size, err
 }
 
+// Changes returns the changes to the filesystem of the container relative to
+// its image. Modified paths which are not the parent of another change are
+// inspected to tell directories from files.
+func (d *Docker) Changes(id string) ([]executor.Change, error) {
+	done := d.trace("diff", "id="+id)
+	items, err := d.client.ContainerDiff(d.globals.Context, id)
+	done(err)
+	if err != nil {
+		return nil, err
+	}
+
+	parents := map[string]struct{}{}
+	for _, item := range items {
+		for dir := path.Dir(item.Path); dir != "/" && dir != "."; dir = path.Dir(dir) {
+			parents[dir] = struct{}{}
+		}
+	}
+
+	changes := []executor.Change{}
+
+	for _, item := range items {
+		change := executor.Change{Path: item.Path, Kind: executor.ChangeKind(item.Kind)}
+
+		if change.Kind == executor.Modified {
+			if _, ok := parents[item.Path]; ok {
+				change.Dir = true
+			} else {
+				done := d.trace("stat path", fmt.Sprintf("id=%s path=%s", id, item.Path))
+				stat, err := d.client.ContainerStatPath(d.globals.Context, id, item.Path)
+				done(err)
+				if err != nil {
+					return nil, err
+				}
+				change.Dir = stat.Mode.IsDir()
+			}
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes, nil
+}
+
 // CopyToContainer copies files from the tarfile specified in reader to the
 // containerto the container so it can then be committed. It does not close the
 // reader.
 func (d *Docker) CopyToContainer(id string, r io.Reader) error {
-	return d.client.CopyToContainer(d.globals.Context, id, "/", r, types.CopyToContainerOptions{AllowOverwriteDirWithFile: true})
+	done := d.trace("copy to container", "id="+id)
+	err := d.client.CopyToContainer(d.globals.Context, id, "/", r, types.CopyToContainerOptions{AllowOverwriteDirWithFile: true})
+	done(err)
+	return err
+}
+
+// trace starts timing a call to the daemon, which is logged with --debug once
+// the returned function is given its error. Environment variables are never
+// logged, as they often carry secrets.
+func (d *Docker) trace(op, params string) func(error) {
+	start := time.Now()
+	return func(err error) { d.debug(op, params, start, err) }
+}
+
+// debug logs a call to the daemon started at start, with --debug.
+func (d *Docker) debug(op, params string, start time.Time, err error) {
+	if d.globals.Debug {
+		d.globals.Logger.Debug(op, params, time.Since(start), err)
+	}
 }
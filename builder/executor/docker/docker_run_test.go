@@ -11,7 +11,7 @@ import (
 )
 
 var (
-	runGlobals = &types.Global{Context: context.Background(), Logger: logger.New("", false), ShowRun: true}
+	runGlobals = &types.Global{Context: context.Background(), Logger: logger.New("", false, 0), ShowRun: true}
 )
 
 func (ds *dockerSuite) TestRunCommit(c *C) {
@@ -3,6 +3,7 @@ package docker
 import (
 	"archive/tar"
 	"context"
+	"errors"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -62,7 +63,7 @@ func (ds *dockerSuite) TearDownSuite(c *C) {
 func (ds *dockerSuite) TestCreate(c *C) {
 	d, err := NewDocker(&btypes.Global{
 		Context: context.Background(),
-		Logger:  logger.New("", false),
+		Logger:  logger.New("", false, 0),
 		ShowRun: true,
 		TTY:     ds.tty,
 	})
@@ -76,10 +77,23 @@ func (ds *dockerSuite) TestCreate(c *C) {
 	c.Assert(id, Not(Equals), "")
 }
 
+func (ds *dockerSuite) TestPriorityError(c *C) {
+	for msg, refused := range map[string]bool{
+		"Error response from daemon: Your kernel does not support CPU shares or the cgroup is not mounted. Shares discarded.": true,
+		"Error response from daemon: Range of CPU shares is from 2 to 262144":                                                 true,
+		"Error response from daemon: invalid --blkio-weight: Range is from 10 to 1000":                                        true,
+		"OCI runtime create failed: cpu.weight: no such file or directory":                                                    true,
+		"Error response from daemon: No such image: missing:latest":                                                           false,
+		"Error response from daemon: invalid mount config for type \"bind\": bind source path does not exist: /missing":       false,
+	} {
+		c.Assert(isPriorityError(errors.New(msg)), Equals, refused, Commentf("%s", msg))
+	}
+}
+
 func (ds *dockerSuite) TestCopy(c *C) {
 	d, err := NewDocker(&btypes.Global{
 		Context: context.Background(),
-		Logger:  logger.New("", false),
+		Logger:  logger.New("", false, 0),
 		ShowRun: true,
 		TTY:     ds.tty,
 	})
@@ -88,7 +102,7 @@ func (ds *dockerSuite) TestCopy(c *C) {
 	_, err = d.Layers().Fetch(d.config, "debian:latest")
 	c.Assert(err, IsNil)
 
-	file, _, err := bt.Archive(context.Background(), ".", ".", []string{}, d.globals.Logger)
+	file, _, err := bt.Archive(context.Background(), ".", ".", []string{}, nil, false, d.globals.Logger)
 	c.Assert(err, IsNil)
 
 	f, err := os.Open(file)
@@ -132,7 +146,7 @@ func (ds *dockerSuite) TestCommitCache(c *C) {
 
 	d, err := NewDocker(&btypes.Global{
 		Context: context.Background(),
-		Logger:  logger.New("", false),
+		Logger:  logger.New("", false, 0),
 		ShowRun: true,
 		Cache:   true,
 		TTY:     ds.tty,
@@ -152,7 +166,7 @@ func (ds *dockerSuite) TestCommitCache(c *C) {
 
 	d, err = NewDocker(&btypes.Global{
 		Context: context.Background(),
-		Logger:  logger.New("", false),
+		Logger:  logger.New("", false, 0),
 		ShowRun: true,
 		Cache:   true,
 		TTY:     ds.tty,
@@ -172,7 +186,7 @@ func (ds *dockerSuite) TestCommitCache(c *C) {
 
 	d, err = NewDocker(&btypes.Global{
 		Context: context.Background(),
-		Logger:  logger.New("", false),
+		Logger:  logger.New("", false, 0),
 		ShowRun: true,
 		Cache:   true,
 		TTY:     ds.tty,
@@ -192,7 +206,7 @@ func (ds *dockerSuite) TestCommitCache(c *C) {
 func (ds *dockerSuite) clearDockerPrefix(c *C, prefix string) {
 	d, err := NewDocker(&btypes.Global{
 		Context: context.Background(),
-		Logger:  logger.New("", false),
+		Logger:  logger.New("", false, 0),
 		ShowRun: true,
 		Cache:   true,
 		TTY:     ds.tty,
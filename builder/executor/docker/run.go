@@ -5,9 +5,9 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"os"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/pkg/stdcopy"
@@ -31,12 +31,19 @@ func (d *Docker) stdinCopy(conn net.Conn, errChan chan error) (io.WriteCloser, *
 	return nil, nil
 }
 
+// tty returns true if the step's container has a tty. Content written to the
+// command's stdin would be mangled by one, so it is then turned off.
+func (d *Docker) tty() bool {
+	return d.globals.TTY && d.config.Stdin == nil
+}
+
 func (d *Docker) handleRunError(ctx context.Context, id string, errChan chan error) {
 	select {
 	case <-ctx.Done():
 		if ctx.Err() != nil {
 			d.globals.Logger.Error(ctx.Err())
 		}
+		d.stop(id)
 		d.Destroy(id)
 	case err, ok := <-errChan:
 		if ok {
@@ -46,19 +53,54 @@ func (d *Docker) handleRunError(ctx context.Context, id string, errChan chan err
 	}
 }
 
-// RunHook is the run hook for docker agents.
-func (d *Docker) RunHook(ctx context.Context, id string) error {
-	errChan := make(chan error, 1)
-	defer close(errChan)
+// stop sends the container its stop signal, then kills it if it has not
+// exited after the grace period.
+func (d *Docker) stop(id string) error {
+	var timeout *time.Duration
+	if d.config.StopGrace != 0 {
+		grace := d.config.StopGrace
+		timeout = &grace
+	}
 
-	go d.handleRunError(ctx, id, errChan)
+	// XXX the stored context is canceled at this point, like in Destroy.
+	done := d.trace("stop", "id="+id)
+	err := d.client.ContainerStop(context.Background(), id, timeout)
+	done(err)
+	return err
+}
 
-	cearesp, err := d.client.ContainerAttach(ctx, id, types.ContainerAttachOptions{Stream: true, Stdin: d.stdin, Stdout: true, Stderr: true})
+// RunHook is the run hook for docker agents. If the context is canceled, the
+// command is stopped gracefully before RunHook returns.
+func (d *Docker) RunHook(ctx context.Context, id string) error {
+	errChan := make(chan error, 1)
+	handled := make(chan struct{})
+	defer func() {
+		close(errChan)
+		<-handled
+	}()
+
+	go func() {
+		d.handleRunError(ctx, id, errChan)
+		close(handled)
+	}()
+
+	done := d.trace("attach", "id="+id)
+	cearesp, err := d.client.ContainerAttach(ctx, id, types.ContainerAttachOptions{Stream: true, Stdin: d.stdin || d.config.Stdin != nil, Stdout: true, Stderr: true})
+	done(err)
 	if err != nil {
 		return fmt.Errorf("Could not attach to container: %v", err)
 	}
 	defer cearesp.Close()
 
+	// a command which exits without reading all of its input is not an
+	// error, so neither is failing to write it.
+	if content := d.config.Stdin; content != nil {
+		go func() {
+			cearesp.Conn.Write(content)
+			cearesp.CloseWrite()
+		}()
+	}
+
 	w, state := d.stdinCopy(cearesp.Conn, errChan)
 	if w != nil {
 		defer w.Close()
@@ -73,7 +115,7 @@ func (d *Docker) RunHook(ctx context.Context, id string) error {
 		return err
 	}
 
-	if stat != 0 {
+	if !d.config.ExitAllowed(stat) {
 		return fmt.Errorf("Command exited with status %d for container %q", stat, id)
 	}
 
@@ -95,48 +137,101 @@ repeat:
 }
 
 func (d *Docker) startAndWait(ctx context.Context, id string, reader io.Reader, errChan chan error) (int, error) {
+	done := d.trace("start", "id="+id)
 	err := d.client.ContainerStart(ctx, id, types.ContainerStartOptions{})
+	done(err)
 	if err != nil {
 		return -1, fmt.Errorf("Could not start container: %v", err)
 	}
 
-	var writer io.Writer = os.Stdout
+	// output which is not shown is held, to be shown if the command fails.
+	writer, replay := d.globals.Logger.RunOutput(!d.globals.ShowRun)
 
 	if !d.stdin && d.globals.ShowRun {
 		d.globals.Logger.BeginOutput()
 		defer d.globals.Logger.EndOutput()
 	}
 
-	var buf *bytes.Buffer
+	copied := make(chan struct{})
 
-	if !d.globals.ShowRun {
-		buf = bytes.NewBuffer([]byte{})
-		reader = io.TeeReader(reader, buf)
-		writer = ioutil.Discard
-	}
-
-	if !d.globals.TTY {
+	if !d.tty() {
 		go func() {
+			defer close(copied)
 			// docker mux's the streams, and requires this stdcopy library to unpack them.
-			_, err = stdcopy.StdCopy(writer, writer, reader)
+			_, err := stdcopy.StdCopy(writer, writer, reader)
 			if err != nil && err != io.EOF {
 				select {
+				case errChan <- err:
 				default:
-					errChan <- err
 				}
 			}
 		}()
 	} else {
-		go doCopy(writer, reader, errChan)
+		go func() {
+			defer close(copied)
+			doCopy(writer, reader, errChan)
+		}()
 	}
 
+	done = d.trace("wait", "id="+id)
 	stat, err := d.client.ContainerWait(ctx, id)
+	done(err)
 	if err != nil {
-		if buf != nil {
-			fmt.Println(buf)
-		}
+		replay()
 		return -1, err
 	}
 
+	// the stream ends with the command, so all of its output is written
+	// before it is replayed.
+	if !d.config.ExitAllowed(int(stat)) {
+		<-copied
+		replay()
+	}
+
 	return int(stat), nil
 }
+
+// RunCapture runs the temporary command in a throwaway container without
+// committing it. Returns the output and exit status of the command.
+func (d *Docker) RunCapture(ctx context.Context) (string, int, error) {
+	// a tty would merge the streams in a way we can't unpack, so it is always
+	// off here.
+	start := time.Now()
+	cont, err := d.client.ContainerCreate(ctx, d.config.ToDocker(true, false, false), nil, nil, "")
+	d.debug("create", fmt.Sprintf("image=%s entrypoint=%q cmd=%q id=%s", d.config.Image, d.config.Entrypoint.Temporary, d.config.Cmd.Temporary, cont.ID), start, err)
+	if err != nil {
+		return "", -1, err
+	}
+
+	defer d.Destroy(cont.ID)
+
+	done := d.trace("attach", "id="+cont.ID)
+	cearesp, err := d.client.ContainerAttach(ctx, cont.ID, types.ContainerAttachOptions{Stream: true, Stdout: true, Stderr: true})
+	done(err)
+	if err != nil {
+		return "", -1, fmt.Errorf("Could not attach to container: %v", err)
+	}
+	defer cearesp.Close()
+
+	done = d.trace("start", "id="+cont.ID)
+	err = d.client.ContainerStart(ctx, cont.ID, types.ContainerStartOptions{})
+	done(err)
+	if err != nil {
+		return "", -1, fmt.Errorf("Could not start container: %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+
+	if _, err := stdcopy.StdCopy(buf, buf, cearesp.Reader); err != nil && err != io.EOF {
+		return "", -1, err
+	}
+
+	done = d.trace("wait", "id="+cont.ID)
+	stat, err := d.client.ContainerWait(ctx, cont.ID)
+	done(err)
+	if err != nil {
+		return buf.String(), -1, err
+	}
+
+	return buf.String(), int(stat), nil
+}
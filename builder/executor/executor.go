@@ -3,6 +3,7 @@ package executor
 import (
 	"context"
 	"io"
+	"os"
 
 	"github.com/box-builder/box/builder/config"
 	"github.com/box-builder/box/layers"
@@ -11,6 +12,26 @@ import (
 // Hook is a hook used in commit calls
 type Hook func(context.Context, string) error
 
+// ChangeKind is the kind of a change to a container's filesystem.
+type ChangeKind int
+
+const (
+	// Modified is the kind of a path changed in place.
+	Modified ChangeKind = iota
+	// Added is the kind of a path created in the container.
+	Added
+	// Deleted is the kind of a path removed from the container.
+	Deleted
+)
+
+// Change is a path changed in a container's filesystem relative to its image.
+// Dir is set for modified directories.
+type Change struct {
+	Path string
+	Kind ChangeKind
+	Dir  bool
+}
+
 // Executor is an engine for talking to different layering/execution context
 // subsystems. It is the meat-and-potatoes of image building.
 type Executor interface {
@@ -23,6 +44,10 @@ type Executor interface {
 	// Commit commits an entry to the layer list.
 	Commit(string, Hook) error
 
+	// CommitLayer commits the tar archive of a layer, which may hold
+	// whiteouts, on the current image. A nil layer commits only the config.
+	CommitLayer(string, io.Reader) error
+
 	// CopyFromContainer copies a series of files in a similar fashion to
 	// CopyToContainer, just in reverse.
 	CopyFromContainer(string, string) (io.Reader, int64, error)
@@ -34,6 +59,10 @@ type Executor interface {
 	// CopyOneFileFromContainer copies a file from the container and returns its content.
 	CopyOneFileFromContainer(string) ([]byte, error)
 
+	// StatPath returns the mode of the path in the current image, following
+	// symlinks, and false if nothing is there.
+	StatPath(string) (os.FileMode, bool, error)
+
 	// Create a container. Returns the container ID.
 	Create() (string, error)
 
@@ -44,6 +73,14 @@ type Executor interface {
 	// statement.
 	RunHook(context.Context, string) error
 
+	// Changes returns the changes to the filesystem of a container, by ID,
+	// relative to its image.
+	Changes(string) ([]Change, error)
+
+	// RunCapture runs the temporary command in a throwaway container without
+	// committing it. Returns the output and exit status of the command.
+	RunCapture(context.Context) (string, int, error)
+
 	// SetStdin turns on the stdin features during run invocations. It is used to
 	// facilitate debugging.
 	SetStdin(bool)
@@ -53,4 +90,8 @@ type Executor interface {
 
 	// Image returns the image handler for this executor.
 	Image() layers.Image
+
+	// KeptContainers returns the IDs of the containers which were not
+	// destroyed, as Global.KeepContainers is set.
+	KeptContainers() []string
 }
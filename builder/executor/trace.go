@@ -0,0 +1,386 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/box-builder/box/builder/config"
+	"github.com/box-builder/box/layers"
+	"github.com/box-builder/box/logger"
+	"github.com/box-builder/box/types"
+)
+
+// Observer is called after each operation of an observed executor with the
+// operation's name, parameters, duration and error. nested is true for
+// operations started by another operation, such as the runs of a commit's
+// hook, so their time is not counted twice.
+type Observer func(op, params string, elapsed time.Duration, err error, nested bool)
+
+// observation is shared by the wrappers of an executor and its layer and
+// image handlers, so nesting is tracked across them. An operation is nested if
+// it was started by the hook of a commit, the only operation calling back into
+// the plan. The runs of a parallel block are observed concurrently without
+// being nested in each other, so the hooks running are counted, not the
+// operations.
+type observation struct {
+	observer Observer
+	mutex    sync.Mutex
+	hooks    int
+}
+
+// tracer is an Executor which reports each operation of the executor it
+// wraps, and of its layer and image handlers, to an Observer. Environment
+// variables are never reported, as they often carry secrets.
+type tracer struct {
+	exec   Executor
+	obs    *observation
+	ops    bool // false if the executor reports its own operations
+	layers *layerTracer
+	image  *imageTracer
+}
+
+type layerTracer struct {
+	layers.Layers
+	obs *observation
+}
+
+type imageTracer struct {
+	layers.Image
+	obs *observation
+}
+
+// Observe wraps the executor so its operations are reported to the observer.
+// Operations which only read or set local state, such as Config, are not
+// reported.
+func Observe(exec Executor, observer Observer) Executor {
+	return observe(exec, observer, true)
+}
+
+// Trace wraps the executor so the operations of its layer and image handlers
+// are logged through the logger's Debug method. The executor logs its own
+// calls to the daemon with --debug, including those it makes internally, such
+// as the create of a commit, so they are not logged here.
+func Trace(exec Executor, logger *logger.Logger) Executor {
+	return observe(exec, func(op, params string, elapsed time.Duration, err error, nested bool) {
+		logger.Debug(op, params, elapsed, err)
+	}, false)
+}
+
+func observe(exec Executor, observer Observer, ops bool) Executor {
+	obs := &observation{observer: observer}
+
+	return &tracer{
+		exec:   exec,
+		obs:    obs,
+		ops:    ops,
+		layers: &layerTracer{Layers: exec.Layers(), obs: obs},
+		image:  &imageTracer{Image: exec.Image(), obs: obs},
+	}
+}
+
+// trace is like observation.trace for the operations of the executor, which
+// are only reported if the tracer reports them.
+func (t *tracer) trace(op, params string) func(error) {
+	if !t.ops {
+		return func(error) {}
+	}
+	return t.obs.trace(op, params)
+}
+
+// trace starts timing the operation. The returned function reports it with
+// the error it returned.
+func (o *observation) trace(op, params string) func(error) {
+	start := time.Now()
+	nested := o.inHook()
+
+	return func(err error) {
+		o.observer(op, params, time.Since(start), err, nested)
+	}
+}
+
+// inHook returns true if the hook of a commit is running.
+func (o *observation) inHook() bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.hooks > 0
+}
+
+// hook wraps the hook of a commit so that the operations it starts are
+// nested.
+func (o *observation) hook(hook Hook) Hook {
+	if hook == nil {
+		return nil
+	}
+
+	return func(ctx context.Context, id string) error {
+		o.mutex.Lock()
+		o.hooks++
+		o.mutex.Unlock()
+
+		defer func() {
+			o.mutex.Lock()
+			o.hooks--
+			o.mutex.Unlock()
+		}()
+
+		return hook(ctx, id)
+	}
+}
+
+func (t *tracer) LoadConfig(c *config.Config) error {
+	return t.exec.LoadConfig(c)
+}
+
+func (t *tracer) Config() *config.Config {
+	return t.exec.Config()
+}
+
+func (t *tracer) SetStdin(on bool) {
+	t.exec.SetStdin(on)
+}
+
+func (t *tracer) KeptContainers() []string {
+	return t.exec.KeptContainers()
+}
+
+func (t *tracer) Layers() layers.Layers {
+	return t.layers
+}
+
+func (t *tracer) Image() layers.Image {
+	return t.image
+}
+
+func (t *tracer) Commit(cacheKey string, hook Hook) error {
+	done := t.trace("commit", fmt.Sprintf("parent=%s comment=%q", t.exec.Config().Image, cacheKey))
+	err := t.exec.Commit(cacheKey, t.obs.hook(hook))
+	done(err)
+	return err
+}
+
+func (t *tracer) CommitLayer(cacheKey string, layer io.Reader) error {
+	done := t.trace("commit layer", fmt.Sprintf("parent=%s comment=%q", t.exec.Config().Image, cacheKey))
+	err := t.exec.CommitLayer(cacheKey, layer)
+	done(err)
+	return err
+}
+
+func (t *tracer) CopyFromContainer(id, path string) (io.Reader, int64, error) {
+	done := t.trace("copy from container", fmt.Sprintf("id=%s path=%s", id, path))
+	r, size, err := t.exec.CopyFromContainer(id, path)
+	done(err)
+	return r, size, err
+}
+
+func (t *tracer) CopyToContainer(id string, r io.Reader) error {
+	done := t.trace("copy to container", "id="+id)
+	err := t.exec.CopyToContainer(id, r)
+	done(err)
+	return err
+}
+
+func (t *tracer) CopyOneFileFromContainer(fn string) ([]byte, error) {
+	done := t.trace("copy file from container", fmt.Sprintf("image=%s path=%s", t.exec.Config().Image, fn))
+	content, err := t.exec.CopyOneFileFromContainer(fn)
+	done(err)
+	return content, err
+}
+
+func (t *tracer) StatPath(fn string) (os.FileMode, bool, error) {
+	done := t.trace("stat path", fmt.Sprintf("image=%s path=%s", t.exec.Config().Image, fn))
+	mode, ok, err := t.exec.StatPath(fn)
+	done(err)
+	return mode, ok, err
+}
+
+func (t *tracer) Create() (string, error) {
+	if !t.ops {
+		return t.exec.Create()
+	}
+
+	c := t.exec.Config()
+	params := fmt.Sprintf("image=%s user=%q workdir=%q entrypoint=%q cmd=%q mounts=%q binds=%q tmpfs=%q", c.Image, c.User.Temporary, c.WorkDir.Temporary, c.Entrypoint.Temporary, c.Cmd.Temporary, c.Mounts, c.Binds, c.Tmpfs)
+	if c.Stdin != nil {
+		params += fmt.Sprintf(" stdin=%d bytes", len(c.Stdin))
+	}
+
+	// the id is only known afterwards, so this is reported by hand.
+	start := time.Now()
+	nested := t.obs.inHook()
+	id, err := t.exec.Create()
+	t.obs.observer("create", params+" id="+id, time.Since(start), err, nested)
+	return id, err
+}
+
+func (t *tracer) Destroy(id string) error {
+	done := t.trace("destroy", "id="+id)
+	err := t.exec.Destroy(id)
+	done(err)
+	return err
+}
+
+func (t *tracer) RunHook(ctx context.Context, id string) error {
+	done := t.trace("start and wait", "id="+id)
+	err := t.exec.RunHook(ctx, id)
+	done(err)
+	return err
+}
+
+func (t *tracer) Changes(id string) ([]Change, error) {
+	done := t.trace("diff", "id="+id)
+	changes, err := t.exec.Changes(id)
+	done(err)
+	return changes, err
+}
+
+func (t *tracer) RunCapture(ctx context.Context) (string, int, error) {
+	c := t.exec.Config()
+	done := t.trace("run capture", fmt.Sprintf("image=%s entrypoint=%q cmd=%q", c.Image, c.Entrypoint.Temporary, c.Cmd.Temporary))
+	out, status, err := t.exec.RunCapture(ctx)
+	done(err)
+	return out, status, err
+}
+
+func (l *layerTracer) Fetch(c *config.Config, name string) (string, error) {
+	done := l.obs.trace("pull", "image="+name)
+	id, err := l.Layers.Fetch(c, name)
+	done(err)
+	return id, err
+}
+
+func (l *layerTracer) Pull(name string) (string, error) {
+	done := l.obs.trace("pull", "image="+name)
+	id, err := l.Layers.Pull(name)
+	done(err)
+	return id, err
+}
+
+func (l *layerTracer) Load(r io.Reader) (string, error) {
+	done := l.obs.trace("load", "")
+	id, err := l.Layers.Load(r)
+	done(err)
+	return id, err
+}
+
+func (l *layerTracer) AddImage(id string) error {
+	done := l.obs.trace("add image", "id="+id)
+	err := l.Layers.AddImage(id)
+	done(err)
+	return err
+}
+
+func (l *layerTracer) MakeImage(c *config.Config) (string, error) {
+	done := l.obs.trace("make image", "image="+c.Image)
+	id, err := l.Layers.MakeImage(c)
+	done(err)
+	return id, err
+}
+
+func (l *layerTracer) Lookup(c *config.Config, name string) (string, error) {
+	done := l.obs.trace("lookup", "image="+name)
+	id, err := l.Layers.Lookup(c, name)
+	done(err)
+	return id, err
+}
+
+func (l *layerTracer) Resolve(name string) (string, error) {
+	done := l.obs.trace("resolve", "image="+name)
+	id, err := l.Layers.Resolve(name)
+	done(err)
+	return id, err
+}
+
+func (l *layerTracer) ResolvePlatform(name, digest string, platform types.Platform) (string, error) {
+	done := l.obs.trace("resolve platform", fmt.Sprintf("image=%s digest=%s arch=%s variant=%s", name, digest, platform.Architecture, platform.Variant))
+	resolved, err := l.Layers.ResolvePlatform(name, digest, platform)
+	done(err)
+	return resolved, err
+}
+
+func (l *layerTracer) RepoDigests(id string) ([]string, error) {
+	done := l.obs.trace("inspect digests", "id="+id)
+	digests, err := l.Layers.RepoDigests(id)
+	done(err)
+	return digests, err
+}
+
+func (l *layerTracer) LayerDigests(id string) ([]string, error) {
+	done := l.obs.trace("inspect layers", "id="+id)
+	digests, err := l.Layers.LayerDigests(id)
+	done(err)
+	return digests, err
+}
+
+func (l *layerTracer) RepoTags(id string) ([]string, error) {
+	done := l.obs.trace("inspect tags", "id="+id)
+	tags, err := l.Layers.RepoTags(id)
+	done(err)
+	return tags, err
+}
+
+func (l *layerTracer) ImageSize(id string) (int64, error) {
+	done := l.obs.trace("inspect size", "id="+id)
+	size, err := l.Layers.ImageSize(id)
+	done(err)
+	return size, err
+}
+
+func (i *imageTracer) Flatten(r io.Reader) error {
+	done := i.obs.trace("flatten", "")
+	err := i.Image.Flatten(r)
+	done(err)
+	return err
+}
+
+func (i *imageTracer) Tag(name string) error {
+	done := i.obs.trace("tag", "name="+name)
+	err := i.Image.Tag(name)
+	done(err)
+	return err
+}
+
+func (i *imageTracer) CheckCache(cacheKey string) (bool, error) {
+	done := i.obs.trace("check cache", fmt.Sprintf("comment=%q", cacheKey))
+	cached, err := i.Image.CheckCache(cacheKey)
+	done(err)
+	return cached, err
+}
+
+func (i *imageTracer) AddLayer(layer io.Reader, cacheKey string) error {
+	done := i.obs.trace("add layer", fmt.Sprintf("parent=%s comment=%q", i.Image.ImageID(), cacheKey))
+	err := i.Image.AddLayer(layer, cacheKey)
+	done(err)
+	return err
+}
+
+func (i *imageTracer) UseImage(id string) error {
+	done := i.obs.trace("use image", "id="+id)
+	err := i.Image.UseImage(id)
+	done(err)
+	return err
+}
+
+func (i *imageTracer) Push(tag string) (string, error) {
+	done := i.obs.trace("push", "tag="+tag)
+	ref, err := i.Image.Push(tag)
+	done(err)
+	return ref, err
+}
+
+func (i *imageTracer) PushCache(tag string) (string, error) {
+	done := i.obs.trace("push cache", "tag="+tag)
+	ref, err := i.Image.PushCache(tag)
+	done(err)
+	return ref, err
+}
+
+func (i *imageTracer) Save(filename, kind, tag string) error {
+	done := i.obs.trace("save", fmt.Sprintf("file=%s kind=%s tag=%s", filename, kind, tag))
+	err := i.Image.Save(filename, kind, tag)
+	done(err)
+	return err
+}
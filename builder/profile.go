@@ -0,0 +1,94 @@
+package builder
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Profile is where a build spent its time, as recorded with the Profile
+// global.
+type Profile struct {
+	Plan       time.Duration      // time in the evaluator, running the plan's own code
+	Executor   time.Duration      // time in executor operations started by the plan
+	Operations []ProfileOperation // the executor operations, longest first
+}
+
+// ProfileOperation is the time spent in one kind of executor operation.
+type ProfileOperation struct {
+	Name    string
+	Count   int
+	Elapsed time.Duration
+}
+
+// profiler accumulates the profile of a builder. The runs of a parallel block
+// are observed from goroutines of their own, so it is locked.
+type profiler struct {
+	mutex      sync.Mutex
+	evaluating time.Duration
+	executing  time.Duration
+	operations map[string]*ProfileOperation
+}
+
+func newProfiler() *profiler {
+	return &profiler{operations: map[string]*ProfileOperation{}}
+}
+
+// observe is the executor.Observer recording the executor's operations.
+// Nested operations are already part of the time of the one that started them.
+func (p *profiler) observe(op, params string, elapsed time.Duration, err error, nested bool) {
+	if nested {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.executing += elapsed
+
+	if p.operations[op] == nil {
+		p.operations[op] = &ProfileOperation{Name: op}
+	}
+
+	p.operations[op].Count++
+	p.operations[op].Elapsed += elapsed
+}
+
+// evaluate runs the evaluator call, recording its time.
+func (p *profiler) evaluate(run func()) {
+	start := time.Now()
+	run()
+
+	p.mutex.Lock()
+	p.evaluating += time.Since(start)
+	p.mutex.Unlock()
+}
+
+func (p *profiler) profile() Profile {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	profile := Profile{
+		Executor:   p.executing,
+		Operations: []ProfileOperation{},
+	}
+
+	// executor operations may also happen outside the evaluator, e.g. when
+	// tagging, so the plan's time cannot go below zero.
+	if p.evaluating > p.executing {
+		profile.Plan = p.evaluating - p.executing
+	}
+
+	for _, op := range p.operations {
+		profile.Operations = append(profile.Operations, *op)
+	}
+
+	sort.Slice(profile.Operations, func(i, j int) bool {
+		if profile.Operations[i].Elapsed == profile.Operations[j].Elapsed {
+			return profile.Operations[i].Name < profile.Operations[j].Name
+		}
+		return profile.Operations[i].Elapsed > profile.Operations[j].Elapsed
+	})
+
+	return profile
+}
@@ -16,11 +16,22 @@ import (
 )
 
 func runBuilder(script string) (*Builder, error) {
+	return runBuilderExperimental(script, false)
+}
+
+// runExperimental runs the script with the experimental verbs and funcs
+// allowed, as --experimental does.
+func runExperimental(script string) (*Builder, error) {
+	return runBuilderExperimental(script, true)
+}
+
+func runBuilderExperimental(script string, experimental bool) (*Builder, error) {
 	b, err := NewBuilder(BuildConfig{
 		Globals: &btypes.Global{
-			Cache:   os.Getenv("NO_CACHE") == "",
-			ShowRun: true,
-			Context: context.Background(),
+			Cache:        os.Getenv("NO_CACHE") == "",
+			ShowRun:      true,
+			Experimental: experimental,
+			Context:      context.Background(),
 		},
 		Runner: make(chan struct{}),
 	})
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/box-builder/box/types"
 	"github.com/rendon/testcli"
 
 	. "gopkg.in/check.v1"
@@ -81,6 +85,20 @@ func (s *cliSuite) TestTag(c *C) {
 	c.Assert(strings.Contains(cmd.Stdout(), `Tagged: tagtest`), Equals, true, Commentf("%s", cmd.Stdout()))
 }
 
+func (s *cliSuite) TestTagTemplate(c *C) {
+	os.Setenv("SOURCE_DATE_EPOCH", "")
+
+	cmd, err := build(`from "debian"`, "--reproducible", "-v", "VERSION=1.2", "-t", "tagtest:{{.Var.VERSION}}-{{.Date}}-{{len .Git.SHA}}")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), `Tagged: tagtest:1.2-19700101-40`), Equals, true, Commentf("%s", cmd.Stdout()))
+
+	cmd, err = build(`from "debian"`, "-t", "tagtest:{{.Var.VERSION}}")
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), `map has no entry for key "VERSION"`), Equals, true, Commentf("%s", cmd.Stdout()))
+}
+
 func (s *cliSuite) TestHelp(c *C) {
 	cmd := testcli.Command("box", "--help")
 	cmd.Run()
@@ -123,3 +141,268 @@ func (s *cliSuite) TestCanonicalFile(c *C) {
 	os.Chdir(cwd)
 	os.RemoveAll(tmpPath)
 }
+
+func (s *cliSuite) TestStdin(c *C) {
+	dir, err := ioutil.TempDir("", "box-context")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "context-file"), []byte{}, 0644), IsNil)
+
+	cmd := testcli.Command("box", "--build-context", dir, "-")
+	cmd.SetStdin(strings.NewReader(`
+    from "debian"
+    copy "context-file", "/"
+    run "test -f /context-file"
+  `))
+	cmd.Run()
+	checkSuccess(c, cmd)
+
+	// without -, the plan is not read from standard input.
+	cmd = testcli.Command("box", "--build-context", dir)
+	cmd.SetStdin(strings.NewReader(`from "debian"`))
+	cmd.Run()
+	checkFailure(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "give - to read the plan from standard input"), Equals, true, Commentf("%s", cmd.Stdout()))
+}
+
+func (s *cliSuite) TestInspectPlan(c *C) {
+	plan := `
+    from "debian"
+    run "echo inspected >/inspected"
+    with_user "nobody" do
+      run "true"
+    end
+  `
+
+	cmd, err := build(plan, "inspect-plan", "--format", "json")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	var steps []types.PlannedStep
+	c.Assert(json.Unmarshal([]byte(cmd.Stdout()), &steps), IsNil, Commentf("%s", cmd.Stdout()))
+	c.Assert(len(steps), Equals, 2)
+	c.Assert(steps[0].Verb, Equals, "run")
+	c.Assert(steps[0].Args, DeepEquals, []string{"echo inspected >/inspected"})
+	c.Assert(steps[0].CacheKey, Equals, base64.StdEncoding.EncodeToString([]byte("run, echo inspected >/inspected")))
+	c.Assert(steps[1].Args, DeepEquals, []string{"true"})
+
+	// the table is printed without the build's own output.
+	cmd, err = build(plan, "inspect-plan")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "STEP"), Equals, true, Commentf("%s", cmd.Stdout()))
+	c.Assert(strings.Contains(cmd.Stdout(), "Finish"), Equals, false, Commentf("%s", cmd.Stdout()))
+
+	cmd, err = build(plan, "inspect-plan", "--format", "yaml")
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+
+	// the functions with side effects are not run.
+	dir, err := ioutil.TempDir("", "box-inspect")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	cmd, err = build(fmt.Sprintf(`
+    from "debian"
+    local_run "touch %[1]s/local_run"
+    save file: "%[1]s/image.tar"
+    run "echo #{run_capture("hostname")[:status]}"
+    after do
+      local_run "touch %[1]s/after"
+    end
+  `, dir), "--allow-local-exec", "inspect-plan", "--format", "json")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	c.Assert(json.Unmarshal([]byte(cmd.Stdout()), &steps), IsNil, Commentf("%s", cmd.Stdout()))
+	c.Assert(steps[0].Args, DeepEquals, []string{"echo 0"})
+
+	files, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 0)
+}
+
+func (s *cliSuite) TestLogFileQuiet(c *C) {
+	dir, err := ioutil.TempDir("", "box-log-file")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "box.log")
+	c.Assert(ioutil.WriteFile(fn, []byte("earlier run\n"), 0644), IsNil)
+
+	cmd, err := build(`
+    from "debian"
+    run "echo logged"
+  `, "-n", "--log-file", fn, "--quiet")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+	c.Assert(cmd.Stdout(), Equals, "")
+
+	content, err := ioutil.ReadFile(fn)
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(string(content), "earlier run\n"), Equals, true, Commentf("%s", content))
+	c.Assert(strings.Contains(string(content), "Execute: run echo logged"), Equals, true, Commentf("%s", content))
+	c.Assert(strings.Contains(string(content), "\nlogged\n"), Equals, true, Commentf("%s", content))
+	c.Assert(strings.Contains(string(content), "\x1b["), Equals, false, Commentf("%q", content))
+
+	// errors are still printed, with the output of the failed run.
+	cmd, err = build(`
+    from "debian"
+    run "echo shown on failure; false"
+  `, "-n", "--log-file", fn, "--quiet")
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "Error:"), Equals, true, Commentf("%s", cmd.Stdout()))
+	c.Assert(strings.Contains(cmd.Stdout(), "shown on failure"), Equals, true, Commentf("%s", cmd.Stdout()))
+}
+
+func (s *cliSuite) TestCI(c *C) {
+	os.Setenv("CI", "true")
+	defer os.Unsetenv("CI")
+
+	cmd, err := build(`from "debian"`)
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "\x1b["), Equals, false, Commentf("%q", cmd.Stdout()))
+
+	// explicit flags win over the preset.
+	for _, args := range [][]string{{"--force-color"}, {"--ci", "--force-color"}, {"--ci=false", "--force-color"}} {
+		cmd, err = build(`from "debian"`, args...)
+		c.Assert(err, IsNil)
+		checkSuccess(c, cmd)
+		c.Assert(strings.Contains(cmd.Stdout(), "\x1b["), Equals, true, Commentf("%v: %q", args, cmd.Stdout()))
+	}
+
+	// the output of runs is only printed if they fail, unless --show-run is
+	// given.
+	for _, test := range []struct {
+		args  []string
+		shown bool
+	}{{nil, false}, {[]string{"--show-run"}, true}, {[]string{"--ci=false"}, true}} {
+		cmd, err = build(`
+      from "debian"
+      run "echo run output"
+    `, append([]string{"-n"}, test.args...)...)
+		c.Assert(err, IsNil)
+		checkSuccess(c, cmd)
+		c.Assert(strings.Contains(cmd.Stdout(), "run output"), Equals, test.shown, Commentf("%v: %s", test.args, cmd.Stdout()))
+	}
+
+	cmd, err = build(`
+    from "debian"
+    run "echo run output; false"
+  `, "-n")
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "run output"), Equals, true, Commentf("%s", cmd.Stdout()))
+
+	// the plans of multi are built the same way.
+	dir, err := ioutil.TempDir("", "box-ci")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "plan.rb")
+	c.Assert(ioutil.WriteFile(fn, []byte("from \"debian\"\nrun \"true\"\n"), 0644), IsNil)
+
+	cmd = testcli.Command("box", "--ci", "multi", fn)
+	cmd.Run()
+	checkSuccess(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "\x1b["), Equals, false, Commentf("%q", cmd.Stdout()))
+}
+
+func (s *cliSuite) TestDiff(c *C) {
+	dir, err := ioutil.TempDir("", "box-diff")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	a := filepath.Join(dir, "a.rb")
+	b := filepath.Join(dir, "b.rb")
+	c.Assert(ioutil.WriteFile(a, []byte("from \"debian\"\nrun \"true\"\nuser \"root\"\n"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(b, []byte("from \"debian\"\nrun \"true\"\ncmd \"sh\"\nuser \"nobody\"\n"), 0644), IsNil)
+
+	for _, args := range [][]string{{"diff", "--config-only"}, {"diff"}} {
+		cmd := testcli.Command("box", append(args, a, b)...)
+		cmd.Run()
+		checkFailure(c, cmd)
+		c.Assert(cmd.Stdout(), Equals, strings.Join([]string{
+			"--- " + a,
+			"+++ " + b,
+			"@@ config @@",
+			"-user root",
+			"+user nobody",
+			"-cmd [\"bash\"]",
+			"+cmd [\"sh\"]",
+			"@@ steps @@",
+			" run true",
+			"-user root",
+			"+cmd sh",
+			"+user nobody",
+			"",
+		}, "\n"))
+
+		cmd = testcli.Command("box", append(args, a, a)...)
+		cmd.Run()
+		checkSuccess(c, cmd)
+		c.Assert(cmd.Stdout(), Equals, "")
+	}
+
+	cmd := testcli.Command("box", "diff", a)
+	cmd.Run()
+	checkFailure(c, cmd)
+}
+
+func (s *cliSuite) TestFmt(c *C) {
+	dir, err := ioutil.TempDir("", "box-fmt")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "box.rb")
+	c.Assert(ioutil.WriteFile(fn, []byte("from   \"debian\"\nrun \"ls\" do\nrun \"true\",:privileged=>true\nend\n"), 0600), IsNil)
+
+	cmd := testcli.Command("box", "fmt", "--check", fn)
+	cmd.Run()
+	checkFailure(c, cmd)
+	c.Assert(cmd.Stdout(), Equals, fn+"\n")
+
+	cmd = testcli.Command("box", "fmt", fn)
+	cmd.Run()
+	checkSuccess(c, cmd)
+
+	content, err := ioutil.ReadFile(fn)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "from \"debian\"\nrun \"ls\" do\n  run \"true\", privileged: true\nend\n")
+
+	fi, err := os.Stat(fn)
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0600))
+
+	cmd = testcli.Command("box", "fmt", "--check", fn)
+	cmd.Run()
+	checkSuccess(c, cmd)
+	c.Assert(cmd.Stdout(), Equals, "")
+
+	// a plan which does not parse is left alone.
+	c.Assert(ioutil.WriteFile(fn, []byte("run \"ls\" do\n"), 0600), IsNil)
+	cmd = testcli.Command("box", "fmt", fn)
+	cmd.Run()
+	checkFailure(c, cmd)
+}
+
+func (s *cliSuite) TestPlatform(c *C) {
+	for _, test := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"--platform", "linux/amd64,linux/arm64"}, "--platform requires --tag and --push"},
+		{[]string{"--platform", "linux/arm64", "-t", "localhost:5000/platformtest", "--push", "--output", "type=oci,dest=out"}, "--output cannot be used with --platform"},
+		{[]string{"--platform", "windows/amd64", "-t", "localhost:5000/platformtest", "--push"}, `Invalid --platform "windows/amd64"`},
+		{[]string{"--platform", "linux/arm/", "-t", "localhost:5000/platformtest", "--push"}, `Invalid --platform "linux/arm/"`},
+		{[]string{"--platform", "linux/arm64,linux/arm64", "-t", "localhost:5000/platformtest", "--push"}, "linux/arm64 is given more than once"},
+	} {
+		cmd, err := build(`from "debian"`, test.args...)
+		c.Assert(err, IsNil)
+		checkFailure(c, cmd)
+		c.Assert(strings.Contains(cmd.Stdout(), test.err), Equals, true, Commentf("%v: %s", test.args, cmd.Stdout()))
+	}
+}
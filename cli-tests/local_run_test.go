@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *cliSuite) TestLocalRun(c *C) {
+	cmd, err := build(`
+    from "debian"
+    run "test #{local_run("echo -n foo")} = foo"
+  `, "--allow-local-exec")
+
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	cmd, err = build(`
+    from "debian"
+    run "test #{local_run("echo -n foo")} = foo"
+  `)
+
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "--allow-local-exec"), Equals, true, Commentf("%s", cmd.Stdout()))
+
+	cmd, err = build(`
+    from "debian"
+    local_run "exit 1"
+  `, "--allow-local-exec")
+
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+}
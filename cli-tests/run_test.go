@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 
 	. "gopkg.in/check.v1"
@@ -20,3 +23,66 @@ func (s *cliSuite) TestRunNoOutput(c *C) {
 	checkSuccess(c, cmd)
 	c.Assert(strings.Contains(cmd.Stdout(), "basic_test.go"), Equals, false, Commentf("%s", cmd.Stdout()))
 }
+
+func (s *cliSuite) TestRunPrivileged(c *C) {
+	cmd, err := build(`
+    from "debian"
+    run "mount -t tmpfs tmpfs /mnt", privileged: true
+  `, "--allow-privileged")
+
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	cmd, err = build(`
+    from "debian"
+    run "mount -t tmpfs tmpfs /mnt", privileged: true
+  `)
+
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "--allow-privileged"), Equals, true, Commentf("%s", cmd.Stdout()))
+}
+
+func (s *cliSuite) TestTimeout(c *C) {
+	cmd, err := build(`
+    from "debian"
+    run "sleep 60"
+  `, "-n", "--timeout", "5s")
+
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+	c.Assert(cmd.Error(), ErrorMatches, "exit status 124")
+	c.Assert(strings.Contains(cmd.Stdout(), "Build timed out after 5s"), Equals, true, Commentf("%s", cmd.Stdout()))
+
+	cmd, err = build(`
+    from "debian"
+    run "true"
+  `, "-n", "--timeout", "5m")
+
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+}
+
+func (s *cliSuite) TestRunBind(c *C) {
+	dir, err := ioutil.TempDir("", "box-bind")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "tool"), []byte("hello"), 0644), IsNil)
+
+	plan := fmt.Sprintf(`
+    from "debian"
+    run "test \"$(cat /opt/tool/tool)\" = hello", bind: { src: %q, dst: "/opt/tool", ro: true }
+    run "! touch /opt/tool/other", bind: { src: %q, dst: "/opt/tool" }
+    run "test ! -e /opt/tool/tool"
+  `, dir, dir)
+
+	cmd, err := build(plan, "-n")
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "--allow-bind"), Equals, true, Commentf("%s", cmd.Stdout()))
+
+	cmd, err = build(plan, "-n", "--allow-bind")
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+}
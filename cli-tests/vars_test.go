@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"strings"
 
 	. "gopkg.in/check.v1"
 )
@@ -48,3 +49,75 @@ func (s *cliSuite) TestVars(c *C) {
 	c.Assert(err, IsNil)
 	checkSuccess(c, cmd)
 }
+
+func (s *cliSuite) TestVarsHash(c *C) {
+	cmd, err := build(`
+    arg "version", "1.0"
+    from "debian"
+		run "test '#{vars.keys.join(",")}' = 'a,b,version'"
+		run "test '#{vars["a"]}' = 1 && test '#{vars["version"]}' = 1.0"
+		vars.each do |name, value|
+			run "echo #{name}=#{value}"
+		end
+		all = vars
+		all["a"] = "2"
+		run "test '#{var("a")}' = 1"
+  `, "-n", "--strict-vars", "-v", "b=2", "-v", "a=1")
+
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "b=2"), Equals, true, Commentf("%s", cmd.Stdout()))
+}
+
+func (s *cliSuite) TestStrictVars(c *C) {
+	cmd, err := build(`
+    arg "optional"
+    arg "version", "1.0"
+    from "debian"
+		run "test #{var("version")} = 1.0"
+		run "false" if var_exists("optional")
+  `, "-n", "--strict-vars")
+
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	cmd, err = build(`
+    testfile = var_exists("tetsfile")
+    other = var("otehr")
+    from "debian"
+  `, "-n", "--strict-vars", "-v", "testfile=test.rb")
+
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), "tetsfile, otehr"), Equals, true, Commentf("%s", cmd.Stdout()))
+}
+
+func (s *cliSuite) TestVarsExpandEnv(c *C) {
+	os.Setenv("BOX_TEST_TOKEN", "s3cret")
+	defer os.Unsetenv("BOX_TEST_TOKEN")
+
+	cmd, err := build(`
+    from "debian"
+		run "test '#{var("token")}' = s3cret"
+		run "test '#{var("braced")}' = s3cret-b"
+		run "test '#{var("middle")}' = 'ab$BOX_TEST_TOKEN'"
+		run "test '#{var("literal")}' = '$BOX_TEST_TOKEN'"
+		run "test '#{var("escaped")}' = 'ab\\$cd'"
+		run "test '#{var("unset")}' = ''"
+  `, "-n",
+		"-v", "token=$BOX_TEST_TOKEN",
+		"-v", "braced=${BOX_TEST_TOKEN}-b",
+		"-v", "middle=ab$BOX_TEST_TOKEN",
+		"-v", `literal=\$BOX_TEST_TOKEN`,
+		"-v", `escaped=ab\$cd`,
+		"-v", "unset=$BOX_TEST_UNSET",
+	)
+
+	c.Assert(err, IsNil)
+	checkSuccess(c, cmd)
+
+	cmd, err = build(`from "debian"`, "-v", "token")
+	c.Assert(err, IsNil)
+	checkFailure(c, cmd)
+	c.Assert(strings.Contains(cmd.Stdout(), `Invalid --var "token": expected name=value`), Equals, true, Commentf("%s", cmd.Stdout()))
+}
@@ -17,10 +17,7 @@ var NoTTY bool
 // NoOut turns copy output off entirely
 var NoOut bool
 
-const (
-	megaByte = float64(1024 * 1024)
-	interval = 10 * time.Millisecond
-)
+const interval = 10 * time.Millisecond
 
 // WithProgress implements io.Copy with a buffered reader, then measures
 // progress throughout the copy process. The buffer is set at a reasonable size
@@ -42,14 +39,14 @@ func WithProgress(writer io.Writer, reader io.Reader, logger *logger.Logger, pre
 	// below if this is the case.
 	if _, termErr := term.GetWinsize(0); termErr == nil && !NoOut && !NoTTY {
 		pr := progress.NewReader(prefix, reader, interval)
-		count := float64(0)
+		count := uint64(0)
 
 		go func(pr *progress.Reader, printed *bool) {
 			<-pr.C
 			for tick := range pr.C {
 				*printed = true
-				count += float64(tick.Value)
-				logger.Progress(tick.Artifact, count/megaByte)
+				count += tick.Value
+				logger.Progress(tick.Artifact, count)
 			}
 			close(endChan)
 		}(pr, &printed)
@@ -0,0 +1,145 @@
+package fetcher
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+const (
+	// dockerHubAuthKey is the key of Docker Hub in the docker client
+	// configuration.
+	dockerHubAuthKey = "https://index.docker.io/v1/"
+
+	// credentialsNotFound is the error of the credential helpers for a server
+	// they have no credentials for.
+	credentialsNotFound = "credentials not found in native keychain"
+	// identityTokenUser is the username of the credentials of a helper which
+	// are an identity token.
+	identityTokenUser = "<token>"
+)
+
+// RegistryAuth returns the credentials for the registry from the docker
+// client configuration, or empty credentials if there are none.
+func RegistryAuth(domain string) (types.AuthConfig, error) {
+	auth := types.AuthConfig{}
+
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if os.IsNotExist(err) {
+		return auth, nil
+	} else if err != nil {
+		return auth, err
+	}
+
+	var cfg struct {
+		Auths       map[string]types.AuthConfig `json:"auths"`
+		CredsStore  string                      `json:"credsStore"`
+		CredHelpers map[string]string           `json:"credHelpers"`
+	}
+
+	if err := json.Unmarshal(content, &cfg); err != nil {
+		return auth, fmt.Errorf("Could not parse docker client configuration: %v", err)
+	}
+
+	key := domain
+	if domain == dockerHub {
+		key = dockerHubAuthKey
+	}
+
+	// like the docker client, a helper for the registry takes precedence over
+	// the store, which takes precedence over the file.
+	helper, ok := cfg.CredHelpers[domain]
+	if !ok {
+		helper, ok = cfg.CredHelpers[key]
+	}
+	if !ok {
+		helper = cfg.CredsStore
+	}
+
+	if helper != "" {
+		return helperAuth(helper, key)
+	}
+
+	for server, entry := range cfg.Auths {
+		if server == key || strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://") == key {
+			auth = entry
+			auth.ServerAddress = server
+			break
+		}
+	}
+
+	if auth.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return types.AuthConfig{}, fmt.Errorf("Invalid credentials for registry %q: %v", domain, err)
+		}
+
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) == 2 {
+			auth.Username, auth.Password = parts[0], parts[1]
+		}
+		auth.Auth = ""
+	}
+
+	return auth, nil
+}
+
+// helperAuth gets the credentials for the server from the docker credential
+// helper, following the protocol of docker-credential-helpers: the server is
+// written to the standard input of `docker-credential-<helper> get`, which
+// prints the credentials as JSON. No credentials for the server give empty
+// credentials; any other failure is an error, rather than silently using the
+// registry anonymously.
+func helperAuth(helper, server string) (types.AuthConfig, error) {
+	program := "docker-credential-" + helper
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(program, "get")
+	cmd.Stdin = strings.NewReader(server)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		// helpers print the error to stdout, but some use stderr.
+		msg := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(msg, credentialsNotFound) {
+			return types.AuthConfig{}, nil
+		}
+		if msg == "" {
+			msg = err.Error()
+		}
+		return types.AuthConfig{}, fmt.Errorf("Could not get the credentials for registry %q from %s: %s", server, program, msg)
+	}
+
+	var creds struct {
+		ServerURL string
+		Username  string
+		Secret    string
+	}
+
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return types.AuthConfig{}, fmt.Errorf("Invalid credentials for registry %q from %s: %v", server, program, err)
+	}
+
+	auth := types.AuthConfig{ServerAddress: server}
+	if creds.Username == identityTokenUser {
+		auth.IdentityToken = creds.Secret
+	} else {
+		auth.Username, auth.Password = creds.Username, creds.Secret
+	}
+
+	return auth, nil
+}
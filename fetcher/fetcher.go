@@ -6,65 +6,299 @@ import (
 	"io"
 	"io/ioutil"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/box-builder/box/builder/config"
 	"github.com/box-builder/box/pull"
 	btypes "github.com/box-builder/box/types"
+	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
 )
 
-// Docker does stuff
-func Docker(context context.Context, globals *btypes.Global, client *client.Client, config *config.Config, name string) (string, []string, error) {
+const dockerHub = "docker.io"
+
+var (
+	// resolved holds the images the names given to Docker resolved to in this
+	// process, so that the plans of a multi build sharing a base pull it
+	// once.
+	resolved = map[string]resolvedImage{}
+	// resolving holds the names being resolved, so that the plans resolving
+	// a name at the same time share the pull.
+	resolving     = map[string]*resolveCall{}
+	resolvedMutex = new(sync.Mutex)
+)
+
+// resolvedImage is the id of the image a name resolved to, and whether it was
+// pulled to resolve it rather than found in the daemon.
+type resolvedImage struct {
+	id      string
+	pulled  bool
+	expires time.Time
+}
+
+// resolveCall is a resolution of a name in progress. done is closed once id
+// and err are set.
+type resolveCall struct {
+	done chan struct{}
+	id   string
+	err  error
+}
+
+// ResetResolved is a function to facilitate testing of the resolved image
+// cache.
+func ResetResolved() {
+	resolvedMutex.Lock()
+	defer resolvedMutex.Unlock()
+	resolved = map[string]resolvedImage{}
+}
+
+// Forget drops the image the name resolved to, once the name is tagged on
+// another image in this process.
+func Forget(name string) {
+	resolvedMutex.Lock()
+	defer resolvedMutex.Unlock()
+	delete(resolved, withTag(name))
+}
+
+// lookupResolved returns the id of the image the name resolved to, if it has
+// not expired. Unless found is true, it must have been pulled.
+func lookupResolved(name string, found bool) (string, bool) {
+	resolvedMutex.Lock()
+	image, ok := resolved[name]
+	resolvedMutex.Unlock()
+
+	if !ok || time.Now().After(image.expires) || (!found && !image.pulled) {
+		return "", false
+	}
+
+	return image.id, true
+}
+
+// storeResolved records the id of the image the name resolved to for the
+// ttl. Nothing is kept if the ttl is not positive.
+func storeResolved(name, id string, pulled bool, ttl time.Duration) {
+	if ttl <= 0 || id == "" {
+		return
+	}
+
+	resolvedMutex.Lock()
+	defer resolvedMutex.Unlock()
+	resolved[name] = resolvedImage{id: id, pulled: pulled, expires: time.Now().Add(ttl)}
+}
+
+// resolveOnce calls resolve for the name, unless it is being resolved
+// already, in which case it waits for that resolution and returns its result.
+func resolveOnce(context context.Context, name string, resolve func() (string, error)) (string, error) {
+	resolvedMutex.Lock()
+	call, ok := resolving[name]
+	if !ok {
+		call = &resolveCall{done: make(chan struct{})}
+		resolving[name] = call
+	}
+	resolvedMutex.Unlock()
+
+	if ok {
+		select {
+		case <-call.done:
+			return call.id, call.err
+		case <-context.Done():
+			return "", context.Err()
+		}
+	}
+
+	call.id, call.err = resolve()
+
+	resolvedMutex.Lock()
+	delete(resolving, name)
+	resolvedMutex.Unlock()
+	close(call.done)
+
+	return call.id, call.err
+}
+
+// withTag adds the latest tag to a name without one, so the name is not taken
+// for the whole repository.
+func withTag(name string) string {
 	if !strings.Contains(name, ":") {
-		// if we don't have a sub-tag, we need to add :latest to avoid pulling the whole repo.
-		name += ":latest"
+		return name + ":latest"
 	}
 
-	inspect, _, err := client.ImageInspectWithRaw(context, name)
-	if err != nil {
-		reader, err := client.ImagePull(context, name, types.ImagePullOptions{})
+	return name
+}
+
+// Docker resolves the named image, pulling it if the daemon does not have it,
+// or always with --pull always, sets the config from it and returns its id and
+// layers. Names resolved within the --base-cache-ttl are not looked up again;
+// with --pull always, only those pulled in this process are reused. The plans
+// resolving a name at the same time share one pull.
+func Docker(context context.Context, globals *btypes.Global, client *client.Client, config *config.Config, name string) (string, []string, error) {
+	name = withTag(name)
+
+	id, ok := lookupResolved(name, !globals.PullAlways)
+	if !ok {
+		var err error
+		id, err = resolveOnce(context, name, func() (string, error) {
+			return resolve(context, globals, client, name)
+		})
 		if err != nil {
 			return "", nil, err
 		}
+	}
 
-		if !globals.TTY {
-			globals.Logger.Print(fmt.Sprintf("Pulling %q... ", name))
+	inspect, _, err := client.ImageInspectWithRaw(context, id)
+	if err != nil {
+		return "", nil, err
+	}
 
-			if _, err := io.Copy(ioutil.Discard, reader); err != io.EOF && err != nil {
-				return "", nil, err
-			}
+	return useImage(config, inspect)
+}
 
-			fmt.Fprintln(globals.Logger.Output(), "done.")
-		} else {
-			pull.NewProgress(globals.TTY, reader).Process()
+// resolve returns the id of the named image, pulling it if the daemon does
+// not have it, or always with --pull always, and records it for the
+// --base-cache-ttl.
+func resolve(context context.Context, globals *btypes.Global, client *client.Client, name string) (string, error) {
+	pulled := globals.PullAlways
+
+	if pulled {
+		if err := Pull(context, globals, client, name); err != nil {
+			return "", err
 		}
+	}
 
-		select {
-		case <-context.Done():
-			if context.Err() != nil {
-				return "", nil, context.Err()
+	inspect, _, err := client.ImageInspectWithRaw(context, name)
+	if err != nil && !pulled {
+		if !pullMirrors(context, globals, client, name) {
+			if err := pullImage(context, globals, client, name); err != nil {
+				return "", err
 			}
-		default:
 		}
+		pulled = true
 
 		// this will fallthrough to the assignment below
 		inspect, _, err = client.ImageInspectWithRaw(context, name)
-		if err != nil {
-			return "", nil, err
-		}
+	}
+	if err != nil {
+		return "", err
+	}
 
-		select {
-		case <-context.Done():
-			if context.Err() != nil {
-				return "", nil, context.Err()
-			}
-		default:
+	select {
+	case <-context.Done():
+		if context.Err() != nil {
+			return "", context.Err()
 		}
+	default:
 	}
 
+	storeResolved(name, inspect.ID, pulled, globals.BaseCacheTTL)
+	return inspect.ID, nil
+}
+
+// useImage sets the config from the inspected image and returns its id and
+// layers.
+func useImage(config *config.Config, inspect types.ImageInspect) (string, []string, error) {
 	config.FromDocker(false, inspect.Config)
 	config.Image = inspect.ID
+	if inspect.Os != "" {
+		config.OS = inspect.Os
+	}
 
 	return inspect.ID, inspect.RootFS.Layers, nil
 }
+
+// Pull pulls the named image even if the daemon already has it, through the
+// registry mirrors first like Docker.
+func Pull(context context.Context, globals *btypes.Global, client *client.Client, name string) error {
+	if pullMirrors(context, globals, client, name) {
+		return nil
+	}
+
+	return pullImage(context, globals, client, name)
+}
+
+// pullImage pulls the named image, reporting progress.
+func pullImage(context context.Context, globals *btypes.Global, client *client.Client, name string) error {
+	if err := CheckInsecure(context, globals, client, name); err != nil {
+		return err
+	}
+
+	reader, err := client.ImagePull(context, name, types.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+
+	if !globals.TTY {
+		globals.Logger.Print(fmt.Sprintf("Pulling %q... ", name))
+
+		if _, err := io.Copy(ioutil.Discard, reader); err != io.EOF && err != nil {
+			return err
+		}
+
+		fmt.Fprintln(globals.Logger.Output(), "done.")
+	} else {
+		pull.NewProgress(globals.TTY, reader).Process()
+	}
+
+	select {
+	case <-context.Done():
+		if context.Err() != nil {
+			return context.Err()
+		}
+	default:
+	}
+
+	return nil
+}
+
+// pullMirrors tries to pull a Docker Hub image through each registry mirror
+// in turn, tagging the first one that succeeds with the canonical name. The
+// mirror's reference is kept, as the image's registry digest is recorded
+// under it. Returns false if the image is not on Docker Hub or no mirror had it.
+func pullMirrors(context context.Context, globals *btypes.Global, client *client.Client, name string) bool {
+	if len(globals.Mirrors) == 0 {
+		return false
+	}
+
+	ref, err := reference.ParseNormalizedNamed(name)
+	if err != nil || reference.Domain(ref) != dockerHub {
+		return false
+	}
+
+	for _, mirror := range globals.Mirrors {
+		mirrored := mirrorName(mirror, ref)
+
+		err := pullImage(context, globals, client, mirrored)
+		if err == nil {
+			// pull errors are reported in the stream, so check it actually arrived
+			_, _, err = client.ImageInspectWithRaw(context, mirrored)
+		}
+
+		if err == nil {
+			err = client.ImageTag(context, mirrored, name)
+		}
+
+		if err != nil {
+			if context.Err() != nil {
+				return false
+			}
+
+			globals.Logger.MirrorFailed(mirror, err)
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// mirrorName rewrites a Docker Hub reference to point at the mirror. The
+// mirror may be given as a URL or a bare host.
+func mirrorName(mirror string, ref reference.Named) string {
+	mirror = strings.TrimPrefix(mirror, "https://")
+	mirror = strings.TrimPrefix(mirror, "http://")
+	mirror = strings.TrimSuffix(mirror, "/")
+
+	return mirror + "/" + strings.TrimPrefix(ref.String(), dockerHub+"/")
+}
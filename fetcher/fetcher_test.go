@@ -0,0 +1,454 @@
+package fetcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	. "testing"
+	"time"
+
+	btypes "github.com/box-builder/box/types"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	. "gopkg.in/check.v1"
+)
+
+type fetcherSuite struct{}
+
+var _ = Suite(&fetcherSuite{})
+
+func TestFetcher(t *T) {
+	TestingT(t)
+}
+
+func (fs *fetcherSuite) SetUpTest(c *C) {
+	ResetResolved()
+}
+
+func (fs *fetcherSuite) TestResolved(c *C) {
+	_, ok := lookupResolved("debian:latest", true)
+	c.Assert(ok, Equals, false)
+
+	storeResolved("debian:latest", "sha256:abc", false, 0)
+	_, ok = lookupResolved("debian:latest", true)
+	c.Assert(ok, Equals, false, Commentf("stored without a ttl"))
+
+	storeResolved("debian:latest", "sha256:abc", false, time.Minute)
+	id, ok := lookupResolved("debian:latest", true)
+	c.Assert(ok, Equals, true)
+	c.Assert(id, Equals, "sha256:abc")
+
+	// pulling always only reuses the images pulled.
+	_, ok = lookupResolved("debian:latest", false)
+	c.Assert(ok, Equals, false)
+
+	storeResolved("debian:latest", "sha256:def", true, time.Minute)
+	id, ok = lookupResolved("debian:latest", false)
+	c.Assert(ok, Equals, true)
+	c.Assert(id, Equals, "sha256:def")
+
+	_, ok = lookupResolved("debian:stretch", true)
+	c.Assert(ok, Equals, false)
+
+	// tagging the name drops it.
+	Forget("debian")
+	_, ok = lookupResolved("debian:latest", true)
+	c.Assert(ok, Equals, false, Commentf("forgotten"))
+
+	resolved["debian:latest"] = resolvedImage{id: "sha256:abc", expires: time.Now().Add(-time.Second)}
+	_, ok = lookupResolved("debian:latest", true)
+	c.Assert(ok, Equals, false, Commentf("expired"))
+}
+
+func (fs *fetcherSuite) TestResolveOnce(c *C) {
+	release := make(chan struct{})
+	result := make(chan string)
+
+	go func() {
+		id, err := resolveOnce(context.Background(), "debian:latest", func() (string, error) {
+			<-release
+			return "sha256:abc", nil
+		})
+		c.Assert(err, IsNil)
+		result <- id
+	}()
+
+	for {
+		resolvedMutex.Lock()
+		_, ok := resolving["debian:latest"]
+		resolvedMutex.Unlock()
+		if ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// a resolution of the same name waits for the one in progress, rather
+	// than resolving it again.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := resolveOnce(ctx, "debian:latest", func() (string, error) {
+		c.Fatal("resolved twice")
+		return "", nil
+	})
+	c.Assert(err, Equals, context.Canceled)
+
+	close(release)
+	c.Assert(<-result, Equals, "sha256:abc")
+
+	// once done, the name is resolved again.
+	id, err := resolveOnce(context.Background(), "debian:latest", func() (string, error) { return "sha256:def", nil })
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, "sha256:def")
+}
+
+func (fs *fetcherSuite) TestInsecure(c *C) {
+	globals := &btypes.Global{AllowInsecure: []string{"registry.local:5000", "10.1.2.3"}}
+
+	c.Assert(AllowedInsecure(globals, "registry.local:5000"), Equals, true)
+	c.Assert(AllowedInsecure(globals, "Registry.Local:5000"), Equals, true)
+	c.Assert(AllowedInsecure(globals, "registry.local"), Equals, false)
+	c.Assert(AllowedInsecure(globals, "docker.io"), Equals, false)
+
+	_, private, err := net.ParseCIDR("10.0.0.0/8")
+	c.Assert(err, IsNil)
+
+	config := &registry.ServiceConfig{
+		InsecureRegistryCIDRs: []*registry.NetIPNet{(*registry.NetIPNet)(private)},
+		IndexConfigs: map[string]*registry.IndexInfo{
+			"docker.io":           {Name: "docker.io", Secure: true},
+			"registry.local:5000": {Name: "registry.local:5000", Secure: false},
+		},
+	}
+
+	c.Assert(daemonInsecure(config, "registry.local:5000"), Equals, true)
+	c.Assert(daemonInsecure(config, "docker.io"), Equals, false)
+	c.Assert(daemonInsecure(config, "10.1.2.3:5000"), Equals, true)
+	c.Assert(daemonInsecure(config, "10.1.2.3"), Equals, true)
+	c.Assert(daemonInsecure(config, "192.168.1.1:5000"), Equals, false)
+	c.Assert(daemonInsecure(nil, "10.1.2.3"), Equals, false)
+}
+
+func (fs *fetcherSuite) TestSelectPlatform(c *C) {
+	list := &manifestList{MediaType: manifestListType}
+	for _, platform := range []string{"linux/amd64", "linux/arm/v6", "linux/arm/v7", "linux/arm64/v8", "windows/amd64"} {
+		parts := append(strings.Split(platform, "/"), "")
+		entry := manifestEntry{Digest: "sha256:" + strings.Replace(platform, "/", "-", -1)}
+		entry.Platform.OS, entry.Platform.Architecture, entry.Platform.Variant = parts[0], parts[1], parts[2]
+		list.Manifests = append(list.Manifests, entry)
+	}
+
+	for _, test := range []struct {
+		platform btypes.Platform
+		digest   string
+	}{
+		{btypes.Platform{Architecture: "arm", Variant: "v7"}, "sha256:linux-arm-v7"},
+		{btypes.Platform{Variant: "v6"}, "sha256:linux-arm-v6"},
+		{btypes.Platform{Architecture: "amd64"}, "sha256:linux-amd64"},
+		{btypes.Platform{Architecture: "arm64"}, "sha256:linux-arm64-v8"},
+	} {
+		entry, err := selectPlatform(list, test.platform)
+		c.Assert(err, IsNil, Commentf("%+v", test))
+		c.Assert(entry.Digest, Equals, test.digest, Commentf("%+v", test))
+	}
+
+	for _, test := range []struct {
+		platform btypes.Platform
+		err      string
+	}{
+		{btypes.Platform{Architecture: "arm"}, "arm matches more than one entry, linux/arm/v6, linux/arm/v7; give both arch and variant"},
+		{btypes.Platform{Architecture: "s390x"}, "no entry is for s390x; it has linux/amd64, linux/arm/v6, linux/arm/v7, linux/arm64/v8"},
+	} {
+		_, err := selectPlatform(list, test.platform)
+		c.Assert(err, NotNil, Commentf("%+v", test))
+		c.Assert(err.Error(), Equals, test.err)
+	}
+}
+
+func (fs *fetcherSuite) TestResolvePlatform(c *C) {
+	list := `{
+  "mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+  "manifests": [
+    {"digest": "sha256:amd64", "platform": {"os": "linux", "architecture": "amd64"}},
+    {"digest": "sha256:armv7", "platform": {"os": "linux", "architecture": "arm", "variant": "v7"}},
+    {"digest": "sha256:arm64", "platform": {"os": "linux", "architecture": "arm64", "variant": "v8"}}
+  ]
+}`
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			c.Check(r.URL.Query().Get("scope"), Equals, "repository:library/alpine:pull")
+			w.Write([]byte(`{"token": "anonymous"}`))
+		case r.Header.Get("Authorization") != "Bearer anonymous":
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:library/alpine:pull"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/v2/library/alpine/manifests/3.9", r.URL.Path == "/v2/library/alpine/manifests/sha256:list":
+			w.Header().Set("Content-Type", manifestListType)
+			w.Write([]byte(list))
+		case r.URL.Path == "/v2/library/alpine/manifests/single":
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+			w.Write([]byte(`{"schemaVersion": 2}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	globals := &btypes.Global{AllowInsecure: []string{host}}
+	name := host + "/library/alpine"
+
+	for _, test := range []struct {
+		name, digest string
+		platform     btypes.Platform
+		result       string
+	}{
+		{name + ":3.9", "", btypes.Platform{Architecture: "arm", Variant: "v7"}, name + "@sha256:armv7"},
+		{name + ":moved", "sha256:list", btypes.Platform{Architecture: "arm64"}, name + "@sha256:arm64"},
+	} {
+		result, err := ResolvePlatform(context.Background(), globals, test.name, test.digest, test.platform)
+		c.Assert(err, IsNil, Commentf("%+v", test))
+		c.Assert(result, Equals, test.result, Commentf("%+v", test))
+	}
+
+	for _, test := range []struct {
+		name string
+		err  string
+	}{
+		{name + ":single", "it is not a multi-platform image"},
+		{name + ":missing", "the registry returned 404 Not Found"},
+	} {
+		_, err := ResolvePlatform(context.Background(), globals, test.name, "", btypes.Platform{Architecture: "arm"})
+		c.Assert(err, NotNil, Commentf("%+v", test))
+		c.Assert(strings.HasSuffix(err.Error(), test.err), Equals, true, Commentf("%v", err))
+	}
+
+	// without --allow-insecure-registry, the registry is only read over TLS.
+	_, err := ResolvePlatform(context.Background(), &btypes.Global{}, name+":3.9", "", btypes.Platform{Variant: "v7"})
+	c.Assert(err, NotNil)
+}
+
+func (fs *fetcherSuite) TestRegistryAuth(c *C) {
+	dir, err := ioutil.TempDir("", "box-docker-config")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	orig := os.Getenv("DOCKER_CONFIG")
+	os.Setenv("DOCKER_CONFIG", dir)
+	defer os.Setenv("DOCKER_CONFIG", orig)
+
+	auth, err := RegistryAuth("localhost:5000")
+	c.Assert(err, IsNil)
+	c.Assert(auth, DeepEquals, types.AuthConfig{})
+
+	config := `{"auths":{"https://index.docker.io/v1/":{"auth":"` + base64.StdEncoding.EncodeToString([]byte("hub:secret")) + `"},"localhost:5000":{"auth":"` + base64.StdEncoding.EncodeToString([]byte("local:pass")) + `"}}}`
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600), IsNil)
+
+	auth, err = RegistryAuth("docker.io")
+	c.Assert(err, IsNil)
+	c.Assert(auth, DeepEquals, types.AuthConfig{Username: "hub", Password: "secret", ServerAddress: "https://index.docker.io/v1/"})
+
+	auth, err = RegistryAuth("localhost:5000")
+	c.Assert(err, IsNil)
+	c.Assert(auth, DeepEquals, types.AuthConfig{Username: "local", Password: "pass", ServerAddress: "localhost:5000"})
+
+	// the helper answers for localhost:5000 only, and fails for the others.
+	helper := `#!/bin/sh
+read server
+case "$server" in
+  localhost:5000) echo '{"ServerURL":"localhost:5000","Username":"helped","Secret":"s3cret"}' ;;
+  gcr.io) echo '{"ServerURL":"gcr.io","Username":"<token>","Secret":"tok"}' ;;
+  https://index.docker.io/v1/) echo "credentials not found in native keychain"; exit 1 ;;
+  *) echo "helper is broken"; exit 1 ;;
+esac
+`
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "docker-credential-box-test"), []byte(helper), 0700), IsNil)
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	defer os.Setenv("PATH", path)
+
+	config = `{"auths":{"localhost:5000":{"auth":"` + base64.StdEncoding.EncodeToString([]byte("local:pass")) + `"}},"credsStore":"box-test","credHelpers":{"quay.io":"missing"}}`
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600), IsNil)
+
+	auth, err = RegistryAuth("localhost:5000")
+	c.Assert(err, IsNil)
+	c.Assert(auth, DeepEquals, types.AuthConfig{Username: "helped", Password: "s3cret", ServerAddress: "localhost:5000"})
+
+	auth, err = RegistryAuth("gcr.io")
+	c.Assert(err, IsNil)
+	c.Assert(auth, DeepEquals, types.AuthConfig{IdentityToken: "tok", ServerAddress: "gcr.io"})
+
+	auth, err = RegistryAuth("docker.io")
+	c.Assert(err, IsNil)
+	c.Assert(auth, DeepEquals, types.AuthConfig{})
+
+	_, err = RegistryAuth("example.com")
+	c.Assert(err, NotNil)
+
+	// a helper which is not installed is an error rather than anonymous.
+	_, err = RegistryAuth("quay.io")
+	c.Assert(err, NotNil)
+}
+
+func (fs *fetcherSuite) TestResolvePlatformCredentials(c *C) {
+	list := `{
+  "mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+  "manifests": [{"digest": "sha256:arm64", "platform": {"os": "linux", "architecture": "arm64"}}]
+}`
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+
+		switch {
+		case r.URL.Path == "/token" && user == "user" && pass == "pass":
+			w.Write([]byte(`{"token": "private"}`))
+		case r.URL.Path == "/token":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.Header.Get("Authorization") != "Bearer private":
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:private/app:pull"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.Header().Set("Content-Type", manifestListType)
+			w.Write([]byte(list))
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "box-docker-config")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	orig := os.Getenv("DOCKER_CONFIG")
+	os.Setenv("DOCKER_CONFIG", dir)
+	defer os.Setenv("DOCKER_CONFIG", orig)
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	globals := &btypes.Global{AllowInsecure: []string{host}}
+	name := host + "/private/app:1"
+
+	// without credentials, the token is refused.
+	_, err = ResolvePlatform(context.Background(), globals, name, "", btypes.Platform{Architecture: "arm64"})
+	c.Assert(err, NotNil)
+
+	config := `{"auths":{"` + host + `":{"auth":"` + base64.StdEncoding.EncodeToString([]byte("user:pass")) + `"}}}`
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600), IsNil)
+
+	result, err := ResolvePlatform(context.Background(), globals, name, "", btypes.Platform{Architecture: "arm64"})
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, host+"/private/app@sha256:arm64")
+}
+
+func (fs *fetcherSuite) TestPlatformTag(c *C) {
+	for _, test := range []struct {
+		tag      string
+		platform btypes.Platform
+		result   string
+	}{
+		{"app:1.0", btypes.Platform{Architecture: "arm", Variant: "v7"}, "app:1.0-linux-arm-v7"},
+		{"app", btypes.Platform{Architecture: "amd64"}, "app:latest-linux-amd64"},
+		{"localhost:5000/team/app:2", btypes.Platform{Architecture: "arm64"}, "localhost:5000/team/app:2-linux-arm64"},
+	} {
+		result, err := PlatformTag(test.tag, test.platform)
+		c.Assert(err, IsNil, Commentf("%+v", test))
+		c.Assert(result, Equals, test.result)
+	}
+
+	_, err := PlatformTag("app@sha256:"+strings.Repeat("a", 64), btypes.Platform{Architecture: "amd64"})
+	c.Assert(err, NotNil)
+}
+
+func (fs *fetcherSuite) TestPushManifestList(c *C) {
+	amd64 := "sha256:" + strings.Repeat("a", 64)
+	arm := "sha256:" + strings.Repeat("b", 64)
+
+	var (
+		server *httptest.Server
+		pushed []byte
+	)
+
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			c.Check(r.URL.Query().Get("scope"), Equals, "repository:team/app:pull,push")
+			w.Write([]byte(`{"token": "push"}`))
+		case r.Header.Get("Authorization") != "Bearer push":
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:team/app:pull,push"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.Method == "GET" && r.URL.Path == "/v2/team/app/manifests/"+amd64:
+			w.Header().Set("Content-Type", manifestType)
+			w.Write([]byte(`{"schemaVersion": 2, "mediaType": "` + manifestType + `"}`))
+		case r.Method == "GET" && r.URL.Path == "/v2/team/app/manifests/"+arm:
+			w.Header().Set("Content-Type", manifestType)
+			w.Write([]byte(`{"schemaVersion": 2}`))
+		case r.Method == "PUT" && r.URL.Path == "/v2/team/app/manifests/1.0":
+			c.Check(r.Header.Get("Content-Type"), Equals, manifestListType)
+			body, err := ioutil.ReadAll(r.Body)
+			c.Check(err, IsNil)
+			pushed = body
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	globals := &btypes.Global{AllowInsecure: []string{host}}
+	name := host + "/team/app"
+
+	images := []PlatformImage{
+		{name + "@" + amd64, btypes.Platform{Architecture: "amd64"}},
+		{name + "@" + arm, btypes.Platform{Architecture: "arm", Variant: "v7"}},
+	}
+
+	result, err := PushManifestList(context.Background(), globals, name+":1.0", images)
+	c.Assert(err, IsNil)
+
+	sum := sha256.Sum256(pushed)
+	c.Assert(result, Equals, name+"@sha256:"+hex.EncodeToString(sum[:]))
+
+	var list struct {
+		SchemaVersion int
+		manifestList
+	}
+	c.Assert(json.Unmarshal(pushed, &list), IsNil)
+	c.Assert(list.SchemaVersion, Equals, 2)
+	c.Assert(list.MediaType, Equals, manifestListType)
+	c.Assert(list.Manifests, HasLen, 2)
+	c.Assert(list.Manifests[0].Digest, Equals, amd64)
+	c.Assert(list.Manifests[0].MediaType, Equals, manifestType)
+	c.Assert(list.Manifests[0].Size, Equals, int64(len(`{"schemaVersion": 2, "mediaType": "`+manifestType+`"}`)))
+	c.Assert(list.Manifests[0].platform(), Equals, "linux/amd64")
+	c.Assert(list.Manifests[1].Digest, Equals, arm)
+	c.Assert(list.Manifests[1].platform(), Equals, "linux/arm/v7")
+
+	// the images must be in the repository of the list, and in the registry.
+	for _, test := range []struct {
+		image PlatformImage
+		err   string
+	}{
+		{PlatformImage{host + "/team/other@" + amd64, btypes.Platform{Architecture: "amd64"}}, "it is not in the repository"},
+		{PlatformImage{name + ":1.0-linux-amd64", btypes.Platform{Architecture: "amd64"}}, "it has no digest"},
+		{PlatformImage{name + "@sha256:" + strings.Repeat("c", 64), btypes.Platform{Architecture: "amd64"}}, "the registry returned 404 Not Found"},
+	} {
+		pushed = nil
+		_, err := PushManifestList(context.Background(), globals, name+":1.0", []PlatformImage{test.image})
+		c.Assert(err, NotNil, Commentf("%+v", test))
+		c.Assert(strings.Contains(err.Error(), test.err), Equals, true, Commentf("%v", err))
+		c.Assert(pushed, IsNil)
+	}
+}
@@ -0,0 +1,87 @@
+package fetcher
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	btypes "github.com/box-builder/box/types"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/client"
+)
+
+// CheckInsecure warns that the registry of the named image is used without
+// TLS verification if it was given to --allow-insecure-registry. The daemon
+// does the pulls and pushes and only skips the verification for the
+// registries of its insecure-registries, so an error is returned if it would
+// still verify this one, rather than the daemon's TLS error.
+func CheckInsecure(ctx context.Context, globals *btypes.Global, client *client.Client, name string) error {
+	ref, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil // the daemon reports the invalid name
+	}
+
+	domain := reference.Domain(ref)
+	if !AllowedInsecure(globals, domain) {
+		return nil
+	}
+
+	info, err := client.Info(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !daemonInsecure(info.RegistryConfig, domain) {
+		return fmt.Errorf("Registry %q is allowed with --allow-insecure-registry, but the docker daemon verifies its TLS; add it to the insecure-registries of the daemon", domain)
+	}
+
+	globals.Logger.Warning(fmt.Sprintf("Using registry %q without TLS verification", domain))
+	return nil
+}
+
+// AllowedInsecure returns true if the registry, as host[:port], was given to
+// --allow-insecure-registry.
+func AllowedInsecure(globals *btypes.Global, domain string) bool {
+	for _, allowed := range globals.AllowInsecure {
+		if strings.EqualFold(allowed, domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// daemonInsecure returns true if the daemon's registry configuration skips
+// the TLS verification for the registry, by its name or, like the daemon, by
+// the networks of its addresses.
+func daemonInsecure(config *registry.ServiceConfig, domain string) bool {
+	if config == nil {
+		return false
+	}
+
+	if index, ok := config.IndexConfigs[domain]; ok {
+		return !index.Secure
+	}
+
+	host := domain
+	if h, _, err := net.SplitHostPort(domain); err == nil {
+		host = h
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		ips, _ = net.LookupIP(host)
+	}
+
+	for _, ip := range ips {
+		for _, cidr := range config.InsecureRegistryCIDRs {
+			if (*net.IPNet)(cidr).Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,172 @@
+package fetcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	btypes "github.com/box-builder/box/types"
+	"github.com/docker/distribution/reference"
+)
+
+// the media types of the manifests of single-platform images.
+const (
+	manifestType    = "application/vnd.docker.distribution.manifest.v2+json"
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+)
+
+// PlatformImage is an image pushed for a platform of --platform, by its
+// `name@digest`.
+type PlatformImage struct {
+	Ref      string
+	Platform btypes.Platform
+}
+
+// PlatformTag returns the tag the image of the platform is pushed as, before
+// the manifest list of all of them is pushed as the tag itself: the platform
+// is appended to the tag, so `app:1.0` for linux/arm/v7 is
+// `app:1.0-linux-arm-v7`.
+func PlatformTag(tag string, platform btypes.Platform) (string, error) {
+	ref, err := parseTag(tag)
+	if err != nil {
+		return "", err
+	}
+
+	tagged, err := reference.WithTag(ref, ref.Tag()+"-"+strings.Replace(platform.String(), "/", "-", -1))
+	if err != nil {
+		return "", err
+	}
+
+	return reference.FamiliarString(tagged), nil
+}
+
+// PushManifestList pushes the manifest list of the images, which must have
+// been pushed to the repository of the tag already, as the tag. It returns
+// the list as `name@digest`. The manifest of each image is read from the
+// registry for its media type and size, which the list records.
+func PushManifestList(ctx context.Context, globals *btypes.Global, tag string, images []PlatformImage) (string, error) {
+	ref, err := parseTag(tag)
+	if err != nil {
+		return "", err
+	}
+	domain, path := reference.Domain(ref), reference.Path(ref)
+
+	list := manifestList{MediaType: manifestListType}
+
+	for _, image := range images {
+		entry, err := platformEntry(ctx, globals, ref, image)
+		if err != nil {
+			return "", fmt.Errorf("Could not read the manifest of %q: %v", image.Ref, err)
+		}
+
+		if entry.MediaType == ociManifestType {
+			list.MediaType = ociIndexType
+		}
+
+		list.Manifests = append(list.Manifests, entry)
+	}
+
+	// the schema version is only written, so it is not a field of the lists
+	// read.
+	body, err := json.Marshal(struct {
+		SchemaVersion int `json:"schemaVersion"`
+		manifestList
+	}{2, list})
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := manifestRequest(ctx, globals, domain, path, ref.Tag(), "PUT", "", list.MediaType, body)
+	if err != nil {
+		return "", fmt.Errorf("Could not push the manifest list of %q: %v", tag, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+		return "", fmt.Errorf("Could not push the manifest list of %q: the registry returned %s: %s", tag, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	sum := sha256.Sum256(body)
+	return reference.FamiliarName(ref) + "@sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// parseTag parses the name to tag, with the default tag if it has none.
+func parseTag(tag string) (reference.NamedTagged, error) {
+	named, err := reference.ParseNormalizedNamed(tag)
+	if err != nil {
+		return nil, err
+	}
+
+	ref, ok := reference.TagNameOnly(named).(reference.NamedTagged)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a tag", tag)
+	}
+
+	return ref, nil
+}
+
+// platformEntry returns the entry of the manifest list for the image, which
+// must be in the repository of ref.
+func platformEntry(ctx context.Context, globals *btypes.Global, ref reference.Named, image PlatformImage) (manifestEntry, error) {
+	named, err := reference.ParseNormalizedNamed(image.Ref)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+
+	canonical, ok := named.(reference.Canonical)
+	if !ok {
+		return manifestEntry{}, fmt.Errorf("it has no digest")
+	}
+
+	if named.Name() != ref.Name() {
+		return manifestEntry{}, fmt.Errorf("it is not in the repository %q", reference.FamiliarName(ref))
+	}
+
+	resp, err := manifestRequest(ctx, globals, reference.Domain(ref), reference.Path(ref), canonical.Digest().String(), "GET", manifestType+", "+ociManifestType, "", nil)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return manifestEntry{}, fmt.Errorf("the registry returned %s", resp.Status)
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return manifestEntry{}, err
+	}
+
+	var manifest struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return manifestEntry{}, err
+	}
+
+	if manifest.MediaType == "" {
+		manifest.MediaType = strings.TrimSpace(strings.SplitN(resp.Header.Get("Content-Type"), ";", 2)[0])
+	}
+
+	if manifest.MediaType != manifestType && manifest.MediaType != ociManifestType {
+		return manifestEntry{}, fmt.Errorf("its manifest is %q, not that of a single-platform image", manifest.MediaType)
+	}
+
+	entry := manifestEntry{
+		MediaType: manifest.MediaType,
+		Size:      int64(len(content)),
+		Digest:    canonical.Digest().String(),
+	}
+	entry.Platform.OS = "linux"
+	entry.Platform.Architecture = image.Platform.Architecture
+	entry.Platform.Variant = image.Platform.Variant
+
+	return entry, nil
+}
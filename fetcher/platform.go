@@ -0,0 +1,353 @@
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	btypes "github.com/box-builder/box/types"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+)
+
+// the media types of the manifests of multi-platform images.
+const (
+	manifestListType = "application/vnd.docker.distribution.manifest.list.v2+json"
+	ociIndexType     = "application/vnd.oci.image.index.v1+json"
+)
+
+// dockerHubRegistry is the host serving the registry API of Docker Hub.
+const dockerHubRegistry = "registry-1.docker.io"
+
+// maxManifestSize bounds the manifest lists and tokens read from registries.
+const maxManifestSize = 4 << 20
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+var insecureClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	},
+}
+
+// manifestList is the manifest list, or OCI index, of a multi-platform image.
+type manifestList struct {
+	MediaType string          `json:"mediaType"`
+	Manifests []manifestEntry `json:"manifests"`
+}
+
+type manifestEntry struct {
+	MediaType string `json:"mediaType,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	Digest    string `json:"digest"`
+	Platform  struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+		Variant      string `json:"variant,omitempty"`
+	} `json:"platform"`
+}
+
+func (e manifestEntry) platform() string {
+	platform := e.Platform.OS + "/" + e.Platform.Architecture
+	if e.Platform.Variant != "" {
+		platform += "/" + e.Platform.Variant
+	}
+
+	return platform
+}
+
+// ResolvePlatform returns the entry of the multi-platform image for the
+// platform as `name@digest`, so that it is pulled by its digest; the daemon
+// would otherwise pull the entry for its own platform. The manifest list is
+// read from the image's registry, anonymously, by the digest if it is not
+// empty, so a pinned list is used even if the tag has moved.
+func ResolvePlatform(ctx context.Context, globals *btypes.Global, name, digest string, platform btypes.Platform) (string, error) {
+	ref, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return "", err
+	}
+
+	version := "latest"
+	if tagged, ok := ref.(reference.Tagged); ok {
+		version = tagged.Tag()
+	}
+	if canonical, ok := ref.(reference.Canonical); ok {
+		version = canonical.Digest().String()
+	}
+	if digest != "" {
+		version = digest
+	}
+
+	list, err := fetchManifestList(ctx, globals, reference.Domain(ref), reference.Path(ref), version)
+	if err != nil {
+		return "", fmt.Errorf("Could not read the manifest list of %q: %v", name, err)
+	}
+
+	entry, err := selectPlatform(list, platform)
+	if err != nil {
+		return "", fmt.Errorf("Could not select from %q: %v", name, err)
+	}
+
+	return reference.FamiliarName(ref) + "@" + entry.Digest, nil
+}
+
+// selectPlatform returns the linux entry of the list matching the platform,
+// which must be the only one.
+func selectPlatform(list *manifestList, platform btypes.Platform) (manifestEntry, error) {
+	matches := []manifestEntry{}
+	platforms := []string{}
+
+	for _, entry := range list.Manifests {
+		if entry.Platform.OS != "linux" {
+			continue
+		}
+		platforms = append(platforms, entry.platform())
+
+		if platform.Architecture != "" && entry.Platform.Architecture != platform.Architecture {
+			continue
+		}
+
+		if platform.Variant != "" && entry.Platform.Variant != platform.Variant {
+			continue
+		}
+
+		matches = append(matches, entry)
+	}
+
+	wanted := strings.Trim(platform.Architecture+"/"+platform.Variant, "/")
+
+	switch len(matches) {
+	case 1:
+		return matches[0], nil
+	case 0:
+		return manifestEntry{}, fmt.Errorf("no entry is for %s; it has %s", wanted, strings.Join(platforms, ", "))
+	default:
+		found := []string{}
+		for _, entry := range matches {
+			found = append(found, entry.platform())
+		}
+
+		return manifestEntry{}, fmt.Errorf("%s matches more than one entry, %s; give both arch and variant", wanted, strings.Join(found, ", "))
+	}
+}
+
+// fetchManifestList reads the manifest list of the repository at the tag or
+// digest from the registry, with the credentials RegistryAuth finds for it if
+// the registry asks for them. The registries of --allow-insecure-registry are
+// read without TLS verification, or over plain HTTP.
+func fetchManifestList(ctx context.Context, globals *btypes.Global, domain, path, version string) (*manifestList, error) {
+	resp, err := manifestRequest(ctx, globals, domain, path, version, "GET", manifestListType+", "+ociIndexType, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the registry returned %s", resp.Status)
+	}
+
+	var list manifestList
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	mediaType := list.MediaType
+	if mediaType == "" {
+		mediaType = strings.TrimSpace(strings.SplitN(resp.Header.Get("Content-Type"), ";", 2)[0])
+	}
+
+	if mediaType != manifestListType && mediaType != ociIndexType {
+		return nil, fmt.Errorf("it is not a multi-platform image")
+	}
+
+	return &list, nil
+}
+
+// manifestRequest makes the request to the manifest of the repository at the
+// path at the tag or digest, with the credentials RegistryAuth finds for the
+// registry if it asks for them. The registries of --allow-insecure-registry
+// are used without TLS verification, or over plain HTTP.
+func manifestRequest(ctx context.Context, globals *btypes.Global, domain, path, version, method, accept, contentType string, body []byte) (*http.Response, error) {
+	auth, err := RegistryAuth(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	client := http.DefaultClient
+	schemes := []string{"https"}
+	if AllowedInsecure(globals, domain) {
+		client = insecureClient
+		schemes = append(schemes, "http")
+	}
+
+	host := domain
+	if domain == dockerHub {
+		host = dockerHubRegistry
+	}
+
+	req := registryRequest{method: method, accept: accept, contentType: contentType, body: body}
+
+	var resp *http.Response
+
+	for _, scheme := range schemes {
+		req.url = fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, host, path, version)
+		resp, err = req.do(ctx, client, auth)
+		if err == nil {
+			break
+		}
+	}
+
+	return resp, err
+}
+
+// registryRequest is a request to the registry API, which is made again with
+// credentials if it is refused without them.
+type registryRequest struct {
+	method      string
+	url         string
+	accept      string
+	contentType string
+	body        []byte
+}
+
+// do makes the request. If it is refused without credentials, it is made
+// again with those in auth, or a token for them from the registry's
+// authorization service.
+func (r registryRequest) do(ctx context.Context, client *http.Client, auth types.AuthConfig) (*http.Response, error) {
+	resp, err := r.send(ctx, client, "")
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	challenge := resp.Header.Get("Www-Authenticate")
+
+	if strings.HasPrefix(strings.ToLower(challenge), "basic") {
+		if auth.Username == "" {
+			return nil, fmt.Errorf("the registry requires credentials")
+		}
+
+		basic := base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password))
+		return r.send(ctx, client, "Basic "+basic)
+	}
+
+	token, err := registryToken(ctx, client, challenge, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.send(ctx, client, "Bearer "+token)
+}
+
+// send makes the request once, with the Authorization header if it is not
+// empty.
+func (r registryRequest) send(ctx context.Context, client *http.Client, authorization string) (*http.Response, error) {
+	var body io.Reader
+	if r.body != nil {
+		body = bytes.NewReader(r.body)
+	}
+
+	req, err := http.NewRequest(r.method, r.url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.accept != "" {
+		req.Header.Set("Accept", r.accept)
+	}
+	if r.contentType != "" {
+		req.Header.Set("Content-Type", r.contentType)
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	return client.Do(req.WithContext(ctx))
+}
+
+// registryToken requests a token from the authorization service of the bearer
+// challenge. It is requested with the username and password of auth, or for
+// its identity token, which is exchanged for one as an OAuth2 refresh token;
+// without either, the token is anonymous.
+func registryToken(ctx context.Context, client *http.Client, challenge string, auth types.AuthConfig) (string, error) {
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return "", fmt.Errorf("the registry requires credentials")
+	}
+
+	params := map[string]string{}
+	for _, match := range challengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+
+	if params["realm"] == "" {
+		return "", fmt.Errorf("the registry's challenge %q has no realm", challenge)
+	}
+
+	query := url.Values{}
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+
+	var (
+		req *http.Request
+		err error
+	)
+
+	if auth.IdentityToken != "" {
+		query.Set("grant_type", "refresh_token")
+		query.Set("refresh_token", auth.IdentityToken)
+		query.Set("client_id", "box")
+
+		req, err = http.NewRequest("POST", params["realm"], strings.NewReader(query.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req, err = http.NewRequest("GET", params["realm"]+"?"+query.Encode(), nil)
+		if err != nil {
+			return "", err
+		}
+
+		if auth.Username != "" {
+			req.SetBasicAuth(auth.Username, auth.Password)
+		}
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return "", fmt.Errorf("the registry's authorization service returned %s", resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&token); err != nil {
+		return "", err
+	}
+
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+
+	return token.Token, nil
+}
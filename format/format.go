@@ -0,0 +1,701 @@
+// Package format rewrites plans in a standard style.
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Indent is the indentation of each level of nesting.
+const Indent = "  "
+
+// the keywords which open a block closed by `end`, when they start an
+// expression rather than modify one.
+var blockKeywords = map[string]bool{
+	"if":     true,
+	"unless": true,
+	"while":  true,
+	"until":  true,
+	"case":   true,
+	"begin":  true,
+	"def":    true,
+	"class":  true,
+	"module": true,
+	"for":    true,
+}
+
+// the keywords which continue a block, and are aligned with its opening line.
+var middleKeywords = map[string]bool{
+	"else":   true,
+	"elsif":  true,
+	"when":   true,
+	"in":     true,
+	"rescue": true,
+	"ensure": true,
+}
+
+// the keywords after which an expression is a value, like an identifier.
+var valueKeywords = map[string]bool{
+	"end":   true,
+	"self":  true,
+	"true":  true,
+	"false": true,
+	"nil":   true,
+}
+
+// Plan formats a plan. It is conservative: only the whitespace outside of
+// strings, heredocs and comments changes, and hash keys written as symbols
+// with `=>` are written in the `key: value` form, so the plan means the same.
+//
+// Each line is indented by its nesting in blocks, hashes, arrays and
+// arguments, and a line continuing a statement by one more level. Runs of
+// spaces are reduced to one, commas are followed by a space and `=>` is
+// surrounded by them. Trailing whitespace is removed, as are runs of empty
+// lines and those at the start and end of the plan.
+//
+// Lines starting inside a multi-line string or a heredoc are left alone. An
+// error is returned if the plan's blocks, brackets or strings are not closed.
+func Plan(src []byte) ([]byte, error) {
+	f := &formatter{}
+
+	lines := strings.Split(strings.Replace(string(src), "\r\n", "\n", -1), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	for n, line := range lines {
+		f.line = n + 1
+		if err := f.format(line); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n+1, err)
+		}
+	}
+
+	if f.comment {
+		return nil, fmt.Errorf("line %d: =begin is not closed", f.line)
+	}
+
+	if len(f.heredocs) > 0 {
+		return nil, fmt.Errorf("line %d: heredoc %s is not closed", f.line, f.heredocs[0].terminator)
+	}
+
+	if len(f.contexts) > 0 {
+		return nil, fmt.Errorf("line %d: string opened on line %d is not closed", f.line, f.contexts[0].line)
+	}
+
+	if len(f.openers) > 0 {
+		opener := f.openers[len(f.openers)-1]
+		return nil, fmt.Errorf("line %d: %q opened on line %d is not closed", f.line, opener.token, opener.line)
+	}
+
+	out := bytes.TrimRight(f.out.Bytes(), "\n")
+	if len(out) == 0 {
+		return out, nil
+	}
+
+	return append(out, '\n'), nil
+}
+
+// opener is an unclosed block, hash, array or argument list.
+type opener struct {
+	token   string
+	keyword bool // closed by `end`, rather than a bracket
+	indent  int  // the indentation of the line opening it, and closing it
+	level   int  // the indentation of the lines within it
+	line    int
+}
+
+// context is a string, or the code interpolated into one, which is copied
+// as is.
+type context struct {
+	open, close byte // the delimiters; open is 0 unless they nest
+	nest        int  // for nesting delimiters, or braces in interpolated code
+	interpolate bool
+	code        bool // interpolated code, rather than the string
+	line        int
+}
+
+type heredoc struct {
+	terminator string
+	indented   bool // the terminator may be indented, with <<- and <<~
+}
+
+type formatter struct {
+	out      bytes.Buffer
+	line     int
+	openers  []opener
+	contexts []context
+	heredocs []heredoc // started on the current line, or whose body is being copied
+	inBody   bool      // copying the body of heredocs[0]
+	comment  bool      // in =begin ... =end
+	end      bool      // after __END__, which ends the code
+	blanks   int       // empty lines not yet written
+	wrote    bool      // a line was written
+
+	// the statement the last line ends continues on the next one.
+	continues bool
+	// the last significant token ends a value, as an identifier or a
+	// closing bracket does, which makes a following `if` a modifier.
+	lastValue bool
+}
+
+// lineState is the state of the line being formatted.
+type lineState struct {
+	buf      bytes.Buffer
+	indent   int
+	fixed    bool // indent is known
+	space    bool // a space is written before the next token
+	tokens   int  // tokens written, other than leading closers
+	loopDo   bool // a `do` on the line belongs to its while, until or for
+	last     string
+	value    bool
+	verbatim bool
+}
+
+func (f *formatter) format(line string) error {
+	switch {
+	case f.end:
+		f.write(line, true)
+		return nil
+	case f.inBody:
+		f.write(line, true)
+		h := f.heredocs[0]
+		if line == h.terminator || (h.indented && strings.TrimSpace(line) == h.terminator) {
+			f.heredocs = f.heredocs[1:]
+			f.inBody = len(f.heredocs) > 0
+		}
+		return nil
+	case f.comment:
+		f.write(line, true)
+		f.comment = !strings.HasPrefix(line, "=end")
+		return nil
+	case strings.HasPrefix(line, "=begin"):
+		f.write(line, true)
+		f.comment = true
+		return nil
+	case line == "__END__":
+		f.write(line, true)
+		f.end = true
+		return nil
+	}
+
+	ls := &lineState{verbatim: len(f.contexts) > 0, value: f.lastValue && f.continues}
+	if ls.verbatim {
+		ls.indent, ls.fixed = f.level(), true
+	}
+
+	code := strings.TrimLeft(line, " \t")
+	if err := f.scan(ls, code); err != nil {
+		return err
+	}
+
+	if ls.verbatim {
+		f.write(line, true)
+	} else if ls.buf.Len() == 0 {
+		f.blanks++
+	} else {
+		f.fix(ls)
+		f.write(strings.Repeat(Indent, ls.indent)+ls.buf.String(), false)
+	}
+
+	if ls.last != "" || ls.verbatim {
+		f.continues = len(f.contexts) == 0 && continues(ls.last) && (len(f.openers) == 0 || f.openers[len(f.openers)-1].keyword)
+		f.lastValue = ls.value
+	}
+
+	f.inBody = len(f.heredocs) > 0
+	return nil
+}
+
+// scan formats the code of a line into the line state, keeping track of the
+// blocks, strings and heredocs it opens and closes.
+func (f *formatter) scan(ls *lineState, code string) error {
+	for i := 0; i < len(code); {
+		if len(f.contexts) > 0 {
+			n := f.scanContext(code[i:])
+			if !ls.verbatim {
+				ls.buf.WriteString(code[i : i+n])
+			}
+			i += n
+			if len(f.contexts) == 0 {
+				ls.value = true
+			}
+			continue
+		}
+
+		c := code[i]
+		rest := code[i:]
+
+		switch {
+		case c == ' ' || c == '\t':
+			ls.space = true
+			i++
+			continue
+		case c == '#':
+			// a comment does not end the statement, which may continue on
+			// the next line.
+			last, value := ls.last, ls.value
+			f.emit(ls, strings.TrimRight(rest, " \t"), false)
+			ls.last, ls.value = last, value
+			return nil
+		}
+
+		var token string
+
+		switch {
+		case c == '"' || c == '`':
+			token = string(c)
+			f.push(context{close: c, interpolate: true})
+		case c == '\'':
+			token = "'"
+			f.push(context{close: c})
+		case c == ',':
+			ls.space = false
+			f.emit(ls, ",", false)
+			ls.space = true
+			i++
+			continue
+		case strings.HasPrefix(rest, "<=>"):
+			token = "<=>"
+			f.emit(ls, token, false)
+			ls.value = false
+			i += len(token)
+			continue
+		case strings.HasPrefix(rest, "=>"):
+			ls.space = true
+			f.emit(ls, "=>", false)
+			ls.space = true
+			i += 2
+			continue
+		case strings.HasPrefix(rest, "::"):
+			f.emit(ls, "::", false)
+			i += 2
+			continue
+		case c == ':' && symbolRocket(rest) != "":
+			sym := symbolRocket(rest)
+			f.emit(ls, identifier(rest[1:])+":", false)
+			ls.space = true
+			i += len(sym)
+			continue
+		case c == '<' && heredocStart(rest, ls) != "":
+			token = heredocStart(rest, ls)
+			f.heredocs = append(f.heredocs, parseHeredoc(token))
+		case c == '%' && percentLiteral(rest, ls, code, i) != "":
+			token = percentLiteral(rest, ls, code, i)
+			f.push(percentContext(token))
+		case c == '/' && startsLiteral(ls, code, i):
+			token = "/"
+			f.push(context{close: '/', interpolate: true})
+		case c == '(' || c == '[' || c == '{':
+			token = string(c)
+			f.emit(ls, token, false)
+			f.open(ls, token, false)
+			ls.value = false
+			i++
+			continue
+		case c == ')' || c == ']' || c == '}':
+			token = string(c)
+			if err := f.close(ls, token); err != nil {
+				return err
+			}
+			f.emit(ls, token, ls.tokens == 0)
+			ls.value = true
+			i++
+			continue
+		case isIdentStart(c) || (c >= '0' && c <= '9'):
+			token = identifier(rest)
+			if token == "" {
+				token = number(rest)
+			}
+
+			if err := f.word(ls, token, code, i); err != nil {
+				return err
+			}
+			i += len(token)
+			continue
+		default:
+			token = operator(rest)
+			f.emit(ls, token, false)
+			ls.value = false
+			i += len(token)
+			continue
+		}
+
+		// the string itself is copied by the next iteration.
+		f.emit(ls, token, false)
+		ls.value = strings.HasPrefix(token, "<<")
+		i += len(token)
+	}
+
+	return nil
+}
+
+// word formats an identifier, keyword or number.
+func (f *formatter) word(ls *lineState, word, code string, i int) error {
+	before := byte(0)
+	if i > 0 {
+		before = code[i-1]
+	}
+
+	after := code[i+len(word):]
+	label := strings.HasPrefix(after, ":") && !strings.HasPrefix(after, "::")
+	keyword := !label && before != '.' && before != ':' && before != '@' && before != '$'
+
+	switch {
+	case keyword && word == "end":
+		if err := f.close(ls, "end"); err != nil {
+			return err
+		}
+		f.emit(ls, word, ls.tokens == 0)
+		ls.value = true
+		return nil
+	case keyword && middleKeywords[word] && ls.tokens == 0 && ls.buf.Len() == 0:
+		if len(f.openers) > 0 && f.openers[len(f.openers)-1].keyword {
+			ls.indent, ls.fixed = f.openers[len(f.openers)-1].indent, true
+		}
+		f.emit(ls, word, false)
+		ls.value = false
+		return nil
+	case keyword && blockKeywords[word] && !ls.value:
+		f.emit(ls, word, false)
+		f.open(ls, word, true)
+		ls.loopDo = word == "while" || word == "until" || word == "for"
+		ls.value = false
+		return nil
+	case keyword && word == "do":
+		f.emit(ls, word, false)
+		if ls.loopDo {
+			ls.loopDo = false
+		} else {
+			f.open(ls, word, true)
+		}
+		ls.value = false
+		return nil
+	}
+
+	f.emit(ls, word, false)
+	ls.value = !keyword || valueKeywords[word] || !isKeyword(word)
+	return nil
+}
+
+// emit writes a token to the line. closer is true for closing tokens at the
+// start of the line, which do not fix its indentation.
+func (f *formatter) emit(ls *lineState, token string, closer bool) {
+	if !closer {
+		f.fix(ls)
+		ls.tokens++
+	}
+
+	if ls.space && ls.buf.Len() > 0 {
+		ls.buf.WriteByte(' ')
+	}
+	ls.space = false
+
+	if !ls.verbatim {
+		ls.buf.WriteString(token)
+	}
+	ls.last = token
+}
+
+// fix fixes the indentation of the line, at the level of its innermost
+// block, or one more if it continues the last line's statement.
+func (f *formatter) fix(ls *lineState) {
+	if ls.fixed {
+		return
+	}
+
+	ls.indent, ls.fixed = f.level(), true
+	if f.continues {
+		ls.indent++
+	}
+}
+
+func (f *formatter) level() int {
+	if len(f.openers) == 0 {
+		return 0
+	}
+
+	return f.openers[len(f.openers)-1].level
+}
+
+func (f *formatter) open(ls *lineState, token string, keyword bool) {
+	f.fix(ls)
+	f.openers = append(f.openers, opener{token: token, keyword: keyword, indent: ls.indent, level: ls.indent + 1, line: f.line})
+}
+
+var closers = map[string]string{")": "(", "]": "[", "}": "{"}
+
+func (f *formatter) close(ls *lineState, token string) error {
+	if len(f.openers) == 0 {
+		return fmt.Errorf("unexpected %q", token)
+	}
+
+	opener := f.openers[len(f.openers)-1]
+	if opener.keyword != (token == "end") || (!opener.keyword && closers[token] != opener.token) {
+		return fmt.Errorf("unexpected %q; %q opened on line %d is not closed", token, opener.token, opener.line)
+	}
+
+	f.openers = f.openers[:len(f.openers)-1]
+
+	// the line closing a block is aligned with the line opening it.
+	if ls.tokens == 0 && !ls.verbatim {
+		ls.indent, ls.fixed = opener.indent, true
+	}
+
+	return nil
+}
+
+func (f *formatter) push(c context) {
+	c.line = f.line
+	f.contexts = append(f.contexts, c)
+}
+
+// scanContext scans a string, or code interpolated into one, and returns
+// how much of the input it covers: up to the end of the string or code, or
+// of the line.
+func (f *formatter) scanContext(input string) int {
+	c := &f.contexts[len(f.contexts)-1]
+
+	for i := 0; i < len(input); i++ {
+		ch := input[i]
+
+		if c.code {
+			switch {
+			case ch == '"' || ch == '`':
+				f.push(context{close: ch, interpolate: true})
+				return i + 1
+			case ch == '\'':
+				f.push(context{close: ch})
+				return i + 1
+			case ch == '{':
+				c.nest++
+			case ch == '}' && c.nest > 0:
+				c.nest--
+			case ch == '}':
+				f.contexts = f.contexts[:len(f.contexts)-1]
+				return i + 1
+			}
+			continue
+		}
+
+		switch {
+		case ch == '\\':
+			i++
+		case c.interpolate && ch == '#' && i+1 < len(input) && input[i+1] == '{':
+			f.push(context{code: true})
+			return i + 2
+		case c.open != 0 && ch == c.open:
+			c.nest++
+		case ch == c.close && c.nest > 0:
+			c.nest--
+		case ch == c.close:
+			f.contexts = f.contexts[:len(f.contexts)-1]
+			return i + 1
+		}
+	}
+
+	return len(input)
+}
+
+// write writes a line, after the empty lines before it, of which at most one
+// is kept. Blank lines at the start of the plan are dropped.
+func (f *formatter) write(line string, verbatim bool) {
+	if !verbatim {
+		line = strings.TrimRight(line, " \t")
+	}
+
+	if f.wrote && f.blanks > 0 {
+		f.out.WriteString("\n")
+	}
+	f.blanks = 0
+
+	f.out.WriteString(line)
+	f.out.WriteString("\n")
+	f.wrote = true
+}
+
+func continues(last string) bool {
+	switch last {
+	case ",", "\\", "&&", "||", "and", "or", "+", "=", "=>", "+=", "||=":
+		return true
+	}
+
+	return false
+}
+
+func isKeyword(word string) bool {
+	return blockKeywords[word] || middleKeywords[word] || valueKeywords[word] || word == "do" || word == "then" ||
+		word == "and" || word == "or" || word == "not" || word == "return"
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdent(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+// identifier returns the identifier at the start of the input, with its
+// trailing ? or !, if any.
+func identifier(input string) string {
+	if input == "" || !isIdentStart(input[0]) {
+		return ""
+	}
+
+	n := 1
+	for n < len(input) && isIdent(input[n]) {
+		n++
+	}
+
+	if n < len(input) && (input[n] == '?' || input[n] == '!') && (n+1 == len(input) || input[n+1] != '=') {
+		n++
+	}
+
+	return input[:n]
+}
+
+func number(input string) string {
+	n := 1
+	for n < len(input) {
+		if isIdent(input[n]) {
+			n++
+		} else if input[n] == '.' && n+1 < len(input) && input[n+1] >= '0' && input[n+1] <= '9' {
+			n += 2
+		} else {
+			break
+		}
+	}
+
+	return input[:n]
+}
+
+// operator returns the run of operator characters at the start of the
+// input, or its first character if it is not an operator.
+func operator(input string) string {
+	n := 0
+	for n < len(input) && strings.IndexByte("=<>!~+-*&|^.;?", input[n]) >= 0 {
+		// a character starting a literal or token of its own ends the run.
+		if n > 0 && (strings.HasPrefix(input[n:], "=>") || input[n] == '?' || input[n] == ';') {
+			break
+		}
+		n++
+	}
+
+	if n == 0 {
+		return input[:1]
+	}
+
+	return input[:n]
+}
+
+// symbolRocket returns `:key =>`, with the whitespace in it, if the input
+// starts with a symbol key written with a hash rocket.
+func symbolRocket(input string) string {
+	key := identifier(input[1:])
+	if key == "" || strings.HasSuffix(key, "?") || strings.HasSuffix(key, "!") {
+		return ""
+	}
+
+	rest := input[1+len(key):]
+	trimmed := strings.TrimLeft(rest, " \t")
+	if !strings.HasPrefix(trimmed, "=>") {
+		return ""
+	}
+
+	return input[:len(input)-len(trimmed)+2]
+}
+
+// startsLiteral returns true if the / or % at i starts a literal rather than
+// being an operator: the last token is not a value, or it is separated from
+// the previous token but not the next, as in `assert /x/`.
+func startsLiteral(ls *lineState, code string, i int) bool {
+	if !ls.value {
+		return true
+	}
+
+	spaceBefore := i > 0 && (code[i-1] == ' ' || code[i-1] == '\t')
+	spaceAfter := i+1 < len(code) && (code[i+1] == ' ' || code[i+1] == '\t' || code[i+1] == '=')
+	return spaceBefore && !spaceAfter
+}
+
+// heredocStart returns the start of a heredoc, such as `<<-EOF`, at the start
+// of the input.
+func heredocStart(input string, ls *lineState) string {
+	if !strings.HasPrefix(input, "<<") || len(input) < 3 {
+		return ""
+	}
+
+	n := 2
+	if input[n] == '-' || input[n] == '~' {
+		n++
+	}
+
+	// a value before `<<x` makes it a shift: it is a heredoc only after a
+	// space, like a literal.
+	if ls.value && !ls.space {
+		return ""
+	}
+
+	if n < len(input) && (input[n] == '\'' || input[n] == '"') {
+		end := strings.IndexByte(input[n+1:], input[n])
+		if end <= 0 {
+			return ""
+		}
+		return input[:n+end+2]
+	}
+
+	word := identifier(input[n:])
+	if word == "" {
+		return ""
+	}
+
+	return input[:n+len(word)]
+}
+
+func parseHeredoc(token string) heredoc {
+	term := strings.TrimLeft(token[2:], "-~")
+	return heredoc{
+		terminator: strings.Trim(term, `'"`),
+		indented:   token[2] == '-' || token[2] == '~',
+	}
+}
+
+var pairs = map[byte]byte{'(': ')', '[': ']', '{': '}', '<': '>'}
+
+// percentLiteral returns the start of a percent literal, such as `%w[`, at
+// the start of the input.
+func percentLiteral(input string, ls *lineState, code string, i int) string {
+	if len(input) < 2 {
+		return ""
+	}
+
+	n := 1
+	if strings.IndexByte("qQwWiIrsx", input[1]) >= 0 {
+		n++
+	} else if !startsLiteral(ls, code, i) {
+		return ""
+	}
+
+	if n >= len(input) {
+		return ""
+	}
+
+	delim := input[n]
+	if isIdent(delim) || delim == ' ' || delim == '\t' || delim == '=' {
+		return ""
+	}
+
+	return input[:n+1]
+}
+
+func percentContext(token string) context {
+	delim := token[len(token)-1]
+	c := context{close: delim, interpolate: len(token) == 2 || strings.IndexByte("QWIrx", token[1]) >= 0}
+
+	if close, ok := pairs[delim]; ok {
+		c.open, c.close = delim, close
+	}
+
+	return c
+}
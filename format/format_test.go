@@ -0,0 +1,82 @@
+package format
+
+import (
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type formatSuite struct{}
+
+var _ = Suite(&formatSuite{})
+
+func TestFormat(t *T) {
+	TestingT(t)
+}
+
+func (fs *formatSuite) TestPlan(c *C) {
+	table := map[string]string{
+		"": "",
+		"\n\nfrom   \"debian\"  \n\n\n\nrun \"ls\"\n\n":                                   "from \"debian\"\n\nrun \"ls\"\n",
+		"from \"debian\"\r\nrun \"ls\"":                                                   "from \"debian\"\nrun \"ls\"\n",
+		"run \"ls\" do\nrun \"true\"\n    end\n":                                          "run \"ls\" do\n  run \"true\"\nend\n",
+		"if getenv(\"X\") != \"\"\nrun \"a\"\nelsif x\nrun \"b\"\nelse\nrun \"c\"\nend\n": "if getenv(\"X\") != \"\"\n  run \"a\"\nelsif x\n  run \"b\"\nelse\n  run \"c\"\nend\n",
+		"case x\nwhen 1\nrun \"a\"\nend\n":                                                "case x\nwhen 1\n  run \"a\"\nend\n",
+		"run \"a\" if x\nrun \"b\" unless y\n":                                            "run \"a\" if x\nrun \"b\" unless y\n",
+		"x = if y\n1\nend\n":                                                              "x = if y\n  1\nend\n",
+		"begin\nrun \"a\"\nend while x\n":                                                 "begin\n  run \"a\"\nend while x\n",
+		"while x do\nrun \"a\"\nend\n":                                                    "while x do\n  run \"a\"\nend\n",
+		"def f(a,b)\nreturn a.end\nend\n":                                                 "def f(a, b)\n  return a.end\nend\n",
+		"copy \".\",\"/\" ,:ignore_list=>[\"a\",\n\"b\"]\n":                               "copy \".\", \"/\", ignore_list: [\"a\",\n  \"b\"]\n",
+		"x = {\"a\"=>1, 'b' =>   2}\n":                                                    "x = {\"a\" => 1, 'b' => 2}\n",
+		"x = a <=> b\n":                                                                   "x = a <=> b\n",
+		"env \"A\" =>  \"1\",\n\"B\" => \"2\"\n":                                          "env \"A\" => \"1\",\n  \"B\" => \"2\"\n",
+		"run \"a\",\n# why\nprivileged: true\n":                                           "run \"a\",\n  # why\n  privileged: true\n",
+		"run \"a\"    # a   comment   \n":                                                 "run \"a\" # a   comment\n",
+		"foo({\na: 1,\n})\n":                                                              "foo({\n  a: 1,\n})\n",
+		"run \"a  ,b  =>  c\"\n":                                                          "run \"a  ,b  =>  c\"\n",
+		"run \"#{x  ,  \"a,b\"}  \"\n":                                                    "run \"#{x  ,  \"a,b\"}  \"\n",
+		"run \"a\n   b  ,  \"  ,  x\n":                                                    "run \"a\n   b  ,  \"  ,  x\n",
+		"run <<-EOF\n  a  ,  b\n\n\n  EOF\nrun \"x\"\n":                                   "run <<-EOF\n  a  ,  b\n\n\n  EOF\nrun \"x\"\n",
+		"run <<EOF , <<'B'\na\nEOF\nb\nB\n":                                               "run <<EOF, <<'B'\na\nEOF\nb\nB\n",
+		"x = y << z\n":                                                                    "x = y << z\n",
+		"assert_match /a  ,  b/, x\n":                                                     "assert_match /a  ,  b/, x\n",
+		"x = a / b\n":                                                                     "x = a / b\n",
+		"x = %w[a  ,  b]\n":                                                               "x = %w[a  ,  b]\n",
+		"x = a % b\n":                                                                     "x = a % b\n",
+		"x = foo.class\ny = {\nif: 1,\n}\n":                                               "x = foo.class\ny = {\n  if: 1,\n}\n",
+		"x = Foo::Bar\n":                                                                  "x = Foo::Bar\n",
+		"x = a &&\nb\n":                                                                   "x = a &&\n  b\n",
+		"=begin\n  a  ,\n=end\nrun \"a\"\n":                                               "=begin\n  a  ,\n=end\nrun \"a\"\n",
+		"run \"a\"\n__END__\n  a  ,\n\n":                                                  "run \"a\"\n__END__\n  a  ,\n",
+	}
+
+	for src, formatted := range table {
+		out, err := Plan([]byte(src))
+		c.Assert(err, IsNil, Commentf("%q", src))
+		c.Assert(string(out), Equals, formatted, Commentf("%q", src))
+
+		// formatting is idempotent.
+		again, err := Plan(out)
+		c.Assert(err, IsNil, Commentf("%q", formatted))
+		c.Assert(string(again), Equals, formatted, Commentf("%q", formatted))
+	}
+}
+
+func (fs *formatSuite) TestPlanErrors(c *C) {
+	table := map[string]string{
+		"run \"a\" do\n":          `line 1: "do" opened on line 1 is not closed`,
+		"end\n":                   `line 1: unexpected "end"`,
+		"foo(\n]\n":               `line 2: unexpected "]"; "(" opened on line 1 is not closed`,
+		"run \"a\nb\n":            `line 2: string opened on line 1 is not closed`,
+		"run <<-EOF\na\n":         `line 2: heredoc EOF is not closed`,
+		"=begin\na\n":             `line 2: =begin is not closed`,
+		"if x\nrun \"a\"\n}\nend": `line 3: unexpected "}"; "if" opened on line 1 is not closed`,
+	}
+
+	for src, msg := range table {
+		_, err := Plan([]byte(src))
+		c.Assert(err, NotNil, Commentf("%q", src))
+		c.Assert(err.Error(), Equals, msg, Commentf("%q", src))
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"path"
 	"time"
+
+	"github.com/box-builder/box/util"
 )
 
 func (i *Image) writeConfig(tw *tar.Writer) error {
@@ -15,6 +17,11 @@ func (i *Image) writeConfig(tw *tar.Writer) error {
 
 	lastLayer := i.layers[len(i.layers)-1]
 
+	now := time.Now()
+	if i.globals.Reproducible {
+		now = util.SourceDate()
+	}
+
 	jsonFile := fmt.Sprintf("%s.json", lastLayer.id)
 	tarFiles := []string{}
 	layerIDs := []string{}
@@ -28,7 +35,7 @@ func (i *Image) writeConfig(tw *tar.Writer) error {
 		"Layers": tarFiles,
 	}}
 
-	content, err := json.Marshal(i.config.ToImage(layerIDs))
+	content, err := json.Marshal(i.config.ToImage(layerIDs, now))
 	if err != nil {
 		return err
 	}
@@ -41,9 +48,9 @@ func (i *Image) writeConfig(tw *tar.Writer) error {
 		Size:       int64(len(content)),
 		Mode:       0666,
 		Typeflag:   tar.TypeReg,
-		ModTime:    time.Now(),
-		AccessTime: time.Now(),
-		ChangeTime: time.Now(),
+		ModTime:    now,
+		AccessTime: now,
+		ChangeTime: now,
 	})
 
 	if err != nil {
@@ -63,9 +70,9 @@ func (i *Image) writeConfig(tw *tar.Writer) error {
 		Linkname:   "manifest.json",
 		Uname:      "root",
 		Gname:      "root",
-		ModTime:    time.Now(),
-		AccessTime: time.Now(),
-		ChangeTime: time.Now(),
+		ModTime:    now,
+		AccessTime: now,
+		ChangeTime: now,
 		Size:       int64(len(content)),
 		Mode:       0666,
 		Typeflag:   tar.TypeReg,
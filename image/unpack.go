@@ -103,7 +103,7 @@ func extractLayers(img *imageInfo, dir, file string) error {
 				return errors.New("layer not found")
 			}
 
-			sum, err := bt.SumWithCopy(ioutil.Discard, tr, logger.New(chainID[:12], false), fmt.Sprintf("Unpacking Layer ID %s", chainID[:12]))
+			sum, err := bt.SumWithCopy(ioutil.Discard, tr, logger.New(chainID[:12], false, 0), fmt.Sprintf("Unpacking Layer ID %s", chainID[:12]))
 			if err != nil {
 				return err
 			}
@@ -0,0 +1,439 @@
+package layers
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/box-builder/box/fetcher"
+	"github.com/docker/docker/api/types/container"
+)
+
+const (
+	// cacheLabel holds the steps that built an image pushed with
+	// --cache-image-push.
+	cacheLabel = "org.box-builder.cache"
+	// cacheVersion is the format of the steps in cacheLabel. Images with
+	// another format are not used.
+	cacheVersion = 1
+)
+
+type cacheManifest struct {
+	Version int         `json:"version"`
+	Steps   []cacheStep `json:"steps"`
+}
+
+// cacheStep is a committed step of the build of a cache image.
+type cacheStep struct {
+	Parent string            `json:"parent"` // the image the step was applied to
+	ID     string            `json:"id"`     // the image the step committed
+	Key    string            `json:"key"`    // the cache key of the step
+	Layers int               `json:"layers"` // the layers of the cache image in the step's image
+	Config *container.Config `json:"config"`
+}
+
+// cacheImage is an image named with --cache-image. The steps that built it
+// are restored as images of their own when a build computes the same cache
+// key on the same parent image.
+type cacheImage struct {
+	mutex    sync.Mutex
+	id       string
+	created  time.Time
+	os       string
+	arch     string
+	layers   []string
+	steps    []cacheStep
+	restored map[string]string // restored image IDs, by step ID
+	original map[string]string // step IDs, by restored image ID
+}
+
+var (
+	cacheImages      = map[string]*cacheImage{}
+	cacheImagesMutex = new(sync.Mutex)
+)
+
+// cacheImage returns the cache image of the build, loading it the first time
+// it is asked for, or nil if there is none or it cannot be used. The images
+// are shared by all builders in the process, such as the plans of a multi
+// build.
+func (d *DockerImage) cacheImage() *cacheImage {
+	name := d.imageConfig.Globals.CacheImage
+	if name == "" {
+		return nil
+	}
+
+	cacheImagesMutex.Lock()
+	defer cacheImagesMutex.Unlock()
+
+	if ci, ok := cacheImages[name]; ok {
+		return ci
+	}
+
+	ci, err := d.loadCacheImage(name)
+	if err != nil {
+		d.imageConfig.Globals.Logger.Warning(fmt.Sprintf("not using cache image %q: %v", name, err))
+	}
+
+	cacheImages[name] = ci
+	return ci
+}
+
+// loadCacheImage pulls the cache image and reads its steps. If the pull fails,
+// a copy already in the daemon is used.
+func (d *DockerImage) loadCacheImage(name string) (*cacheImage, error) {
+	ctx := d.imageConfig.Globals.Context
+	pullErr := fetcher.Pull(ctx, d.imageConfig.Globals, d.client, name)
+
+	inspect, _, err := d.client.ImageInspectWithRaw(ctx, name)
+	if err != nil {
+		if pullErr != nil {
+			return nil, pullErr
+		}
+		return nil, err
+	}
+
+	if inspect.Config == nil || inspect.Config.Labels[cacheLabel] == "" {
+		return nil, errors.New("it was not pushed with --cache-image-push")
+	}
+
+	var manifest cacheManifest
+	if err := json.Unmarshal([]byte(inspect.Config.Labels[cacheLabel]), &manifest); err != nil || manifest.Version != cacheVersion {
+		return nil, errors.New("it was pushed by a version of box with another cache format")
+	}
+
+	if expired, err := d.cacheExpired(inspect.Created); err != nil {
+		return nil, err
+	} else if expired {
+		return nil, errors.New("it is older than --cache-ttl")
+	}
+
+	created, err := time.Parse(time.RFC3339Nano, inspect.Created)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cacheImage{
+		id:       inspect.ID,
+		created:  created,
+		os:       inspect.Os,
+		arch:     inspect.Architecture,
+		layers:   inspect.RootFS.Layers,
+		steps:    manifest.Steps,
+		restored: map[string]string{},
+		original: map[string]string{},
+	}, nil
+}
+
+// checkCacheImage looks for the step in the cache image, restoring it as an
+// image if it is found.
+func (d *DockerImage) checkCacheImage(cacheKey string) (bool, error) {
+	ci := d.cacheImage()
+	if ci == nil {
+		return false, nil
+	}
+
+	ci.mutex.Lock()
+	defer ci.mutex.Unlock()
+
+	parent := d.imageConfig.Config.Image
+	if original, ok := ci.original[parent]; ok {
+		parent = original
+	}
+
+	for _, step := range ci.steps {
+		if step.Parent != parent || step.Key != cacheKey || step.Layers > len(ci.layers) {
+			continue
+		}
+
+		id, ok := ci.restored[step.ID]
+		if !ok {
+			var err error
+			id, err = d.loadConfig(step.Config, ci.layers[:step.Layers], ci.os, ci.arch, ci.created)
+			if err != nil {
+				return false, err
+			}
+
+			ci.restored[step.ID] = id
+			ci.original[id] = step.ID
+		}
+
+		d.imageConfig.Globals.Logger.CacheHit(id)
+		d.imageConfig.Config.FromDocker(true, step.Config)
+		d.imageConfig.Config.Image = id
+		return true, d.imageConfig.Layers.AddImage(id)
+	}
+
+	return false, nil
+}
+
+// cacheSteps returns the steps that built the current image, from the first
+// one applied to an image box did not commit, such as the one given to
+// `from`. Steps restored from the cache image carry over its own steps.
+func (d *DockerImage) cacheSteps() ([]cacheStep, error) {
+	ci := d.cacheImage()
+	if ci != nil {
+		ci.mutex.Lock()
+		defer ci.mutex.Unlock()
+	}
+
+	steps := []cacheStep{}
+
+	for id := d.imageConfig.Config.Image; id != ""; {
+		if ci != nil {
+			if original, ok := ci.original[id]; ok {
+				steps = append(steps, ci.chain(original)...)
+				break
+			}
+		}
+
+		inspect, _, err := d.client.ImageInspectWithRaw(d.imageConfig.Globals.Context, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if inspect.Parent == "" || inspect.Comment == "" {
+			break
+		}
+
+		parent := inspect.Parent
+		if ci != nil {
+			if original, ok := ci.original[parent]; ok {
+				parent = original
+			}
+		}
+
+		steps = append(steps, cacheStep{
+			Parent: parent,
+			ID:     id,
+			Key:    inspect.Comment,
+			Layers: len(inspect.RootFS.Layers),
+			Config: inspect.Config,
+		})
+
+		id = inspect.Parent
+	}
+
+	for i, j := 0, len(steps)-1; i < j; i, j = i+1, j-1 {
+		steps[i], steps[j] = steps[j], steps[i]
+	}
+
+	return steps, nil
+}
+
+// chain returns the step which committed the image and the steps before it,
+// last first.
+func (ci *cacheImage) chain(id string) []cacheStep {
+	steps := []cacheStep{}
+
+	for found := true; found; {
+		found = false
+		for _, step := range ci.steps {
+			if step.ID == id {
+				steps = append(steps, step)
+				id = step.Parent
+				found = true
+				break
+			}
+		}
+	}
+
+	return steps
+}
+
+// PushCache pushes the current image as the tag, labelled with the steps that
+// built it so later builds can use them with --cache-image. Returns the
+// pushed image in `name@digest` form.
+func (d *DockerImage) PushCache(tag string) (string, error) {
+	steps, err := d.cacheSteps()
+	if err != nil {
+		return "", err
+	}
+
+	content, err := json.Marshal(cacheManifest{Version: cacheVersion, Steps: steps})
+	if err != nil {
+		return "", err
+	}
+
+	inspect, _, err := d.client.ImageInspectWithRaw(d.imageConfig.Globals.Context, d.imageConfig.Config.Image)
+	if err != nil {
+		return "", err
+	}
+
+	config := *inspect.Config
+	config.Labels = map[string]string{cacheLabel: string(content)}
+	for key, value := range inspect.Config.Labels {
+		config.Labels[key] = value
+	}
+
+	created, err := time.Parse(time.RFC3339Nano, inspect.Created)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := d.loadConfig(&config, inspect.RootFS.Layers, inspect.Os, inspect.Architecture, created)
+	if err != nil {
+		return "", err
+	}
+
+	if err := d.client.ImageTag(d.imageConfig.Globals.Context, id, tag); err != nil {
+		return "", err
+	}
+
+	return d.Push(tag)
+}
+
+// loadConfig loads an image with the configuration and layers into the
+// daemon, returning its ID. docker load only reads the layers it does not
+// have, and these are all in the daemon already, so only the image
+// configuration is written.
+func (d *DockerImage) loadConfig(config *container.Config, layers []string, os, arch string, created time.Time) (string, error) {
+	content, err := json.Marshal(map[string]interface{}{
+		"config":       config,
+		"created":      created.UTC().Format(time.RFC3339Nano),
+		"architecture": arch,
+		"os":           os,
+		"rootfs": map[string]interface{}{
+			"diff_ids": layers,
+			"type":     "layers",
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return d.loadImage(content, layers, nil, created)
+}
+
+// loadImage loads an image with the configuration content and layers into
+// the daemon, returning its ID. If layer is not nil, it holds the last of the
+// layers, which is written with the configuration; the daemon has the others.
+func (d *DockerImage) loadImage(content []byte, layers []string, layer *os.File, created time.Time) (string, error) {
+	sum := sha256.Sum256(content)
+	configFile := hex.EncodeToString(sum[:]) + ".json"
+
+	layerFiles := []string{}
+	for _, layer := range layers {
+		layerFiles = append(layerFiles, strings.TrimPrefix(layer, "sha256:")+"/layer.tar")
+	}
+
+	manifest, err := json.Marshal([]map[string]interface{}{{"Config": configFile, "Layers": layerFiles}})
+	if err != nil {
+		return "", err
+	}
+
+	r, w := io.Pipe()
+	defer r.Close()
+
+	go func() {
+		tw := tar.NewWriter(w)
+
+		for _, file := range []struct {
+			name    string
+			content []byte
+		}{{configFile, content}, {"manifest.json", manifest}} {
+			if err := tw.WriteHeader(&tar.Header{Name: file.name, Size: int64(len(file.content)), Mode: 0644, Typeflag: tar.TypeReg, ModTime: created}); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+
+			if _, err := tw.Write(file.content); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+		}
+
+		if layer != nil {
+			if err := writeLayerFile(tw, layerFiles[len(layerFiles)-1], layer, created); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+		}
+
+		w.CloseWithError(tw.Close())
+	}()
+
+	resp, err := d.client.ImageLoad(d.imageConfig.Globals.Context, r, true)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	return loadedImageID(resp.Body)
+}
+
+// writeLayerFile writes the content of the layer file to tw as name.
+func writeLayerFile(tw *tar.Writer, name string, layer *os.File, created time.Time) error {
+	stat, err := layer.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{Name: name, Size: stat.Size(), Mode: 0644, Typeflag: tar.TypeReg, ModTime: created}); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, layer)
+	return err
+}
+
+// loadedImageID returns the ID of the untagged image loaded from the progress
+// stream of docker load.
+func loadedImageID(reader io.Reader) (string, error) {
+	images, err := loadedImages(reader)
+	if err != nil {
+		return "", err
+	}
+
+	if len(images) == 0 {
+		return "", errors.New("cannot locate image id")
+	}
+
+	return images[0], nil
+}
+
+// loadedImages returns the images loaded from the progress stream of docker
+// load: their IDs, or their names for images saved with tags.
+func loadedImages(reader io.Reader) ([]string, error) {
+	images := []string{}
+	buf := bufio.NewReader(reader)
+
+	for {
+		line, err := buf.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) != 0 {
+			var msg struct {
+				Stream string `json:"stream"`
+				Error  string `json:"error"`
+			}
+
+			if err := json.Unmarshal(line, &msg); err != nil {
+				return nil, err
+			}
+
+			if msg.Error != "" {
+				return nil, fmt.Errorf("load failed: %s", msg.Error)
+			}
+
+			for _, prefix := range []string{imgIDText, imgNameText} {
+				if strings.HasPrefix(msg.Stream, prefix) {
+					images = append(images, strings.TrimSpace(strings.TrimPrefix(msg.Stream, prefix)))
+				}
+			}
+		}
+
+		if err == io.EOF {
+			return images, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
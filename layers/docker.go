@@ -2,8 +2,11 @@ package layers
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"github.com/box-builder/box/builder/config"
 	"github.com/box-builder/box/fetcher"
@@ -130,6 +133,99 @@ func (d *Docker) Lookup(config *config.Config, name string) (string, error) {
 	}
 
 	config.FromDocker(false, img.Config)
+	if img.Os != "" {
+		config.OS = img.Os
+	}
+
+	return img.ID, nil
+}
+
+// Resolve returns the id of the named image, or an empty string if the daemon
+// does not have it.
+func (d *Docker) Resolve(name string) (string, error) {
+	img, _, err := d.client.ImageInspectWithRaw(d.globals.Context, name)
+	if client.IsErrImageNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return img.ID, nil
+}
+
+// ResolvePlatform returns the entry of the multi-platform image for the
+// platform, as `name@digest`.
+func (d *Docker) ResolvePlatform(name, digest string, platform types.Platform) (string, error) {
+	return fetcher.ResolvePlatform(d.globals.Context, d.globals, name, digest, platform)
+}
+
+// RepoDigests returns the registry digests known for an image, in
+// `name@algorithm:hex` form.
+func (d *Docker) RepoDigests(name string) ([]string, error) {
+	img, _, err := d.client.ImageInspectWithRaw(d.globals.Context, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return img.RepoDigests, nil
+}
+
+// LayerDigests returns the diff IDs of the layers of an image.
+func (d *Docker) LayerDigests(name string) ([]string, error) {
+	img, _, err := d.client.ImageInspectWithRaw(d.globals.Context, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return img.RootFS.Layers, nil
+}
+
+// RepoTags returns the tags of an image.
+func (d *Docker) RepoTags(name string) ([]string, error) {
+	img, _, err := d.client.ImageInspectWithRaw(d.globals.Context, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return img.RepoTags, nil
+}
+
+// ImageSize returns the size of an image in bytes.
+func (d *Docker) ImageSize(name string) (int64, error) {
+	img, _, err := d.client.ImageInspectWithRaw(d.globals.Context, name)
+	if err != nil {
+		return 0, err
+	}
+
+	return img.Size, nil
+}
+
+// Load loads a `docker save` archive holding a single image and returns the
+// image's id.
+func (d *Docker) Load(r io.Reader) (string, error) {
+	resp, err := d.client.ImageLoad(d.globals.Context, r, true)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	images, err := loadedImages(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	switch len(images) {
+	case 0:
+		return "", errors.New("the archive contains no image")
+	case 1:
+	default:
+		return "", fmt.Errorf("the archive contains %d images (%s); only one can be used", len(images), strings.Join(images, ", "))
+	}
+
+	img, _, err := d.client.ImageInspectWithRaw(d.globals.Context, images[0])
+	if err != nil {
+		return "", err
+	}
 
 	return img.ID, nil
 }
@@ -146,6 +242,13 @@ func (d *Docker) Fetch(config *config.Config, name string) (string, error) {
 	return location, nil
 }
 
+// Pull pulls the named image if the daemon does not have it, without using
+// it, and returns its ID.
+func (d *Docker) Pull(name string) (string, error) {
+	id, _, err := fetcher.Docker(d.globals.Context, d.globals, d.client, config.NewConfig(), name)
+	return id, err
+}
+
 // SetLayers sets the layers.
 func (d *Docker) SetLayers(layers []string) {
 	d.layers = layers
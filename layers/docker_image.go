@@ -2,6 +2,8 @@ package layers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,9 +13,12 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/box-builder/box/copy"
+	"github.com/box-builder/box/fetcher"
 	"github.com/box-builder/box/image"
+	"github.com/box-builder/box/util"
 	om "github.com/box-builder/overmount"
 	"github.com/box-builder/overmount/imgio"
 	"github.com/docker/docker/api/types"
@@ -39,47 +44,105 @@ func NewDockerImage(imageConfig *ImageConfig) (*DockerImage, error) {
 	}, nil
 }
 
-func (d *DockerImage) ociSave(filename, tag string) error {
+// ociExport converts the current image into an OCI image tarball.
+func (d *DockerImage) ociExport(tag string) (io.ReadCloser, error) {
 	repo, err := om.NewRepository(path.Join(os.Getenv("HOME"), ".overmount"), true)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	img, err := imgio.NewDocker(d.client)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	reader, err := d.client.ImageSave(d.imageConfig.Globals.Context, []string{d.imageConfig.Config.Image})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	layers, err := repo.Import(img, reader)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if len(layers) != 1 {
-		return errors.New("image query expected one, returned more than one image")
+		return nil, errors.New("image query expected one, returned more than one image")
 	}
 
-	imageContent, err := repo.Export(imgio.NewOCI(), layers[0], []string{tag})
+	return repo.Export(imgio.NewOCI(), layers[0], []string{tag})
+}
+
+// ociSave writes the current image to the file as an OCI image tarball. With
+// --reproducible, the tarball is rewritten from the layout ociLayoutSave
+// writes, as its timestamps are replaced; otherwise it is saved as exported.
+func (d *DockerImage) ociSave(filename, tag string) error {
+	imageContent, err := d.ociExport(tag)
 	if err != nil {
 		return err
 	}
+	defer imageContent.Close()
 
-	w, err := os.Create(filename)
+	if !d.imageConfig.Globals.Reproducible {
+		f, err := os.Create(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return copy.WithProgress(f, imageContent, d.imageConfig.Globals.Logger, fmt.Sprintf("Saving %q", filename))
+	}
+
+	dir, err := ioutil.TempDir("", "box-oci")
 	if err != nil {
 		return err
 	}
-	defer w.Close()
+	defer os.RemoveAll(dir)
 
-	return copy.WithProgress(w, imageContent, d.imageConfig.Globals.Logger, fmt.Sprintf("Saving %q", filename))
+	if err := writeOCILayout(imageContent, dir, tag, true); err != nil {
+		return err
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(tarOCILayout(dir, w, true))
+	}()
+	defer r.Close()
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return copy.WithProgress(f, r, d.imageConfig.Globals.Logger, fmt.Sprintf("Saving %q", filename))
+}
+
+// ociLayoutSave writes the current image to the directory as an OCI image
+// layout.
+func (d *DockerImage) ociLayoutSave(dir, tag string) error {
+	imageContent, err := d.ociExport(tag)
+	if err != nil {
+		return err
+	}
+	defer imageContent.Close()
+
+	d.imageConfig.Globals.Logger.Print(fmt.Sprintf("Saving OCI layout to %q... ", dir))
+	if err := writeOCILayout(imageContent, dir, tag, d.imageConfig.Globals.Reproducible); err != nil {
+		return err
+	}
+	fmt.Fprintln(d.imageConfig.Globals.Logger.Output(), "done.")
+
+	return nil
 }
 
 func (d *DockerImage) dockerSave(f io.WriteCloser, filename, tag string) error {
-	r, err := d.client.ImageSave(d.imageConfig.Globals.Context, []string{d.imageConfig.Config.Image, tag})
+	names := []string{d.imageConfig.Config.Image}
+	if tag != "" {
+		names = append(names, tag)
+	}
+
+	r, err := d.client.ImageSave(d.imageConfig.Globals.Context, names)
 	if err != nil {
 		return err
 	}
@@ -118,6 +181,8 @@ func (d *DockerImage) Save(filename, kind, tag string) error {
 		return d.dockerSave(f, filename, tag)
 	case "oci":
 		return d.ociSave(filename, tag)
+	case "oci-layout":
+		return d.ociLayoutSave(rel, tag)
 	default:
 		return fmt.Errorf("image kind %q is not valid", kind)
 	}
@@ -185,9 +250,15 @@ func (d *DockerImage) Flatten(tw io.Reader) error {
 	return errors.New("invalid image ID returned")
 }
 
-// Tag an image with the provided string.
+// Tag an image with the provided string. The image the name resolved to for
+// a from is forgotten, as it is now this one.
 func (d *DockerImage) Tag(tag string) error {
-	return d.client.ImageTag(d.imageConfig.Globals.Context, d.imageConfig.Config.Image, tag)
+	if err := d.client.ImageTag(d.imageConfig.Globals.Context, d.imageConfig.Config.Image, tag); err != nil {
+		return err
+	}
+
+	fetcher.Forget(tag)
+	return nil
 }
 
 // CheckCache consults the cache and returns true or false depending on whether
@@ -210,8 +281,19 @@ func (d *DockerImage) CheckCache(cacheKey string) (bool, error) {
 				return false, err
 			}
 
-			if inspect.Comment == cacheKey {
+			if inspect.Comment == cacheKey || inspect.Comment == cacheKey+NoChanges {
+				if expired, err := d.cacheExpired(inspect.Created); err != nil {
+					return false, err
+				} else if expired {
+					d.imageConfig.Globals.Logger.CacheExpired(img.ID)
+					continue
+				}
+
 				d.imageConfig.Globals.Logger.CacheHit(img.ID)
+				if inspect.Comment != cacheKey {
+					return true, nil
+				}
+
 				d.imageConfig.Config.FromDocker(true, inspect.Config)
 				d.imageConfig.Config.Image = img.ID
 				return true, d.imageConfig.Layers.AddImage(img.ID)
@@ -219,7 +301,100 @@ func (d *DockerImage) CheckCache(cacheKey string) (bool, error) {
 		}
 	}
 
-	return false, nil
+	return d.checkCacheImage(cacheKey)
+}
+
+// AddLayer loads an image of the most recent layer with the tar archive of a
+// layer on top, and makes it the most recent layer. The archive is applied as
+// a layer is, so its whiteouts remove the paths under them. If layer is nil,
+// the image has the same layers, and only the config is written as it is, as
+// the daemon would merge that of the image into it on a commit. The image has
+// no parent and the cache key is its comment.
+func (d *DockerImage) AddLayer(layer io.Reader, cacheKey string) error {
+	inspect, _, err := d.client.ImageInspectWithRaw(d.imageConfig.Globals.Context, d.imageConfig.Config.Image)
+	if err != nil {
+		return err
+	}
+
+	layers := inspect.RootFS.Layers
+	var f *os.File
+
+	if layer != nil {
+		f, err = ioutil.TempFile("", "box-layer")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		hasher := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(f, hasher), layer); err != nil {
+			return err
+		}
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		layers = append(layers, "sha256:"+hex.EncodeToString(hasher.Sum(nil)))
+	}
+
+	created := time.Now()
+	if d.imageConfig.Globals.Reproducible {
+		created = util.SourceDate()
+	}
+
+	content, err := json.Marshal(map[string]interface{}{
+		"config":       d.imageConfig.Config.ToDocker(false, false, false),
+		"comment":      cacheKey,
+		"created":      created.UTC().Format(time.RFC3339Nano),
+		"architecture": inspect.Architecture,
+		"os":           inspect.Os,
+		"rootfs": map[string]interface{}{
+			"diff_ids": layers,
+			"type":     "layers",
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	id, err := d.loadImage(content, layers, f, created)
+	if err != nil {
+		return err
+	}
+
+	d.imageConfig.Config.Image = id
+	return d.imageConfig.Layers.AddImage(id)
+}
+
+// UseImage makes the image with the id the most recent layer, taking its
+// config as a cache hit on it would.
+func (d *DockerImage) UseImage(id string) error {
+	inspect, _, err := d.client.ImageInspectWithRaw(d.imageConfig.Globals.Context, id)
+	if err != nil {
+		return err
+	}
+
+	d.imageConfig.Config.FromDocker(true, inspect.Config)
+	d.imageConfig.Config.Image = inspect.ID
+	return d.imageConfig.Layers.AddImage(inspect.ID)
+}
+
+// cacheExpired returns true if the cache TTL is set and the image was
+// created before it.
+func (d *DockerImage) cacheExpired(created string) (bool, error) {
+	ttl := d.imageConfig.Globals.CacheTTL
+	if ttl == 0 {
+		return false, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, created)
+	if err != nil {
+		return false, fmt.Errorf("Could not parse image creation time %q: %v", created, err)
+	}
+
+	return time.Since(t) > ttl, nil
 }
 
 // ImageID returns the image identifier of the most recent layer.
@@ -0,0 +1,117 @@
+package layers
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/box-builder/box/fetcher"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+)
+
+// pushMessage is a line of the progress stream docker returns for a push.
+type pushMessage struct {
+	Error string `json:"error"`
+	Aux   struct {
+		Digest string `json:"Digest"`
+	} `json:"aux"`
+}
+
+// Push pushes the tag to its registry and returns the pushed image as
+// `name@digest`. Credentials are taken from the docker client configuration,
+// as fetcher.RegistryAuth finds them.
+func (d *DockerImage) Push(tag string) (string, error) {
+	ref, err := reference.ParseNormalizedNamed(tag)
+	if err != nil {
+		return "", err
+	}
+
+	auth, err := registryAuth(reference.Domain(ref))
+	if err != nil {
+		return "", err
+	}
+
+	if err := fetcher.CheckInsecure(d.imageConfig.Globals.Context, d.imageConfig.Globals, d.client, tag); err != nil {
+		return "", err
+	}
+
+	reader, err := d.client.ImagePush(d.imageConfig.Globals.Context, tag, types.ImagePushOptions{RegistryAuth: auth})
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	d.imageConfig.Globals.Logger.Print(fmt.Sprintf("Pushing %q... ", tag))
+
+	digest, err := pushDigest(reader)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprintln(d.imageConfig.Globals.Logger.Output(), "done.")
+
+	return reference.FamiliarName(ref) + "@" + digest, nil
+}
+
+// pushDigest reads the progress stream of a push and returns the digest of
+// the pushed manifest. Push failures are reported in the stream, not by the
+// request.
+func pushDigest(reader io.Reader) (string, error) {
+	var digest string
+
+	buf := bufio.NewReader(reader)
+	for {
+		line, err := buf.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) != 0 {
+			var msg pushMessage
+			if err := json.Unmarshal(line, &msg); err != nil {
+				return "", err
+			}
+
+			if msg.Error != "" {
+				return "", fmt.Errorf("push failed: %s", msg.Error)
+			}
+
+			if msg.Aux.Digest != "" {
+				digest = msg.Aux.Digest
+			}
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+
+	if digest == "" {
+		return "", fmt.Errorf("push did not return a digest")
+	}
+
+	return digest, nil
+}
+
+// registryAuth returns the encoded credentials for the registry from the
+// docker client configuration. Docker requires the header even for anonymous
+// pushes, so empty credentials are returned if there are none.
+func registryAuth(domain string) (string, error) {
+	auth, err := fetcher.RegistryAuth(domain)
+	if err != nil {
+		return "", err
+	}
+
+	return encodeAuth(auth)
+}
+
+func encodeAuth(auth types.AuthConfig) (string, error) {
+	encoded, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.URLEncoding.EncodeToString(encoded), nil
+}
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"strings"
 
 	. "testing"
 
@@ -65,7 +66,7 @@ func (ds *dockerSuite) TearDownSuite(c *C) {
 func (ds *dockerSuite) TestLookup(c *C) {
 	imageName := "alpine"
 
-	d, err := NewDocker(&btypes.Global{Context: context.Background(), TTY: ds.tty, Logger: logger.New("", false)})
+	d, err := NewDocker(&btypes.Global{Context: context.Background(), TTY: ds.tty, Logger: logger.New("", false, 0)})
 	c.Assert(err, IsNil)
 
 	// XXX ok if this call fails
@@ -87,7 +88,7 @@ func (ds *dockerSuite) TestLookup(c *C) {
 func (ds *dockerSuite) TestMakeImage(c *C) {
 	imageName := "postgres"
 
-	d, err := NewDocker(&btypes.Global{Context: context.Background(), TTY: ds.tty, Logger: logger.New("", false)})
+	d, err := NewDocker(&btypes.Global{Context: context.Background(), TTY: ds.tty, Logger: logger.New("", false, 0)})
 	c.Assert(err, IsNil)
 
 	_, err = d.Fetch(ds.config, imageName)
@@ -172,8 +173,65 @@ func (ds *dockerSuite) TestMakeImage(c *C) {
 	c.Assert(len(layersOrig)-2, Equals, len(layers))
 }
 
+func (ds *dockerSuite) TestPushDigest(c *C) {
+	stream := `{"status":"The push refers to a repository [localhost:5000/app]"}
+{"status":"Pushed","progressDetail":{},"id":"c4b2c8b4d2b1"}
+{"status":"latest: digest: sha256:0123 size: 528"}
+{"progressDetail":{},"aux":{"Tag":"latest","Digest":"sha256:0123","Size":528}}
+`
+	digest, err := pushDigest(strings.NewReader(stream))
+	c.Assert(err, IsNil)
+	c.Assert(digest, Equals, "sha256:0123")
+
+	_, err = pushDigest(strings.NewReader(`{"errorDetail":{"message":"denied"},"error":"denied"}`))
+	c.Assert(err, ErrorMatches, "push failed: denied")
+
+	_, err = pushDigest(strings.NewReader(`{"status":"Preparing"}`))
+	c.Assert(err, NotNil)
+}
+
+func (ds *dockerSuite) TestLoadedImageID(c *C) {
+	id, err := loadedImageID(strings.NewReader(`{"stream":"Loaded image ID: sha256:0123\n"}
+`))
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, "sha256:0123")
+
+	_, err = loadedImageID(strings.NewReader(`{"errorDetail":{"message":"bad"},"error":"bad"}`))
+	c.Assert(err, ErrorMatches, "load failed: bad")
+
+	_, err = loadedImageID(strings.NewReader(""))
+	c.Assert(err, NotNil)
+}
+
+func (ds *dockerSuite) TestLoadedImages(c *C) {
+	images, err := loadedImages(strings.NewReader(`{"stream":"Loaded image: alpine:latest\n"}
+{"stream":"Loaded image ID: sha256:0123\n"}
+`))
+	c.Assert(err, IsNil)
+	c.Assert(images, DeepEquals, []string{"alpine:latest", "sha256:0123"})
+
+	images, err = loadedImages(strings.NewReader(""))
+	c.Assert(err, IsNil)
+	c.Assert(images, HasLen, 0)
+}
+
+func (ds *dockerSuite) TestCacheImageChain(c *C) {
+	ci := &cacheImage{steps: []cacheStep{
+		{Parent: "base", ID: "one", Key: "a"},
+		{Parent: "one", ID: "two", Key: "b"},
+		{Parent: "two", ID: "three", Key: "c"},
+	}}
+
+	keys := []string{}
+	for _, step := range ci.chain("two") {
+		keys = append(keys, step.Key)
+	}
+	c.Assert(keys, DeepEquals, []string{"b", "a"})
+	c.Assert(ci.chain("base"), HasLen, 0)
+}
+
 func (ds *dockerSuite) TestFetch(c *C) {
-	d, err := NewDocker(&btypes.Global{Context: context.Background(), TTY: ds.tty, Logger: logger.New("", false)})
+	d, err := NewDocker(&btypes.Global{Context: context.Background(), TTY: ds.tty, Logger: logger.New("", false, 0)})
 	c.Assert(err, IsNil)
 
 	id, err := d.Fetch(ds.config, "debian:latest")
@@ -18,7 +18,10 @@ import (
 	"github.com/box-builder/overmount/imgio"
 )
 
-const imgIDText = "Loaded image ID: "
+const (
+	imgIDText   = "Loaded image ID: "
+	imgNameText = "Loaded image: "
+)
 
 func (d *Docker) editLayers(layer *om.Layer) ([]*om.Layer, error) {
 	editedLayers := []*om.Layer{}
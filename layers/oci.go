@@ -0,0 +1,264 @@
+package layers
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/box-builder/box/util"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	ociRefName      = "org.opencontainers.image.ref.name"
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigType   = "application/vnd.oci.image.config.v1+json"
+)
+
+// writeOCILayout unpacks an OCI image tarball into dir as an image layout.
+// The image's labels are copied to the manifest annotations, and an
+// index.json naming the image with the tag is written next to the refs. If
+// reproducible is true, the timestamps in the image config are replaced with
+// util.SourceDate().
+func writeOCILayout(r io.Reader, dir, tag string, reproducible bool) error {
+	if err := unpackOCILayout(r, dir); err != nil {
+		return err
+	}
+
+	return finishOCILayout(dir, tag, reproducible)
+}
+
+// unpackOCILayout unpacks an OCI image tarball into dir. A blob which is in
+// the tarball twice, such as a layer the image has twice, is written once, as
+// blobs are named by their digest. A file cut off by an error is removed, so
+// a failed unpack leaves no partly written blobs.
+func unpackOCILayout(r io.Reader, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	written := map[string]bool{}
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		name := filepath.Join(dir, filepath.Clean("/"+header.Name))
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(name, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if written[name] && strings.HasPrefix(filepath.ToSlash(filepath.Clean(header.Name)), "blobs/") {
+				continue
+			}
+
+			if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+				return err
+			}
+
+			if err := writeFile(name, tr); err != nil {
+				return err
+			}
+			written[name] = true
+		}
+	}
+}
+
+func writeFile(name string, r io.Reader) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	f.Close()
+	if err != nil {
+		os.Remove(name)
+	}
+
+	return err
+}
+
+func finishOCILayout(dir, tag string, reproducible bool) error {
+	var desc v1.Descriptor
+
+	if err := readJSON(filepath.Join(dir, "refs", tag), &desc); err != nil {
+		return err
+	}
+
+	var manifest v1.Manifest
+	if err := readJSON(blobPath(dir, desc.Digest), &manifest); err != nil {
+		return err
+	}
+
+	var config v1.Image
+	if err := readJSON(blobPath(dir, manifest.Config.Digest), &config); err != nil {
+		return err
+	}
+
+	var changed bool
+
+	if reproducible {
+		created := util.SourceDate()
+		config.Created = &created
+		for i := range config.History {
+			config.History[i].Created = &created
+		}
+
+		configDesc, err := replaceBlob(dir, manifest.Config.Digest, ociConfigType, config)
+		if err != nil {
+			return err
+		}
+
+		manifest.Config = configDesc
+		changed = true
+	}
+
+	if len(config.Config.Labels) > 0 {
+		manifest.Annotations = map[string]string{}
+		for key, value := range config.Config.Labels {
+			manifest.Annotations[key] = value
+		}
+		changed = true
+	}
+
+	if changed {
+		var err error
+
+		desc, err = replaceBlob(dir, desc.Digest, ociManifestType, manifest)
+		if err != nil {
+			return err
+		}
+
+		err = filepath.Walk(filepath.Join(dir, "refs"), func(path string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return err
+			}
+
+			return writeJSON(path, desc)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	desc.Annotations = map[string]string{ociRefName: tag}
+	desc.Platform = &v1.Platform{Architecture: config.Architecture, OS: config.OS}
+
+	return writeJSON(filepath.Join(dir, "index.json"), v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []v1.Descriptor{desc},
+	})
+}
+
+// replaceBlob removes the blob with the old digest and writes obj in its
+// place, returning the descriptor for the new blob.
+func replaceBlob(dir string, old digest.Digest, mediaType string, obj interface{}) (v1.Descriptor, error) {
+	content, err := json.Marshal(obj)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	if err := os.Remove(blobPath(dir, old)); err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	desc := v1.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}
+
+	return desc, ioutil.WriteFile(blobPath(dir, desc.Digest), content, 0600)
+}
+
+// tarOCILayout writes the layout in dir to w as a tarball. Entries are
+// written in lexical order; if reproducible is true, their ownership and
+// timestamps are normalized as well.
+func tarOCILayout(dir string, w io.Writer, reproducible bool) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+
+		header.Name = filepath.ToSlash(rel)
+		if reproducible {
+			header.ModTime = util.SourceDate()
+			header.Uid, header.Gid = 0, 0
+			header.Uname, header.Gname = "", ""
+			header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+func blobPath(dir string, dg digest.Digest) string {
+	return filepath.Join(dir, "blobs", dg.Algorithm().String(), dg.Hex())
+}
+
+func readJSON(filename string, obj interface{}) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("reading %q from OCI layout: %v", filepath.Base(filename), err)
+	}
+
+	return json.Unmarshal(content, obj)
+}
+
+func writeJSON(filename string, obj interface{}) error {
+	content, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, content, 0600)
+}
@@ -0,0 +1,112 @@
+package layers
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type ociSuite struct{}
+
+var _ = Suite(&ociSuite{})
+
+// ociTarball returns a tarball laid out like an OCI image export, with a
+// layer which is there twice, and the content of each of its files by name.
+func ociTarball(c *C) ([]byte, map[string][]byte) {
+	random := rand.New(rand.NewSource(1))
+
+	blob := func(size int) []byte {
+		content := make([]byte, size)
+		random.Read(content)
+		return content
+	}
+
+	layer := blob(3<<20 + 17)
+
+	entries := []struct {
+		name    string
+		content []byte
+	}{
+		{"blobs", nil},
+		{"blobs/sha256", nil},
+		{"oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`)},
+		{"blobs/sha256/aaaa", layer},
+		{"blobs/sha256/bbbb", blob(1 << 20)},
+		{"blobs/sha256/cccc", blob(2<<20 + 1)},
+		{"blobs/sha256/aaaa", layer},
+		{"blobs/sha256/dddd", blob(100)},
+		{"refs/latest", []byte(`{"digest":"sha256:dddd"}`)},
+	}
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	files := map[string][]byte{}
+
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0600, Typeflag: tar.TypeReg, Size: int64(len(entry.content))}
+		if entry.content == nil {
+			header.Mode, header.Typeflag = 0700, tar.TypeDir
+		} else {
+			files[entry.name] = entry.content
+		}
+
+		c.Assert(tw.WriteHeader(header), IsNil)
+		_, err := tw.Write(entry.content)
+		c.Assert(err, IsNil)
+	}
+
+	c.Assert(tw.Close(), IsNil)
+	return buf.Bytes(), files
+}
+
+// unpacked unpacks the tarball and returns the content of the files left in
+// the layout, by their names in it, even if it failed.
+func unpacked(c *C, tarball []byte) (map[string][]byte, error) {
+	dir, err := ioutil.TempDir("", "box-oci-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	unpackErr := unpackOCILayout(bytes.NewReader(tarball), dir)
+
+	files := map[string][]byte{}
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		files[filepath.ToSlash(rel)], err = ioutil.ReadFile(path)
+		return err
+	})
+	c.Assert(err, IsNil)
+
+	return files, unpackErr
+}
+
+func (s *ociSuite) TestUnpack(c *C) {
+	tarball, expected := ociTarball(c)
+
+	files, err := unpacked(c, tarball)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, len(expected))
+
+	for name, content := range expected {
+		c.Assert(bytes.Equal(files[name], content), Equals, true, Commentf("%s", name))
+	}
+
+	// a tarball cut off in a blob fails, and leaves no part of it.
+	files, err = unpacked(c, tarball[:2<<20])
+	c.Assert(err, NotNil)
+	c.Assert(files["oci-layout"], NotNil)
+	_, ok := files["blobs/sha256/aaaa"]
+	c.Assert(ok, Equals, false)
+}
@@ -7,6 +7,11 @@ import (
 	"github.com/box-builder/box/types"
 )
 
+// NoChanges is appended to the cache key in the comment of the images
+// committed for steps which changed nothing. They only record the step in the
+// cache: the build goes on from their parent, so they add no layer.
+const NoChanges = " (no changes)"
+
 // Image needs a description
 type Image interface {
 	// Flatten copies a tarred up series of files (passed in through the
@@ -23,8 +28,25 @@ type Image interface {
 	// ImageID returns the image identifier of the most recent layer.
 	ImageID() string
 
+	// AddLayer adds an image of the most recent layer with the tar archive of
+	// a layer, which may hold whiteouts, on top, or only the config if it is
+	// nil. The cache key is its comment.
+	AddLayer(io.Reader, string) error
+
+	// UseImage makes the image with the id the most recent layer, as a cache
+	// hit on it would.
+	UseImage(string) error
+
 	// Save saves an image to the provided filename.
 	Save(string, string, string) error
+
+	// Push pushes a tag of the image to its registry. Returns the pushed image
+	// in `name@digest` form.
+	Push(string) (string, error)
+
+	// PushCache pushes the image as a cache image with the steps that built
+	// it. Returns the pushed image in `name@digest` form.
+	PushCache(string) (string, error)
 }
 
 // Layers needs a description
@@ -32,6 +54,13 @@ type Layers interface {
 	// Pull an image. Takes a name and returns an image ID+error.
 	Fetch(*config.Config, string) (string, error)
 
+	// Pull pulls an image if the daemon does not have it, like Fetch, but
+	// leaves the configuration and layers alone. It returns the image ID.
+	Pull(string) (string, error)
+
+	// Load loads an image from a `docker save` archive and returns its ID.
+	Load(io.Reader) (string, error)
+
 	// SetLayers sets the layers.
 	SetLayers([]string)
 
@@ -51,6 +80,28 @@ type Layers interface {
 
 	// Look up an image identifier.
 	Lookup(*config.Config, string) (string, error)
+
+	// Resolve returns the identifier of the named image without changing the
+	// configuration, or an empty string if there is no such image.
+	Resolve(string) (string, error)
+
+	// ResolvePlatform returns the entry of the named multi-platform image for
+	// the platform in `name@digest` form, from its manifest list in the
+	// registry. The list is read by the digest if it is not empty.
+	ResolvePlatform(string, string, types.Platform) (string, error)
+
+	// RepoDigests returns the registry digests known for an image, in
+	// `name@algorithm:hex` form.
+	RepoDigests(string) ([]string, error)
+
+	// LayerDigests returns the diff IDs of the layers of an image.
+	LayerDigests(string) ([]string, error)
+
+	// RepoTags returns the tags of an image.
+	RepoTags(string) ([]string, error)
+
+	// ImageSize returns the size of an image in bytes.
+	ImageSize(string) (int64, error)
 }
 
 // ImageConfig sets the properties used to construct an image
@@ -0,0 +1,94 @@
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+var (
+	finishMutex    = new(sync.RWMutex)
+	finishTemplate *template.Template
+)
+
+// Summary describes a finished build for Finish. It is what the templates set
+// with SetFinishFormat are rendered against.
+type Summary struct {
+	Plan    string        // the plan file
+	ID      string        // the ID of the final image, without its algorithm
+	Size    int64         // the size of the final image in bytes
+	Tags    []string      // the tags of the final image
+	Elapsed time.Duration // how long the build took
+}
+
+var finishFuncs = template.FuncMap{
+	"join":     strings.Join,
+	"bytes":    func(size int64) string { return FormatBytes(uint64(size)) },
+	"duration": FormatDuration,
+}
+
+// SetFinishFormat sets the Go template Finish renders, for all loggers, in
+// place of its own line. An empty format restores the line. The template is
+// also rendered against an empty Summary, so that references to unknown
+// fields are reported here rather than after the build.
+func SetFinishFormat(format string) error {
+	var tmpl *template.Template
+
+	if format != "" {
+		var err error
+		tmpl, err = template.New("format").Funcs(finishFuncs).Parse(format)
+		if err != nil {
+			return err
+		}
+
+		if err := tmpl.Execute(ioutil.Discard, Summary{}); err != nil {
+			return err
+		}
+	}
+
+	finishMutex.Lock()
+	defer finishMutex.Unlock()
+	finishTemplate = tmpl
+	return nil
+}
+
+// FinishFormat returns true if a template was set with SetFinishFormat.
+func FinishFormat() bool {
+	finishMutex.RLock()
+	defer finishMutex.RUnlock()
+	return finishTemplate != nil
+}
+
+// Finish logs the finish and how long the build took. If a template was set
+// with SetFinishFormat, it is rendered instead, untrimmed and without the
+// plan's name, for scripts to read.
+func (l *Logger) Finish(summary Summary) {
+	finishMutex.RLock()
+	tmpl := finishTemplate
+	finishMutex.RUnlock()
+
+	if tmpl == nil {
+		line := l.Plan()
+		line += l.Good("")
+		line += paint(getPalette().Finish, "Finish: ")
+		l.printLog(fmt.Sprintf("%s %s (%s)", line, summary.ID, FormatDuration(summary.Elapsed)))
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, summary); err != nil {
+		l.Error(err)
+		return
+	}
+
+	if !strings.HasSuffix(buf.String(), "\n") {
+		buf.WriteString("\n")
+	}
+
+	l.output.Write(buf.Bytes())
+	writeTee(buf.String())
+}
@@ -0,0 +1,61 @@
+package logger
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	unitsMutex = new(sync.RWMutex)
+	siUnits    bool
+)
+
+// SetSI selects decimal units (kB, MB, GB) for sizes printed by all loggers
+// when true, and binary units (KiB, MiB, GiB) otherwise.
+func SetSI(si bool) {
+	unitsMutex.Lock()
+	defer unitsMutex.Unlock()
+	siUnits = si
+}
+
+// FormatBytes formats a size in the units selected with SetSI, e.g. "1.50 MiB".
+func FormatBytes(size uint64) string {
+	unitsMutex.RLock()
+	si := siUnits
+	unitsMutex.RUnlock()
+
+	base := uint64(1024)
+	units := []string{"KiB", "MiB", "GiB", "TiB", "PiB"}
+	if si {
+		base = 1000
+		units = []string{"kB", "MB", "GB", "TB", "PB"}
+	}
+
+	if size < base {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	value := float64(size) / float64(base)
+	unit := 0
+	for value >= float64(base) && unit < len(units)-1 {
+		value /= float64(base)
+		unit++
+	}
+
+	return fmt.Sprintf("%.2f %s", value, units[unit])
+}
+
+// FormatDuration formats a duration with a precision suited to its length:
+// milliseconds below a second, tenths of a second below a minute and whole
+// seconds otherwise, e.g. "250ms", "12.3s" or "1m23s".
+func FormatDuration(d time.Duration) string {
+	switch {
+	case d < time.Second:
+		return d.Round(time.Millisecond).String()
+	case d < time.Minute:
+		return d.Round(100 * time.Millisecond).String()
+	default:
+		return d.Round(time.Second).String()
+	}
+}
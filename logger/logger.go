@@ -4,13 +4,91 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"regexp"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 
 	"github.com/docker/docker/pkg/term"
 	"github.com/fatih/color"
 )
 
+var (
+	teeMutex   = new(sync.Mutex)
+	teeWriter  io.Writer
+	sinks      []io.Writer
+	quiet      bool
+	colorRegex = regexp.MustCompile("\x1b\\[[0-9;]*[a-zA-Z]")
+)
+
+// SetTee sets a secondary writer shared by all loggers. It receives a copy of
+// all log output with colors stripped and lines untrimmed. Supplying nil
+// turns it off.
+func SetTee(w io.Writer) {
+	teeMutex.Lock()
+	defer teeMutex.Unlock()
+	teeWriter = w
+}
+
+// AddSink adds a writer shared by all loggers, such as a log file or syslog,
+// to those set before. Like the one set with SetTee, it receives a copy of all
+// log output with colors stripped and lines untrimmed.
+func AddSink(w io.Writer) {
+	teeMutex.Lock()
+	defer teeMutex.Unlock()
+	sinks = append(sinks, w)
+}
+
+// ResetSinks removes the writers added with AddSink.
+func ResetSinks() {
+	teeMutex.Lock()
+	defer teeMutex.Unlock()
+	sinks = nil
+}
+
+// CloseSinks closes the secondary writer and the sinks which can be closed,
+// such as the files they write to, and removes them.
+func CloseSinks() {
+	teeMutex.Lock()
+	defer teeMutex.Unlock()
+
+	for _, w := range append([]io.Writer{teeWriter}, sinks...) {
+		if closer, ok := w.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+
+	teeWriter, sinks = nil, nil
+}
+
+// SetQuiet stops all loggers from writing to the terminal, other than errors
+// and questions. The secondary writer and the sinks still receive everything,
+// as does the buffer of a recording logger.
+func SetQuiet(q bool) {
+	teeMutex.Lock()
+	defer teeMutex.Unlock()
+	quiet = q
+}
+
+// writeTee writes the string to the secondary writer and the sinks.
+func writeTee(str string) {
+	teeMutex.Lock()
+	defer teeMutex.Unlock()
+
+	str = colorRegex.ReplaceAllString(str, "")
+
+	if teeWriter != nil {
+		fmt.Fprint(teeWriter, str)
+	}
+
+	for _, w := range sinks {
+		fmt.Fprint(w, str)
+	}
+}
+
 // Logger implements a per-plan logger.
 type Logger struct {
 	output io.Writer
@@ -19,11 +97,18 @@ type Logger struct {
 	buffer *bytes.Buffer
 	plan   string
 	notrim bool
+	width  int // the width lines are trimmed to; if 0, the terminal's
 }
 
-// New contypes a new per-plan logger.
-func New(plan string, notrim bool) *Logger {
-	return &Logger{plan: plan, output: os.Stdout, notrim: notrim}
+// New contypes a new per-plan logger. Unless notrim is set, its lines are
+// trimmed to width columns, or if it is 0, to the width of the terminal if
+// there is one.
+func New(plan string, notrim bool, width int) *Logger {
+	if width < 0 {
+		width = 0
+	}
+
+	return &Logger{plan: plan, output: os.Stdout, notrim: notrim, width: width}
 }
 
 // Record starts recording to the output buffer, which will be returned by the
@@ -33,51 +118,232 @@ func (l *Logger) Record() {
 	l.output, color.Output = l.buffer, l.buffer
 }
 
-// Output returns the output buffer.
+// Output returns the output buffer, or where the logger writes to if it is
+// not recording.
 func (l *Logger) Output() io.Writer {
+	return l.terminal()
+}
+
+// RunOutput returns a writer for the output of a command run by a step, such
+// as a run, which writes it to the output and a copy to the secondary writer
+// and the sinks. If hold is true, or SetQuiet was called and the logger is not
+// recording, the output is held instead, and the returned function writes it
+// to the output; call it if the command failed.
+func (l *Logger) RunOutput(hold bool) (io.Writer, func()) {
+	w := &runOutput{logger: l}
+
+	teeMutex.Lock()
+	if hold || (quiet && l.buffer == nil) {
+		w.held = new(bytes.Buffer)
+	}
+	teeMutex.Unlock()
+
+	return w, w.replay
+}
+
+// runOutput is the writer returned by RunOutput.
+type runOutput struct {
+	logger *Logger
+	mutex  sync.Mutex
+	held   *bytes.Buffer
+}
+
+func (r *runOutput) Write(p []byte) (int, error) {
+	writeTee(string(p))
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.held != nil {
+		return r.held.Write(p)
+	}
+
+	return r.logger.terminal().Write(p)
+}
+
+// replay writes the held output, if any, to the terminal.
+func (r *runOutput) replay() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.held == nil || r.held.Len() == 0 {
+		return
+	}
+
+	l := r.logger
+	fmt.Fprintln(l.output, l.Plan()+paint(getPalette().Output, "------ BEGIN OUTPUT ------"))
+	l.output.Write(r.held.Bytes())
+	fmt.Fprintln(l.output, l.Plan()+paint(getPalette().Output, "------- END OUTPUT -------"))
+	r.held.Reset()
+}
+
+// terminal returns the output, or a writer discarding everything if the
+// logger is not recording and SetQuiet was called.
+func (l *Logger) terminal() io.Writer {
+	teeMutex.Lock()
+	defer teeMutex.Unlock()
+
+	if quiet && l.buffer == nil {
+		return ioutil.Discard
+	}
+
 	return l.output
 }
 
 // Print is a bare-bones print statement.
 func (l *Logger) Print(str string) {
-	fmt.Fprint(l.output, l.Plan(), str)
+	fmt.Fprint(l.terminal(), l.Plan(), str)
+	writeTee(l.Plan() + str)
 }
 
 // Plan gets the plan name specified at construction time
 func (l *Logger) Plan() string {
-	str := color.New(color.Bold, color.FgBlue).SprintFunc()("[")
-	str += color.New(color.FgBlue).SprintFunc()(l.plan)
-	str += color.New(color.Bold, color.FgBlue).SprintFunc()("] ")
+	p := getPalette()
+	str := paint(p.Bracket, "[")
+	str += paint(p.Plan, l.plan)
+	str += paint(p.Bracket, "] ")
 	return str
 }
 
 // Good reports a nice status in green to indicate successes.
 func (l *Logger) Good(str string) string {
-	return color.New(color.FgGreen).SprintFunc()(fmt.Sprintf("+++ %s", str))
+	return paint(getPalette().Good, fmt.Sprintf("+++ %s", str))
 }
 
 // Notice is an arbitrary message explaining what the heck is going on.
 func (l *Logger) Notice(str string) string {
-	return color.New(color.FgYellow).SprintFunc()(fmt.Sprintf("--- %s", str))
+	return paint(getPalette().Notice, fmt.Sprintf("--- %s", str))
 }
 
-// Error prints an error to the terminal all fancy-like.
+// locatedError is an error which knows where in the source of a plan it was
+// raised, such as a types.PlanError.
+type locatedError interface {
+	error
+	Location() (file, source string, line, column int)
+}
+
+// Error prints an error to the terminal all fancy-like. If the error knows
+// where in the plan it was raised, that line of the plan follows it, with a
+// caret under the column.
 func (l *Logger) Error(err interface{}) {
+	p := getPalette()
 	line := l.Plan()
 
-	line += color.New(color.Bold, color.FgRed).SprintFunc()("!!! ")
-	line += color.New(color.FgWhite).SprintFunc()(fmt.Sprintf("Error: %v", err))
+	line += paint(p.Error, "!!! ")
+	line += paint(p.Text, fmt.Sprintf("Error: %v", err))
 	fmt.Fprintln(l.output, line)
+	writeTee(line + "\n")
+
+	if located, ok := err.(locatedError); ok {
+		for _, str := range snippet(located.Location()) {
+			line := l.Plan() + paint(p.Text, str)
+			fmt.Fprintln(l.output, line)
+			writeTee(line + "\n")
+		}
+	}
+
 	color.Unset()
 }
 
+// snippet returns the lines showing the line of source an error was raised
+// at, like a compiler: where it is, the line itself, and a caret under the
+// column, or the start of the statement if the column is not known. It returns
+// nil if the line is not in the source.
+func snippet(file, source string, lineno, column int) []string {
+	lines := strings.Split(source, "\n")
+	if lineno < 1 || lineno > len(lines) {
+		return nil
+	}
+
+	text := strings.TrimRight(lines[lineno-1], "\r")
+	where := fmt.Sprintf("%s:%d", file, lineno)
+
+	if column < 1 || column > len(text)+1 {
+		column = len(text) - len(strings.TrimLeft(text, " \t")) + 1
+	} else {
+		where += fmt.Sprintf(":%d", column)
+	}
+
+	// tabs are kept, so the caret lines up however wide they are shown.
+	pad := []byte(text[:column-1])
+	for i := range pad {
+		if pad[i] != '\t' {
+			pad[i] = ' '
+		}
+	}
+
+	number := fmt.Sprintf("%d", lineno)
+	gutter := strings.Repeat(" ", len(number))
+
+	return []string{
+		fmt.Sprintf("%s--> %s", gutter, where),
+		fmt.Sprintf("%s | %s", number, text),
+		fmt.Sprintf("%s | %s^", gutter, pad),
+	}
+}
+
+// PlanResult is the outcome of a plan, as logged by PlanResults.
+type PlanResult struct {
+	Plan    string
+	ID      string // the ID of the final image, if the plan succeeded
+	Size    int64  // the size of the final image in bytes
+	Elapsed time.Duration
+	Err     error
+	Skipped bool // set with Err if the plan was not built, as another it depends on failed
+}
+
+// PlanResults logs a table of the outcome of each plan, in order.
+func (l *Logger) PlanResults(results []PlanResult) {
+	p := getPalette()
+
+	buf := new(bytes.Buffer)
+	w := tabwriter.NewWriter(buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PLAN\tSTATUS\tIMAGE\tSIZE\tTIME")
+
+	for _, result := range results {
+		if result.Err != nil {
+			status := "failed"
+			if result.Skipped {
+				status = "skipped"
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t-\t-\t%s\n", result.Plan, status, FormatDuration(result.Elapsed))
+			continue
+		}
+
+		fmt.Fprintf(w, "%s\tok\t%s\t%s\t%s\n", result.Plan, result.ID, FormatBytes(uint64(result.Size)), FormatDuration(result.Elapsed))
+	}
+	w.Flush()
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	for i, line := range lines {
+		c := p.Finish
+		if i > 0 {
+			c = p.Validated
+			if results[i-1].Err != nil {
+				c = p.Error
+			}
+		}
+
+		l.printLog(l.Plan() + paint(c, line))
+	}
+}
+
+// Warning logs a problem that does not stop the build.
+func (l *Logger) Warning(msg string) {
+	line := l.Plan()
+	line += l.Notice("")
+	line += paint(getPalette().Tag, "Warning:")
+	l.printLog(line + " " + msg)
+}
+
 // BuildStep logs a build step.
 func (l *Logger) BuildStep(step, command string) {
 	line := l.Plan()
 	line += l.Good("")
 
-	line += color.New(color.Bold, color.FgWhite).SprintFunc()("Execute: ")
-	line += color.New(color.FgGreen).SprintFunc()(fmt.Sprintf("%s %s", step, command))
+	line += paint(getPalette().Label, "Execute: ")
+	line += paint(getPalette().Step, fmt.Sprintf("%s %s", step, command))
 	l.printLog(line)
 }
 
@@ -85,16 +351,84 @@ func (l *Logger) BuildStep(step, command string) {
 func (l *Logger) CacheHit(imageID string) {
 	line := l.Plan()
 	line += l.Good("")
-	line += color.New(color.FgWhite, color.Bold, color.BgRed).SprintFunc()("Cache hit:")
-	line += color.New(color.FgCyan).SprintFunc()(fmt.Sprintf(" using %q", strings.SplitN(imageID, ":", 2)[1][:12]))
+	line += paint(getPalette().CacheHit, "Cache hit:")
+	line += paint(getPalette().ID, fmt.Sprintf(" using %q", strings.SplitN(imageID, ":", 2)[1][:12]))
+	l.printLog(line)
+}
+
+// Resumed logs that a step was resumed from the image recorded for it in the
+// checkpoint.
+func (l *Logger) Resumed(imageID string) {
+	line := l.Plan()
+	line += l.Good("")
+	line += paint(getPalette().CacheHit, "Checkpoint:")
+	line += paint(getPalette().ID, fmt.Sprintf(" resuming from %q", strings.SplitN(imageID, ":", 2)[1][:12]))
+	l.printLog(line)
+}
+
+// KeptContainers logs the containers left for debugging. They have exited, so
+// they are examined with `docker diff`, `docker cp` or `docker commit`, and
+// removed with `docker rm`.
+func (l *Logger) KeptContainers(ids []string) {
+	for _, id := range ids {
+		if len(id) > 12 {
+			id = id[:12]
+		}
+
+		line := l.Plan()
+		line += l.Notice("")
+		line += paint(getPalette().Tag, "Kept container:")
+		line += paint(getPalette().ID, " "+id)
+		l.printLog(line)
+	}
+}
+
+// CacheExpired logs a cache hit that was discarded because it is too old.
+func (l *Logger) CacheExpired(imageID string) {
+	line := l.Plan()
+	line += l.Notice("")
+	line += paint(getPalette().Tag, "Cache expired:")
+	line += paint(getPalette().ID, fmt.Sprintf(" not using %q", strings.SplitN(imageID, ":", 2)[1][:12]))
 	l.printLog(line)
 }
 
+// NoChanges logs that a step changed nothing, so it adds no layer.
+func (l *Logger) NoChanges() {
+	line := l.Plan()
+	line += l.Notice("")
+	line += paint(getPalette().Tag, "No changes:")
+	l.printLog(line + " not adding a layer")
+}
+
+// CacheDisabled logs that the cache is not used from the step onwards.
+func (l *Logger) CacheDisabled(step int) {
+	line := l.Plan()
+	line += l.Notice("")
+	line += paint(getPalette().Tag, "Cache disabled:")
+	l.printLog(fmt.Sprintf("%s from step %d", line, step))
+}
+
+// DaemonRetry logs a failed attempt to connect to the docker daemon.
+func (l *Logger) DaemonRetry(attempt int, wait time.Duration, err error) {
+	line := l.Plan()
+	line += l.Notice("")
+	line += paint(getPalette().Tag, "Waiting for docker:")
+	l.printLog(fmt.Sprintf("%s attempt %d failed (%v); retrying in %s", line, attempt, err, FormatDuration(wait)))
+}
+
+// MirrorFailed logs a registry mirror that could not supply an image.
+func (l *Logger) MirrorFailed(mirror string, err error) {
+	line := l.Plan()
+	line += l.Notice("")
+	line += paint(getPalette().Tag, "Mirror failed:")
+	l.printLog(fmt.Sprintf("%s %s (%v); trying the next registry", line, mirror, err))
+}
+
 // CopyPath logs a copied path
 func (l *Logger) CopyPath(file1, file2 string) {
 	line := l.Plan()
 	line += l.Notice("")
-	line += color.New(color.FgRed).SprintFunc()("COPY: ")
+	line += paint(getPalette().Copy, "COPY: ")
 	line += fmt.Sprintf("%q -> %q\n", file1, file2)
 	l.printLog(line)
 }
@@ -103,48 +437,131 @@ func (l *Logger) CopyPath(file1, file2 string) {
 func (l *Logger) Tag(name string) {
 	line := l.Plan()
 	line += l.Good("")
-	line += color.New(color.FgYellow).SprintFunc()("Tagged:")
+	line += paint(getPalette().Tag, "Tagged:")
 	l.printLog(line + " " + name)
 }
 
-// EvalResponse logs the eval response
-func (l *Logger) EvalResponse(response string) {
+// Pushed logs a pushed image.
+func (l *Logger) Pushed(ref string) {
 	line := l.Plan()
 	line += l.Good("")
-	line += color.New(color.FgWhite, color.Bold).SprintFunc()("Eval Response:")
-	l.printLog(line + " " + response)
+	line += paint(getPalette().Tag, "Pushed:")
+	l.printLog(line + " " + ref)
+}
+
+// Signed logs an image signed by the --sign hook.
+func (l *Logger) Signed(ref string) {
+	line := l.Plan()
+	line += l.Good("")
+	line += paint(getPalette().Tag, "Signed:")
+	l.printLog(line + " " + ref)
+}
+
+// Validated logs a passing validation check.
+func (l *Logger) Validated(name string) {
+	line := l.Plan()
+	line += l.Good("")
+	line += paint(getPalette().Validated, "Validated:")
+	l.printLog(line + " " + name)
+}
+
+// Resolved logs the registry digest an image name resolved to.
+func (l *Logger) Resolved(name, digest string) {
+	line := l.Plan()
+	line += l.Good("")
+	line += paint(getPalette().Tag, "Resolved:")
+	l.printLog(fmt.Sprintf("%s %s -> from %q", line, name, digest))
+}
+
+// WaitingForTag logs that `from` waits for another plan to tag the image.
+func (l *Logger) WaitingForTag(name string) {
+	line := l.Plan()
+	line += l.Notice("")
+	line += paint(getPalette().Tag, "Waiting:")
+	l.printLog(fmt.Sprintf("%s for another plan to tag %s", line, name))
+}
+
+// FromChosen logs the image chosen from a list given to `from`.
+func (l *Logger) FromChosen(name string) {
+	line := l.Plan()
+	line += l.Good("")
+	line += paint(getPalette().Tag, "Using:")
+	l.printLog(fmt.Sprintf("%s %s", line, name))
+}
+
+// FromFailed logs an image from a list given to `from` that could not be
+// used.
+func (l *Logger) FromFailed(name string, err error) {
+	line := l.Plan()
+	line += l.Notice("")
+	line += paint(getPalette().Tag, "Skipped:")
+	l.printLog(fmt.Sprintf("%s %s (%v)", line, name, err))
+}
+
+// Debug logs an executor operation, its parameters and how long it took.
+func (l *Logger) Debug(op, params string, elapsed time.Duration, err error) {
+	line := l.Plan()
+	line += l.Notice("")
+	line += paint(getPalette().Label, "Debug:")
+	line = fmt.Sprintf("%s %s %s (%s)", line, op, params, FormatDuration(elapsed))
+
+	if err != nil {
+		line += fmt.Sprintf(": %v", err)
+	}
+
+	l.printLog(line)
 }
 
-// Finish logs the finish.
-func (l *Logger) Finish(response string) {
+// Prompt asks a yes or no question. The answer is read by the caller.
+func (l *Logger) Prompt(question string) {
+	line := l.Plan()
+	line += l.Notice("")
+	line += paint(getPalette().Tag, "Confirm:")
+	line = fmt.Sprintf("%s %s [y/N] ", line, question)
+	fmt.Fprint(l.output, line)
+	writeTee(line + "\n")
+}
+
+// Profile logs where the build spent its time. operations is the breakdown of
+// the executor's time.
+func (l *Logger) Profile(plan, executor time.Duration, operations string) {
+	line := l.Plan()
+	line += l.Good("")
+	line += paint(getPalette().Label, "Profile:")
+	l.printLog(fmt.Sprintf("%s plan %s, docker %s (%s)", line, FormatDuration(plan), FormatDuration(executor), operations))
+}
+
+// EvalResponse logs the eval response
+func (l *Logger) EvalResponse(response string) {
 	line := l.Plan()
 	line += l.Good("")
-	line += color.New(color.FgRed, color.Bold).SprintFunc()("Finish: ")
+	line += paint(getPalette().Label, "Eval Response:")
 	l.printLog(line + " " + response)
 }
 
 // BeginOutput demarcates an output section
 func (l *Logger) BeginOutput() {
 	line := l.Plan()
-	line += color.New(color.FgRed, color.Bold, color.BgWhite).SprintFunc()("------ BEGIN OUTPUT ------")
+	line += paint(getPalette().Output, "------ BEGIN OUTPUT ------")
 	l.printLog(line)
 }
 
 // EndOutput ends an output section
 func (l *Logger) EndOutput() {
 	line := l.Plan()
-	line += color.New(color.FgRed, color.Bold, color.BgWhite).SprintFunc()("------- END OUTPUT -------")
+	line += paint(getPalette().Output, "------- END OUTPUT -------")
 	l.printLog(line)
 }
 
-// printLog prints a log message optionally trimming the line to terminal width
-// if l.trim is true
+// printLog prints a log message, trimming the line to the logger's width, or
+// the terminal's, unless notrim is set. The tee gets the whole line.
 func (l *Logger) printLog(line string) {
-	if !l.notrim && term.IsTerminal(0) {
-		fmt.Fprintln(l.output, trimColoredString(line, 0, true))
+	if !l.notrim && (l.width > 0 || term.IsTerminal(0)) {
+		fmt.Fprintln(l.terminal(), trimColoredString(line, l.width, true))
 	} else {
-		fmt.Fprintln(l.output, line)
+		fmt.Fprintln(l.terminal(), line)
 	}
+	writeTee(line + "\n")
 	color.Unset()
 }
 
@@ -191,20 +608,22 @@ func trimColoredString(original string, cap int, dots bool) string {
 	return buf
 }
 
-// Progress is a representation of a progress meter.
-func (l *Logger) Progress(prefix string, count float64) {
+// Progress is a representation of a progress meter. The size is the number
+// of bytes copied so far.
+func (l *Logger) Progress(prefix string, size uint64) {
 	out := fmt.Sprint("\r")
 	wsz, _ := term.GetWinsize(0)
 
-	mbs := fmt.Sprintf("%.02fMB", count)
+	mbs := FormatBytes(size)
 
 	justifiedWidth := int(wsz.Width) - len(mbs) - 2 // ... below
 	if justifiedWidth < 0 {
 		return
 	}
 
-	out += trimColoredString(fmt.Sprintf("%s%s %s", l.Plan(), color.New(color.FgWhite, color.Bold).SprintFunc()("+++"), color.New(color.FgRed, color.Bold).SprintfFunc()("%s", prefix)), justifiedWidth, true)
+	p := getPalette()
+	out += trimColoredString(fmt.Sprintf("%s%s %s", l.Plan(), paint(p.Label, "+++"), paint(p.Progress, prefix)), justifiedWidth, true)
 	out += ": "
-	out += color.New(color.FgWhite).SprintFunc()(mbs)
-	fmt.Fprint(l.output, out)
+	out += paint(p.Text, mbs)
+	fmt.Fprint(l.terminal(), out)
 }
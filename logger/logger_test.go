@@ -0,0 +1,284 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/fatih/color"
+
+	. "gopkg.in/check.v1"
+)
+
+type loggerSuite struct{}
+
+var _ = Suite(&loggerSuite{})
+
+func TestLogger(t *T) {
+	TestingT(t)
+}
+
+func (ls *loggerSuite) TestTee(c *C) {
+	noColor := color.NoColor
+	color.NoColor = false
+	defer func() { color.NoColor = noColor }()
+
+	tee := new(bytes.Buffer)
+	SetTee(tee)
+	defer SetTee(nil)
+
+	l := New("plan.rb", true, 0)
+	l.Record()
+
+	l.BuildStep("run", strings.Repeat("x", 500))
+	l.Error(errors.New("an error"))
+
+	c.Assert(strings.Contains(l.Output().(*bytes.Buffer).String(), "\x1b["), Equals, true)
+	c.Assert(strings.Contains(tee.String(), "\x1b["), Equals, false)
+	c.Assert(strings.Contains(tee.String(), "[plan.rb] +++ Execute: run "+strings.Repeat("x", 500)+"\n"), Equals, true, Commentf("%q", tee.String()))
+	c.Assert(strings.Contains(tee.String(), "[plan.rb] !!! Error: an error\n"), Equals, true, Commentf("%q", tee.String()))
+
+	SetTee(nil)
+	l.BuildStep("run", "ls")
+	c.Assert(strings.Contains(tee.String(), "ls"), Equals, false)
+}
+
+func (ls *loggerSuite) TestSinks(c *C) {
+	file, other := new(bytes.Buffer), new(bytes.Buffer)
+	AddSink(file)
+	AddSink(&lineWriter{writer: other})
+	defer ResetSinks()
+
+	terminal := new(bytes.Buffer)
+	l := &Logger{plan: "plan.rb", output: terminal, notrim: true}
+
+	l.BuildStep("run", "ls")
+	l.Print("partial ")
+	c.Assert(file.String(), Equals, "[plan.rb] +++ Execute: run ls\n[plan.rb] partial ")
+	c.Assert(other.String(), Equals, "[plan.rb] +++ Execute: run ls")
+	c.Assert(terminal.String(), Equals, file.String())
+
+	SetQuiet(true)
+	defer SetQuiet(false)
+
+	file.Reset()
+	terminal.Reset()
+	l.Warning("hidden")
+	l.Error(errors.New("an error"))
+	c.Assert(file.String(), Equals, "[plan.rb] --- Warning: hidden\n[plan.rb] !!! Error: an error\n")
+	c.Assert(terminal.String(), Equals, "[plan.rb] !!! Error: an error\n")
+	c.Assert(other.String(), Equals, "[plan.rb] +++ Execute: run ls[plan.rb] partial [plan.rb] --- Warning: hidden[plan.rb] !!! Error: an error")
+
+	// the output of a command is held, and replayed if it failed.
+	file.Reset()
+	w, replay := l.RunOutput(false)
+	fmt.Fprint(w, "\x1b[1mrun output\x1b[0m\n")
+	c.Assert(file.String(), Equals, "run output\n")
+	c.Assert(terminal.String(), Equals, "[plan.rb] !!! Error: an error\n")
+	replay()
+	c.Assert(colorRegex.ReplaceAllString(terminal.String(), ""), Equals, "[plan.rb] !!! Error: an error\n[plan.rb] ------ BEGIN OUTPUT ------\nrun output\n[plan.rb] ------- END OUTPUT -------\n")
+
+	// recording loggers are not quieted.
+	l.Record()
+	l.Warning("recorded")
+	c.Assert(l.Output().(*bytes.Buffer).String(), Equals, "[plan.rb] --- Warning: recorded\n")
+}
+
+type closeBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closeBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func (ls *loggerSuite) TestCloseSinks(c *C) {
+	tee, file, other := new(closeBuffer), new(closeBuffer), new(bytes.Buffer)
+	SetTee(tee)
+	AddSink(file)
+	AddSink(other)
+
+	l := &Logger{plan: "plan.rb", output: new(bytes.Buffer), notrim: true}
+	l.Print("before")
+
+	CloseSinks()
+	c.Assert(tee.closed, Equals, true)
+	c.Assert(file.closed, Equals, true)
+
+	l.Print("after")
+	c.Assert(tee.String(), Equals, "[plan.rb] before")
+	c.Assert(file.String(), Equals, "[plan.rb] before")
+	c.Assert(other.String(), Equals, "[plan.rb] before")
+}
+
+func (ls *loggerSuite) TestTheme(c *C) {
+	noColor := color.NoColor
+	color.NoColor = false
+	defer func() { color.NoColor = noColor }()
+	defer SetPalette(Themes[DefaultTheme])
+
+	_, err := Theme("neon")
+	c.Assert(err, NotNil)
+
+	p, err := Theme("mono")
+	c.Assert(err, IsNil)
+	SetPalette(p)
+
+	l := New("plan.rb", true, 0)
+	l.Record()
+	l.Tag("test")
+	out := l.Output().(*bytes.Buffer).String()
+	c.Assert(strings.HasPrefix(out, "\x1b[1m[\x1b[0mplan.rb\x1b[1m] \x1b[0m+++ Tagged: test\n"), Equals, true, Commentf("%q", out))
+
+	defer os.Unsetenv("BOX_COLOR_TAG")
+	os.Setenv("BOX_COLOR_TAG", "cyan, bold")
+	p, err = Theme("mono")
+	c.Assert(err, IsNil)
+	c.Assert(p.Tag, DeepEquals, []color.Attribute{color.FgCyan, color.Bold})
+
+	os.Setenv("BOX_COLOR_TAG", "chartreuse")
+	_, err = Theme("mono")
+	c.Assert(err, NotNil)
+}
+
+func (ls *loggerSuite) TestFormat(c *C) {
+	defer SetSI(false)
+
+	for size, expected := range map[uint64]string{
+		0:                      "0 B",
+		1023:                   "1023 B",
+		1024:                   "1.00 KiB",
+		1536:                   "1.50 KiB",
+		5 * 1024 * 1024:        "5.00 MiB",
+		3 * 1024 * 1024 * 1024: "3.00 GiB",
+	} {
+		c.Assert(FormatBytes(size), Equals, expected)
+	}
+
+	SetSI(true)
+	c.Assert(FormatBytes(999), Equals, "999 B")
+	c.Assert(FormatBytes(1500), Equals, "1.50 kB")
+	c.Assert(FormatBytes(2000000), Equals, "2.00 MB")
+
+	for d, expected := range map[time.Duration]string{
+		0: "0s",
+		250*time.Millisecond + 400*time.Microsecond: "250ms",
+		12345 * time.Millisecond:                    "12.3s",
+		83*time.Second + 400*time.Millisecond:       "1m23s",
+		time.Hour + 2*time.Minute + 3*time.Second:   "1h2m3s",
+	} {
+		c.Assert(FormatDuration(d), Equals, expected)
+	}
+}
+
+func (ls *loggerSuite) TestFinishFormat(c *C) {
+	defer SetFinishFormat("")
+
+	summary := Summary{ID: "0123", Size: 1536, Tags: []string{"app:1", "app:latest"}, Elapsed: 2 * time.Second}
+
+	l := New("plan.rb", true, 0)
+	l.Record()
+	l.Finish(summary)
+	c.Assert(strings.Contains(l.Output().(*bytes.Buffer).String(), "Finish:  0123 (2s)"), Equals, true, Commentf("%s", l.Output()))
+
+	c.Assert(SetFinishFormat(`{{.ID}} {{.Size}} {{.Tags}} {{join .Tags ","}} {{bytes .Size}}`), IsNil)
+	c.Assert(FinishFormat(), Equals, true)
+
+	l = New("plan.rb", true, 0)
+	l.Record()
+	l.Finish(summary)
+	c.Assert(l.Output().(*bytes.Buffer).String(), Equals, "0123 1536 [app:1 app:latest] app:1,app:latest 1.50 KiB\n")
+
+	c.Assert(SetFinishFormat("{{.ID"), NotNil)
+	c.Assert(SetFinishFormat("{{.Digest}}"), NotNil)
+
+	// a bad template leaves the current one in place.
+	c.Assert(FinishFormat(), Equals, true)
+
+	c.Assert(SetFinishFormat(""), IsNil)
+	c.Assert(FinishFormat(), Equals, false)
+}
+
+func (ls *loggerSuite) TestPlanResults(c *C) {
+	l := New("multi", true, 0)
+	l.Record()
+	l.PlanResults([]PlanResult{
+		{Plan: "base.rb", ID: "0123", Size: 1536, Elapsed: 2 * time.Second},
+		{Plan: "application.rb", Elapsed: 250 * time.Millisecond, Err: errors.New("failed")},
+		{Plan: "worker.rb", Elapsed: 300 * time.Millisecond, Err: errors.New("failed"), Skipped: true},
+	})
+
+	c.Assert(colorRegex.ReplaceAllString(l.Output().(*bytes.Buffer).String(), ""), Equals, strings.Join([]string{
+		"[multi] PLAN            STATUS   IMAGE  SIZE      TIME",
+		"[multi] base.rb         ok       0123   1.50 KiB  2s",
+		"[multi] application.rb  failed   -      -         250ms",
+		"[multi] worker.rb       skipped  -      -         300ms",
+		"",
+	}, "\n"))
+}
+
+func (ls *loggerSuite) TestDebug(c *C) {
+	l := New("plan.rb", true, 0)
+	l.Record()
+
+	l.Debug("pull", "image=debian", 1200*time.Millisecond, nil)
+	l.Debug("create", "image=sha256:abc", 3*time.Millisecond, errors.New("no such image"))
+
+	out := colorRegex.ReplaceAllString(l.Output().(*bytes.Buffer).String(), "")
+	c.Assert(out, Equals, "[plan.rb] --- Debug: pull image=debian (1.2s)\n[plan.rb] --- Debug: create image=sha256:abc (3ms): no such image\n")
+}
+
+type locatedTestError struct {
+	line, column int
+}
+
+func (e locatedTestError) Error() string {
+	return "undefined method 'rnu'"
+}
+
+func (e locatedTestError) Location() (string, string, int, int) {
+	return "plan.rb", "from \"debian\"\n\n\t  rnu \"ls\"\n", e.line, e.column
+}
+
+func (ls *loggerSuite) TestErrorSnippet(c *C) {
+	l := New("plan.rb", true, 0)
+	l.Record()
+
+	l.Error(locatedTestError{line: 3})
+	l.Error(locatedTestError{line: 3, column: 7})
+	l.Error(locatedTestError{line: 12})
+
+	out := colorRegex.ReplaceAllString(l.Output().(*bytes.Buffer).String(), "")
+	c.Assert(out, Equals, strings.Join([]string{
+		"[plan.rb] !!! Error: undefined method 'rnu'",
+		"[plan.rb]  --> plan.rb:3",
+		"[plan.rb] 3 | \t  rnu \"ls\"",
+		"[plan.rb]   | \t  ^",
+		"[plan.rb] !!! Error: undefined method 'rnu'",
+		"[plan.rb]  --> plan.rb:3:7",
+		"[plan.rb] 3 | \t  rnu \"ls\"",
+		"[plan.rb]   | \t     ^",
+		"[plan.rb] !!! Error: undefined method 'rnu'",
+		"",
+	}, "\n"))
+}
+
+func (ls *loggerSuite) TestTrimWidth(c *C) {
+	line := strings.Repeat("x", 40)
+
+	l := New("plan.rb", false, 20)
+	l.Record()
+	l.Warning(line)
+	c.Assert(colorRegex.ReplaceAllString(l.Output().(*bytes.Buffer).String(), ""), Equals, "[plan.rb] --- War...\n")
+
+	l = New("plan.rb", true, 20)
+	l.Record()
+	l.Warning(line)
+	c.Assert(colorRegex.ReplaceAllString(l.Output().(*bytes.Buffer).String(), ""), Equals, "[plan.rb] --- Warning: "+line+"\n")
+}
@@ -0,0 +1,214 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+// Palette is the set of colors the logger uses for each element of its
+// output. Each element is a list of attributes that are combined when printed;
+// an empty list prints the element without any color.
+type Palette struct {
+	Bracket   []color.Attribute // the brackets around the plan name
+	Plan      []color.Attribute // the plan name
+	Good      []color.Attribute // the +++ status marker
+	Notice    []color.Attribute // the --- status marker
+	Error     []color.Attribute // the !!! error marker
+	Text      []color.Attribute // error text and progress values
+	Label     []color.Attribute // "Execute:", "Eval Response:" and progress markers
+	Step      []color.Attribute // the build step being executed
+	CacheHit  []color.Attribute // the "Cache hit:" label
+	ID        []color.Attribute // image IDs
+	Copy      []color.Attribute // the "COPY:" label
+	Tag       []color.Attribute // "Tagged:", "Resolved:" and "Cache expired:" labels
+	Validated []color.Attribute // the "Validated:" label
+	Finish    []color.Attribute // the "Finish:" label
+	Output    []color.Attribute // the output section banners
+	Progress  []color.Attribute // the progress meter prefix
+}
+
+// Themes is the list of palettes that may be selected by name.
+var Themes = map[string]Palette{
+	"dark": {
+		Bracket:   []color.Attribute{color.Bold, color.FgBlue},
+		Plan:      []color.Attribute{color.FgBlue},
+		Good:      []color.Attribute{color.FgGreen},
+		Notice:    []color.Attribute{color.FgYellow},
+		Error:     []color.Attribute{color.Bold, color.FgRed},
+		Text:      []color.Attribute{color.FgWhite},
+		Label:     []color.Attribute{color.Bold, color.FgWhite},
+		Step:      []color.Attribute{color.FgGreen},
+		CacheHit:  []color.Attribute{color.FgWhite, color.Bold, color.BgRed},
+		ID:        []color.Attribute{color.FgCyan},
+		Copy:      []color.Attribute{color.FgRed},
+		Tag:       []color.Attribute{color.FgYellow},
+		Validated: []color.Attribute{color.FgGreen, color.Bold},
+		Finish:    []color.Attribute{color.FgRed, color.Bold},
+		Output:    []color.Attribute{color.FgRed, color.Bold, color.BgWhite},
+		Progress:  []color.Attribute{color.FgRed, color.Bold},
+	},
+	"light": {
+		Bracket:   []color.Attribute{color.Bold, color.FgBlue},
+		Plan:      []color.Attribute{color.FgBlue},
+		Good:      []color.Attribute{color.FgGreen},
+		Notice:    []color.Attribute{color.FgMagenta},
+		Error:     []color.Attribute{color.Bold, color.FgRed},
+		Text:      []color.Attribute{color.FgBlack},
+		Label:     []color.Attribute{color.Bold, color.FgBlack},
+		Step:      []color.Attribute{color.FgGreen},
+		CacheHit:  []color.Attribute{color.FgWhite, color.Bold, color.BgRed},
+		ID:        []color.Attribute{color.FgBlue},
+		Copy:      []color.Attribute{color.FgRed},
+		Tag:       []color.Attribute{color.FgMagenta},
+		Validated: []color.Attribute{color.FgGreen, color.Bold},
+		Finish:    []color.Attribute{color.FgRed, color.Bold},
+		Output:    []color.Attribute{color.FgWhite, color.Bold, color.BgRed},
+		Progress:  []color.Attribute{color.FgRed, color.Bold},
+	},
+	"mono": {
+		Bracket:  []color.Attribute{color.Bold},
+		Error:    []color.Attribute{color.Bold},
+		Label:    []color.Attribute{color.Bold},
+		CacheHit: []color.Attribute{color.Bold},
+		Finish:   []color.Attribute{color.Bold},
+		Output:   []color.Attribute{color.Bold},
+		Progress: []color.Attribute{color.Bold},
+	},
+}
+
+// DefaultTheme is the theme used when none is selected.
+const DefaultTheme = "dark"
+
+var colorNames = map[string]color.Attribute{
+	"bold":       color.Bold,
+	"faint":      color.Faint,
+	"italic":     color.Italic,
+	"underline":  color.Underline,
+	"black":      color.FgBlack,
+	"red":        color.FgRed,
+	"green":      color.FgGreen,
+	"yellow":     color.FgYellow,
+	"blue":       color.FgBlue,
+	"magenta":    color.FgMagenta,
+	"cyan":       color.FgCyan,
+	"white":      color.FgWhite,
+	"bg-black":   color.BgBlack,
+	"bg-red":     color.BgRed,
+	"bg-green":   color.BgGreen,
+	"bg-yellow":  color.BgYellow,
+	"bg-blue":    color.BgBlue,
+	"bg-magenta": color.BgMagenta,
+	"bg-cyan":    color.BgCyan,
+	"bg-white":   color.BgWhite,
+}
+
+var (
+	paletteMutex = new(sync.RWMutex)
+	palette      = Themes[DefaultTheme]
+)
+
+// SetPalette sets the palette shared by all loggers.
+func SetPalette(p Palette) {
+	paletteMutex.Lock()
+	defer paletteMutex.Unlock()
+	palette = p
+}
+
+// getPalette returns the palette shared by all loggers.
+func getPalette() Palette {
+	paletteMutex.RLock()
+	defer paletteMutex.RUnlock()
+	return palette
+}
+
+// NoColorEnv returns true if the NO_COLOR environment variable is set. When it
+// is, colors are disabled regardless of any other setting.
+func NoColorEnv() bool {
+	return os.Getenv("NO_COLOR") != ""
+}
+
+// Theme returns the palette for the named theme, with any element overridden
+// by a BOX_COLOR_<ELEMENT> environment variable, e.g. BOX_COLOR_STEP=cyan.
+// Values are a comma-separated list of colors and attributes, such as
+// "bold,white,bg-red".
+func Theme(name string) (Palette, error) {
+	p, ok := Themes[name]
+	if !ok {
+		themes := []string{}
+		for theme := range Themes {
+			themes = append(themes, theme)
+		}
+		sort.Strings(themes)
+		return p, fmt.Errorf("invalid theme %q; must be one of: %s", name, strings.Join(themes, ", "))
+	}
+
+	elements := map[string]*[]color.Attribute{
+		"BRACKET":   &p.Bracket,
+		"PLAN":      &p.Plan,
+		"GOOD":      &p.Good,
+		"NOTICE":    &p.Notice,
+		"ERROR":     &p.Error,
+		"TEXT":      &p.Text,
+		"LABEL":     &p.Label,
+		"STEP":      &p.Step,
+		"CACHEHIT":  &p.CacheHit,
+		"ID":        &p.ID,
+		"COPY":      &p.Copy,
+		"TAG":       &p.Tag,
+		"VALIDATED": &p.Validated,
+		"FINISH":    &p.Finish,
+		"OUTPUT":    &p.Output,
+		"PROGRESS":  &p.Progress,
+	}
+
+	for element, attrs := range elements {
+		value, ok := os.LookupEnv("BOX_COLOR_" + element)
+		if !ok {
+			continue
+		}
+
+		parsed, err := parseColors(value)
+		if err != nil {
+			return p, fmt.Errorf("in BOX_COLOR_%s: %v", element, err)
+		}
+
+		*attrs = parsed
+	}
+
+	return p, nil
+}
+
+func parseColors(value string) ([]color.Attribute, error) {
+	attrs := []color.Attribute{}
+
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || name == "none" {
+			continue
+		}
+
+		attr, ok := colorNames[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid color %q", name)
+		}
+
+		attrs = append(attrs, attr)
+	}
+
+	return attrs, nil
+}
+
+// paint colors the string with the attributes. No escape codes are emitted if
+// there are no attributes.
+func paint(attrs []color.Attribute, str string) string {
+	if len(attrs) == 0 {
+		return str
+	}
+
+	return color.New(attrs...).SprintFunc()(str)
+}
@@ -0,0 +1,41 @@
+package logger
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// lineWriter writes each complete line to the writer in its own call, for
+// sinks such as syslog which make a message of each write. Empty lines are
+// dropped, and the end of a line not yet complete is held for the next write.
+type lineWriter struct {
+	writer io.Writer
+	mutex  sync.Mutex
+	held   []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.held = append(l.held, p...)
+
+	for {
+		i := bytes.IndexByte(l.held, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+
+		line := bytes.TrimRight(l.held[:i], "\r")
+		l.held = l.held[i+1:]
+
+		if len(line) == 0 {
+			continue
+		}
+
+		if _, err := l.writer.Write(line); err != nil {
+			return len(p), err
+		}
+	}
+}
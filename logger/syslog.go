@@ -0,0 +1,20 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package logger
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// NewSyslog returns a sink, for AddSink, which sends each line of the log to
+// the local syslog daemon with the tag.
+func NewSyslog(tag string) (io.Writer, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_USER, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lineWriter{writer: w}, nil
+}
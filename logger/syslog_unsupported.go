@@ -0,0 +1,14 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package logger
+
+import (
+	"errors"
+	"io"
+)
+
+// NewSyslog returns an error on platforms without syslog.
+func NewSyslog(tag string) (io.Writer, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
@@ -1,24 +1,48 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"text/template"
 	"time"
 
 	"github.com/box-builder/box/builder"
+	"github.com/box-builder/box/builder/config"
+	"github.com/box-builder/box/builder/evaluator/mruby"
 	"github.com/box-builder/box/copy"
+	"github.com/box-builder/box/fetcher"
+	"github.com/box-builder/box/format"
 	"github.com/box-builder/box/logger"
 	"github.com/box-builder/box/multi"
+	"github.com/box-builder/box/plandiff"
+	"github.com/box-builder/box/policy"
 	"github.com/box-builder/box/repl"
 	"github.com/box-builder/box/signal"
 	"github.com/box-builder/box/types"
+	"github.com/box-builder/box/util"
 	"github.com/docker/docker/pkg/term"
+	"github.com/fatih/color"
 	"github.com/urfave/cli"
 )
 
-const defaultFile = "box.rb"
+const (
+	defaultFile = "box.rb"
+	stdinFile   = builder.StdinFile
+
+	// timeoutExit is the exit status of builds canceled by --timeout, as for
+	// timeout(1).
+	timeoutExit = 124
+)
 
 var (
 	// Version is the version of the application
@@ -35,7 +59,7 @@ var (
 	// Copyright is the copyright, generated automatically for each year.
 	Copyright = fmt.Sprintf("(C) %d %s - Licensed under MIT license", time.Now().Year(), Author)
 	// UsageText is the description of how to use the program.
-	UsageText = "box [options] [filename]"
+	UsageText = "box [options] [filename | -]"
 )
 
 func main() {
@@ -56,12 +80,40 @@ func main() {
 	app.Flags = []cli.Flag{
 		cli.StringSliceFlag{
 			Name:  "var, v",
-			Usage: "Provide a variable to the build plan accepts `key=value` syntax.",
+			Usage: "Provide a variable to the build plan accepts `key=value` syntax, or `plan.rb:key=value` for one plan.",
 		},
 		cli.BoolFlag{
 			Name:  "no-cache, n",
 			Usage: "Disable the build cache",
 		},
+		cli.DurationFlag{
+			Name:  "cache-ttl",
+			Usage: "Treat cached layers older than this `duration` (e.g. 24h) as cache misses",
+		},
+		cli.StringFlag{
+			Name:  "cache-image",
+			Usage: "Pull this `image` and reuse the steps that built it as cached layers",
+		},
+		cli.BoolFlag{
+			Name:  "cache-image-push",
+			Usage: "Push the final image, with the steps that built it, as the --cache-image",
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "Cancel the build if it takes longer than `DURATION`, such as 30m, and exit with status 124",
+		},
+		cli.IntFlag{
+			Name:  "no-cache-from-step",
+			Usage: "Disable the build cache from step `N` onwards, keeping earlier steps cached",
+		},
+		cli.StringFlag{
+			Name:  "steps",
+			Usage: "Only execute the steps in `RANGE`, such as 3-7; earlier steps must be cached and later ones are skipped",
+		},
+		cli.StringFlag{
+			Name:  "checkpoint",
+			Usage: "Record the steps built in `FILE`, such as .box-checkpoint, so a failed build is resumed from its last step",
+		},
 		cli.BoolFlag{
 			Name:  "no-color",
 			Usage: "Disable colors this run",
@@ -74,6 +126,10 @@ func main() {
 			Name:  "no-tty",
 			Usage: "Disable TTY features this run",
 		},
+		cli.BoolFlag{
+			Name:  "ci",
+			Usage: "Build as suited to CI: no tty or colors, unless forced, and multi --fail-fast; the default if CI is set in the environment, so --ci=false turns it off",
+		},
 		cli.BoolFlag{
 			Name:  "force-tty",
 			Usage: "Force TTY features this run",
@@ -94,6 +150,167 @@ func main() {
 			Name:  "no-trim",
 			Usage: "Do not trim the output to terminal width.",
 		},
+		cli.IntFlag{
+			Name:  "trim-width",
+			Usage: "Trim the output to `N` columns, even without a terminal, instead of to the terminal's width",
+		},
+		cli.BoolFlag{
+			Name:  "resolve-digests",
+			Usage: "Pin each `from` image to the registry digest it resolves to, and print it",
+		},
+		cli.BoolFlag{
+			Name:  "allow-local-exec",
+			Usage: "Allow the plan to run commands on the host with local_run",
+		},
+		cli.BoolFlag{
+			Name:  "strict-vars",
+			Usage: "Fail if the plan uses variables that are neither declared with arg nor passed with --var",
+		},
+		cli.BoolFlag{
+			Name:  "allow-privileged",
+			Usage: "Allow run statements with privileged: true or cap_add",
+		},
+		cli.BoolFlag{
+			Name:  "allow-bind",
+			Usage: "Allow run statements to bind-mount host paths with bind:",
+		},
+		cli.BoolFlag{
+			Name:  "experimental",
+			Usage: "Allow the experimental verbs and functions, which may change in future releases",
+		},
+		cli.DurationFlag{
+			Name:  "daemon-connect-timeout",
+			Usage: "Keep retrying the connection to the docker daemon for this `duration` (e.g. 30s)",
+		},
+		cli.StringSliceFlag{
+			Name:  "registry-mirror",
+			Usage: "Pull Docker Hub images through this mirror `url` first. Repeatable; tried in order.",
+		},
+		cli.StringSliceFlag{
+			Name:  "allow-insecure-registry",
+			Usage: "Verify the docker daemon allows insecure access to the registry at `host[:port]` for its pulls and pushes, and read manifest lists from it without TLS verification. Repeatable.",
+		},
+		cli.StringFlag{
+			Name:  "pull",
+			Value: "missing",
+			Usage: "Pull the images given to from when the daemon is `missing` them, or `always`, to pick up moved tags",
+		},
+		cli.DurationFlag{
+			Name:  "base-cache-ttl",
+			Value: time.Minute,
+			Usage: "Reuse the image a from name resolved to for this `duration` in the run instead of looking it up again; 0 disables",
+		},
+		cli.StringFlag{
+			Name:  "base-policy",
+			Usage: "Only allow the base images permitted by the `file` of allow and deny rules",
+		},
+		cli.BoolFlag{
+			Name:  "reproducible",
+			Usage: "Use fixed timestamps (SOURCE_DATE_EPOCH, or the epoch) in the image configs and archives box writes",
+		},
+		cli.BoolFlag{
+			Name:  "push",
+			Usage: "Push the image tagged with --tag to its registry",
+		},
+		cli.StringFlag{
+			Name:  "sign",
+			Usage: "Run this `command` with the pushed image's name@digest as its last argument, e.g. \"cosign sign --yes\"",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "Build the plan once for each of the comma-separated `platforms`, e.g. linux/amd64,linux/arm64, and push them as one multi-platform image; requires --tag and --push",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "Print the final line with this Go `template`, e.g. \"{{.ID}} {{.Size}} {{.Tags}}\"",
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "Export the final image, e.g. `type=oci,dest=./out`. Types are docker, oci and local.",
+		},
+		cli.BoolFlag{
+			Name:  "attach",
+			Usage: "Run a shell in a container from the image after the build",
+		},
+		cli.StringFlag{
+			Name:  "attach-shell",
+			Value: "/bin/sh",
+			Usage: "The `shell` run by --attach",
+		},
+		cli.StringFlag{
+			Name:  "sbom",
+			Usage: "Write a CycloneDX software bill of materials for the image to this `path`",
+		},
+		cli.StringFlag{
+			Name:  "build-context",
+			Usage: "Resolve copy sources and other local paths against this `directory`",
+		},
+		cli.StringFlag{
+			Name:  "context-from-git",
+			Usage: "Clone the repository at `URL#ref:subdir` and build with it as the context",
+		},
+		cli.StringFlag{
+			Name:  "theme",
+			Value: logger.DefaultTheme,
+			Usage: "Color `theme` for the output: dark, light or mono",
+		},
+		cli.BoolFlag{
+			Name:  "si",
+			Usage: "Print sizes in decimal (kB, MB) instead of binary (KiB, MiB) units",
+		},
+		cli.BoolFlag{
+			Name:  "interactive",
+			Usage: "Ask before overwriting existing tags",
+		},
+		cli.BoolFlag{
+			Name:  "yes, y",
+			Usage: "Answer yes to the questions asked by --interactive; required without a TTY",
+		},
+		cli.IntFlag{
+			Name:  "concurrency",
+			Usage: "Start at most `N` runs of a parallel block at once; 0 starts them all",
+		},
+		cli.BoolFlag{
+			Name:  "profile",
+			Usage: "Print how long the build spent running the plan's code and in docker",
+		},
+		cli.BoolFlag{
+			Name:  "debug",
+			Usage: "Log each docker operation with its parameters and duration",
+		},
+		cli.BoolFlag{
+			Name:  "keep-containers",
+			Usage: "Do not remove the containers of the steps, including failed ones, and log their IDs at the end",
+		},
+		cli.StringFlag{
+			Name:  "build-priority",
+			Value: "normal",
+			Usage: "Run the steps' containers at `normal` or low cpu and I/O priority, so the build does not starve the host",
+		},
+		cli.StringFlag{
+			Name:  "post-commit-hook",
+			Usage: "Run this `command` with the ID of each committed layer's image as its last argument; a failure fails the build",
+		},
+		cli.StringFlag{
+			Name:  "progress-log",
+			Usage: "Write a plain-text copy of the build output to this `path`, truncating it first.",
+		},
+		cli.StringFlag{
+			Name:  "log-file",
+			Usage: "Append a plain-text copy of the build output to this `path`",
+		},
+		cli.BoolFlag{
+			Name:  "syslog",
+			Usage: "Send a copy of the build output to the local syslog daemon",
+		},
+		cli.BoolFlag{
+			Name:  "quiet, q",
+			Usage: "Only print errors to the terminal; the output still goes to the log files and syslog",
+		},
+		cli.BoolFlag{
+			Name:  "show-run",
+			Usage: "Print the output of run statements as they run with --ci, instead of only if they fail",
+		},
 	}
 
 	app.Commands = []cli.Command{
@@ -103,6 +320,56 @@ func main() {
 			Description: "Run the multi build functionality; supply multiple plans to build",
 			Usage:       "Run the multi build functionality; supply multiple plans to build",
 			ArgsUsage:   "[filename] [filename]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "fail-fast",
+					Usage: "Cancel the remaining plans as soon as one fails",
+				},
+				cli.BoolFlag{
+					Name:  "no-omit-debug",
+					Usage: "Allow debug in the plans, which is omitted by default as they share the terminal",
+				},
+			},
+		},
+		{
+			Name:        "inspect-plan",
+			Action:      runInspectPlan,
+			Description: "Print the steps of a plan with their cache keys, without building it",
+			Usage:       "Print the steps of a plan with their cache keys, without building it",
+			ArgsUsage:   "[filename]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: "table",
+					Usage: "Print the steps as a `table` or as json",
+				},
+			},
+		},
+		{
+			Name:        "diff",
+			Action:      runDiff,
+			Description: "Print the differences between the steps and resulting image configs of two plans",
+			Usage:       "Print the differences between the steps and resulting image configs of two plans",
+			ArgsUsage:   "[filename] [filename]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "config-only",
+					Usage: "Compare the configs set by the plans without building them",
+				},
+			},
+		},
+		{
+			Name:        "fmt",
+			Action:      runFmt,
+			Description: "Rewrite plans with consistent indentation and spacing",
+			Usage:       "Rewrite plans with consistent indentation and spacing",
+			ArgsUsage:   "[filename] [filename]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "check",
+					Usage: "Only print the plans which are not formatted, and exit non-zero if there are any",
+				},
+			},
 		},
 		{
 			Name:        "repl",
@@ -110,6 +377,7 @@ func main() {
 			Description: "Run the read-eval-print loop to interactively work with box",
 			Usage:       "Run the read-eval-print loop to interactively work with box",
 			ArgsUsage:   " ",
+			Flags:       replFlags,
 		},
 		{
 			Name:        "shell",
@@ -117,124 +385,298 @@ func main() {
 			Description: "Run the read-eval-print loop to interactively work with box",
 			Usage:       "Run the read-eval-print loop to interactively work with box",
 			ArgsUsage:   " ",
+			Flags:       replFlags,
 		},
 	}
 
 	app.Action = func(ctx *cli.Context) {
-		notrim := ctx.GlobalBool("no-trim")
-		log := logger.New("main", notrim)
+		start := time.Now()
+		notrim, width := ctx.GlobalBool("no-trim"), ctx.GlobalInt("trim-width")
+		log := logger.New("main", notrim, width)
+
+		var b *builder.Builder
+		cleanup := func() {}
+
+		// exit closes the builder and removes the cloned context before
+		// exiting, as os.Exit skips the defers, so on_exit blocks must run here.
+		// The log sinks are closed last, so they have all of the output.
+		exit := func(status int) {
+			if b != nil {
+				b.Close()
+			}
+			cleanup()
+			logger.CloseSinks()
+			os.Exit(status)
+		}
+
+		fail := func(err interface{}) {
+			log.Error(err)
+			exit(1)
+		}
 
 		if ctx.Bool("help") {
 			cli.ShowAppHelp(ctx)
 			os.Exit(0)
 		}
 
-		filename := detectFile(ctx)
+		if err := setDisplay(ctx); err != nil {
+			fail(err)
+		}
+
+		if err := setLogSinks(ctx); err != nil {
+			fail(err)
+		}
+		defer logger.CloseSinks()
+
+		// read before changing to the build context, so the file is relative
+		// to the working directory.
+		basePolicy, err := loadBasePolicy(ctx)
+		if err != nil {
+			fail(err)
+		}
+
+		globals, err := globalsFromContext(ctx, basePolicy)
+		if err != nil {
+			fail(err)
+		}
+		warnInsecure(log, globals.AllowInsecure)
+
+		var filename string
 
-		tty := term.IsTerminal(1)
+		if ctx.GlobalString("context-from-git") != "" {
+			var remove func()
+			filename, remove, err = cloneContext(ctx)
+			if err != nil {
+				fail(err)
+			}
+			cleanup = remove
+			defer cleanup()
+		} else {
+			if filename, err = detectFile(ctx); err != nil {
+				fail(err)
+			}
 
-		if ctx.Bool("no-tty") {
-			tty = false
+			if err := chdirContext(ctx, &filename); err != nil {
+				fail(err)
+			}
 		}
 
-		if ctx.Bool("force-tty") {
-			tty = true
+		vars, err := parseVars(ctx, filename)
+		if err != nil {
+			fail(err)
 		}
 
-		color := tty
+		// rendered before the build, so a bad template fails it early.
+		tag, err := renderTag(ctx, vars)
+		if err != nil {
+			fail(err)
+		}
 
-		if ctx.Bool("no-color") {
-			color = false
+		platforms, err := parsePlatforms(ctx.String("platform"))
+		if err != nil {
+			fail(err)
+		}
+		if len(platforms) > 0 {
+			if err := checkPlatforms(ctx, globals, tag, filename); err != nil {
+				fail(err)
+			}
 		}
 
-		if ctx.Bool("force-color") {
-			color = true
+		planName := filename
+		if filename == stdinFile {
+			planName = "stdin"
 		}
 
-		cancelCtx, cancel := context.WithCancel(context.Background())
-		runChan := make(chan struct{})
+		cancelCtx, cancel := buildContext(ctx)
+		globals.Logger = logger.New(planName, notrim, width)
+		globals.Context = cancelCtx
+
 		buildConfig := builder.BuildConfig{
-			Globals: &types.Global{
-				ShowRun:   true,
-				Color:     color,
-				TTY:       tty,
-				OmitFuncs: ctx.GlobalStringSlice("omit"),
-				Cache:     getCache(ctx),
-				Logger:    logger.New(filename, notrim),
-				Context:   cancelCtx,
-			},
-			Runner:   runChan,
+			Globals:  globals,
+			Runner:   make(chan struct{}),
 			FileName: filename,
-			Vars:     parseVars(ctx),
+			Vars:     vars,
+		}
+
+		if len(platforms) > 0 {
+			ref, err := buildPlatforms(ctx, cancel, buildConfig, planName, platforms, tag)
+			if err != nil {
+				if timedOut(ctx, cancelCtx, log) {
+					exit(timeoutExit)
+				}
+
+				fail(err)
+			}
+
+			log.Finish(logger.Summary{Plan: planName, ID: ref[strings.LastIndex(ref, ":")+1:], Tags: []string{tag}, Elapsed: time.Since(start)})
+			return
 		}
 
-		b, err := mkBuilder(cancel, buildConfig)
+		b, err = mkBuilder(cancel, buildConfig)
 		if err != nil {
-			log.Error(err)
-			os.Exit(1)
+			fail(err)
 		}
 
 		defer b.Close()
 
 		result := b.Run()
 		if result.Err != nil {
-			log.Error(result.Err)
-			os.Exit(1)
+			if timedOut(ctx, cancelCtx, log) {
+				exit(timeoutExit)
+			}
+
+			fail(result.Err)
 		}
 
 		if result.Value != "" {
 			log.EvalResponse(result.Value)
 		}
 
-		tag := ctx.String("tag")
-
 		if tag != "" {
 			if err := b.Tag(tag); err != nil {
-				log.Error(fmt.Sprintf("Can't tag with tag %q: %v", tag, err))
-				os.Exit(1)
+				fail(fmt.Sprintf("Can't tag with tag %q: %v", tag, err))
 			}
 			log.Tag(tag)
 		}
 
+		if ctx.Bool("push") {
+			if err := push(b, tag, ctx.String("sign")); err != nil {
+				fail(err)
+			}
+		} else if ctx.String("sign") != "" {
+			fail("--sign requires --push")
+		}
+
+		if ctx.Bool("cache-image-push") {
+			if err := pushCache(b, ctx.String("cache-image")); err != nil {
+				fail(err)
+			}
+		}
+
+		if output := ctx.String("output"); output != "" {
+			if err := saveOutput(b, output, tag); err != nil {
+				fail(err)
+			}
+		}
+
+		if fn := ctx.String("sbom"); fn != "" {
+			if err := b.SBOM(fn, tag, Version); err != nil {
+				fail(fmt.Sprintf("Can't write SBOM to %q: %v", fn, err))
+			}
+		}
+
+		// the shell is interactive, so it needs the terminal on all of its
+		// streams, not only the output box shows the build on.
+		if ctx.Bool("attach") {
+			if globals.TTY && term.IsTerminal(0) && term.IsTerminal(2) {
+				if err := b.Attach(ctx.String("attach-shell")); err != nil {
+					log.Error(err)
+				}
+			} else {
+				log.Warning("not attaching to the image without a TTY")
+			}
+		}
+
 		id := result.Value
 
 		if strings.Contains(id, ":") {
 			id = strings.SplitN(id, ":", 2)[1]
 		}
 
-		log.Finish(id)
+		logProfile(b)
+
+		summary := logger.Summary{Plan: planName, ID: id, Elapsed: time.Since(start)}
+		if logger.FinishFormat() {
+			if summary.Size, summary.Tags, err = b.ImageInfo(); err != nil {
+				fail(err)
+			}
+		}
+
+		log.Finish(summary)
 	}
 
 	if err := app.Run(os.Args); err != nil {
-		logger.New("main", false).Error(err)
+		logger.New("main", false, 0).Error(err)
 		os.Exit(1)
 	}
 }
 
 func runMulti(ctx *cli.Context) {
 	copy.NoOut = true
-	notrim := ctx.GlobalBool("no-trim")
+	notrim, width := ctx.GlobalBool("no-trim"), ctx.GlobalInt("trim-width")
 	builders := []*builder.Builder{}
-	log := logger.New("main", notrim)
+	log := logger.New("main", notrim, width)
+
+	if err := setDisplay(ctx); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if err := setLogSinks(ctx); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	// os.Exit skips the defers, so the log sinks are closed here.
+	exit := func(status int) {
+		logger.CloseSinks()
+		os.Exit(status)
+	}
+	defer logger.CloseSinks()
+
+	basePolicy, err := loadBasePolicy(ctx)
+	if err != nil {
+		log.Error(err)
+		exit(1)
+	}
+
+	base, err := globalsFromContext(ctx, basePolicy)
+	if err != nil {
+		log.Error(err)
+		exit(1)
+	}
+	warnInsecure(log, base.AllowInsecure)
+
+	// the plans would all write the same checkpoint.
+	if base.Checkpoint != "" {
+		log.Error("--checkpoint cannot be used with multi")
+		exit(1)
+	}
+
+	if ctx.GlobalString("platform") != "" {
+		log.Error("--platform cannot be used with multi")
+		exit(1)
+	}
+
+	// the output of the plans' runs would be interleaved.
+	base.ShowRun = false
+	if !ctx.Bool("no-omit-debug") {
+		base.OmitFuncs = append(base.OmitFuncs, "debug")
+	}
 
 	args := ctx.Args()
+	failCtx, failCancel := buildContext(ctx)
+	defer failCancel()
 
 	for _, filename := range args {
-		cancelCtx, cancel := context.WithCancel(context.Background())
+		vars, err := parseVars(ctx, filename)
+		if err != nil {
+			log.Error(err)
+			exit(1)
+		}
+
+		cancelCtx, cancel := context.WithCancel(failCtx)
 		runChan := make(chan struct{})
+
+		globals := *base
+		globals.Logger = logger.New(filename, notrim, width)
+		globals.Context = cancelCtx
+
 		buildConfig := builder.BuildConfig{
-			Globals: &types.Global{
-				ShowRun:   false,
-				Color:     true,
-				TTY:       true,
-				OmitFuncs: append(ctx.StringSlice("omit"), "debug"),
-				Cache:     getCache(ctx),
-				Logger:    logger.New(filename, notrim),
-				Context:   cancelCtx,
-			},
+			Globals:  &globals,
 			Runner:   runChan,
 			FileName: filename,
-			Vars:     parseVars(ctx),
+			Vars:     vars,
 		}
 		signal.Handler.AddFunc(cancel)
 		signal.Handler.AddRunner(runChan)
@@ -242,69 +684,1172 @@ func runMulti(ctx *cli.Context) {
 		b, err := builder.NewBuilder(buildConfig)
 		if err != nil {
 			log.Error(err)
-			os.Exit(1)
+			exit(1)
 		}
 		builders = append(builders, b)
 	}
 
 	mb := multi.NewBuilder(builders)
+	if ctx.Bool("fail-fast") || (inCI(ctx) && !ctx.IsSet("fail-fast")) {
+		mb.FailFast(failCancel)
+	}
 	mb.Build()
-	if err := mb.Wait(); err != nil {
+	err = mb.Wait()
+	mb.Close()
+
+	for _, b := range builders {
+		logProfile(b)
+	}
+
+	if err != nil {
+		if timedOut(ctx, failCtx, log) {
+			exit(timeoutExit)
+		}
+
 		log.Error(err)
-		os.Exit(2)
+		exit(2)
 	}
 }
 
-func getCache(ctx *cli.Context) bool {
-	cache := os.Getenv("NO_CACHE") == ""
-	if ctx.GlobalBool("no-cache") {
-		cache = false
+// runInspectPlan evaluates the plan without building it and prints its steps:
+// from is still evaluated, so the steps can be looked up in the cache, but the
+// other steps are only recorded.
+func runInspectPlan(ctx *cli.Context) {
+	log := logger.New("main", ctx.GlobalBool("no-trim"), ctx.GlobalInt("trim-width"))
+
+	format := ctx.String("format")
+	if format != "table" && format != "json" {
+		log.Error(fmt.Sprintf("invalid --format %q; expected table or json", format))
+		os.Exit(1)
 	}
 
-	return cache
-}
+	if err := setDisplay(ctx); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
 
-func runRepl(ctx *cli.Context) {
-	log := logger.New("repl", ctx.GlobalBool("no-trim"))
-	r, err := repl.NewRepl(ctx.GlobalStringSlice("omit"), log, parseVars(ctx))
+	basePolicy, err := loadBasePolicy(ctx)
 	if err != nil {
-		log.Error(fmt.Sprintf("bootstrapping repl: %v\n", err))
+		log.Error(err)
 		os.Exit(1)
 	}
 
-	r.Loop() // the REPL manages its own exit states
-}
+	filename, err := detectFile(ctx)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
 
-func mkBuilder(cancel context.CancelFunc, buildConfig builder.BuildConfig) (*builder.Builder, error) {
-	b, err := builder.NewBuilder(buildConfig)
+	if err := chdirContext(ctx, &filename); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	planned, _, err := evaluatePlan(ctx, filename, basePolicy, true)
 	if err != nil {
-		return nil, err
+		log.Error(err)
+		os.Exit(1)
 	}
 
-	signal.Handler.AddFunc(cancel)
-	signal.Handler.AddRunner(buildConfig.Runner)
-	return b, nil
+	if err := printPlan(planned, format); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
 }
 
-func detectFile(ctx *cli.Context) string {
-	a := ctx.Args()
-	if len(a) < 1 {
-		if _, err := os.Stat("box.rb"); os.IsNotExist(err) {
-			cli.ShowAppHelp(ctx)
-			os.Exit(0)
-		}
-		return defaultFile
+// evaluatePlan inspects the plan, or builds it if inspect is false, without
+// printing the build's output, and returns its steps and the resulting image
+// config. The steps are only returned by an inspection.
+func evaluatePlan(ctx *cli.Context, filename string, basePolicy *policy.Base, inspect bool) ([]types.PlannedStep, *config.Config, error) {
+	// the build's own output is not wanted, only its result.
+	buildLog := logger.New(filename, true, 0)
+	buildLog.Record()
+
+	globals, err := globalsFromContext(ctx, basePolicy)
+	if err != nil {
+		return nil, nil, err
 	}
-	return a[0]
-}
 
-func parseVars(ctx *cli.Context) map[string]string {
-	vars := map[string]string{}
+	vars, err := parseVars(ctx, filename)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	for _, v := range ctx.StringSlice("var") {
-		parts := strings.SplitN(v, "=", 2)
-		vars[parts[0]] = parts[1]
+	// the plan is built without output or prompts, and without recording
+	// anything, for its steps and config only.
+	globals.ShowRun, globals.TTY, globals.Color = false, false, false
+	globals.Steps = types.StepRange{}
+	globals.Checkpoint, globals.PostCommitHook = "", ""
+	globals.Interactive, globals.Profile, globals.KeepContainers = false, false, false
+
+	planned := []types.PlannedStep{}
+	cancelCtx, cancel := buildContext(ctx)
+	globals.Logger = buildLog
+	globals.Context = cancelCtx
+
+	buildConfig := builder.BuildConfig{
+		Globals:  globals,
+		Runner:   make(chan struct{}),
+		FileName: filename,
+		Vars:     vars,
+	}
+
+	if inspect {
+		buildConfig.Globals.Inspect = func(step types.PlannedStep) { planned = append(planned, step) }
+	}
+
+	b, err := mkBuilder(cancel, buildConfig)
+	if err != nil {
+		return nil, nil, err
 	}
+	defer b.Close()
+
+	if result := b.Run(); result.Err != nil {
+		return nil, nil, result.Err
+	}
+
+	return planned, b.ImageConfig(), nil
+}
+
+// runDiff prints the differences between the steps and resulting image
+// configs of two plans, and exits non-zero if there are any, like diff(1).
+// Both plans are built for their configs, unless --config-only is given, when
+// the configs are those set by the inspected plans.
+func runDiff(ctx *cli.Context) {
+	log := logger.New("main", ctx.GlobalBool("no-trim"), ctx.GlobalInt("trim-width"))
+
+	filenames := append([]string{}, ctx.Args()...)
+	if len(filenames) != 2 {
+		log.Error(fmt.Sprintf("diff takes two plans to compare; %d given", len(filenames)))
+		os.Exit(1)
+	}
+
+	if err := setDisplay(ctx); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	basePolicy, err := loadBasePolicy(ctx)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	// the plans are named relative to the directory box was run in, which
+	// the build context may change.
+	for i := range filenames {
+		abs, err := filepath.Abs(filenames[i])
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		filenames[i] = abs
+	}
+
+	if err := chdirContext(ctx, &filenames[0]); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	steps := [2][]types.PlannedStep{}
+	configs := [2]*config.Config{}
+	for i, filename := range filenames {
+		steps[i], configs[i], err = evaluatePlan(ctx, filename, basePolicy, true)
+		if err != nil {
+			log.Error(fmt.Sprintf("%s: %v", ctx.Args()[i], err))
+			os.Exit(1)
+		}
+
+		if !ctx.Bool("config-only") {
+			if _, configs[i], err = evaluatePlan(ctx, filename, basePolicy, false); err != nil {
+				log.Error(fmt.Sprintf("%s: %v", ctx.Args()[i], err))
+				os.Exit(1)
+			}
+		}
+	}
+
+	configLines := plandiff.Configs(configs[0], configs[1])
+	stepLines := plandiff.Steps(steps[0], steps[1])
+	if len(configLines) == 0 && !plandiff.Changed(stepLines) {
+		return
+	}
+
+	fmt.Printf("--- %s\n+++ %s\n", ctx.Args()[0], ctx.Args()[1])
+
+	if len(configLines) > 0 {
+		fmt.Println("@@ config @@")
+		for _, line := range configLines {
+			fmt.Println(line)
+		}
+	}
+
+	if plandiff.Changed(stepLines) {
+		fmt.Println("@@ steps @@")
+		for _, line := range stepLines {
+			fmt.Println(line)
+		}
+	}
+
+	os.Exit(1)
+}
+
+// runFmt formats the plans given, or box.rb, in place. Plans which do not
+// parse, before or after formatting, are left alone.
+func runFmt(ctx *cli.Context) {
+	log := logger.New("main", ctx.GlobalBool("no-trim"), ctx.GlobalInt("trim-width"))
+
+	filenames := ctx.Args()
+	if len(filenames) == 0 {
+		filenames = []string{defaultFile}
+	}
+
+	unformatted := false
+	for _, filename := range filenames {
+		changed, err := formatPlan(filename, ctx.Bool("check"))
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+
+		if changed && ctx.Bool("check") {
+			fmt.Println(filename)
+			unformatted = true
+		}
+	}
+
+	if unformatted {
+		os.Exit(1)
+	}
+}
+
+// formatPlan formats a plan, writing it unless check is true, and returns
+// true if it changed.
+func formatPlan(filename string, check bool) (bool, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return false, err
+	}
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return false, err
+	}
+
+	if err := mruby.CheckSyntax(filename, string(content)); err != nil {
+		return false, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	formatted, err := format.Plan(content)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	if bytes.Equal(content, formatted) {
+		return false, nil
+	}
+
+	// a plan which no longer parses, or compiles to other bytecode, is a bug
+	// in the formatter, and is not written.
+	if err := mruby.CheckSyntax(filename, string(formatted)); err != nil {
+		return false, fmt.Errorf("%s: not formatting, as the result does not parse: %v", filename, err)
+	}
+
+	before, err := mruby.Bytecode(string(content))
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	after, err := mruby.Bytecode(string(formatted))
+	if err != nil {
+		return false, fmt.Errorf("%s: not formatting, as the result does not compile: %v", filename, err)
+	}
+
+	if !bytes.Equal(before, after) {
+		return false, fmt.Errorf("%s: not formatting, as the result compiles to other bytecode", filename)
+	}
+
+	if check {
+		return true, nil
+	}
+
+	return true, ioutil.WriteFile(filename, formatted, fi.Mode().Perm())
+}
+
+// printPlan prints the steps of an inspected plan to standard output in the
+// format, table or json.
+func printPlan(planned []types.PlannedStep, format string) error {
+	if format == "json" {
+		content, err := json.MarshalIndent(planned, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Println(string(content))
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tVERB\tARGS\tCACHED\tCACHE KEY")
+
+	for _, step := range planned {
+		cached := "no"
+		if step.Cached {
+			cached = "yes"
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", step.Step, step.Verb, strconv.Quote(strings.Join(step.Args, ", ")), cached, step.CacheKey)
+	}
+
+	return w.Flush()
+}
+
+// buildContext returns the context of the whole build, which is canceled once
+// the --timeout, if any, has passed.
+func buildContext(ctx *cli.Context) (context.Context, context.CancelFunc) {
+	if timeout := ctx.GlobalDuration("timeout"); timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+
+	return context.WithCancel(context.Background())
+}
+
+// timedOut returns true, logging it, if the build was canceled because the
+// --timeout passed.
+func timedOut(ctx *cli.Context, buildCtx context.Context, log *logger.Logger) bool {
+	if buildCtx.Err() != context.DeadlineExceeded {
+		return false
+	}
+
+	log.Error(fmt.Sprintf("Build timed out after %v", ctx.GlobalDuration("timeout")))
+	return true
+}
+
+// logProfile logs the profile of the build, if it was recorded.
+func logProfile(b *builder.Builder) {
+	profile, ok := b.Profile()
+	if !ok {
+		return
+	}
+
+	operations := []string{}
+	for _, op := range profile.Operations {
+		operations = append(operations, fmt.Sprintf("%s %dx %s", op.Name, op.Count, logger.FormatDuration(op.Elapsed)))
+	}
+
+	b.Config().Globals.Logger.Profile(profile.Plan, profile.Executor, strings.Join(operations, ", "))
+}
+
+// loadBasePolicy reads the --base-policy file, if any.
+func loadBasePolicy(ctx *cli.Context) (*policy.Base, error) {
+	filename := ctx.GlobalString("base-policy")
+	if filename == "" {
+		return nil, nil
+	}
+
+	base, err := policy.LoadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read base image policy: %v", err)
+	}
+
+	return base, nil
+}
+
+// globalsFromContext returns the globals of a build from the flags. The
+// callers set the logger and context of each build, and change what differs
+// in their builds.
+func globalsFromContext(ctx *cli.Context, basePolicy *policy.Base) (*types.Global, error) {
+	steps, err := parseSteps(ctx.GlobalString("steps"))
+	if err != nil {
+		return nil, err
+	}
+
+	pullAlways, err := parsePull(ctx.GlobalString("pull"))
+	if err != nil {
+		return nil, err
+	}
+
+	allowInsecure, err := parseInsecure(ctx.GlobalStringSlice("allow-insecure-registry"))
+	if err != nil {
+		return nil, err
+	}
+
+	lowPriority, err := parsePriority(ctx.GlobalString("build-priority"))
+	if err != nil {
+		return nil, err
+	}
+
+	tty, color := ttyColor(ctx)
+
+	return &types.Global{
+		ShowRun:         showRun(ctx),
+		Color:           color,
+		TTY:             tty,
+		OmitFuncs:       ctx.GlobalStringSlice("omit"),
+		Cache:           getCache(ctx),
+		CacheTTL:        ctx.GlobalDuration("cache-ttl"),
+		CacheImage:      ctx.GlobalString("cache-image"),
+		NoCacheFrom:     ctx.GlobalInt("no-cache-from-step"),
+		Steps:           steps,
+		Checkpoint:      ctx.GlobalString("checkpoint"),
+		ResolveDigests:  ctx.GlobalBool("resolve-digests"),
+		AllowLocalExec:  ctx.GlobalBool("allow-local-exec"),
+		StrictVars:      ctx.GlobalBool("strict-vars"),
+		AllowPrivileged: ctx.GlobalBool("allow-privileged"),
+		AllowBind:       ctx.GlobalBool("allow-bind"),
+		Experimental:    ctx.GlobalBool("experimental"),
+		DaemonTimeout:   ctx.GlobalDuration("daemon-connect-timeout"),
+		Reproducible:    ctx.GlobalBool("reproducible"),
+		Mirrors:         ctx.GlobalStringSlice("registry-mirror"),
+		AllowInsecure:   allowInsecure,
+		PullAlways:      pullAlways,
+		BaseCacheTTL:    ctx.GlobalDuration("base-cache-ttl"),
+		Debug:           ctx.GlobalBool("debug"),
+		KeepContainers:  ctx.GlobalBool("keep-containers"),
+		PostCommitHook:  ctx.GlobalString("post-commit-hook"),
+		LowPriority:     lowPriority,
+		Profile:         ctx.GlobalBool("profile"),
+		Interactive:     ctx.GlobalBool("interactive"),
+		AssumeYes:       ctx.GlobalBool("yes"),
+		Concurrency:     ctx.GlobalInt("concurrency"),
+		BasePolicy:      basePolicy,
+		Version:         Version,
+	}, nil
+}
+
+// parseSteps parses the --steps range: `N-M`, `N-` for the steps from N
+// onwards, or `N` for a single step.
+func parseSteps(value string) (types.StepRange, error) {
+	var steps types.StepRange
+	if value == "" {
+		return steps, nil
+	}
+
+	parts := strings.SplitN(value, "-", 2)
+	if len(parts) == 1 {
+		parts = append(parts, parts[0])
+	}
+
+	first, err := strconv.Atoi(parts[0])
+	if err != nil || first < 1 {
+		return steps, fmt.Errorf("Invalid --steps %q: expected a range of steps such as 3-7", value)
+	}
+	steps.First = first
+
+	if parts[1] != "" {
+		last, err := strconv.Atoi(parts[1])
+		if err != nil || last < first {
+			return steps, fmt.Errorf("Invalid --steps %q: expected a range of steps such as 3-7", value)
+		}
+		steps.Last = last
+	}
+
+	return steps, nil
+}
+
+// parsePull parses the --pull policy, returning true if the images are always
+// pulled.
+func parsePull(value string) (bool, error) {
+	switch value {
+	case "", "missing":
+		return false, nil
+	case "always":
+		return true, nil
+	default:
+		return false, fmt.Errorf("Invalid --pull %q: expected missing or always", value)
+	}
+}
+
+// parseInsecure parses the registries of --allow-insecure-registry, which are
+// given as host[:port] like in the names of images.
+func parseInsecure(values []string) ([]string, error) {
+	for _, value := range values {
+		host, port := value, ""
+		if i := strings.LastIndex(value, ":"); i >= 0 {
+			host, port = value[:i], value[i+1:]
+			if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+				host = ""
+			}
+		}
+
+		if host == "" || strings.ContainsAny(host, "/:@ ") {
+			return nil, fmt.Errorf("Invalid --allow-insecure-registry %q: expected host[:port]", value)
+		}
+	}
+
+	return values, nil
+}
+
+// warnInsecure warns that the registries are used without TLS verification.
+func warnInsecure(log *logger.Logger, registries []string) {
+	if len(registries) > 0 {
+		log.Warning(fmt.Sprintf("Insecure registries allowed; %s are used without TLS verification", strings.Join(registries, ", ")))
+	}
+}
+
+// parsePriority parses the --build-priority, returning true if it is low.
+func parsePriority(value string) (bool, error) {
+	switch value {
+	case "", "normal":
+		return false, nil
+	case "low":
+		return true, nil
+	default:
+		return false, fmt.Errorf("Invalid --build-priority %q: expected normal or low", value)
+	}
+}
+
+// push pushes the tag and, if a sign command is set, runs it with the pushed
+// image's name@digest appended to its arguments.
+func push(b *builder.Builder, tag, sign string) error {
+	if tag == "" {
+		return errors.New("--push requires --tag")
+	}
+
+	log := b.Config().Globals.Logger
+
+	ref, err := b.Push(tag)
+	if err != nil {
+		return fmt.Errorf("Can't push %q: %v", tag, err)
+	}
+	log.Pushed(ref)
+
+	return signImage(log, ref, sign)
+}
+
+// signImage runs the sign command, if it is set, with the pushed image's
+// name@digest appended to its arguments.
+func signImage(log *logger.Logger, ref, sign string) error {
+	if sign == "" {
+		return nil
+	}
+
+	// the command is run by the shell so it may carry its own arguments;
+	// "$@" adds the reference as the last one.
+	cmd := exec.Command("/bin/sh", "-c", sign+` "$@"`, "sh", ref)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Signing %q with %q failed: %v", ref, sign, err)
+	}
+	log.Signed(ref)
+
+	return nil
+}
+
+// tagData is what a --tag template is rendered with.
+type tagData struct {
+	Var  map[string]string // the variables passed to the plan
+	Git  tagGit
+	Date string // the date of the build in UTC, as 20060102, or of SOURCE_DATE_EPOCH with --reproducible
+}
+
+// tagGit gives the commit checked out in the build context. It is only looked
+// up if the template uses it.
+type tagGit struct{}
+
+// SHA returns the commit checked out in the build context.
+func (tagGit) SHA() (string, error) {
+	out, err := exec.Command("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "", errors.New("the build context is not a git checkout")
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// ShortSHA returns the abbreviated commit checked out in the build context.
+func (g tagGit) ShortSHA() (string, error) {
+	sha, err := g.SHA()
+	if len(sha) > 7 {
+		sha = sha[:7]
+	}
+
+	return sha, err
+}
+
+// renderTag renders the --tag as a template, such as
+// `myorg/app:{{.Var.VERSION}}-{{.Git.ShortSHA}}`. Undefined variables and
+// fields are errors.
+func renderTag(ctx *cli.Context, vars map[string]string) (string, error) {
+	tag := ctx.String("tag")
+	if !strings.Contains(tag, "{{") {
+		return tag, nil
+	}
+
+	tmpl, err := template.New("tag").Option("missingkey=error").Parse(tag)
+	if err != nil {
+		return "", fmt.Errorf("Invalid --tag template %q: %v", tag, err)
+	}
+
+	date := time.Now().UTC()
+	if ctx.GlobalBool("reproducible") {
+		date = util.SourceDate()
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, tagData{Var: vars, Date: date.Format("20060102")}); err != nil {
+		return "", fmt.Errorf("Can't render --tag template %q: %v", tag, err)
+	}
+
+	return buf.String(), nil
+}
+
+// parsePlatforms parses the comma-separated platforms of --platform, which are
+// given as linux/arch[/variant] like in manifest lists.
+func parsePlatforms(value string) ([]types.Platform, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	platforms := []types.Platform{}
+	seen := map[types.Platform]bool{}
+
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.Split(strings.TrimSpace(item), "/")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] != "linux" || parts[1] == "" || (len(parts) == 3 && parts[2] == "") {
+			return nil, fmt.Errorf("Invalid --platform %q: expected linux/arch or linux/arch/variant", item)
+		}
+
+		platform := types.Platform{Architecture: parts[1]}
+		if len(parts) == 3 {
+			platform.Variant = parts[2]
+		}
+
+		if seen[platform] {
+			return nil, fmt.Errorf("Invalid --platform %q: %s is given more than once", value, platform)
+		}
+		seen[platform] = true
+
+		platforms = append(platforms, platform)
+	}
+
+	return platforms, nil
+}
+
+// checkPlatforms checks the options of a --platform build, which pushes a
+// manifest list rather than leaving one image to tag, export or attach to.
+func checkPlatforms(ctx *cli.Context, globals *types.Global, tag, filename string) error {
+	if tag == "" || !ctx.Bool("push") {
+		return errors.New("--platform requires --tag and --push, as the multi-platform image only exists in the registry")
+	}
+
+	for _, flag := range []string{"output", "sbom", "attach", "cache-image-push", "format"} {
+		if ctx.IsSet(flag) {
+			return fmt.Errorf("--%s cannot be used with --platform, as it applies to a single image", flag)
+		}
+	}
+
+	// each platform is built by a plan of its own.
+	if globals.Checkpoint != "" {
+		return errors.New("--checkpoint cannot be used with --platform")
+	}
+
+	if filename == stdinFile {
+		return errors.New("--platform cannot build a plan from standard input, as the plan is read once per platform")
+	}
+
+	return nil
+}
+
+// buildPlatforms builds the plan once for each platform, where `from` uses the
+// registry images' entries for it, then pushes each image with the platform
+// appended to the tag and the manifest list of them as the tag. It returns the
+// list as `name@digest`. Nothing is pushed unless all of the builds succeed,
+// and the list only once all of its images are, so a failure never leaves a
+// list missing platforms.
+func buildPlatforms(ctx *cli.Context, cancel context.CancelFunc, buildConfig builder.BuildConfig, planName string, platforms []types.Platform, tag string) (string, error) {
+	notrim, width := ctx.GlobalBool("no-trim"), ctx.GlobalInt("trim-width")
+	base := buildConfig.Globals
+	builders := []*builder.Builder{}
+
+	// the builders are closed before returning, so the on_exit blocks of all
+	// of them run.
+	defer func() {
+		for _, b := range builders {
+			b.Close()
+		}
+	}()
+
+	for _, platform := range platforms {
+		globals := *base
+		globals.Platform = platform
+		globals.Logger = logger.New(fmt.Sprintf("%s (%s)", planName, platform), notrim, width)
+
+		config := buildConfig
+		config.Globals = &globals
+		config.Runner = make(chan struct{})
+
+		b, err := mkBuilder(cancel, config)
+		if err != nil {
+			return "", err
+		}
+		builders = append(builders, b)
+
+		if result := b.Run(); result.Err != nil {
+			return "", fmt.Errorf("Can't build for %s: %v", platform, result.Err)
+		}
+	}
+
+	images := []fetcher.PlatformImage{}
+
+	for i, b := range builders {
+		log := b.Config().Globals.Logger
+
+		platformTag, err := fetcher.PlatformTag(tag, platforms[i])
+		if err != nil {
+			return "", err
+		}
+
+		if err := b.Tag(platformTag); err != nil {
+			return "", fmt.Errorf("Can't tag with tag %q: %v", platformTag, err)
+		}
+		log.Tag(platformTag)
+
+		ref, err := b.Push(platformTag)
+		if err != nil {
+			return "", fmt.Errorf("Can't push %q: %v", platformTag, err)
+		}
+		log.Pushed(ref)
+
+		images = append(images, fetcher.PlatformImage{Ref: ref, Platform: platforms[i]})
+	}
+
+	ref, err := fetcher.PushManifestList(base.Context, base, tag, images)
+	if err != nil {
+		return "", err
+	}
+	base.Logger.Pushed(ref)
+
+	return ref, signImage(base.Logger, ref, ctx.String("sign"))
+}
+
+// pushCache pushes the final image as the cache image.
+func pushCache(b *builder.Builder, name string) error {
+	if name == "" {
+		return errors.New("--cache-image-push requires --cache-image")
+	}
+
+	ref, err := b.PushCache(name)
+	if err != nil {
+		return fmt.Errorf("Can't push cache image %q: %v", name, err)
+	}
+	b.Config().Globals.Logger.Pushed(ref)
+
+	return nil
+}
+
+// saveOutput exports the image according to an --output specification.
+func saveOutput(b *builder.Builder, output, tag string) error {
+	opts := map[string]string{}
+
+	for _, opt := range strings.Split(output, ",") {
+		parts := strings.SplitN(opt, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid --output option %q; must be key=value", opt)
+		}
+		opts[parts[0]] = parts[1]
+	}
+
+	dest := opts["dest"]
+	if dest == "" {
+		return fmt.Errorf("--output %q requires a dest", output)
+	}
+
+	var kind string
+
+	switch opts["type"] {
+	case "docker":
+		kind = "docker"
+	case "oci":
+		kind = "oci-layout"
+		if tag == "" {
+			tag = filepath.Base(dest)
+		}
+	case "local":
+		src := opts["src"]
+		if src == "" {
+			src = "/"
+		}
+		return b.Export(src, dest)
+	default:
+		return fmt.Errorf("invalid --output type %q; must be docker, oci or local", opts["type"])
+	}
+
+	return b.Save(dest, kind, tag)
+}
+
+// setDisplay configures the colors and units of the output.
+func setDisplay(ctx *cli.Context) error {
+	logger.SetSI(ctx.GlobalBool("si"))
+
+	if logger.NoColorEnv() {
+		color.NoColor = true
+	}
+
+	palette, err := logger.Theme(ctx.GlobalString("theme"))
+	if err != nil {
+		return err
+	}
+
+	logger.SetPalette(palette)
+
+	if err := logger.SetFinishFormat(ctx.GlobalString("format")); err != nil {
+		return fmt.Errorf("Invalid --format template: %v", err)
+	}
+
+	return nil
+}
+
+// setLogSinks sets up the copies of the build output given by --progress-log,
+// --log-file and --syslog, and --quiet.
+func setLogSinks(ctx *cli.Context) error {
+	if fn := ctx.GlobalString("progress-log"); fn != "" {
+		f, err := os.Create(fn)
+		if err != nil {
+			return fmt.Errorf("Could not open progress log %q: %v", fn, err)
+		}
+
+		logger.SetTee(f)
+	}
+
+	if fn := ctx.GlobalString("log-file"); fn != "" {
+		f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("Could not open log file %q: %v", fn, err)
+		}
+
+		logger.AddSink(f)
+	}
+
+	if ctx.GlobalBool("syslog") {
+		w, err := logger.NewSyslog("box")
+		if err != nil {
+			return fmt.Errorf("Could not connect to syslog: %v", err)
+		}
+
+		logger.AddSink(w)
+	}
+
+	logger.SetQuiet(ctx.GlobalBool("quiet"))
+	return nil
+}
+
+// ttyColor returns true for each of the TTY features and colors if they are
+// used in this run: if the output is a terminal and --ci is not in effect,
+// unless --no-tty, --force-tty, --no-color, --force-color or NO_COLOR say
+// otherwise.
+func ttyColor(ctx *cli.Context) (bool, bool) {
+	tty := term.IsTerminal(1) && !inCI(ctx)
+
+	if ctx.GlobalBool("no-tty") {
+		tty = false
+	}
+
+	if ctx.GlobalBool("force-tty") {
+		tty = true
+	}
+
+	color := tty
+
+	if ctx.GlobalBool("no-color") {
+		color = false
+	}
+
+	if ctx.GlobalBool("force-color") {
+		color = true
+	}
+
+	if logger.NoColorEnv() {
+		color = false
+	}
+
+	return tty, color
+}
+
+// showRun returns true if the output of run statements is printed as they
+// run. With --quiet, or --ci unless --show-run is given, it is only printed if
+// they fail.
+func showRun(ctx *cli.Context) bool {
+	if ctx.GlobalBool("quiet") {
+		return false
+	}
+
+	if ctx.GlobalIsSet("show-run") {
+		return ctx.GlobalBool("show-run")
+	}
+
+	return !inCI(ctx)
+}
+
+// inCI returns true if box should build as suited to CI: if --ci is given, or
+// it is not given and the CI variable is set in the environment, as most CI
+// services do.
+func inCI(ctx *cli.Context) bool {
+	if ctx.GlobalIsSet("ci") {
+		return ctx.GlobalBool("ci")
+	}
+
+	value := os.Getenv("CI")
+	return value != "" && value != "false" && value != "0"
+}
+
+func getCache(ctx *cli.Context) bool {
+	cache := os.Getenv("NO_CACHE") == ""
+	if ctx.GlobalBool("no-cache") {
+		cache = false
+	}
+
+	return cache
+}
+
+// replFlags are the flags of the repl and shell commands.
+var replFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "vi",
+		Usage: "Edit lines with vi keys; BOX_REPL_MODE=vi does the same",
+	},
+}
+
+func runRepl(ctx *cli.Context) {
+	log := logger.New("repl", ctx.GlobalBool("no-trim"), ctx.GlobalInt("trim-width"))
+
+	if err := setDisplay(ctx); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	config, err := repl.LoadConfig(repl.ConfigFile())
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if ctx.Bool("vi") {
+		config.ViMode = true
+	}
+
+	config.Experimental = ctx.GlobalBool("experimental")
+
+	vars, err := parseVars(ctx, "")
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	r, err := repl.NewRepl(ctx.GlobalStringSlice("omit"), log, vars, Version, config)
+	if err != nil {
+		log.Error(fmt.Sprintf("bootstrapping repl: %v\n", err))
+		os.Exit(1)
+	}
+
+	r.Loop() // the REPL manages its own exit states
+}
+
+func mkBuilder(cancel context.CancelFunc, buildConfig builder.BuildConfig) (*builder.Builder, error) {
+	b, err := builder.NewBuilder(buildConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	signal.Handler.AddFunc(cancel)
+	signal.Handler.AddRunner(buildConfig.Runner)
+	return b, nil
+}
+
+// detectFile returns the plan to build. If no plan is given and there is no
+// box.rb, the usage is shown; without a terminal, such as in CI, that is an
+// error, as the plan is only read from standard input if `-` is given.
+func detectFile(ctx *cli.Context) (string, error) {
+	a := ctx.Args()
+	if len(a) < 1 {
+		if _, err := os.Stat(defaultFile); os.IsNotExist(err) {
+			cli.ShowAppHelp(ctx)
+			if !term.IsTerminal(0) {
+				return "", errors.New("No plan was given and there is no box.rb in the current directory; give - to read the plan from standard input")
+			}
+
+			os.Exit(0)
+		}
+		return defaultFile, nil
+	}
+	return a[0], nil
+}
+
+// chdirContext changes to the directory supplied with --build-context, if
+// any, keeping the plan filename valid.
+func chdirContext(ctx *cli.Context, filename *string) error {
+	dir := ctx.GlobalString("build-context")
+	if dir == "" {
+		return nil
+	}
+
+	if *filename != stdinFile {
+		abs, err := filepath.Abs(*filename)
+		if err != nil {
+			return err
+		}
+		*filename = abs
+	}
+
+	if err := os.Chdir(dir); err != nil {
+		return fmt.Errorf("Could not use build context %q: %v", dir, err)
+	}
+
+	return nil
+}
+
+// cloneContext clones the repository supplied with --context-from-git, in the
+// form URL#ref:subdir where the ref and subdir are optional, and changes to
+// the checkout. The plan is box.rb, or the plan argument, inside it. The
+// returned function removes the checkout.
+func cloneContext(ctx *cli.Context) (string, func(), error) {
+	if ctx.GlobalString("build-context") != "" {
+		return "", nil, errors.New("--context-from-git cannot be combined with --build-context")
+	}
+
+	var ref, subdir string
+
+	parts := strings.SplitN(ctx.GlobalString("context-from-git"), "#", 2)
+	url := parts[0]
+	if len(parts) == 2 {
+		fragment := strings.SplitN(parts[1], ":", 2)
+		ref = fragment[0]
+		if len(fragment) == 2 {
+			subdir = fragment[1]
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "box-git-")
+	if err != nil {
+		return "", nil, err
+	}
+
+	signal.Handler.AddFile(dir)
+	cleanup := func() {
+		os.RemoveAll(dir)
+		signal.Handler.RemoveFile(dir)
+	}
+
+	commands := [][]string{{"clone", "--quiet", "--recurse-submodules", url, dir}}
+	if ref != "" {
+		commands = append(commands,
+			[]string{"checkout", "--quiet", ref},
+			[]string{"submodule", "update", "--quiet", "--init", "--recursive"},
+		)
+	}
+
+	for _, args := range commands {
+		// credentials for ssh and https come from the environment, like
+		// SSH_AUTH_SOCK or git's credential helpers.
+		cmd := exec.Command("git", args...)
+		if args[0] != "clone" {
+			cmd.Dir = dir
+		}
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("Could not check out %q: git %s: %v", ctx.GlobalString("context-from-git"), args[0], err)
+		}
+	}
+
+	contextDir := filepath.Join(dir, filepath.Clean("/"+subdir))
+	if fi, err := os.Stat(contextDir); err != nil || !fi.IsDir() {
+		cleanup()
+		return "", nil, fmt.Errorf("Could not use build context: %q is not a directory in the repository", subdir)
+	}
+
+	filename := defaultFile
+	if len(ctx.Args()) > 0 {
+		filename = ctx.Args()[0]
+	}
+
+	if filename != stdinFile && !filepath.IsAbs(filename) {
+		filename = filepath.Join(contextDir, filename)
+	}
+
+	if err := os.Chdir(contextDir); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("Could not use build context %q: %v", contextDir, err)
+	}
+
+	return filename, cleanup, nil
+}
+
+// parseVars returns the variables for the plan. Variables may be scoped to a
+// plan as `plan.rb:key=value`, which override unscoped ones of the same name.
+func parseVars(ctx *cli.Context, plan string) (map[string]string, error) {
+	vars := map[string]string{}
+	scoped := map[string]string{}
+
+	for _, v := range ctx.GlobalStringSlice("var") {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid --var %q: expected name=value", v)
+		}
+		parts[1] = expandEnv(parts[1])
+
+		if i := strings.LastIndex(parts[0], ":"); i >= 0 {
+			if matchPlan(parts[0][:i], plan) {
+				scoped[parts[0][i+1:]] = parts[1]
+			}
+			continue
+		}
+
+		vars[parts[0]] = parts[1]
+	}
+
+	for key, value := range scoped {
+		vars[key] = value
+	}
+
+	return vars, nil
+}
+
+// expandEnv replaces a reference to an environment variable, `$NAME` or
+// `${NAME}`, at the start of the value of a variable. Unset variables are
+// empty, as in the shell. A leading `\$` is a literal dollar sign; dollar
+// signs anywhere else are left as they are.
+func expandEnv(value string) string {
+	switch {
+	case strings.HasPrefix(value, `\$`):
+		return value[1:]
+	case strings.HasPrefix(value, "${"):
+		end := strings.Index(value, "}")
+		if end < 0 {
+			return value
+		}
+
+		return os.Getenv(value[2:end]) + value[end+1:]
+	case strings.HasPrefix(value, "$"):
+		n := 1
+		for n < len(value) && isNameByte(value[n], n == 1) {
+			n++
+		}
+
+		if n == 1 {
+			return value
+		}
+
+		return os.Getenv(value[1:n]) + value[n:]
+	}
+
+	return value
+}
+
+func isNameByte(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+// matchPlan returns true if the scope of a variable names the plan, either by
+// the path it was given as or by its file name.
+func matchPlan(scope, plan string) bool {
+	if plan == "" {
+		return false
+	}
+
+	scope = filepath.Clean(scope)
+	plan = filepath.Clean(plan)
 
-	return vars
+	return scope == plan || (!strings.Contains(scope, string(filepath.Separator)) && scope == filepath.Base(plan))
 }
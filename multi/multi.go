@@ -1,7 +1,10 @@
 package multi
 
 import (
+	"context"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/box-builder/box/builder"
 	"github.com/box-builder/box/logger"
@@ -12,6 +15,9 @@ import (
 // builders.
 type Builder struct {
 	builders []*builder.Builder
+	cancel   context.CancelFunc
+	start    time.Time
+	results  []logger.PlanResult
 }
 
 // NewBuilder contypes a *Builder.
@@ -19,38 +25,106 @@ func NewBuilder(builders []*builder.Builder) *Builder {
 	return &Builder{builders: builders}
 }
 
-// Build builds all the builders in parallel.
+// FailFast makes Wait call cancel when the first build fails, which is expected
+// to cancel the remaining builds. Without it, the other builds run to
+// completion.
+func (b *Builder) FailFast(cancel context.CancelFunc) {
+	b.cancel = cancel
+}
+
+// Build builds all the builders in parallel. The names each plan tags are
+// recorded first, so that a plan using another's tag in `from` waits for it.
 func (b *Builder) Build() {
+	b.start = time.Now()
+
+	for _, br := range b.builders {
+		br.ExpectTags()
+	}
+
 	for _, br := range b.builders {
 		go br.Run()
 	}
 }
 
-// Wait waits for all builds to complete.
+// Wait waits for all builds to complete, then logs a table of the results of
+// the plans, which Results returns afterwards. It returns an error if any of
+// them failed.
 func (b *Builder) Wait() error {
-	log := logger.New("multi", false)
+	log := logger.New("multi", false, 0)
 
-	resChan := make(chan types.BuildResult, len(b.builders))
+	type finished struct {
+		index   int
+		res     types.BuildResult
+		elapsed time.Duration
+	}
 
-	for _, br := range b.builders {
-		go func(br *builder.Builder) {
-			resChan <- br.Wait()
-		}(br)
+	resChan := make(chan finished, len(b.builders))
+
+	for i, br := range b.builders {
+		go func(i int, br *builder.Builder) {
+			res := br.Wait()
+			resChan <- finished{index: i, res: res, elapsed: time.Since(b.start)}
+		}(i, br)
 	}
 
 	var errored bool
+	b.results = make([]logger.PlanResult, len(b.builders))
 
 	for i := 0; i < len(b.builders); i++ {
-		res := <-resChan
+		f := <-resChan
+		res := f.res
+		// the time is from the start of the multi build until the plan
+		// finished.
+		result := logger.PlanResult{Plan: b.builders[f.index].Config().FileName, Elapsed: f.elapsed, Err: res.Err}
+		result.Skipped = res.Err != nil && b.builders[f.index].FailedTag() != ""
+
+		// a plan that succeeded without making an image has no size.
+		if res.Err == nil {
+			result.ID = res.Value
+			if parts := strings.SplitN(res.Value, ":", 2); len(parts) == 2 {
+				result.ID = parts[1]
+			}
+
+			if size, _, err := b.builders[f.index].ImageInfo(); err == nil {
+				result.Size = size
+			}
+		}
+		b.results[f.index] = result
+
+		if result.Skipped {
+			log.Warning(fmt.Sprintf("%s: skipped, as the plan tagging %q failed", res.FileName, b.builders[f.index].FailedTag()))
+		} else if res.Err != nil {
+			log.Error(fmt.Sprintf("%s: error occurred during plan execution: %v", res.FileName, res.Err))
+		}
+
 		if res.Err != nil {
+			if !errored && b.cancel != nil {
+				log.Warning("canceling the remaining builds")
+				b.cancel()
+			}
+
 			errored = true
-			log.Error(fmt.Sprintf("%s: error occurred during plan execution: %v", res.FileName, res.Err))
 		}
 	}
 
+	log.PlanResults(b.results)
+
 	if errored {
 		return fmt.Errorf("some builds contained errors")
 	}
 
 	return nil
 }
+
+// Results returns the result of each plan, in the order the builders were
+// given to NewBuilder. It is empty until Wait returns.
+func (b *Builder) Results() []logger.PlanResult {
+	return append([]logger.PlanResult{}, b.results...)
+}
+
+// Close closes all the builders, running the on_exit blocks of their plans.
+func (b *Builder) Close() {
+	for _, br := range b.builders {
+		br.Close()
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"strings"
 	. "testing"
+	"time"
 
 	"github.com/box-builder/box/builder"
 	"github.com/box-builder/box/builder/command"
@@ -97,6 +98,7 @@ func (ms *multiSuite) SetUpSuite(c *C) {
 func (ms *multiSuite) SetUpTest(c *C) {
 	os.Setenv("NO_CACHE", "1")
 	command.ResetPulls()
+	command.ResetTags()
 }
 
 func mkPlanDir(dir string, i int) string {
@@ -119,19 +121,23 @@ func mkPlans(plans map[int]string) string {
 }
 
 func mkBuilders(plans map[int]string) []*builder.Builder {
+	return mkBuildersContext(context.Background(), plans)
+}
+
+func mkBuildersContext(ctx context.Context, plans map[int]string) []*builder.Builder {
 	dir := mkPlans(plans)
 
 	builders := []*builder.Builder{}
 
 	for i := range plans {
-		l := logger.New("", false)
+		l := logger.New("", false, 0)
 		l.Record()
 
 		b, err := builder.NewBuilder(builder.BuildConfig{
 			Globals: &btypes.Global{
 				Logger:  l,
 				Cache:   os.Getenv("NO_CACHE") == "",
-				Context: context.Background(),
+				Context: ctx,
 			},
 			Runner:   make(chan struct{}),
 			FileName: mkPlanDir(dir, i),
@@ -148,9 +154,20 @@ func mkBuilders(plans map[int]string) []*builder.Builder {
 }
 
 func (ms *multiSuite) TestBuilderBasic(c *C) {
-	mb := NewBuilder(mkBuilders(SuccessPlans))
+	builders := mkBuilders(SuccessPlans)
+	mb := NewBuilder(builders)
 	mb.Build()
 	c.Assert(mb.Wait(), IsNil)
+
+	results := mb.Results()
+	c.Assert(len(results), Equals, len(SuccessPlans))
+	for i, result := range results {
+		c.Assert(result.Plan, Equals, builders[i].Config().FileName)
+		c.Assert(result.Err, IsNil)
+		c.Assert(result.ID, Not(Equals), "")
+		c.Assert(result.Size > 0, Equals, true)
+	}
+
 	images, err := dockerClient.ImageList(context.Background(), types.ImageListOptions{})
 	c.Assert(err, IsNil)
 
@@ -176,6 +193,10 @@ func (ms *multiSuite) TestBuilderBasic(c *C) {
 	mb = NewBuilder(mkBuilders(FailPlans))
 	mb.Build()
 	c.Assert(mb.Wait(), NotNil)
+	for _, result := range mb.Results() {
+		c.Assert(result.Err, NotNil)
+		c.Assert(result.ID, Equals, "")
+	}
 	images, err = dockerClient.ImageList(context.Background(), types.ImageListOptions{})
 	c.Assert(err, IsNil)
 
@@ -199,6 +220,32 @@ func (ms *multiSuite) TestBuilderBasic(c *C) {
 	c.Assert(len(filtered), Equals, 0)
 }
 
+func (ms *multiSuite) TestMultiFailFast(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mb := NewBuilder(mkBuildersContext(ctx, map[int]string{
+		1: `
+		from "debian"
+		run "exit 1"
+		`,
+		2: `
+		from "debian"
+		run "sleep 120"
+		`,
+	}))
+	mb.FailFast(cancel)
+
+	start := time.Now()
+	mb.Build()
+	c.Assert(mb.Wait(), NotNil)
+	c.Assert(time.Since(start) < time.Minute, Equals, true)
+
+	for _, b := range mb.builders {
+		c.Assert(b.Result().Err, NotNil)
+	}
+}
+
 func (ms *multiSuite) TestMultiFrom(c *C) {
 	imageName := "alpine:latest"
 
@@ -228,3 +275,84 @@ func (ms *multiSuite) TestMultiFrom(c *C) {
 
 	c.Assert(found, Equals, true)
 }
+
+func (ms *multiSuite) TestMultiLocalTag(c *C) {
+	defer dockerClient.ImageRemove(context.Background(), "box-multi-tag-test:base", types.ImageRemoveOptions{Force: true})
+
+	// the base is slow, so the other plan reaches its from first, and waits.
+	mb := NewBuilder(mkBuilders(map[int]string{
+		1: `
+		from "debian"
+		run "sleep 2 && echo base >/base"
+		tag "box-multi-tag-test:base"
+		`,
+		2: `
+		from "box-multi-tag-test:base"
+		run "test -f /base"
+		`,
+	}))
+	mb.Build()
+	c.Assert(mb.Wait(), IsNil)
+
+	// the plans using the tag of a failed plan are skipped.
+	mb = NewBuilder(mkBuilders(map[int]string{
+		1: `
+		from "debian"
+		run "exit 1"
+		tag "box-multi-tag-test:failed"
+		`,
+		2: `
+		from "box-multi-tag-test:failed"
+		run "true"
+		`,
+	}))
+	mb.Build()
+	c.Assert(mb.Wait(), NotNil)
+
+	for _, result := range mb.Results() {
+		c.Assert(result.Err, NotNil)
+		c.Assert(result.Skipped, Equals, strings.HasSuffix(result.Plan, "2.rb"), Commentf("%s", result.Plan))
+	}
+
+	// plans waiting for each other fail.
+	mb = NewBuilder(mkBuilders(map[int]string{
+		1: `
+		from "box-multi-tag-test:b"
+		tag "box-multi-tag-test:a"
+		`,
+		2: `
+		from "box-multi-tag-test:a"
+		tag "box-multi-tag-test:b"
+		`,
+	}))
+
+	start := time.Now()
+	mb.Build()
+	c.Assert(mb.Wait(), NotNil)
+	c.Assert(time.Since(start) < time.Minute, Equals, true)
+}
+
+func (ms *multiSuite) TestMultiSharedCache(c *C) {
+	os.Setenv("NO_CACHE", "")
+	defer os.Setenv("NO_CACHE", "1")
+
+	builders := map[int]string{}
+
+	for i := 0; i < 5; i++ {
+		builders[i] = `
+		from "debian"
+		run "date +%s%N > /stamp"
+		`
+	}
+
+	mb := NewBuilder(mkBuilders(builders))
+	mb.Build()
+	c.Assert(mb.Wait(), IsNil)
+
+	id := mb.builders[0].Result().Value
+	c.Assert(id, Not(Equals), "")
+
+	for _, b := range mb.builders {
+		c.Assert(b.Result().Value, Equals, id)
+	}
+}
@@ -0,0 +1,144 @@
+// Package plandiff compares the steps and resulting image configs of two
+// plans.
+package plandiff
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/box-builder/box/builder/config"
+	"github.com/box-builder/box/types"
+)
+
+// Line is a line of a diff. Op is ' ' for a line both plans have, '-' for one
+// only the first has and '+' for one only the second has.
+type Line struct {
+	Op   byte
+	Text string
+}
+
+func (l Line) String() string {
+	return string(l.Op) + l.Text
+}
+
+// Changed returns true if any of the lines differ between the plans.
+func Changed(lines []Line) bool {
+	for _, line := range lines {
+		if line.Op != ' ' {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Steps returns the steps of both plans, one per line, with the steps
+// removed or added by the second marked.
+func Steps(a, b []types.PlannedStep) []Line {
+	return lines(stepLines(a), stepLines(b))
+}
+
+func stepLines(steps []types.PlannedStep) []string {
+	result := []string{}
+	for _, step := range steps {
+		result = append(result, strings.TrimSpace(step.Verb+" "+strings.Join(step.Args, ", ")))
+	}
+
+	return result
+}
+
+// Configs returns the settings of the image configs which differ, with the
+// value in the first config removed and the one in the second added. Each
+// variable of the environment and each label is a setting of its own.
+func Configs(a, b *config.Config) []Line {
+	result := []Line{}
+	for _, field := range []struct {
+		name string
+		get  func(*config.Config) []string
+	}{
+		{"user", func(c *config.Config) []string { return []string{c.User.Image} }},
+		{"workdir", func(c *config.Config) []string { return []string{c.WorkDir.Image} }},
+		{"entrypoint", func(c *config.Config) []string { return []string{quote(c.Entrypoint.Image)} }},
+		{"cmd", func(c *config.Config) []string { return []string{quote(c.Cmd.Image)} }},
+		{"shell", func(c *config.Config) []string { return []string{quote(c.Shell)} }},
+		{"env", func(c *config.Config) []string { return sorted(c.Env) }},
+		{"label", labels},
+		{"volume", func(c *config.Config) []string { return sorted(c.Volumes) }},
+	} {
+		for _, line := range lines(field.get(a), field.get(b)) {
+			if line.Op != ' ' {
+				result = append(result, Line{line.Op, field.name + " " + line.Text})
+			}
+		}
+	}
+
+	return result
+}
+
+func quote(value []string) string {
+	if value == nil {
+		value = []string{}
+	}
+
+	content, _ := json.Marshal(value)
+	return string(content)
+}
+
+func sorted(values []string) []string {
+	result := append([]string{}, values...)
+	sort.Strings(result)
+	return result
+}
+
+func labels(c *config.Config) []string {
+	result := []string{}
+	for key, value := range c.Labels {
+		result = append(result, key+"="+value)
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+// lines diffs a and b by their longest common subsequence, listing the lines
+// only a has before those only b has where they differ.
+func lines(a, b []string) []Line {
+	// common[i][j] is the length of the longest subsequence common to a[i:]
+	// and b[j:].
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+
+	result := []Line{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			result = append(result, Line{' ', a[i]})
+			i++
+			j++
+		case j == len(b) || (i < len(a) && common[i+1][j] >= common[i][j+1]):
+			result = append(result, Line{'-', a[i]})
+			i++
+		default:
+			result = append(result, Line{'+', b[j]})
+			j++
+		}
+	}
+
+	return result
+}
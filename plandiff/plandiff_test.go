@@ -0,0 +1,94 @@
+package plandiff
+
+import (
+	"strings"
+	. "testing"
+
+	"github.com/box-builder/box/builder/config"
+	"github.com/box-builder/box/types"
+	. "gopkg.in/check.v1"
+)
+
+type plandiffSuite struct{}
+
+var _ = Suite(&plandiffSuite{})
+
+func TestPlandiff(t *T) {
+	TestingT(t)
+}
+
+func steps(lines ...string) []types.PlannedStep {
+	result := []types.PlannedStep{}
+	for i, line := range lines {
+		parts := strings.SplitN(line, " ", 2)
+		result = append(result, types.PlannedStep{Step: i + 1, Verb: parts[0], Args: []string{parts[1]}})
+	}
+
+	return result
+}
+
+func strs(lines []Line) []string {
+	result := []string{}
+	for _, line := range lines {
+		result = append(result, line.String())
+	}
+
+	return result
+}
+
+func (ps *plandiffSuite) TestSteps(c *C) {
+	a := steps("from debian", "run a", "run b", "env A=1")
+	b := steps("from debian", "run b", "run c", "env A=1")
+
+	lines := Steps(a, b)
+	c.Assert(Changed(lines), Equals, true)
+	c.Assert(strs(lines), DeepEquals, []string{
+		" from debian",
+		"-run a",
+		" run b",
+		"+run c",
+		" env A=1",
+	})
+
+	lines = Steps(a, a)
+	c.Assert(Changed(lines), Equals, false)
+	c.Assert(lines, HasLen, 4)
+
+	c.Assert(strs(Steps(nil, steps("from debian"))), DeepEquals, []string{"+from debian"})
+	c.Assert(strs(Steps(steps("from debian"), nil)), DeepEquals, []string{"-from debian"})
+}
+
+func (ps *plandiffSuite) TestConfigs(c *C) {
+	a := config.NewConfig()
+	a.Env = []string{"B=2", "A=1"}
+	a.Labels["x"] = "1"
+	a.Cmd.Image = []string{"bash"}
+
+	b := config.NewConfig()
+	b.User.Image = "app"
+	b.Env = []string{"A=1", "B=3"}
+	b.Labels["x"] = "1"
+	b.Labels["y"] = "2"
+	b.Cmd.Image = []string{"bash"}
+
+	c.Assert(strs(Configs(a, b)), DeepEquals, []string{
+		"-user root",
+		"+user app",
+		"-env B=2",
+		"+env B=3",
+		"+label y=2",
+	})
+
+	c.Assert(Configs(a, a), HasLen, 0)
+
+	b = config.NewConfig()
+	b.Env = a.Env
+	b.Labels = a.Labels
+	b.Entrypoint.Image = []string{"/bin/sh", "-c"}
+	c.Assert(strs(Configs(a, b)), DeepEquals, []string{
+		`-entrypoint []`,
+		`+entrypoint ["/bin/sh","-c"]`,
+		`-cmd ["bash"]`,
+		`+cmd []`,
+	})
+}
@@ -0,0 +1,114 @@
+// Package policy restricts the base images plans may use.
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/box-builder/box/util"
+	"github.com/docker/distribution/reference"
+)
+
+// Base is an allowlist and denylist of base images. Rules are repositories
+// with their registry but without a tag, such as `docker.io/library/debian`,
+// or registries and namespaces such as `registry.example.com/team`, which
+// also match everything below them. `*` matches within a path component.
+type Base struct {
+	Source string // where the rules came from, for reporting
+	Allow  []string
+	Deny   []string
+}
+
+// LoadFile reads a policy file. Each line is `allow RULE` or `deny RULE`;
+// empty lines and lines starting with `#` are ignored.
+func LoadFile(filename string) (*Base, error) {
+	lines, err := util.ReadLines(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	base := &Base{Source: fmt.Sprintf("policy file %q", filename)}
+
+	for n, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected `allow RULE` or `deny RULE`", filename, n+1)
+		}
+
+		switch fields[0] {
+		case "allow":
+			base.Allow = append(base.Allow, fields[1])
+		case "deny":
+			base.Deny = append(base.Deny, fields[1])
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown action %q, expected allow or deny", filename, n+1, fields[0])
+		}
+	}
+
+	return base, nil
+}
+
+// Check returns an error naming the image if the policy forbids it. The names
+// are the repositories the image is known by, such as the one given to `from`
+// and those of its registry digests; ref is the reference reported. Denied
+// names fail the check. If there is an allowlist, one of the names must be on
+// it.
+func (b *Base) Check(ref string, names []string) error {
+	for _, name := range names {
+		if rule, ok := matchAny(b.Deny, name); ok {
+			return fmt.Errorf("base image %s is denied by rule %q of the %s", ref, rule, b.Source)
+		}
+	}
+
+	if len(b.Allow) == 0 {
+		return nil
+	}
+
+	for _, name := range names {
+		if _, ok := matchAny(b.Allow, name); ok {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("base image %s is not allowed by the %s", ref, b.Source)
+}
+
+// Names returns the repository of the image reference, with its registry, to
+// be checked. References which are not names, such as image IDs, yield none.
+func Names(image string) []string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil
+	}
+
+	return []string{named.Name()}
+}
+
+func matchAny(rules []string, name string) (string, bool) {
+	for _, rule := range rules {
+		if match(rule, name) {
+			return rule, true
+		}
+	}
+
+	return "", false
+}
+
+// match returns true if the rule matches the name or one of its parents.
+func match(rule, name string) bool {
+	rule = strings.TrimSuffix(rule, "/")
+
+	for ; name != "." && name != ""; name = path.Dir(name) {
+		if ok, err := path.Match(rule, name); err == nil && ok {
+			return true
+		}
+	}
+
+	return false
+}
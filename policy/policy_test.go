@@ -0,0 +1,65 @@
+package policy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	. "testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type policySuite struct{}
+
+var _ = Suite(&policySuite{})
+
+func TestPolicy(t *T) {
+	TestingT(t)
+}
+
+func (ps *policySuite) TestLoadFile(c *C) {
+	dir, err := ioutil.TempDir("", "box-policy")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "policy")
+	content := "# base images\nallow docker.io/library/*\n\nallow registry.example.com\ndeny docker.io/library/centos\n"
+	c.Assert(ioutil.WriteFile(fn, []byte(content), 0600), IsNil)
+
+	base, err := LoadFile(fn)
+	c.Assert(err, IsNil)
+	c.Assert(base.Allow, DeepEquals, []string{"docker.io/library/*", "registry.example.com"})
+	c.Assert(base.Deny, DeepEquals, []string{"docker.io/library/centos"})
+
+	c.Assert(ioutil.WriteFile(fn, []byte("permit debian\n"), 0600), IsNil)
+	_, err = LoadFile(fn)
+	c.Assert(err, ErrorMatches, `.*:1: unknown action "permit", expected allow or deny`)
+
+	c.Assert(ioutil.WriteFile(fn, []byte("allow\n"), 0600), IsNil)
+	_, err = LoadFile(fn)
+	c.Assert(err, ErrorMatches, ".*:1: expected `allow RULE` or `deny RULE`")
+}
+
+func (ps *policySuite) TestCheck(c *C) {
+	base := &Base{
+		Source: "plan",
+		Allow:  []string{"docker.io/library/*", "registry.example.com/team"},
+		Deny:   []string{"docker.io/library/centos"},
+	}
+
+	for _, image := range []string{"debian", "debian:stretch", "registry.example.com/team/app:1.0", "registry.example.com/team/sub/app"} {
+		c.Assert(base.Check(image, Names(image)), IsNil, Commentf("%s", image))
+	}
+
+	c.Assert(base.Check("centos:7", Names("centos:7")), ErrorMatches, `base image centos:7 is denied by rule "docker.io/library/centos" of the plan`)
+	c.Assert(base.Check("quay.io/app", Names("quay.io/app")), ErrorMatches, "base image quay.io/app is not allowed by the plan")
+	c.Assert(base.Check("registry.example.com/other/app", Names("registry.example.com/other/app")), NotNil)
+	c.Assert(base.Check("mytool/debian", Names("mytool/debian")), NotNil)
+
+	// rules match the whole path component, not a prefix of it.
+	c.Assert((&Base{Deny: []string{"registry.example.com/team"}}).Check("x", []string{"registry.example.com/teamwork/app"}), IsNil)
+
+	// an image with no name cannot be allowed.
+	c.Assert(base.Check("0123", nil), NotNil)
+	c.Assert((&Base{}).Check("0123", nil), IsNil)
+}
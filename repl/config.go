@@ -0,0 +1,121 @@
+package repl
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/box-builder/box/util"
+)
+
+// Config is the configuration of the repl. The line editing settings are read
+// from its configuration file; the others are set by flags.
+type Config struct {
+	ViMode   bool          // edit lines with vi keys instead of emacs ones
+	Bindings map[byte]byte // typed control keys, replaced by the keys bound to them
+
+	Experimental bool // allow the experimental verbs and funcs, set with --experimental
+}
+
+// ConfigFile returns the path of the repl's configuration file: the value of
+// BOX_REPL_CONFIG, or .box_repl in the home directory.
+func ConfigFile() string {
+	if fn := os.Getenv("BOX_REPL_CONFIG"); fn != "" {
+		return fn
+	}
+
+	return filepath.Join(os.Getenv("HOME"), ".box_repl")
+}
+
+// LoadConfig reads a repl configuration file. Each line is `mode vi`, `mode
+// emacs` or `bind KEY KEY`, where the keys are control keys such as `^P`;
+// empty lines and lines starting with `#` are ignored. A missing file is an
+// empty configuration. BOX_REPL_MODE, if set to vi or emacs, overrides the
+// mode of the file.
+func LoadConfig(filename string) (Config, error) {
+	config := Config{Bindings: map[byte]byte{}}
+
+	lines, err := util.ReadLines(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return config, err
+	}
+
+	for n, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		switch {
+		case fields[0] == "mode" && len(fields) == 2:
+			if config.ViMode, err = parseMode(fields[1]); err != nil {
+				return config, fmt.Errorf("%s:%d: %v", filename, n+1, err)
+			}
+		case fields[0] == "bind" && len(fields) == 3:
+			from, err := parseKey(fields[1])
+			if err != nil {
+				return config, fmt.Errorf("%s:%d: %v", filename, n+1, err)
+			}
+
+			to, err := parseKey(fields[2])
+			if err != nil {
+				return config, fmt.Errorf("%s:%d: %v", filename, n+1, err)
+			}
+
+			config.Bindings[from] = to
+		default:
+			return config, fmt.Errorf("%s:%d: expected `mode vi`, `mode emacs` or `bind KEY KEY`", filename, n+1)
+		}
+	}
+
+	if mode := os.Getenv("BOX_REPL_MODE"); mode != "" {
+		if config.ViMode, err = parseMode(mode); err != nil {
+			return config, fmt.Errorf("BOX_REPL_MODE: %v", err)
+		}
+	}
+
+	return config, nil
+}
+
+func parseMode(mode string) (bool, error) {
+	switch mode {
+	case "vi":
+		return true, nil
+	case "emacs":
+		return false, nil
+	default:
+		return false, fmt.Errorf("unknown mode %q, expected vi or emacs", mode)
+	}
+}
+
+// parseKey parses a control key such as `^P`. Enter and escape cannot be
+// bound, as the repl relies on them to tell lines and pastes apart.
+func parseKey(key string) (byte, error) {
+	if len(key) != 2 || key[0] != '^' {
+		return 0, fmt.Errorf("invalid key %q, expected a control key such as ^P", key)
+	}
+
+	c := key[1]
+	if c >= 'a' && c <= 'z' {
+		c -= 'a' - 'A'
+	}
+
+	var b byte
+	switch {
+	case c == '?':
+		b = 0x7f
+	case c >= '@' && c <= '_':
+		b = c - '@'
+	default:
+		return 0, fmt.Errorf("invalid key %q, expected a control key such as ^P", key)
+	}
+
+	if b == '\r' || b == '\n' || b == 0x1b {
+		return 0, fmt.Errorf("key %q cannot be bound", key)
+	}
+
+	return b, nil
+}
@@ -0,0 +1,42 @@
+package repl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+func (rs *replSuite) TestLoadConfig(c *C) {
+	dir, err := ioutil.TempDir("", "box-repl")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "box_repl")
+
+	config, err := LoadConfig(fn)
+	c.Assert(err, IsNil)
+	c.Assert(config.ViMode, Equals, false)
+	c.Assert(config.Bindings, DeepEquals, map[byte]byte{})
+
+	c.Assert(ioutil.WriteFile(fn, []byte("# keys\nmode vi\n\nbind ^n ^P\nbind ^? ^H\n"), 0600), IsNil)
+	config, err = LoadConfig(fn)
+	c.Assert(err, IsNil)
+	c.Assert(config.ViMode, Equals, true)
+	c.Assert(config.Bindings, DeepEquals, map[byte]byte{0x0e: 0x10, 0x7f: 0x08})
+
+	os.Setenv("BOX_REPL_MODE", "emacs")
+	config, err = LoadConfig(fn)
+	os.Unsetenv("BOX_REPL_MODE")
+	c.Assert(err, IsNil)
+	c.Assert(config.ViMode, Equals, false)
+
+	c.Assert(ioutil.WriteFile(fn, []byte("bind ^M ^J\n"), 0600), IsNil)
+	_, err = LoadConfig(fn)
+	c.Assert(err, ErrorMatches, `.*:1: key "\^M" cannot be bound`)
+
+	c.Assert(ioutil.WriteFile(fn, []byte("mode\n"), 0600), IsNil)
+	_, err = LoadConfig(fn)
+	c.Assert(err, ErrorMatches, ".*:1: expected `mode vi`, `mode emacs` or `bind KEY KEY`")
+}
@@ -0,0 +1,139 @@
+package repl
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Terminals in bracketed paste mode wrap pasted text in these markers, so it
+// can be told apart from typed text.
+const (
+	pasteOn    = "\x1b[?2004h"
+	pasteOff   = "\x1b[?2004l"
+	pasteStart = "\x1b[200~"
+	pasteEnd   = "\x1b[201~"
+)
+
+// pasteReader removes the paste markers from the terminal input and records
+// which paste each line end belongs to, so the repl can wait for the rest of a
+// paste before evaluating it. Input is read ahead of the lines the repl takes,
+// so the line ends are queued in order. Typed control keys are replaced by
+// the keys bound to them, if any; pasted text is left alone.
+type pasteReader struct {
+	reader  io.Reader
+	keys    map[byte]byte
+	mutex   sync.Mutex
+	held    []byte // the start of a marker which may continue in the next read
+	out     []byte // filtered input not yet returned
+	pasting bool
+	lastEnd bool  // the paste so far ends with a line end
+	paste   int   // the number of pastes started
+	open    int   // the paste the next line end belongs to, or 0 for typed lines
+	ends    []int // the pastes of the line ends not yet taken
+}
+
+func newPasteReader(reader io.Reader, keys map[byte]byte) *pasteReader {
+	return &pasteReader{reader: reader, keys: keys}
+}
+
+func (p *pasteReader) Read(b []byte) (int, error) {
+	for len(p.out) == 0 {
+		buf := make([]byte, len(b))
+		n, err := p.reader.Read(buf)
+		p.filter(buf[:n], err != nil)
+
+		if err != nil && len(p.out) == 0 {
+			return 0, err
+		}
+	}
+
+	n := copy(b, p.out)
+	p.out = p.out[n:]
+	return n, nil
+}
+
+// filter appends the input to out without the markers. A marker cut off at
+// the end of the input is held for the next read, unless it is the last.
+func (p *pasteReader) filter(input []byte, last bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	input = append(p.held, input...)
+	p.held = nil
+
+	for i := 0; i < len(input); i++ {
+		if input[i] == 0x1b {
+			rest := input[i:]
+
+			if bytes.HasPrefix(rest, []byte(pasteStart)) {
+				p.paste++
+				p.open, p.pasting, p.lastEnd = p.paste, true, false
+				i += len(pasteStart) - 1
+				continue
+			}
+
+			// a paste without a final line end is completed by the next one
+			// typed.
+			if bytes.HasPrefix(rest, []byte(pasteEnd)) {
+				if p.lastEnd {
+					p.open = 0
+				}
+				p.pasting = false
+				i += len(pasteEnd) - 1
+				continue
+			}
+
+			if !last && (bytes.HasPrefix([]byte(pasteStart), rest) || bytes.HasPrefix([]byte(pasteEnd), rest)) {
+				p.held = append([]byte{}, rest...)
+				return
+			}
+		}
+
+		if key, ok := p.keys[input[i]]; ok && !p.pasting {
+			input[i] = key
+		}
+
+		p.lastEnd = input[i] == '\r' || input[i] == '\n'
+		if p.lastEnd {
+			p.ends = append(p.ends, p.open)
+			if !p.pasting {
+				p.open = 0
+			}
+		}
+
+		p.out = append(p.out, input[i])
+	}
+}
+
+// more is called for each line read. It returns true if the line was pasted
+// and the paste has more lines, which should be read before it is evaluated.
+func (p *pasteReader) more() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(p.ends) == 0 {
+		return false
+	}
+
+	paste := p.ends[0]
+	p.ends = p.ends[1:]
+
+	if paste == 0 {
+		return false
+	}
+
+	if len(p.ends) > 0 {
+		return p.ends[0] == paste
+	}
+
+	return p.open == paste
+}
+
+// reset forgets the lines read, when the statement is canceled.
+func (p *pasteReader) reset() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.ends = nil
+	p.open = 0
+}
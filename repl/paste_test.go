@@ -0,0 +1,52 @@
+package repl
+
+import (
+	"io/ioutil"
+	"strings"
+	. "testing"
+	"testing/iotest"
+
+	. "gopkg.in/check.v1"
+)
+
+type replSuite struct{}
+
+var _ = Suite(&replSuite{})
+
+func TestRepl(t *T) {
+	TestingT(t)
+}
+
+func (rs *replSuite) TestPasteReader(c *C) {
+	input := "typed\r" + pasteStart + "run \"ls\" do\r  run \"true\"\rend" + pasteEnd + "\r"
+
+	// one byte at a time, so the markers are split across reads.
+	p := newPasteReader(iotest.OneByteReader(strings.NewReader(input)), nil)
+	content, err := ioutil.ReadAll(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "typed\rrun \"ls\" do\r  run \"true\"\rend\r")
+
+	c.Assert(p.more(), Equals, false) // typed
+	c.Assert(p.more(), Equals, true)  // run "ls" do
+	c.Assert(p.more(), Equals, true)  // run "true"
+	c.Assert(p.more(), Equals, false) // end, completed by the typed line end
+	c.Assert(p.more(), Equals, false)
+
+	p = newPasteReader(strings.NewReader(pasteStart+"a\rb\r"), nil)
+	_, err = ioutil.ReadAll(p)
+	c.Assert(err, IsNil)
+	c.Assert(p.more(), Equals, true)
+	c.Assert(p.more(), Equals, true) // the paste has not ended
+	c.Assert(p.more(), Equals, false)
+
+	p = newPasteReader(strings.NewReader("\x1b[A\x1b[20"), nil)
+	content, err = ioutil.ReadAll(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "\x1b[A\x1b[20")
+
+	// bound keys are replaced when typed, not when pasted.
+	p = newPasteReader(strings.NewReader("\x0e\r"+pasteStart+"\x0e"+pasteEnd), map[byte]byte{0x0e: 0x10})
+	content, err = ioutil.ReadAll(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "\x10\r\x0e")
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"strings"
 	"syscall"
@@ -15,6 +16,7 @@ import (
 	"github.com/box-builder/box/builder/command"
 	"github.com/box-builder/box/builder/evaluator"
 	"github.com/box-builder/box/builder/evaluator/mruby"
+	"github.com/box-builder/box/builder/executor"
 	"github.com/box-builder/box/builder/executor/docker"
 	"github.com/box-builder/box/logger"
 	"github.com/box-builder/box/signal"
@@ -22,25 +24,37 @@ import (
 	"github.com/chzyer/readline"
 	"github.com/docker/docker/pkg/term"
 	"github.com/fatih/color"
+	"github.com/pkg/errors"
 )
 
 const (
 	normalPrompt    = "box> "
 	multilinePrompt = "box*> "
+
+	// defaultPlan is the plan loaded by source when it is not given a file.
+	defaultPlan = "box.rb"
 )
 
 // Repl encapsulates a series of items used to create a read-evaluate-print
 // loop so that end users can manually enter build instructions.
 type Repl struct {
 	readline  *readline.Instance
+	paste     *pasteReader
 	evaluator evaluator.Evaluator
+	exec      executor.Executor
 	globals   *types.Global
 	vars      map[string]string
 }
 
 // NewRepl contypes a new Repl.
-func NewRepl(omit []string, log *logger.Logger, vars map[string]string) (*Repl, error) {
-	rl, err := readline.New(normalPrompt)
+func NewRepl(omit []string, log *logger.Logger, vars map[string]string, version string, config Config) (*Repl, error) {
+	paste := newPasteReader(readline.Stdin, config.Bindings)
+
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:  normalPrompt,
+		Stdin:   readline.NewCancelableStdin(paste),
+		VimMode: config.ViMode,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -49,16 +63,18 @@ func NewRepl(omit []string, log *logger.Logger, vars map[string]string) (*Repl,
 	signal.Handler.IgnoreRunners = true
 	ctx, cancel := context.WithCancel(context.Background())
 	globals := &types.Global{
-		OmitFuncs: omit,
-		TTY:       term.IsTerminal(1),
-		Color:     true,
-		Cache:     false,
-		ShowRun:   true,
-		Logger:    log,
-		Context:   ctx,
+		OmitFuncs:    omit,
+		TTY:          term.IsTerminal(1),
+		Color:        true,
+		Cache:        false,
+		ShowRun:      true,
+		Experimental: config.Experimental,
+		Version:      version,
+		Logger:       log,
+		Context:      ctx,
 	}
 
-	color.NoColor = false // force color on
+	color.NoColor = logger.NoColorEnv() // force color on unless NO_COLOR is set
 
 	exec, err := docker.NewDocker(globals)
 	if err != nil {
@@ -81,12 +97,22 @@ func NewRepl(omit []string, log *logger.Logger, vars map[string]string) (*Repl,
 
 	signal.Handler.AddFunc(cancel)
 
-	return &Repl{readline: rl, evaluator: e, globals: globals, vars: vars}, nil
+	return &Repl{readline: rl, paste: paste, evaluator: e, exec: exec, globals: globals, vars: vars}, nil
+}
+
+// exit turns bracketed paste mode off again before exiting, as the terminal
+// would otherwise keep it for the shell.
+func (r *Repl) exit(code int) {
+	if r.globals.TTY {
+		fmt.Print(pasteOff)
+	}
+
+	os.Exit(code)
 }
 
 func (r *Repl) handleError(line string, err error) bool {
 	if err == io.EOF {
-		os.Exit(0)
+		r.exit(0)
 	}
 
 	if _, interrupted := err.(*readline.InterruptError); interrupted || err.Error() == "Interrupt" {
@@ -99,7 +125,7 @@ func (r *Repl) handleError(line string, err error) bool {
 		return true
 	} else if err != nil {
 		fmt.Printf("+++ Error %#v\n", err)
-		os.Exit(1)
+		r.exit(1)
 	}
 	return false
 }
@@ -109,7 +135,7 @@ func (r *Repl) Loop() {
 	defer func() {
 		if err := recover(); err != nil {
 			fmt.Printf("Aborting due to interpreter error: %v\n", err)
-			os.Exit(2)
+			r.exit(2)
 		}
 		r.readline.Close()
 	}()
@@ -123,6 +149,12 @@ func (r *Repl) Loop() {
 		defer gosig.Stop(signals)
 	}
 
+	// pastes are marked, so they are evaluated once they are complete.
+	if r.globals.TTY {
+		fmt.Print(pasteOn)
+		defer fmt.Print(pasteOff)
+	}
+
 	printHelp()
 
 	lineChan := make(chan string, 1)
@@ -150,16 +182,57 @@ Thanks for trying box! We don't have on-line help yet :(
 If you want, try our documentation here: https://box-builder.github.io/box
 
 * If you ever need to reset your repl, type "reset".
+* To load a plan into the repl, type "source", or "source FILE" for one other
+  than box.rb.
 * If you need to cancel a ruby statement, press Control+C.
 		`)
 }
 
+// sourceFile returns the file of a source command, and false if the line is
+// not one.
+func sourceFile(line string) (string, bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || len(fields) > 2 || fields[0] != "source" {
+		return "", false
+	}
+
+	if len(fields) == 1 {
+		return defaultPlan, true
+	}
+
+	return fields[1], true
+}
+
+// source runs the plan in the file and keeps its state, including its local
+// variables, so the repl continues from it. It takes the stack reference of
+// the repl and returns the new one. If the plan fails, the error says where it
+// stopped and the repl continues from the last step done.
+func (r *Repl) source(filename string, stackKeep int) int {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		r.globals.Logger.Error(err)
+		return stackKeep
+	}
+
+	keep, err := r.evaluator.Source(filename, string(content), stackKeep)
+	if err != nil {
+		r.globals.Logger.Error(err)
+		if id := r.exec.Config().Image; id != "" {
+			r.globals.Logger.EvalResponse(fmt.Sprintf("Continuing from %s, the image of the last step done", id))
+		}
+		return keep
+	}
+
+	r.globals.Logger.EvalResponse(fmt.Sprintf("Sourced %s: %s", filename, r.evaluator.Result().Value))
+	return keep
+}
+
 func (r *Repl) checkQuit(line string) (bool, error) {
 	switch strings.TrimSpace(line) {
 	case "quit":
 		fallthrough
 	case "exit":
-		os.Exit(0)
+		r.exit(0)
 	case "help":
 		printHelp()
 		return true, nil
@@ -179,7 +252,7 @@ func (r *Repl) checkQuit(line string) (bool, error) {
 			return false, err
 		}
 
-		r.evaluator = e
+		r.evaluator, r.exec = e, exec
 		return true, nil
 	}
 
@@ -232,13 +305,29 @@ func (r *Repl) doLoop(lineChan <-chan string, errChan <-chan error, signals <-ch
 		line, cont = r.readChannels(line, lineChan, errChan, signals)
 
 		if cont {
+			r.paste.reset()
+			syncChan <- struct{}{}
+			continue
+		}
+
+		// the lines of a paste are evaluated together, so that a pasted block
+		// runs as one statement rather than a line at a time.
+		if r.paste.more() {
+			r.readline.SetPrompt(multilinePrompt)
+			syncChan <- struct{}{}
+			continue
+		}
+
+		if filename, ok := sourceFile(line); ok {
+			stackKeep = r.source(filename, stackKeep)
+			line = ""
 			syncChan <- struct{}{}
 			continue
 		}
 
 		if skip, err := r.checkQuit(line); err != nil {
 			fmt.Printf("+++ Error: %v\n", err)
-			os.Exit(1)
+			r.exit(1)
 		} else if skip {
 			line = ""
 			syncChan <- struct{}{}
@@ -247,7 +336,7 @@ func (r *Repl) doLoop(lineChan <-chan string, errChan <-chan error, signals <-ch
 
 		newKeep, err := r.evaluator.RunCode(line, stackKeep, false)
 		if err != nil {
-			switch err.(type) {
+			switch errors.Cause(err).(type) {
 			case *gm.ParserError:
 				if newKeep == stackKeep {
 					r.readline.SetPrompt(multilinePrompt)
@@ -262,7 +351,7 @@ func (r *Repl) doLoop(lineChan <-chan string, errChan <-chan error, signals <-ch
 
 		r.readline.SetPrompt(normalPrompt)
 		if err != nil {
-			fmt.Printf("+++ Error: %v\n", err)
+			r.globals.Logger.Error(err)
 			syncChan <- struct{}{}
 			continue
 		}
@@ -0,0 +1,21 @@
+package repl
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (rs *replSuite) TestSourceFile(c *C) {
+	for line, file := range map[string]string{
+		"source\n":                "box.rb",
+		"  source  \n":            "box.rb",
+		"source plans/app.rb\n":   "plans/app.rb",
+		"source plans/app.rb x\n": "",
+		"source = 1\n":            "",
+		"source_dir\n":            "",
+		"\n":                      "",
+	} {
+		fn, ok := sourceFile(line)
+		c.Assert(ok, Equals, file != "", Commentf("%q", line))
+		c.Assert(fn, Equals, file, Commentf("%q", line))
+	}
+}
@@ -0,0 +1,118 @@
+package sbom
+
+import (
+	"bufio"
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// Package is a package installed in the image by its package manager.
+type Package struct {
+	Name         string
+	Version      string
+	Architecture string
+	Type         string // the purl type, e.g. deb or apk
+}
+
+// Databases maps the paths of the package manager databases box can read to
+// the functions parsing them.
+var Databases = map[string]func([]byte) []Package{
+	"/var/lib/dpkg/status":  ParseDpkg,
+	"/lib/apk/db/installed": ParseApk,
+}
+
+// ParseDpkg returns the installed packages in a dpkg status file.
+func ParseDpkg(content []byte) []Package {
+	packages := []Package{}
+
+	for _, stanza := range stanzas(content, ": ") {
+		if !strings.HasSuffix(stanza["Status"], " installed") {
+			continue
+		}
+
+		packages = append(packages, Package{
+			Name:         stanza["Package"],
+			Version:      stanza["Version"],
+			Architecture: stanza["Architecture"],
+			Type:         "deb",
+		})
+	}
+
+	return sortPackages(packages)
+}
+
+// ParseApk returns the installed packages in an apk installed database.
+func ParseApk(content []byte) []Package {
+	packages := []Package{}
+
+	for _, stanza := range stanzas(content, ":") {
+		packages = append(packages, Package{
+			Name:         stanza["P"],
+			Version:      stanza["V"],
+			Architecture: stanza["A"],
+			Type:         "apk",
+		})
+	}
+
+	return sortPackages(packages)
+}
+
+// ParseOSRelease returns the ID field of an os-release file.
+func ParseOSRelease(content []byte) string {
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); strings.HasPrefix(line, "ID=") {
+			return strings.Trim(strings.TrimPrefix(line, "ID="), `"'`)
+		}
+	}
+
+	return ""
+}
+
+// stanzas splits key/value records separated by blank lines. Continuation
+// lines, which start with whitespace, are skipped.
+func stanzas(content []byte, sep string) []map[string]string {
+	result := []map[string]string{}
+	stanza := map[string]string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, 1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.TrimSpace(line) == "" {
+			if len(stanza) > 0 {
+				result = append(result, stanza)
+				stanza = map[string]string{}
+			}
+			continue
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+
+		parts := strings.SplitN(line, sep, 2)
+		if len(parts) == 2 {
+			stanza[parts[0]] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	if len(stanza) > 0 {
+		result = append(result, stanza)
+	}
+
+	return result
+}
+
+func sortPackages(packages []Package) []Package {
+	sort.Slice(packages, func(i, j int) bool {
+		if packages[i].Name == packages[j].Name {
+			return packages[i].Architecture < packages[j].Architecture
+		}
+		return packages[i].Name < packages[j].Name
+	})
+
+	return packages
+}
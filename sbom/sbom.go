@@ -0,0 +1,133 @@
+// Package sbom generates software bills of materials for built images in the
+// CycloneDX JSON format.
+package sbom
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+)
+
+const specVersion = "1.4"
+
+// Image describes an image listed in the bill of materials.
+type Image struct {
+	Name    string
+	ID      string
+	Digests []string // registry digests, in `name@algorithm:hex` form
+}
+
+// Info is the information about a build recorded in the bill of materials.
+type Info struct {
+	Image    Image     // the built image
+	Base     *Image    // the image given to the last `from`, if any
+	Layers   []string  // the diff IDs of the image's layers
+	Packages []Package // the packages installed in the image
+	Distro   string    // the ID from the image's os-release, used in package URLs
+	Version  string    // the version of box
+	Created  time.Time
+}
+
+type document struct {
+	BOMFormat   string      `json:"bomFormat"`
+	SpecVersion string      `json:"specVersion"`
+	Version     int         `json:"version"`
+	Metadata    metadata    `json:"metadata"`
+	Components  []component `json:"components"`
+}
+
+type metadata struct {
+	Timestamp string    `json:"timestamp"`
+	Tools     []tool    `json:"tools"`
+	Component component `json:"component"`
+}
+
+type tool struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type component struct {
+	Type       string     `json:"type"`
+	BOMRef     string     `json:"bom-ref,omitempty"`
+	Name       string     `json:"name"`
+	Version    string     `json:"version,omitempty"`
+	PURL       string     `json:"purl,omitempty"`
+	Properties []property `json:"properties,omitempty"`
+}
+
+type property struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Write writes the bill of materials for the build to w.
+func Write(w io.Writer, info Info) error {
+	image := imageComponent(info.Image)
+	for _, layer := range info.Layers {
+		image.Properties = append(image.Properties, property{Name: "box:layer", Value: layer})
+	}
+
+	doc := document{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: specVersion,
+		Version:     1,
+		Metadata: metadata{
+			Timestamp: info.Created.UTC().Format(time.RFC3339),
+			Tools:     []tool{{Name: "box", Version: info.Version}},
+			Component: image,
+		},
+		Components: []component{},
+	}
+
+	if info.Base != nil {
+		base := imageComponent(*info.Base)
+		base.Properties = append(base.Properties, property{Name: "box:base", Value: "true"})
+		doc.Components = append(doc.Components, base)
+	}
+
+	for _, pkg := range info.Packages {
+		doc.Components = append(doc.Components, component{
+			Type:    "library",
+			Name:    pkg.Name,
+			Version: pkg.Version,
+			PURL:    packageURL(pkg, info.Distro),
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+func imageComponent(image Image) component {
+	c := component{
+		Type:    "container",
+		BOMRef:  image.ID,
+		Name:    image.Name,
+		Version: image.ID,
+	}
+
+	for _, digest := range image.Digests {
+		c.Properties = append(c.Properties, property{Name: "box:repo-digest", Value: digest})
+	}
+
+	return c
+}
+
+// packageURL returns the purl of the package, or an empty string if the
+// distribution is not known.
+func packageURL(pkg Package, distro string) string {
+	if distro == "" {
+		return ""
+	}
+
+	purl := fmt.Sprintf("pkg:%s/%s/%s@%s", pkg.Type, url.PathEscape(distro), url.PathEscape(pkg.Name), url.PathEscape(pkg.Version))
+	if pkg.Architecture != "" {
+		purl += "?arch=" + url.QueryEscape(pkg.Architecture)
+	}
+
+	return purl
+}
@@ -0,0 +1,90 @@
+package sbom
+
+import (
+	"bytes"
+	"encoding/json"
+	. "testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type sbomSuite struct{}
+
+var _ = Suite(&sbomSuite{})
+
+func TestSBOM(t *T) {
+	TestingT(t)
+}
+
+const dpkgStatus = `Package: zlib1g
+Status: install ok installed
+Architecture: amd64
+Version: 1:1.2.11.dfsg-1
+Description: compression library - runtime
+ zlib is a library implementing the deflate compression method.
+
+Package: bash
+Status: install ok installed
+Architecture: amd64
+Version: 5.0-4
+
+Package: removed
+Status: deinstall ok config-files
+Architecture: amd64
+Version: 1.0
+`
+
+const apkInstalled = `C:Q1abc=
+P:musl
+V:1.1.24-r2
+A:x86_64
+
+C:Q1def=
+P:busybox
+V:1.31.1-r9
+A:x86_64
+`
+
+func (ss *sbomSuite) TestParse(c *C) {
+	c.Assert(ParseDpkg([]byte(dpkgStatus)), DeepEquals, []Package{
+		{Name: "bash", Version: "5.0-4", Architecture: "amd64", Type: "deb"},
+		{Name: "zlib1g", Version: "1:1.2.11.dfsg-1", Architecture: "amd64", Type: "deb"},
+	})
+
+	c.Assert(ParseApk([]byte(apkInstalled)), DeepEquals, []Package{
+		{Name: "busybox", Version: "1.31.1-r9", Architecture: "x86_64", Type: "apk"},
+		{Name: "musl", Version: "1.1.24-r2", Architecture: "x86_64", Type: "apk"},
+	})
+
+	c.Assert(ParseOSRelease([]byte("NAME=\"Debian GNU/Linux\"\nID=debian\n")), Equals, "debian")
+	c.Assert(ParseOSRelease([]byte("ID=\"alpine\"\n")), Equals, "alpine")
+	c.Assert(ParseOSRelease([]byte("# comment\n\nID=ubuntu\nVERSION_ID=\"22.04\"\n")), Equals, "ubuntu")
+	c.Assert(ParseOSRelease(nil), Equals, "")
+}
+
+func (ss *sbomSuite) TestWrite(c *C) {
+	buf := new(bytes.Buffer)
+
+	err := Write(buf, Info{
+		Image:    Image{Name: "test", ID: "sha256:1234"},
+		Base:     &Image{Name: "debian", ID: "sha256:abcd", Digests: []string{"debian@sha256:ef01"}},
+		Layers:   []string{"sha256:5678"},
+		Packages: ParseDpkg([]byte(dpkgStatus)),
+		Distro:   "debian",
+		Version:  "0.4.2",
+		Created:  time.Unix(0, 0),
+	})
+	c.Assert(err, IsNil)
+
+	var doc document
+	c.Assert(json.Unmarshal(buf.Bytes(), &doc), IsNil)
+	c.Assert(doc.BOMFormat, Equals, "CycloneDX")
+	c.Assert(doc.Metadata.Timestamp, Equals, "1970-01-01T00:00:00Z")
+	c.Assert(doc.Metadata.Component.Name, Equals, "test")
+	c.Assert(doc.Metadata.Component.Properties, DeepEquals, []property{{Name: "box:layer", Value: "sha256:5678"}})
+	c.Assert(doc.Components, HasLen, 3)
+	c.Assert(doc.Components[0].Name, Equals, "debian")
+	c.Assert(doc.Components[0].Properties[0], DeepEquals, property{Name: "box:repo-digest", Value: "debian@sha256:ef01"})
+	c.Assert(doc.Components[2].PURL, Equals, "pkg:deb/debian/zlib1g@1:1.2.11.dfsg-1?arch=amd64")
+}
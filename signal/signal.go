@@ -45,6 +45,7 @@ func NewCancellable() *Cancellable {
 }
 
 // AddFile adds a temporary filename to be reaped if the action is canceled.
+// Directories are removed with their contents.
 func (c *Cancellable) AddFile(filename string) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
@@ -102,7 +103,7 @@ func (c *Cancellable) SignalHandler(signals chan os.Signal) {
 		for fn := range files {
 			fmt.Fprintf(os.Stderr, "Cleaning up temporary file %q", fn)
 
-			if err := os.Remove(fn); err != nil {
+			if err := os.RemoveAll(fn); err != nil {
 				fmt.Fprintf(os.Stderr, ": %v", err)
 			}
 
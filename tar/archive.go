@@ -2,13 +2,16 @@ package tar
 
 import (
 	"archive/tar"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/box-builder/box/copy"
 	"github.com/box-builder/box/logger"
@@ -16,8 +19,13 @@ import (
 	"github.com/docker/docker/pkg/archive"
 )
 
-// rewriteTar rewrites the tar's paths to copy the source to the target.
-func rewriteTar(source, target string, logger *logger.Logger, tr *tar.Reader, tw *tar.Writer) error {
+// rewriteTar rewrites the tar's paths to copy the source to the target. The
+// extended attributes of each file are carried over, and any supplied xattrs
+// are set on every regular file. If parents is true, the directories leading to
+// the source from the working directory are kept under the target. Hard links
+// between the files are kept as hard links to the rewritten path, so the image
+// holds one copy of the content.
+func rewriteTar(source, target string, xattrs map[string]string, parents bool, logger *logger.Logger, tr *tar.Reader, tw *tar.Writer) error {
 	// all this code is terrible
 	fi, err := os.Stat(source)
 	if err != nil {
@@ -26,6 +34,31 @@ func rewriteTar(source, target string, logger *logger.Logger, tr *tar.Reader, tw
 
 	dir := fi.IsDir()
 
+	root := source
+	if !dir {
+		root = filepath.Dir(source)
+	}
+
+	var prefix string
+	if parents {
+		prefix, err = parentsPrefix(root)
+		if err != nil {
+			return err
+		}
+	}
+
+	rewrite := func(name string) string {
+		if dir || parents {
+			return filepath.Join(target, prefix, name)
+		}
+
+		if target[len(target)-1] == '/' {
+			return filepath.Join(target, name)
+		}
+
+		return target
+	}
+
 	for {
 		header, err := tr.Next()
 		if err != nil {
@@ -36,35 +69,48 @@ func rewriteTar(source, target string, logger *logger.Logger, tr *tar.Reader, tw
 			return err
 		}
 
-		var name string
-		if header.Name[0] == '/' {
-			name = header.Name[1:]
-		} else {
-			name = header.Name
-		}
+		name := strings.TrimPrefix(header.Name, "/")
 
 		if header.Linkname != "" {
-			var linkName string
+			header.Linkname = strings.TrimPrefix(header.Linkname, "/")
 
-			if header.Linkname[0] == '/' {
-				linkName = header.Linkname[1:]
-			} else {
-				linkName = header.Linkname
+			// a hard link names another entry of the archive, which is moved
+			// with it.
+			if header.Typeflag == tar.TypeLink {
+				header.Linkname = rewrite(header.Linkname)
+			}
+		}
+
+		if header.Typeflag != tar.TypeSymlink {
+			attrs, err := readXattrs(filepath.Join(root, name))
+			if err != nil {
+				return err
 			}
 
-			header.Linkname = linkName
+			for key, value := range attrs {
+				if header.Xattrs == nil {
+					header.Xattrs = map[string]string{}
+				}
+				header.Xattrs[key] = value
+			}
 		}
 
-		if dir {
-			header.Name = filepath.Join(target, name)
-		} else {
-			if target[len(target)-1] == '/' {
-				header.Name = filepath.Join(target, name)
-			} else {
-				header.Name = target
+		if header.Typeflag == tar.TypeReg && len(xattrs) > 0 {
+			if header.Xattrs == nil {
+				header.Xattrs = map[string]string{}
+			}
+
+			for key, value := range xattrs {
+				header.Xattrs[key] = value
 			}
 		}
 
+		if len(header.Xattrs) > 0 {
+			header.Format = tar.FormatPAX // only PAX headers can carry xattrs
+		}
+
+		header.Name = rewrite(name)
+
 		if err := tw.WriteHeader(header); err != nil {
 			return err
 		}
@@ -77,6 +123,34 @@ func rewriteTar(source, target string, logger *logger.Logger, tr *tar.Reader, tw
 	return nil
 }
 
+// parentsPrefix returns the path of root relative to the working directory.
+func parentsPrefix(root string) (string, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("cannot keep the parents of %q because it falls below the root build directory", root)
+	}
+
+	if rel == "." {
+		return "", nil
+	}
+
+	return rel, nil
+}
+
 func expandIncludeList(source string) (string, []string, error) {
 	files, err := filepath.Glob(source)
 	if err != nil {
@@ -108,21 +182,67 @@ func expandIncludeList(source string) (string, []string, error) {
 }
 
 // Archive archives the source into target, ignoring the list of patterns
-// supplied in the string array.
-func Archive(ctx context.Context, source, target string, ignoreList []string, logger *logger.Logger) (string, string, error) {
-	var relFiles []string
-	var err error
+// supplied in the string array. xattrs, if not nil, are set on every regular
+// file in the archive. If parents is true, the source's directories relative to
+// the working directory are recreated under the target, which is then always
+// treated as a directory.
+//
+// A directory or several files are copied into the target. A single file is
+// copied into the target if it ends with a slash, and to the target as its
+// file name otherwise. The directories leading to the target are created on
+// extraction if they are missing.
+func Archive(ctx context.Context, source, target string, ignoreList []string, xattrs map[string]string, parents bool, logger *logger.Logger) (string, string, error) {
+	return archiveFiles(func(tw *tar.Writer) error {
+		return archiveInto(tw, source, target, ignoreList, xattrs, parents, logger)
+	})
+}
+
+// ArchiveMap archives each source of the mapping to its target, as Archive
+// does for one, into a single archive. The sources are archived in sorted
+// order, so the archive and its sum are the same on every build.
+func ArchiveMap(ctx context.Context, mapping map[string]string, ignoreList []string, xattrs map[string]string, logger *logger.Logger) (string, string, error) {
+	sources := []string{}
+	for source := range mapping {
+		sources = append(sources, source)
+	}
+
+	sort.Strings(sources)
+
+	return archiveFiles(func(tw *tar.Writer) error {
+		for _, source := range sources {
+			if err := archiveInto(tw, source, mapping[source], ignoreList, xattrs, false, logger); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// archiveInto writes the source, rewritten to be copied to the target, to the
+// archive.
+func archiveInto(tw *tar.Writer, source, target string, ignoreList []string, xattrs map[string]string, parents bool, logger *logger.Logger) error {
+	if target == "" {
+		return fmt.Errorf("no target to copy %q to", source)
+	}
 
-	source, relFiles, err = expandIncludeList(source)
+	source, relFiles, err := expandIncludeList(source)
 	if err != nil {
-		return "", "", err
+		return err
 	}
 
 	reader, err := archive.TarWithOptions(source, &archive.TarOptions{IncludeFiles: relFiles, ExcludePatterns: ignoreList})
 	if err != nil {
-		return "", "", err
+		return err
 	}
+	defer reader.Close()
 
+	return rewriteTar(source, target, xattrs, parents, logger, tar.NewReader(reader), tw)
+}
+
+// archiveFiles writes the archive to a temporary file with write, and returns
+// the file's name and the sum of the archive.
+func archiveFiles(write func(*tar.Writer) error) (string, string, error) {
 	f, err := ioutil.TempFile("", "box-archive")
 	if err != nil {
 		return "", "", err
@@ -132,14 +252,13 @@ func Archive(ctx context.Context, source, target string, ignoreList []string, lo
 	signal.Handler.AddFile(f.Name())
 	defer signal.Handler.RemoveFile(f.Name())
 
-	tr := tar.NewReader(reader)
 	tw := tar.NewWriter(f)
 
-	if err := rewriteTar(source, target, logger, tr, tw); err != nil {
+	if err := write(tw); err != nil {
+		os.Remove(f.Name())
 		return "", "", err
 	}
 
-	reader.Close()
 	tw.Close()
 
 	if _, err := f.Seek(0, 0); err != nil {
@@ -154,3 +273,50 @@ func Archive(ctx context.Context, source, target string, ignoreList []string, lo
 
 	return f.Name(), sum, nil
 }
+
+// File is a file archived from memory by ArchiveFile.
+type File struct {
+	Name    string // the path in the image
+	Content []byte
+	Mode    os.FileMode
+	UID     int
+	GID     int
+	ModTime time.Time
+	Xattrs  map[string]string // set on the file, if not nil
+}
+
+// ArchiveFile archives the file into an in-memory tarball, so content that is
+// not on disk can be copied without a temporary file.
+func ArchiveFile(file File) (*bytes.Buffer, error) {
+	header := &tar.Header{
+		Name:     strings.TrimPrefix(file.Name, "/"),
+		Typeflag: tar.TypeReg,
+		Mode:     int64(file.Mode.Perm()),
+		Size:     int64(len(file.Content)),
+		Uid:      file.UID,
+		Gid:      file.GID,
+		ModTime:  file.ModTime,
+		Xattrs:   file.Xattrs,
+	}
+
+	if len(header.Xattrs) > 0 {
+		header.Format = tar.FormatPAX // only PAX headers can carry xattrs
+	}
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+
+	if err := tw.WriteHeader(header); err != nil {
+		return nil, err
+	}
+
+	if _, err := tw.Write(file.Content); err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
@@ -0,0 +1,123 @@
+package tar
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// CapabilityXattr is the extended attribute file capabilities are stored in.
+const CapabilityXattr = "security.capability"
+
+const (
+	vfsCapRevision2     = 0x02000000
+	vfsCapFlagEffective = 0x000001
+)
+
+var capabilities = []string{
+	"chown",
+	"dac_override",
+	"dac_read_search",
+	"fowner",
+	"fsetid",
+	"kill",
+	"setgid",
+	"setuid",
+	"setpcap",
+	"linux_immutable",
+	"net_bind_service",
+	"net_broadcast",
+	"net_admin",
+	"net_raw",
+	"ipc_lock",
+	"ipc_owner",
+	"sys_module",
+	"sys_rawio",
+	"sys_chroot",
+	"sys_ptrace",
+	"sys_pacct",
+	"sys_admin",
+	"sys_boot",
+	"sys_nice",
+	"sys_resource",
+	"sys_time",
+	"sys_tty_config",
+	"mknod",
+	"lease",
+	"audit_write",
+	"audit_control",
+	"setfcap",
+	"mac_override",
+	"mac_admin",
+	"syslog",
+	"wake_alarm",
+	"block_suspend",
+	"audit_read",
+	"perfmon",
+	"bpf",
+	"checkpoint_restore",
+}
+
+func capabilityBit(name string) (uint, error) {
+	name = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(name)), "cap_")
+	for i, capability := range capabilities {
+		if capability == name {
+			return uint(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown capability %q", name)
+}
+
+// EncodeCapabilities converts a list of capabilities in the text format used
+// by setcap, e.g. "cap_net_bind_service+ep", into the value of the
+// security.capability extended attribute.
+func EncodeCapabilities(caps []string) (string, error) {
+	var permitted, inheritable [2]uint32
+	var effective bool
+
+	for _, text := range caps {
+		idx := strings.LastIndexAny(text, "+=")
+		if idx < 0 {
+			return "", fmt.Errorf("capability %q has no flags, e.g. %s+ep", text, text)
+		}
+
+		var bits []uint
+		for _, name := range strings.Split(text[:idx], ",") {
+			bit, err := capabilityBit(name)
+			if err != nil {
+				return "", err
+			}
+			bits = append(bits, bit)
+		}
+
+		for _, flag := range text[idx+1:] {
+			for _, bit := range bits {
+				switch flag {
+				case 'e':
+					effective = true
+				case 'p':
+					permitted[bit/32] |= 1 << (bit % 32)
+				case 'i':
+					inheritable[bit/32] |= 1 << (bit % 32)
+				default:
+					return "", fmt.Errorf("invalid flag %q in capability %q", flag, text)
+				}
+			}
+		}
+	}
+
+	magic := uint32(vfsCapRevision2)
+	if effective {
+		magic |= vfsCapFlagEffective
+	}
+
+	buf := make([]byte, 20)
+	binary.LittleEndian.PutUint32(buf[0:], magic)
+	binary.LittleEndian.PutUint32(buf[4:], permitted[0])
+	binary.LittleEndian.PutUint32(buf[8:], inheritable[0])
+	binary.LittleEndian.PutUint32(buf[12:], permitted[1])
+	binary.LittleEndian.PutUint32(buf[16:], inheritable[1])
+
+	return string(buf), nil
+}
@@ -2,8 +2,10 @@ package tar
 
 import (
 	"archive/tar"
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -20,7 +22,7 @@ import (
 
 type tarSuite struct{}
 
-var log = logger.New("", false)
+var log = logger.New("", false, 0)
 
 var _ = Suite(&tarSuite{})
 
@@ -29,7 +31,7 @@ func TestTar(t *T) {
 }
 
 func (ts *tarSuite) TestArchive(c *C) {
-	tarball, sum, err := Archive(context.Background(), ".", "/", []string{}, log)
+	tarball, sum, err := Archive(context.Background(), ".", "/", []string{}, nil, false, log)
 	c.Assert(err, IsNil)
 	c.Assert(sum, Not(Equals), "")
 	c.Assert(tarball, Not(Equals), "")
@@ -62,7 +64,7 @@ func (ts *tarSuite) TestArchiveSpecialFile(c *C) {
 	c.Assert(os.Symlink(tmp.Name(), filepath.Join(dir, "testsym")), IsNil)
 	c.Assert(unix.Mkfifo(filepath.Join(dir, "test.fifo"), 0666), IsNil)
 
-	tarball, _, err := Archive(context.Background(), dir, "/", []string{}, log)
+	tarball, _, err := Archive(context.Background(), dir, "/", []string{}, nil, false, log)
 	c.Assert(err, IsNil)
 	c.Assert(tarball, Not(Equals), "")
 	defer os.Remove(tarball)
@@ -105,7 +107,7 @@ func (ts *tarSuite) TestArchiveRelativeSymlink(c *C) {
 	os.Mkdir(filepath.Join(dir, "testdir"), 0777)
 	c.Assert(os.Symlink(filepath.Join("..", "test"), filepath.Join(dir, "testdir", "testsym")), IsNil)
 
-	tarball, _, err := Archive(context.Background(), dir, "/", []string{}, log)
+	tarball, _, err := Archive(context.Background(), dir, "/", []string{}, nil, false, log)
 	c.Assert(err, IsNil)
 	c.Assert(tarball, Not(Equals), "")
 	defer os.Remove(tarball)
@@ -137,6 +139,53 @@ func (ts *tarSuite) TestArchiveRelativeSymlink(c *C) {
 	c.Assert(count, Equals, 3, Commentf("%v", names))
 }
 
+func (ts *tarSuite) TestArchiveHardLinks(c *C) {
+	dir, err := ioutil.TempDir("", "tar-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("busybox"), 4096)
+	c.Assert(os.Mkdir(filepath.Join(dir, "bin"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "bin", "busybox"), content, 0755), IsNil)
+	for _, name := range []string{"ls", "cat"} {
+		c.Assert(os.Link(filepath.Join(dir, "bin", "busybox"), filepath.Join(dir, "bin", name)), IsNil)
+	}
+
+	tarball, _, err := Archive(context.Background(), dir, "/opt/", []string{}, nil, false, log)
+	c.Assert(err, IsNil)
+	defer os.Remove(tarball)
+
+	fi, err := os.Stat(tarball)
+	c.Assert(err, IsNil)
+	c.Assert(fi.Size() < int64(2*len(content)), Equals, true, Commentf("%d", fi.Size()))
+
+	f, err := os.Open(tarball)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	r := tar.NewReader(f)
+	regular := []string{}
+	links := map[string]string{}
+
+	for {
+		header, err := r.Next()
+		if err != nil {
+			break
+		}
+
+		switch header.Typeflag {
+		case tar.TypeReg:
+			regular = append(regular, header.Name)
+		case tar.TypeLink:
+			links[header.Name] = header.Linkname
+		}
+	}
+
+	// the first of the names in the archive holds the content.
+	c.Assert(regular, DeepEquals, []string{"/opt/bin/busybox"})
+	c.Assert(links, DeepEquals, map[string]string{"/opt/bin/cat": "/opt/bin/busybox", "/opt/bin/ls": "/opt/bin/busybox"})
+}
+
 func (ts *tarSuite) TestArchiveGlob(c *C) {
 	prefixes := []string{"foo", "bar"}
 
@@ -151,7 +200,7 @@ func (ts *tarSuite) TestArchiveGlob(c *C) {
 	}
 
 	for _, prefix := range prefixes {
-		tarball, _, err := Archive(context.Background(), fmt.Sprintf("%s/%s*", dir, prefix), "/", []string{}, log)
+		tarball, _, err := Archive(context.Background(), fmt.Sprintf("%s/%s*", dir, prefix), "/", []string{}, nil, false, log)
 		c.Assert(err, IsNil)
 		defer os.Remove(tarball)
 
@@ -176,6 +225,117 @@ func (ts *tarSuite) TestArchiveGlob(c *C) {
 	}
 }
 
+func (ts *tarSuite) TestArchiveMap(c *C) {
+	dir, err := ioutil.TempDir("", "tar-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "c"), []byte("c"), 0644), IsNil)
+	c.Assert(os.Mkdir(filepath.Join(dir, "sub"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "sub", "e"), []byte("e"), 0644), IsNil)
+
+	mapping := map[string]string{
+		filepath.Join(dir, "a"):   "/app/b",
+		filepath.Join(dir, "c"):   "/app/d",
+		filepath.Join(dir, "sub"): "/app/f",
+	}
+
+	tarball, sum, err := ArchiveMap(context.Background(), mapping, []string{}, nil, log)
+	c.Assert(err, IsNil)
+	defer os.Remove(tarball)
+
+	f, err := os.Open(tarball)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	files := map[string]string{}
+	r := tar.NewReader(f)
+
+	for {
+		header, err := r.Next()
+		if err != nil {
+			break
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		content, err := ioutil.ReadAll(r)
+		c.Assert(err, IsNil)
+		files[header.Name] = string(content)
+	}
+
+	c.Assert(files, DeepEquals, map[string]string{"/app/b": "a", "/app/d": "c", "/app/f/e": "e"})
+
+	// the sum follows the content of every source.
+	again, sum2, err := ArchiveMap(context.Background(), mapping, []string{}, nil, log)
+	c.Assert(err, IsNil)
+	defer os.Remove(again)
+	c.Assert(sum2, Equals, sum)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "c"), []byte("changed"), 0644), IsNil)
+	changed, sum3, err := ArchiveMap(context.Background(), mapping, []string{}, nil, log)
+	c.Assert(err, IsNil)
+	defer os.Remove(changed)
+	c.Assert(sum3, Not(Equals), sum)
+
+	_, _, err = ArchiveMap(context.Background(), map[string]string{filepath.Join(dir, "missing"): "/app/x"}, []string{}, nil, log)
+	c.Assert(err, NotNil)
+}
+
+func (ts *tarSuite) TestArchiveParents(c *C) {
+	dir, err := ioutil.TempDir("", "tar-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	wd, err := os.Getwd()
+	c.Assert(err, IsNil)
+	c.Assert(os.Chdir(dir), IsNil)
+	defer os.Chdir(wd)
+
+	c.Assert(os.MkdirAll("src/app", 0755), IsNil)
+	for _, name := range []string{"main.go", "util.go", "README"} {
+		c.Assert(ioutil.WriteFile(filepath.Join("src/app", name), nil, 0644), IsNil)
+	}
+
+	names := func(source string, parents bool) []string {
+		tarball, _, err := Archive(context.Background(), source, "/out/", []string{}, nil, parents, log)
+		c.Assert(err, IsNil)
+		defer os.Remove(tarball)
+
+		f, err := os.Open(tarball)
+		c.Assert(err, IsNil)
+		defer f.Close()
+
+		result := []string{}
+		r := tar.NewReader(f)
+		for {
+			header, err := r.Next()
+			if err != nil {
+				break
+			}
+
+			if header.Typeflag != tar.TypeDir {
+				result = append(result, header.Name)
+			}
+		}
+
+		return result
+	}
+
+	c.Assert(names("src/app/*.go", false), DeepEquals, []string{"/out/main.go", "/out/util.go"})
+	c.Assert(names("src/app/*.go", true), DeepEquals, []string{"/out/src/app/main.go", "/out/src/app/util.go"})
+	c.Assert(names("src/app/README", false), DeepEquals, []string{"/out/README"})
+	c.Assert(names("src/app/README", true), DeepEquals, []string{"/out/src/app/README"})
+	c.Assert(names("src/app", false), DeepEquals, []string{"/out/README", "/out/main.go", "/out/util.go"})
+	c.Assert(names("src/app", true), DeepEquals, []string{"/out/src/app/README", "/out/src/app/main.go", "/out/src/app/util.go"})
+
+	_, _, err = Archive(context.Background(), wd, "/out/", []string{}, nil, true, log)
+	c.Assert(err, NotNil)
+}
+
 func (ts *tarSuite) TestArchiveIgnore(c *C) {
 	prefixes := []string{"foo", "bar"}
 
@@ -190,7 +350,7 @@ func (ts *tarSuite) TestArchiveIgnore(c *C) {
 	}
 
 	for _, prefix := range prefixes {
-		tarball, _, err := Archive(context.Background(), dir, "/", []string{fmt.Sprintf("%s*", prefix)}, log)
+		tarball, _, err := Archive(context.Background(), dir, "/", []string{fmt.Sprintf("%s*", prefix)}, nil, false, log)
 		c.Assert(err, IsNil)
 		defer os.Remove(tarball)
 
@@ -215,6 +375,182 @@ func (ts *tarSuite) TestArchiveIgnore(c *C) {
 	}
 }
 
+func (ts *tarSuite) TestExtract(c *C) {
+	mkTar := func(headers ...*tar.Header) *bytes.Buffer {
+		buf := new(bytes.Buffer)
+		tw := tar.NewWriter(buf)
+		for _, header := range headers {
+			c.Assert(tw.WriteHeader(header), IsNil)
+			if header.Typeflag == tar.TypeReg {
+				_, err := tw.Write([]byte(header.Name))
+				c.Assert(err, IsNil)
+			}
+		}
+		c.Assert(tw.Close(), IsNil)
+		return buf
+	}
+
+	file := func(name string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0755, Size: int64(len(name))}
+	}
+
+	dest, err := ioutil.TempDir("", "tar-extract-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dest)
+
+	dir := mkTar(
+		&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		file("bin/app"),
+		&tar.Header{Name: "bin/app2", Typeflag: tar.TypeLink, Linkname: "bin/app"},
+		file("bin/binary"),
+	)
+	c.Assert(Extract(dir, "/usr/local/bin/", filepath.Join(dest, "dir")), IsNil)
+
+	content, err := ioutil.ReadFile(filepath.Join(dest, "dir", "app"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "bin/app")
+	content, err = ioutil.ReadFile(filepath.Join(dest, "dir", "app2"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "bin/app")
+	_, err = os.Stat(filepath.Join(dest, "dir", "binary"))
+	c.Assert(err, IsNil)
+
+	c.Assert(Extract(mkTar(file("app")), "/usr/local/bin/app", filepath.Join(dest, "file")), IsNil)
+	content, err = ioutil.ReadFile(filepath.Join(dest, "file", "app"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "app")
+
+	root := mkTar(&tar.Header{Name: "/", Typeflag: tar.TypeDir, Mode: 0755}, file("/etc/hostname"))
+	c.Assert(Extract(root, "/", filepath.Join(dest, "root")), IsNil)
+	_, err = os.Stat(filepath.Join(dest, "root", "etc", "hostname"))
+	c.Assert(err, IsNil)
+}
+
+func (ts *tarSuite) TestRebase(c *C) {
+	mkTar := func(headers ...*tar.Header) *bytes.Buffer {
+		buf := new(bytes.Buffer)
+		tw := tar.NewWriter(buf)
+		for _, header := range headers {
+			c.Assert(tw.WriteHeader(header), IsNil)
+			if header.Typeflag == tar.TypeReg {
+				_, err := tw.Write([]byte(header.Name))
+				c.Assert(err, IsNil)
+			}
+		}
+		c.Assert(tw.Close(), IsNil)
+		return buf
+	}
+
+	names := func(buf *bytes.Buffer) []string {
+		result := []string{}
+		tr := tar.NewReader(buf)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				return result
+			}
+			c.Assert(err, IsNil)
+			if header.Typeflag == tar.TypeLink {
+				result = append(result, header.Name+" => "+header.Linkname)
+			} else {
+				result = append(result, header.Name)
+			}
+		}
+	}
+
+	source := func() *bytes.Buffer {
+		return mkTar(
+			&tar.Header{Name: "app/", Typeflag: tar.TypeDir, Mode: 0755},
+			&tar.Header{Name: "app/bin", Typeflag: tar.TypeReg, Mode: 0755, Size: int64(len("app/bin"))},
+			&tar.Header{Name: "app/bin2", Typeflag: tar.TypeLink, Linkname: "app/bin"},
+		)
+	}
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	c.Assert(Rebase(source(), tw, "/usr/local", false), IsNil)
+	c.Assert(Rebase(mkTar(&tar.Header{Name: "hostname", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len("hostname"))}), tw, "/etc", false), IsNil)
+	c.Assert(tw.Close(), IsNil)
+	c.Assert(names(buf), DeepEquals, []string{"usr/local/app/", "usr/local/app/bin", "usr/local/app/bin2 => usr/local/app/bin", "etc/hostname"})
+
+	buf = new(bytes.Buffer)
+	tw = tar.NewWriter(buf)
+	c.Assert(Rebase(source(), tw, "/", true), IsNil)
+	c.Assert(tw.Close(), IsNil)
+	c.Assert(names(buf), DeepEquals, []string{"app/"})
+}
+
+func (ts *tarSuite) TestMove(c *C) {
+	move := func(target string, headers ...*tar.Header) []string {
+		buf := new(bytes.Buffer)
+		tw := tar.NewWriter(buf)
+		for _, header := range headers {
+			c.Assert(tw.WriteHeader(header), IsNil)
+		}
+		c.Assert(tw.Close(), IsNil)
+
+		out := new(bytes.Buffer)
+		tw = tar.NewWriter(out)
+		c.Assert(Move(buf, tw, target), IsNil)
+		c.Assert(tw.Close(), IsNil)
+
+		result := []string{}
+		tr := tar.NewReader(out)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				return result
+			}
+			c.Assert(err, IsNil)
+			if header.Typeflag == tar.TypeLink {
+				result = append(result, header.Name+" => "+header.Linkname)
+			} else {
+				result = append(result, header.Name)
+			}
+		}
+	}
+
+	c.Assert(move("/opt/app",
+		&tar.Header{Name: "build/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "build/bin", Typeflag: tar.TypeReg, Mode: 0755},
+		&tar.Header{Name: "build/bin2", Typeflag: tar.TypeLink, Linkname: "build/bin"},
+	), DeepEquals, []string{"opt/app/", "opt/app/bin", "opt/app/bin2 => opt/app/bin"})
+
+	c.Assert(move("/usr/bin/tool", &tar.Header{Name: "tool-1.0", Typeflag: tar.TypeReg, Mode: 0755}), DeepEquals, []string{"usr/bin/tool"})
+}
+
+func (ts *tarSuite) TestChown(c *C) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "www/", Typeflag: tar.TypeDir, Mode: 0755, Uname: "root"}), IsNil)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "www/index.html", Typeflag: tar.TypeReg, Mode: 0644, Size: 2, Uid: 1000, Gid: 1000}), IsNil)
+	_, err := tw.Write([]byte("hi"))
+	c.Assert(err, IsNil)
+	c.Assert(tw.Close(), IsNil)
+
+	out := new(bytes.Buffer)
+	tw = tar.NewWriter(out)
+	c.Assert(Chown(buf, tw, 33, 34), IsNil)
+	c.Assert(tw.Close(), IsNil)
+
+	tr := tar.NewReader(out)
+	for _, name := range []string{"www/", "www/index.html"} {
+		header, err := tr.Next()
+		c.Assert(err, IsNil)
+		c.Assert(header.Name, Equals, name)
+		c.Assert(header.Uid, Equals, 33)
+		c.Assert(header.Gid, Equals, 34)
+		c.Assert(header.Uname, Equals, "")
+	}
+
+	content, err := ioutil.ReadAll(tr)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "hi")
+
+	_, err = tr.Next()
+	c.Assert(err, Equals, io.EOF)
+}
+
 func (ts *tarSuite) TestUnarchive(c *C) {
 	prefixes := []string{"foo", "bar"}
 
@@ -232,7 +568,7 @@ func (ts *tarSuite) TestUnarchive(c *C) {
 	c.Assert(err, IsNil)
 	defer os.RemoveAll(target)
 
-	tarball, _, err := Archive(context.Background(), dir, "/", []string{}, log)
+	tarball, _, err := Archive(context.Background(), dir, "/", []string{}, nil, false, log)
 	c.Assert(err, IsNil)
 
 	f, err := os.Open(tarball)
@@ -250,3 +586,88 @@ func (ts *tarSuite) TestUnarchive(c *C) {
 		}
 	}
 }
+
+func (ts *tarSuite) TestArchiveXattrs(c *C) {
+	dir, err := ioutil.TempDir("", "tar-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "app")
+	c.Assert(ioutil.WriteFile(fn, []byte("app"), 0755), IsNil)
+
+	if err := unix.Setxattr(fn, "user.box", []byte("test"), 0); err != nil {
+		c.Skip(fmt.Sprintf("xattrs unsupported: %v", err))
+	}
+
+	capability, err := EncodeCapabilities([]string{"cap_net_bind_service+ep"})
+	c.Assert(err, IsNil)
+
+	tarball, _, err := Archive(context.Background(), fn, "/app", []string{}, map[string]string{CapabilityXattr: capability}, false, log)
+	c.Assert(err, IsNil)
+	defer os.Remove(tarball)
+
+	f, err := os.Open(tarball)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	header, err := tar.NewReader(f).Next()
+	c.Assert(err, IsNil)
+	c.Assert(header.Name, Equals, "/app")
+	c.Assert(header.Xattrs["user.box"], Equals, "test")
+	c.Assert(header.Xattrs[CapabilityXattr], Equals, capability)
+}
+
+func (ts *tarSuite) TestEncodeCapabilities(c *C) {
+	capability, err := EncodeCapabilities([]string{"cap_net_bind_service+ep"})
+	c.Assert(err, IsNil)
+	c.Assert([]byte(capability), DeepEquals, []byte{1, 0, 0, 2, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+
+	capability, err = EncodeCapabilities([]string{"cap_chown,cap_bpf+pi"})
+	c.Assert(err, IsNil)
+	c.Assert([]byte(capability), DeepEquals, []byte{0, 0, 0, 2, 1, 0, 0, 0, 1, 0, 0, 0, 128, 0, 0, 0, 128, 0, 0, 0})
+
+	for _, bad := range []string{"cap_net_bind_service", "cap_bogus+ep", "cap_chown+x"} {
+		_, err = EncodeCapabilities([]string{bad})
+		c.Assert(err, NotNil, Commentf("%s", bad))
+	}
+}
+
+func (ts *tarSuite) TestArchiveTarget(c *C) {
+	dir, err := ioutil.TempDir("", "tar-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "tool")
+	c.Assert(ioutil.WriteFile(fn, []byte("tool"), 0755), IsNil)
+
+	names := func(source, target string) []string {
+		tarball, _, err := Archive(context.Background(), source, target, []string{}, nil, false, log)
+		c.Assert(err, IsNil)
+		defer os.Remove(tarball)
+
+		f, err := os.Open(tarball)
+		c.Assert(err, IsNil)
+		defer f.Close()
+
+		result := []string{}
+		r := tar.NewReader(f)
+		for {
+			header, err := r.Next()
+			if err != nil {
+				break
+			}
+			result = append(result, header.Name)
+		}
+
+		return result
+	}
+
+	// a trailing slash makes the target a directory, even for a single file.
+	c.Assert(names(fn, "/fresh/bin/"), DeepEquals, []string{"/fresh/bin/tool"})
+	c.Assert(names(fn, "/fresh/bin/mytool"), DeepEquals, []string{"/fresh/bin/mytool"})
+	c.Assert(names(dir, "/fresh/bin"), DeepEquals, []string{"/fresh/bin/tool"})
+	c.Assert(names(dir, "/fresh/bin/"), DeepEquals, []string{"/fresh/bin/tool"})
+
+	_, _, err = Archive(context.Background(), fn, "", []string{}, nil, false, log)
+	c.Assert(err, ErrorMatches, "no target to copy .*")
+}
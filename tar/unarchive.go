@@ -1,7 +1,11 @@
 package tar
 
 import (
+	"archive/tar"
 	"io"
+	"os"
+	"path"
+	"strings"
 
 	"github.com/docker/docker/pkg/archive"
 )
@@ -12,3 +16,188 @@ func Unarchive(reader io.Reader, dest string) error {
 	options := &archive.TarOptions{WhiteoutFormat: archive.OverlayWhiteoutFormat}
 	return archive.Unpack(reader, dest, options)
 }
+
+// Extract unpacks an archive of the path src, as copied from a container,
+// into the host directory dest, which is created if missing. If src is a
+// directory, its contents are placed in dest; otherwise the file is. Files are
+// owned by the current user.
+func Extract(reader io.Reader, src, dest string) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(rebaseExtract(reader, pw, path.Base(path.Clean("/"+src))))
+	}()
+	defer pr.Close()
+
+	return archive.Unpack(pr, dest, &archive.TarOptions{NoLchown: true})
+}
+
+// rebaseExtract strips the base name of the copied directory from the entries
+// of the archive, so its contents are at the root. Archives of files, which
+// begin with a non-directory entry, are left alone.
+func rebaseExtract(r io.Reader, w io.Writer, base string) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+
+	var first, dir bool
+
+	for first = true; ; first = false {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if first {
+			dir = header.Typeflag == tar.TypeDir
+		}
+
+		if dir && base != "/" {
+			header.Name = stripBase(header.Name, base)
+			if header.Typeflag == tar.TypeLink {
+				header.Linkname = stripBase(header.Linkname, base)
+			}
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+func stripBase(name, base string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+
+	switch {
+	case name == base:
+		return "."
+	case strings.HasPrefix(name, base+"/"):
+		return name[len(base)+1:]
+	default:
+		return name
+	}
+}
+
+// Rebase copies the entries of an archive of a path, as copied from a
+// container, to tw with dir prepended to their names, so they are extracted
+// to the path again at the root of a container. If dirOnly is set only the
+// first entry, the directory itself, is copied without its contents.
+func Rebase(r io.Reader, tw *tar.Writer, dir string, dirOnly bool) error {
+	tr := tar.NewReader(r)
+	dir = strings.TrimPrefix(path.Clean("/"+dir), "/")
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		header.Name = path.Join(dir, header.Name)
+		if header.Typeflag == tar.TypeDir {
+			header.Name += "/"
+		}
+
+		if header.Typeflag == tar.TypeLink {
+			header.Linkname = path.Join(dir, header.Linkname)
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+
+		if dirOnly {
+			return nil
+		}
+	}
+}
+
+// Move copies the entries of an archive of a path, as copied from a
+// container, to tw with the path renamed to target, so they are extracted to
+// the target at the root of a container. Hard links within the path are
+// renamed with it.
+func Move(r io.Reader, tw *tar.Writer, target string) error {
+	tr := tar.NewReader(r)
+	target = strings.TrimPrefix(path.Clean("/"+target), "/")
+
+	var base string
+
+	for first := true; ; first = false {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if first {
+			base = strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		}
+
+		header.Name = path.Join(target, stripBase(header.Name, base))
+		if header.Typeflag == tar.TypeDir {
+			header.Name += "/"
+		}
+
+		if header.Typeflag == tar.TypeLink {
+			header.Linkname = path.Join(target, stripBase(header.Linkname, base))
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// Chown copies the entries of an archive to tw, owned by uid and gid. The
+// owner's names are removed, so the ids are used when it is extracted.
+func Chown(r io.Reader, tw *tar.Writer, uid, gid int) error {
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		header.Uid, header.Gid = uid, gid
+		header.Uname, header.Gname = "", ""
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
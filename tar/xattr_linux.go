@@ -0,0 +1,54 @@
+package tar
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of the file at path. SELinux
+// labels are skipped, as they describe the host and not the image.
+func readXattrs(path string) (map[string]string, error) {
+	sz, err := unix.Listxattr(path, nil)
+	if err != nil {
+		if err == unix.ENOTSUP {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if sz == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, sz)
+	sz, err = unix.Listxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := map[string]string{}
+
+	for _, name := range bytes.Split(buf[:sz], []byte{0}) {
+		key := string(name)
+		if key == "" || strings.HasPrefix(key, "security.selinux") {
+			continue
+		}
+
+		vsz, err := unix.Getxattr(path, key, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		value := make([]byte, vsz)
+		vsz, err = unix.Getxattr(path, key, value)
+		if err != nil {
+			return nil, err
+		}
+
+		xattrs[key] = string(value[:vsz])
+	}
+
+	return xattrs, nil
+}
@@ -2,8 +2,11 @@ package types
 
 import (
 	"context"
+	"strings"
+	"time"
 
 	"github.com/box-builder/box/logger"
+	"github.com/box-builder/box/policy"
 )
 
 // BuildResult is an bunch of stuff that communicates a build result.
@@ -13,13 +16,97 @@ type BuildResult struct {
 	Err      error
 }
 
+// PlanError is an error raised by a plan, with the line, and if known the
+// column, of its source it was raised at. Both count from 1; Column is 0 if it
+// is not known.
+type PlanError struct {
+	Err    error
+	File   string
+	Source string // the code of the plan, or of the statement entered into the repl
+	Line   int
+	Column int
+}
+
+func (e *PlanError) Error() string {
+	return e.Err.Error()
+}
+
+// Cause returns the error raised, for errors.Cause.
+func (e *PlanError) Cause() error {
+	return e.Err
+}
+
+// Location returns where the error was raised, for the logger to show the
+// line.
+func (e *PlanError) Location() (string, string, int, int) {
+	return e.File, e.Source, e.Line, e.Column
+}
+
+// Platform selects the entry of a multi-platform image given to `from`. The
+// empty fields match any entry.
+type Platform struct {
+	Architecture string
+	Variant      string
+}
+
+// String returns the platform as `linux/arch[/variant]`, as --platform
+// takes it.
+func (p Platform) String() string {
+	return strings.TrimSuffix("linux/"+p.Architecture+"/"+p.Variant, "/")
+}
+
+// StepRange is a range of plan steps, counted from 1. If Last is zero, the
+// range has no end.
+type StepRange struct {
+	First int
+	Last  int
+}
+
+// PlannedStep is a step of a plan, as reported to Global.Inspect.
+type PlannedStep struct {
+	Step     int      `json:"step"`
+	Verb     string   `json:"verb"`
+	Args     []string `json:"args"`
+	CacheKey string   `json:"cache_key"`
+	Cached   bool     `json:"cached"`
+}
+
 // Global represents global variables for the processing of an entire box run.
 type Global struct {
-	Cache     bool
-	Color     bool
-	TTY       bool
-	ShowRun   bool
-	OmitFuncs []string
-	Logger    *logger.Logger
-	Context   context.Context
+	Cache           bool
+	CacheTTL        time.Duration // if non-zero, cache entries older than this are misses
+	CacheImage      string        // an image pushed with --cache-image-push whose steps are reused
+	NoCacheFrom     int           // if non-zero, the step number from which the cache is disabled
+	Steps           StepRange     // if set, the steps executed; earlier ones must be cached and later ones are skipped
+	Checkpoint      string        // if set, the file the build's steps are recorded in, and resumed from by the next build
+	Color           bool
+	TTY             bool
+	ShowRun         bool
+	ResolveDigests  bool          // print the registry digest of each image pulled by `from`
+	AllowLocalExec  bool          // permit plans to run commands on the host
+	StrictVars      bool          // fail on the use of variables neither declared with arg nor passed
+	AllowPrivileged bool          // permit run statements with privileged: true
+	AllowBind       bool          // permit run statements with bind mounts of host paths
+	Experimental    bool          // permit the verbs and funcs which are experimental
+	DaemonTimeout   time.Duration // if non-zero, retry connecting to the docker daemon for this long
+	Reproducible    bool          // use fixed timestamps in image configs and archives box writes
+	Mirrors         []string      // registries tried in order for Docker Hub pulls before the hub itself
+	AllowInsecure   []string      // registries, as host[:port], pulled from and pushed to without TLS verification
+	PullAlways      bool          // pull the images of `from` even when the daemon has them
+	BaseCacheTTL    time.Duration // if non-zero, how long the image a `from` name resolved to is reused in this process
+	Debug           bool          // log each executor operation with its parameters and duration
+	KeepContainers  bool          // leave the containers of the steps for debugging, instead of removing them
+	PostCommitHook  string        // if set, a host command run with the id of each image committed
+	LowPriority     bool          // run the containers of the steps at the lowest cpu and I/O priority, unless a run sets its own
+	Interactive     bool          // ask before overwriting existing tags
+	Profile         bool          // record the time spent evaluating the plan and in the executor
+	AssumeYes       bool          // answer yes to all questions, as required for Interactive without a TTY
+	Concurrency     int           // if non-zero, the most runs of a parallel block started at once
+	BasePolicy      *policy.Base  // if set, the base images `from` may use
+	Platform        Platform      // if set, the platform of --platform being built, used by `from` to select from registry images
+	OmitFuncs       []string
+	Version         string            // the version of box, checked by box_version
+	Inspect         func(PlannedStep) // if set, the steps are reported to it instead of evaluated; from and blocks still are
+	Logger          *logger.Logger
+	Context         context.Context
 }
@@ -4,9 +4,23 @@ import (
 	"context"
 	"errors"
 	"io/ioutil"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// SourceDate returns the timestamp recorded in reproducible output. It is
+// taken from the SOURCE_DATE_EPOCH environment variable if that is set, and is
+// the unix epoch otherwise.
+func SourceDate() time.Time {
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		return time.Unix(epoch, 0).UTC()
+	}
+
+	return time.Unix(0, 0).UTC()
+}
+
 // CheckContext validates that a context, if done, returns the appropriate
 // error value stored in it. Otherwise, it will return nil if not terminated.
 func CheckContext(ctx context.Context) error {